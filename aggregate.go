@@ -0,0 +1,315 @@
+package onion
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// aggregateFile is the consolidation of the runs of an invocation of Run, in the results directory.
+const aggregateFile = "aggregate.json"
+
+// RunsAggregate consolidates the runs of a cohort, telling mismatches and failures that recur in every run apart
+// from intermittent ones and tracking how the mismatch and failure rates move from run to run.
+type RunsAggregate struct {
+	Cohort string `json:",omitempty"`
+	// Runs are the numbers of the aggregated runs and RunIDs their IDs, in run order. The series of the pairs and
+	// components are in the same order.
+	Runs   []int
+	RunIDs []string
+	// Chaos are the chaos actions injected before every run, "" for runs without, if any run had some.
+	Chaos []string `json:",omitempty"`
+	// Pairs is keyed by pair name.
+	Pairs map[string]*PairAggregate
+	// Components is keyed by component name.
+	Components map[string]*ComponentAggregate
+}
+
+// PairAggregate consolidates the mismatches of a pair across runs. A path mismatches in a run if either the status
+// codes or the response bytes of the pair differ.
+type PairAggregate struct {
+	// Persistent are the paths that mismatched in every one of at least two runs that requested them, Intermittent
+	// those that mismatched in some of them only, and Once those that mismatched in the only run that requested
+	// them, which can not tell either apart.
+	Persistent   []string
+	Intermittent []string
+	Once         []string `json:",omitempty"`
+	// StatusMismatchRate and BytesMismatchRate are the percentages of paths of every run whose status codes and
+	// response bytes mismatched.
+	StatusMismatchRate []float64
+	BytesMismatchRate  []float64
+	// StatusTrend and BytesTrend are the slopes of the least squares lines through the mismatch rates, in
+	// percentage points per run. They are positive if mismatches get more frequent.
+	StatusTrend float64
+	BytesTrend  float64
+}
+
+// ComponentAggregate consolidates the requests to a component across runs.
+type ComponentAggregate struct {
+	// Paths is the number of paths requested from the component in more than one run.
+	Paths int
+	// FlakyPaths are the paths whose outcome differed between runs: they failed in some runs but not in others, or
+	// their response bodies differed between the runs they succeeded in.
+	FlakyPaths []string
+	// Flakiness is the share of Paths that are flaky, from 0 to 1.
+	Flakiness float64
+	// FailureRate is the percentage of failed requests of every run, and P50 and P90 the latencies of its responses.
+	FailureRate []float64
+	P50         []time.Duration
+	P90         []time.Duration
+	// FailureTrend is the slope of the least squares line through the failure rates, in percentage points per run.
+	FailureTrend float64
+}
+
+// AggregateRuns consolidates the runs of every cohort, in the order the cohorts first appear in runs.
+func AggregateRuns(runs []RunSummary) []*RunsAggregate {
+	var out []*RunsAggregate
+	byCohort := make(map[string][]RunSummary)
+	for _, s := range runs {
+		if _, ok := byCohort[s.Cohort]; !ok {
+			out = append(out, &RunsAggregate{Cohort: s.Cohort})
+		}
+		byCohort[s.Cohort] = append(byCohort[s.Cohort], s)
+	}
+	for i, a := range out {
+		out[i] = aggregateCohort(a.Cohort, byCohort[a.Cohort])
+	}
+	return out
+}
+
+// aggregateCohort consolidates the runs of a single cohort.
+func aggregateCohort(cohort string, runs []RunSummary) *RunsAggregate {
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].N < runs[j].N })
+	a := &RunsAggregate{
+		Cohort:     cohort,
+		Pairs:      make(map[string]*PairAggregate),
+		Components: make(map[string]*ComponentAggregate),
+	}
+	chaos := false
+	for _, s := range runs {
+		a.Runs = append(a.Runs, s.N)
+		a.RunIDs = append(a.RunIDs, s.RunID.String())
+		a.Chaos = append(a.Chaos, s.Chaos)
+		chaos = chaos || len(s.Chaos) != 0
+	}
+	if !chaos {
+		a.Chaos = nil
+	}
+
+	pairs := make(map[string]bool)
+	components := make(map[string]bool)
+	for _, s := range runs {
+		if s.ResponseReads != nil {
+			for pair := range s.ResponseReads.Pairs {
+				pairs[pair] = true
+			}
+		}
+		for _, rs := range s.Results {
+			for name := range rs {
+				components[name] = true
+			}
+		}
+	}
+
+	for pair := range pairs {
+		pa := &PairAggregate{}
+		requested := make(map[string]int)
+		mismatched := make(map[string]int)
+		for _, s := range runs {
+			for path := range s.Results {
+				requested[path]++
+			}
+			var bytesPaths []string
+			if s.ResponseReads != nil && s.ResponseReads.Pairs[pair] != nil {
+				bytesPaths = s.ResponseReads.Pairs[pair].MismatchPaths
+			}
+			statusPaths := s.StatusMismatchPaths[pair]
+			seen := make(map[string]bool, len(statusPaths)+len(bytesPaths))
+			for _, path := range append(append([]string{}, statusPaths...), bytesPaths...) {
+				if !seen[path] {
+					seen[path] = true
+					mismatched[path]++
+				}
+			}
+			pa.StatusMismatchRate = append(pa.StatusMismatchRate, percentOf(len(statusPaths), len(s.Results)))
+			pa.BytesMismatchRate = append(pa.BytesMismatchRate, percentOf(len(bytesPaths), len(s.Results)))
+		}
+		for path, k := range mismatched {
+			switch {
+			case requested[path] < 2:
+				pa.Once = append(pa.Once, path)
+			case k >= requested[path]:
+				pa.Persistent = append(pa.Persistent, path)
+			default:
+				pa.Intermittent = append(pa.Intermittent, path)
+			}
+		}
+		sort.Strings(pa.Persistent)
+		sort.Strings(pa.Intermittent)
+		sort.Strings(pa.Once)
+		pa.StatusTrend = trend(pa.StatusMismatchRate)
+		pa.BytesTrend = trend(pa.BytesMismatchRate)
+		a.Pairs[pair] = pa
+	}
+
+	for name := range components {
+		ca := &ComponentAggregate{}
+		// outcomes are the distinct outcomes of every path across runs
+		outcomes := make(map[string]map[string]bool)
+		for _, s := range runs {
+			var requests, failures int
+			for path, rs := range s.Results {
+				r := rs[name]
+				if r == nil {
+					continue
+				}
+				requests++
+				if outcomes[path] == nil {
+					outcomes[path] = make(map[string]bool)
+				}
+				outcomes[path][runOutcome(r)] = true
+				if len(r.ErrorKind) != 0 {
+					failures++
+				}
+			}
+			ca.FailureRate = append(ca.FailureRate, percentOf(failures, requests))
+			stats := componentLatencyStats([]Component{{Name: name}}, s.Results)[name]
+			ca.P50 = append(ca.P50, stats.P50)
+			ca.P90 = append(ca.P90, stats.P90)
+		}
+		for path := range outcomes {
+			n := 0
+			for _, s := range runs {
+				if s.Results[path][name] != nil {
+					n++
+				}
+			}
+			if n < 2 {
+				continue
+			}
+			ca.Paths++
+			if isFlaky(outcomes[path]) {
+				ca.FlakyPaths = append(ca.FlakyPaths, path)
+			}
+		}
+		sort.Strings(ca.FlakyPaths)
+		if ca.Paths != 0 {
+			ca.Flakiness = float64(len(ca.FlakyPaths)) / float64(ca.Paths)
+		}
+		ca.FailureTrend = trend(ca.FailureRate)
+		a.Components[name] = ca
+	}
+	return a
+}
+
+// runOutcome summarises the result of a request so that it can be compared across runs: the kind of failure if it
+// failed, or else the digest of its response. The digest of the file bytes of CARs is preferred so that CARs
+// whose blocks are ordered differently are not flaky.
+func runOutcome(r *Result) string {
+	if len(r.ErrorKind) != 0 {
+		return "failed"
+	}
+	if len(r.RawDigest) != 0 {
+		return "ok:" + r.RawDigest
+	}
+	return "ok:" + r.ResponseDigest
+}
+
+// isFlaky reports whether the outcomes of a path differ between runs. Successful responses without a digest, e.g.
+// to HEAD requests, do not differ from other successful responses.
+func isFlaky(outcomes map[string]bool) bool {
+	var failed, undigested bool
+	digests := 0
+	for o := range outcomes {
+		switch {
+		case o == "failed":
+			failed = true
+		case o == "ok:":
+			undigested = true
+		default:
+			digests++
+		}
+	}
+	if failed {
+		return digests != 0 || undigested
+	}
+	return digests > 1
+}
+
+// percentOf returns k of n as a percentage.
+func percentOf(k, n int) float64 {
+	if n == 0 {
+		return 0
+	}
+	return float64(k) * 100 / float64(n)
+}
+
+// trend returns the slope of the least squares line through the series of values of consecutive runs.
+func trend(ys []float64) float64 {
+	n := float64(len(ys))
+	if len(ys) < 2 {
+		return 0
+	}
+	var sx, sy, sxy, sxx float64
+	for i, y := range ys {
+		x := float64(i)
+		sx += x
+		sy += y
+		sxy += x * y
+		sxx += x * x
+	}
+	return (n*sxy - sx*sy) / (n*sxx - sx*sx)
+}
+
+// writeAggregates writes the consolidation of the runs to aggregate.json in the results directory and prints the
+// persistent and intermittent mismatches of every pair and the flakiness of every component.
+func (cfg RunConfig) writeAggregates(resultsDir string, aggregates []*RunsAggregate) error {
+	if err := cfg.writeReport(resultsDir, aggregateFile, aggregates); err != nil {
+		return err
+	}
+
+	series := func(vs []float64) string {
+		s := make([]string, len(vs))
+		for i, v := range vs {
+			s[i] = fmt.Sprintf("%.2f%%", v)
+		}
+		return strings.Join(s, " -> ")
+	}
+	fmt.Println("\n ----------SUMMARY OF ALL RUNS --------------")
+	for _, a := range aggregates {
+		label := fmt.Sprintf("Runs %d-%d", a.Runs[0], a.Runs[len(a.Runs)-1])
+		if len(a.Cohort) != 0 {
+			label += "; cohort " + a.Cohort
+		}
+		for i, chaos := range a.Chaos {
+			if len(chaos) != 0 {
+				fmt.Printf("\n %s; chaos before run %d: %s", label, a.Runs[i], chaos)
+			}
+		}
+		pairs := make([]string, 0, len(a.Pairs))
+		for pair := range a.Pairs {
+			pairs = append(pairs, pair)
+		}
+		sort.Strings(pairs)
+		for _, pair := range pairs {
+			pa := a.Pairs[pair]
+			fmt.Printf("\n %s; %s: %d paths mismatched in every run, %d intermittently, %d in the only run that requested them",
+				label, pair, len(pa.Persistent), len(pa.Intermittent), len(pa.Once))
+			fmt.Printf("\n %s; %s: status mismatches %s (%+.2f pp/run), bytes mismatches %s (%+.2f pp/run)", label, pair,
+				series(pa.StatusMismatchRate), pa.StatusTrend, series(pa.BytesMismatchRate), pa.BytesTrend)
+		}
+		names := make([]string, 0, len(a.Components))
+		for name := range a.Components {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ca := a.Components[name]
+			fmt.Printf("\n %s; %s: flakiness %.3f (%d of %d paths), failures %s (%+.2f pp/run)", label, name,
+				ca.Flakiness, len(ca.FlakyPaths), ca.Paths, series(ca.FailureRate), ca.FailureTrend)
+		}
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,120 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultAlertExamples = 5
+
+// AlertConfig configures posting a summary of a run to a Slack or Discord webhook when too many paths mismatch.
+type AlertConfig struct {
+	// WebhookURL is the incoming webhook to post to. Discord webhooks are detected from their host.
+	WebhookURL string
+	// Threshold is the fraction of requested paths, e.g. 0.01, above which status or bytes mismatches of a pair
+	// are alerted on.
+	Threshold float64
+	// Examples is the number of example paths to list per pair. Defaults to 5.
+	Examples int
+	// Client sends the alert. Defaults to a client with a timeout of a minute.
+	Client *http.Client
+}
+
+// PairAlert is a pair of components whose mismatch rate is above the threshold.
+type PairAlert struct {
+	Pair             string
+	StatusMismatches int
+	BytesMismatches  int
+	// Examples are some of the mismatched paths, sorted.
+	Examples []string
+}
+
+// Check returns the pairs of the run whose status or bytes mismatches exceed the threshold, sorted by name.
+func (ac *AlertConfig) Check(s RunSummary) []PairAlert {
+	if len(s.Results) == 0 {
+		return nil
+	}
+	examples := ac.Examples
+	if examples <= 0 {
+		examples = defaultAlertExamples
+	}
+
+	var out []PairAlert
+	for pair, pm := range s.ResponseReads.Pairs {
+		status := s.StatusMismatchPaths[pair]
+		rate := func(paths []string) float64 { return float64(len(paths)) / float64(len(s.Results)) }
+		if rate(status) <= ac.Threshold && rate(pm.MismatchPaths) <= ac.Threshold {
+			continue
+		}
+
+		paths := append(append([]string{}, status...), pm.MismatchPaths...)
+		sort.Strings(paths)
+		if len(paths) > examples {
+			paths = paths[:examples]
+		}
+		out = append(out, PairAlert{
+			Pair:             pair,
+			StatusMismatches: len(status),
+			BytesMismatches:  len(pm.MismatchPaths),
+			Examples:         paths,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pair < out[j].Pair })
+	return out
+}
+
+// Alert posts a summary of the run to the webhook if any pair exceeds the threshold. It reports whether an alert
+// was posted.
+func (ac *AlertConfig) Alert(s RunSummary) (bool, error) {
+	alerts := ac.Check(s)
+	if len(alerts) == 0 {
+		return false, nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Onion run %d (%s) in %s: mismatches above %.1f%% of %d paths\n", s.N, s.RunID, s.Dir,
+		ac.Threshold*100, len(s.Results))
+	for _, a := range alerts {
+		fmt.Fprintf(&sb, "• %s: %d status mismatches, %d bytes mismatches; e.g. %s\n", a.Pair, a.StatusMismatches,
+			a.BytesMismatches, strings.Join(a.Examples, ", "))
+	}
+
+	if err := ac.post(sb.String()); err != nil {
+		return false, fmt.Errorf("failed to post alert: %w", err)
+	}
+	return true, nil
+}
+
+func (ac *AlertConfig) post(text string) error {
+	// Slack takes the message as text and Discord as content
+	payload := map[string]string{"text": text}
+	if u, err := url.Parse(ac.WebhookURL); err == nil && strings.Contains(u.Host, "discord") {
+		payload = map[string]string{"content": text}
+	}
+	bz, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := ac.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	resp, err := client.Post(ac.WebhookURL, "application/json", bytes.NewReader(bz))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook returned %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package onion
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// artifactsDir is the directory of a results directory that the responses of mismatched paths are saved to by
+// SaveArtifacts.
+const artifactsDir = "artifacts"
+
+// defaultArtifactMaxBytes is how much of every body is saved as an artifact by default.
+const defaultArtifactMaxBytes = 16 << 20
+
+// ArtifactManifest describes the artifacts saved for a mismatched path, in the manifest.json of its artifacts
+// directory.
+type ArtifactManifest struct {
+	Path string
+	// Pairs are the names of the pairs whose responses mismatched.
+	Pairs []string
+	// Results is keyed by Component.Name, for the components of the mismatched pairs.
+	Results Results
+	// Files is keyed by Component.Name.
+	Files map[string][]ArtifactFile
+}
+
+// ArtifactFile is a gzip-compressed response body or file extracted from a CAR response saved as an artifact.
+type ArtifactFile struct {
+	Name string
+	// Kind is "body" for the response body and "raw" for the file bytes extracted from a CAR body.
+	Kind string
+	// Size is the size of the uncompressed body. Only the first Saved bytes of it are saved if it is larger than
+	// the cap on artifacts.
+	Size  int
+	Saved int
+	// Digest is the hex encoded sha256 of the whole uncompressed body.
+	Digest string
+}
+
+// artifactDir returns the directory, relative to the artifacts directory of the run, that the artifacts of the path
+// are saved to. Paths are hashed as they may be longer than a file name can be.
+func artifactDir(path string) string {
+	return sha256Hex([]byte(path))[:16]
+}
+
+// saveArtifacts saves the captured response bodies of the components of the mismatched pairs, and the file bytes
+// extracted from their CAR bodies, to the artifacts directory of the path, so that the mismatch can be debugged
+// without running again.
+func (re *RequestExecutor) saveArtifacts(path string, pc *pathComparer, pairs []Pair) error {
+	dir := filepath.Join(re.dir, artifactsDir, artifactDir(path))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	manifest := ArtifactManifest{Path: path, Results: make(Results), Files: make(map[string][]ArtifactFile)}
+	for _, p := range pairs {
+		manifest.Pairs = append(manifest.Pairs, p.Name())
+		for _, c := range []Component{p.A, p.B} {
+			if _, ok := manifest.Results[c.Name]; ok {
+				continue
+			}
+			r := pc.rs[c.Name]
+			manifest.Results[c.Name] = r
+			if r == nil || len(r.ResponseBodyReadError) != 0 {
+				continue
+			}
+
+			f, err := re.writeArtifact(dir, c.Name+".body.gz", "body", pc.bodies[c.Name])
+			if err != nil {
+				return err
+			}
+			manifest.Files[c.Name] = append(manifest.Files[c.Name], f)
+
+			if c.Extract != ExtractCAR {
+				continue
+			}
+			if raw, ok := pc.file(c); ok {
+				f, err := re.writeArtifact(dir, c.Name+".raw.gz", "raw", raw)
+				if err != nil {
+					return err
+				}
+				manifest.Files[c.Name] = append(manifest.Files[c.Name], f)
+			}
+		}
+	}
+
+	bz, err := MarshalReport("manifest", manifest)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "manifest.json"), bz, 0644)
+}
+
+// writeArtifact writes the body gzip-compressed to the file of the directory, up to the cap on artifacts.
+func (re *RequestExecutor) writeArtifact(dir, name, kind string, body []byte) (ArtifactFile, error) {
+	af := ArtifactFile{Name: name, Kind: kind, Size: len(body), Saved: len(body), Digest: sha256Hex(body)}
+	if int64(len(body)) > re.opts.ArtifactMaxBytes {
+		af.Saved = int(re.opts.ArtifactMaxBytes)
+	}
+
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return af, err
+	}
+	zw := gzip.NewWriter(f)
+	_, err = zw.Write(body[:af.Saved])
+	if zerr := zw.Close(); err == nil {
+		err = zerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return af, fmt.Errorf("failed to write artifact %s: %w", name, err)
+	}
+	return af, nil
+}
@@ -0,0 +1,284 @@
+package onion
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// AssertionMetric is a metric of a run that an assertion bounds.
+type AssertionMetric string
+
+const (
+	// The latency percentiles of a component, in seconds.
+	MetricP50 AssertionMetric = "p50"
+	MetricP90 AssertionMetric = "p90"
+	MetricP95 AssertionMetric = "p95"
+	MetricP99 AssertionMetric = "p99"
+	// MetricSuccessRate is the fraction of paths for which a component returned a 2xx that was read successfully.
+	MetricSuccessRate AssertionMetric = "success_rate"
+	// MetricMismatchRate is the fraction of paths for which the status or bytes of the responses of a pair
+	// mismatch.
+	MetricMismatchRate AssertionMetric = "mismatch_rate"
+	// MetricStatusMismatchRate and MetricBytesMismatchRate are the fractions of paths for which the status and
+	// bytes of the responses of a pair mismatch.
+	MetricStatusMismatchRate AssertionMetric = "status_mismatch_rate"
+	MetricBytesMismatchRate  AssertionMetric = "bytes_mismatch_rate"
+)
+
+// pairMetric reports whether the metric is a metric of a pair rather than of a component.
+func (m AssertionMetric) pairMetric() bool {
+	return m == MetricMismatchRate || m == MetricStatusMismatchRate || m == MetricBytesMismatchRate
+}
+
+// Assertion bounds a metric of a run, e.g. "nginx p95 <= 1.5 * lassie p95" or "mismatch_rate of lassie-shim <
+// 0.001", so that a run can gate a release. It is the config.toml representation of an assertion as well.
+type Assertion struct {
+	// Name describes the assertion in the summary. Defaults to the assertion itself.
+	Name   string          `toml:"name"`
+	Metric AssertionMetric `toml:"metric"`
+	// Component or Pair is what the metric is of, depending on the metric. If neither is set, the assertion must
+	// hold for every component or pair.
+	Component string `toml:"component"`
+	Pair      string `toml:"pair"`
+	// Op is one of "<", "<=", ">" and ">=".
+	Op string `toml:"op"`
+	// Value is the bound of the metric. If RelativeTo is set, the bound is instead Factor times the same metric of
+	// the RelativeTo component or pair.
+	Value      float64 `toml:"value"`
+	RelativeTo string  `toml:"relativeTo"`
+	// Factor defaults to 1.
+	Factor float64 `toml:"factor"`
+}
+
+// Validate checks that the assertion is well-formed.
+func (a Assertion) Validate() error {
+	switch a.Metric {
+	case MetricP50, MetricP90, MetricP95, MetricP99, MetricSuccessRate:
+		if len(a.Pair) != 0 {
+			return fmt.Errorf("invalid assertion %s: %s is a metric of a component, not a pair", a, a.Metric)
+		}
+	case MetricMismatchRate, MetricStatusMismatchRate, MetricBytesMismatchRate:
+		if len(a.Component) != 0 {
+			return fmt.Errorf("invalid assertion %s: %s is a metric of a pair, not a component", a, a.Metric)
+		}
+	default:
+		return fmt.Errorf("invalid assertion %s: unknown metric %q", a, a.Metric)
+	}
+	if _, ok := assertionOps[a.Op]; !ok {
+		return fmt.Errorf("invalid assertion %s: unknown op %q", a, a.Op)
+	}
+	if a.Factor < 0 {
+		return fmt.Errorf("invalid assertion %s: negative factor", a)
+	}
+	return nil
+}
+
+// validateSubjects checks that the components or pairs the assertion names are among those of the run.
+func (a Assertion) validateSubjects(components []Component, pairs []Pair) error {
+	known := make(map[string]struct{})
+	if a.Metric.pairMetric() {
+		for _, p := range pairs {
+			known[p.Name()] = struct{}{}
+		}
+	} else {
+		for _, c := range EnabledComponents(components) {
+			known[c.Name] = struct{}{}
+		}
+	}
+	for _, name := range []string{a.Component, a.Pair, a.RelativeTo} {
+		if _, ok := known[name]; !ok && len(name) != 0 {
+			return fmt.Errorf("invalid assertion %s: unknown or disabled %s", a, name)
+		}
+	}
+	return nil
+}
+
+func (a Assertion) String() string {
+	if len(a.Name) != 0 {
+		return a.Name
+	}
+	subject := a.Component + a.Pair
+	if len(subject) == 0 {
+		subject = "*"
+	}
+	bound := fmt.Sprint(a.Value)
+	if len(a.RelativeTo) != 0 {
+		bound = fmt.Sprintf("%v * %s %s", a.factor(), a.RelativeTo, a.Metric)
+	}
+	return fmt.Sprintf("%s %s %s %s", subject, a.Metric, a.Op, bound)
+}
+
+func (a Assertion) factor() float64 {
+	if a.Factor == 0 {
+		return 1
+	}
+	return a.Factor
+}
+
+var assertionOps = map[string]func(v, bound float64) bool{
+	"<":  func(v, bound float64) bool { return v < bound },
+	"<=": func(v, bound float64) bool { return v <= bound },
+	">":  func(v, bound float64) bool { return v > bound },
+	">=": func(v, bound float64) bool { return v >= bound },
+}
+
+// AssertionResult is the outcome of an assertion for a component or pair in a run.
+type AssertionResult struct {
+	Assertion string
+	Run       int
+	Cohort    string `json:",omitempty"`
+	// Subject is the component or pair whose metric was bounded.
+	Subject string
+	Metric  AssertionMetric
+	Value   float64
+	Op      string
+	Bound   float64
+	Passed  bool
+	// Error is set if the metric could not be computed, e.g. because the component returned no responses, in
+	// which case the assertion fails.
+	Error string `json:",omitempty"`
+}
+
+// EvaluateAssertions evaluates the assertions against a run. The components are those of the run, of which the
+// enabled ones are asserted on by assertions that name neither a component nor a pair.
+func EvaluateAssertions(assertions []Assertion, components []Component, s RunSummary) []AssertionResult {
+	var out []AssertionResult
+	for _, a := range assertions {
+		for _, subject := range a.subjects(components, s) {
+			r := AssertionResult{
+				Assertion: a.String(),
+				Run:       s.N,
+				Cohort:    s.Cohort,
+				Subject:   subject,
+				Metric:    a.Metric,
+				Op:        a.Op,
+				Bound:     a.Value,
+			}
+			var err error
+			if r.Value, err = runMetric(a.Metric, subject, s); err == nil && len(a.RelativeTo) != 0 {
+				var rel float64
+				if rel, err = runMetric(a.Metric, a.RelativeTo, s); err == nil {
+					r.Bound = a.factor() * rel
+				}
+			}
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Passed = assertionOps[a.Op](r.Value, r.Bound)
+			}
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// subjects returns the components or pairs the assertion is evaluated for.
+func (a Assertion) subjects(components []Component, s RunSummary) []string {
+	if subject := a.Component + a.Pair; len(subject) != 0 {
+		return []string{subject}
+	}
+	var out []string
+	if a.Metric.pairMetric() {
+		for pair := range s.ResponseReads.Pairs {
+			if pair != a.RelativeTo {
+				out = append(out, pair)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	for _, c := range EnabledComponents(components) {
+		if c.Name != a.RelativeTo {
+			out = append(out, c.Name)
+		}
+	}
+	return out
+}
+
+// runMetric computes the metric of the component or pair in the run.
+func runMetric(m AssertionMetric, subject string, s RunSummary) (float64, error) {
+	if len(s.Results) == 0 {
+		return 0, fmt.Errorf("no paths were requested")
+	}
+	total := float64(len(s.Results))
+
+	if m.pairMetric() {
+		pm, ok := s.ResponseReads.Pairs[subject]
+		if !ok {
+			return 0, fmt.Errorf("unknown pair %s", subject)
+		}
+		status := s.StatusMismatchPaths[subject]
+		switch m {
+		case MetricStatusMismatchRate:
+			return float64(len(status)) / total, nil
+		case MetricBytesMismatchRate:
+			return float64(len(pm.MismatchPaths)) / total, nil
+		}
+		mismatched := make(map[string]struct{}, len(status)+len(pm.MismatchPaths))
+		for _, path := range append(append([]string{}, status...), pm.MismatchPaths...) {
+			mismatched[path] = struct{}{}
+		}
+		return float64(len(mismatched)) / total, nil
+	}
+
+	var latencies []time.Duration
+	ok := 0
+	found := false
+	for _, rs := range s.Results {
+		r, has := rs[subject]
+		if !has || r == nil {
+			continue
+		}
+		found = true
+		if isReadOK(r) {
+			ok++
+		}
+		if r.StatusCode != 0 {
+			latencies = append(latencies, r.Latency)
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("unknown component %s", subject)
+	}
+	if m == MetricSuccessRate {
+		return float64(ok) / total, nil
+	}
+	if len(latencies) == 0 {
+		return 0, fmt.Errorf("%s returned no responses", subject)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	p := map[AssertionMetric]int{MetricP50: 50, MetricP90: 90, MetricP95: 95, MetricP99: 99}[m]
+	return percentile(latencies, p).Seconds(), nil
+}
+
+// AssertionsFailed reports whether any assertion failed in any run.
+func (r RunReport) AssertionsFailed() bool {
+	for _, s := range r.Runs {
+		for _, a := range s.Assertions {
+			if !a.Passed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeAssertions writes the outcome of the assertions of a run to assertions.json in its results directory and
+// prints it.
+func (cfg RunConfig) writeAssertions(dir string, n int, results []AssertionResult) error {
+	fmt.Println("\n ----------SUMMARY OF ASSERTIONS --------------")
+	for _, r := range results {
+		verdict := "passed"
+		if !r.Passed {
+			verdict = "FAILED"
+		}
+		detail := fmt.Sprintf("%s %s = %.6g %s %.6g", r.Subject, r.Metric, r.Value, r.Op, r.Bound)
+		if len(r.Error) != 0 {
+			detail = r.Error
+		}
+		fmt.Printf("\n Run-%d; %s%s: %s (%s)", n, r.Assertion, cohortLabel(Cohort{Name: r.Cohort}), verdict, detail)
+	}
+	fmt.Println()
+	return cfg.writeReport(dir, "assertions.json", results)
+}
@@ -0,0 +1,150 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTokenRefresh is how long the token printed by a token command is used before the command is run again.
+	defaultTokenRefresh = 10 * time.Minute
+	// tokenCommandTimeout bounds how long a token command may take to print a token.
+	tokenCommandTimeout = 30 * time.Second
+)
+
+// AuthConfig is the config.toml representation of the credentials sent to a component, e.g. the JWT or shared
+// secret header that a shim or nginx deployment requires. Values may reference env vars as ${VAR} so that secrets
+// do not have to be written to the config. At most one of Bearer, BasicUser and TokenCommand may be set; Headers
+// may be combined with any of them.
+type AuthConfig struct {
+	// Headers are static headers sent with every request, e.g. {"X-Shared-Secret" = "${SHIM_SECRET}"}.
+	Headers map[string]string `toml:"headers"`
+	// Bearer is a static token sent as "Authorization: Bearer {token}".
+	Bearer string `toml:"bearer"`
+	// BasicUser and BasicPassword are sent as basic auth.
+	BasicUser     string `toml:"basicUser"`
+	BasicPassword string `toml:"basicPassword"`
+	// TokenCommand is a shell command that prints a token to send as a bearer token, e.g.
+	// "gcloud auth print-identity-token". It is run again once the token is TokenRefresh old, or when the
+	// component rejects it with a 401.
+	TokenCommand string `toml:"tokenCommand"`
+	// TokenRefresh is how long a token printed by TokenCommand is used, e.g. "50m". Defaults to 10m.
+	TokenRefresh string `toml:"tokenRefresh"`
+}
+
+// Authenticator adds the credentials of a component to its requests. It is shared by the nodes of a layer so that
+// a token command is run once for all of them.
+type Authenticator struct {
+	// cfg is the auth config as written, from which curl reproductions reference the env vars of secrets rather than
+	// their values.
+	cfg AuthConfig
+
+	headers  http.Header
+	bearer   string
+	user     string
+	password string
+
+	command string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	token   string
+	fetched time.Time
+}
+
+// NewAuthenticator returns the authenticator of the auth config, expanding the env vars its values reference.
+func NewAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		cfg:      cfg,
+		headers:  make(http.Header, len(cfg.Headers)),
+		bearer:   os.ExpandEnv(cfg.Bearer),
+		user:     os.ExpandEnv(cfg.BasicUser),
+		password: os.ExpandEnv(cfg.BasicPassword),
+		command:  cfg.TokenCommand,
+		refresh:  defaultTokenRefresh,
+	}
+	for k, v := range cfg.Headers {
+		a.headers.Set(k, os.ExpandEnv(v))
+	}
+
+	schemes := 0
+	for _, s := range []string{a.bearer, a.user, a.command} {
+		if len(s) != 0 {
+			schemes++
+		}
+	}
+	if schemes > 1 {
+		return nil, fmt.Errorf("only one of bearer, basicUser and tokenCommand can be set")
+	}
+	if len(cfg.Bearer) != 0 && len(a.bearer) == 0 {
+		return nil, fmt.Errorf("bearer token %q expands to nothing", cfg.Bearer)
+	}
+	if len(cfg.BasicPassword) != 0 && len(a.user) == 0 {
+		return nil, fmt.Errorf("basicPassword requires basicUser")
+	}
+	if len(cfg.TokenRefresh) != 0 {
+		d, err := time.ParseDuration(cfg.TokenRefresh)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid token refresh: %q", cfg.TokenRefresh)
+		}
+		a.refresh = d
+	}
+	return a, nil
+}
+
+// Apply sets the credentials on the request. It fails if the token command fails.
+func (a *Authenticator) Apply(req *http.Request) error {
+	for k, vs := range a.headers {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	switch {
+	case len(a.bearer) != 0:
+		req.Header.Set("Authorization", "Bearer "+a.bearer)
+	case len(a.user) != 0:
+		req.SetBasicAuth(a.user, a.password)
+	case len(a.command) != 0:
+		token, err := a.commandToken(req.Context())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+// Rejected marks the token sent with a request as rejected, e.g. because it expired early, so that the token command
+// is run again for the next request.
+func (a *Authenticator) Rejected() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.token = ""
+}
+
+// commandToken returns the token printed by the token command, running it if the token is missing or stale.
+func (a *Authenticator) commandToken(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.token) != 0 && time.Since(a.fetched) < a.refresh {
+		return a.token, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tokenCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", a.command)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token command failed: %w", err)
+	}
+	token := strings.TrimSpace(string(out))
+	if len(token) == 0 {
+		return "", fmt.Errorf("token command printed no token")
+	}
+	a.token, a.fetched = token, time.Now()
+	return token, nil
+}
@@ -0,0 +1,415 @@
+package onion
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/core/sec"
+	"github.com/libp2p/go-libp2p/p2p/muxer/yamux"
+	"github.com/libp2p/go-libp2p/p2p/net/upgrader"
+	"github.com/libp2p/go-libp2p/p2p/security/noise"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"github.com/multiformats/go-multistream"
+	"golang.org/x/exp/slog"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// bitswapProtocol is the protocol the root block is requested with, which every current bitswap implementation
+	// speaks.
+	bitswapProtocol = "/ipfs/bitswap/1.2.0"
+	// maxBitswapMessageSize bounds the messages read from a provider, which carry at most a block and its metadata.
+	maxBitswapMessageSize = maxProbeBlockSize + 1<<16
+)
+
+// bitswapProtocols are the versions of bitswap that providers may answer with.
+var bitswapProtocols = []protocol.ID{bitswapProtocol, "/ipfs/bitswap/1.1.0", "/ipfs/bitswap/1.0.0", "/ipfs/bitswap"}
+
+// errBitswapDontHave is returned by a provider that answers that it does not have the block.
+var errBitswapDontHave = errors.New("provider does not have the block")
+
+// BitswapProber retrieves the root block from providers over bitswap with a lightweight libp2p client, to tell
+// whether content that is only provided over bitswap can be retrieved at all. The client dials the TCP addresses of
+// providers with noise and yamux; QUIC and websocket addresses are not dialed. Providers that serve the trustless
+// gateway protocol over HTTP are retrieved from with HTTP first.
+type BitswapProber struct {
+	// HTTP probes the HTTP addresses of providers. Defaults to an HTTPProber with the timeout.
+	HTTP *HTTPProber
+	// Timeout is the timeout of every probe. Defaults to 30 seconds.
+	Timeout time.Duration
+
+	once      sync.Once
+	transport *tcp.TcpTransport
+	err       error
+}
+
+// NewBitswapProber returns a BitswapProber with a new libp2p identity.
+func NewBitswapProber(timeout time.Duration) (*BitswapProber, error) {
+	bp := &BitswapProber{HTTP: &HTTPProber{Timeout: timeout}, Timeout: timeout}
+	if _, err := bp.tcp(); err != nil {
+		return nil, err
+	}
+	return bp, nil
+}
+
+// tcp returns the TCP transport of the libp2p client, which is set up with a new libp2p identity on first use.
+func (bp *BitswapProber) tcp() (*tcp.TcpTransport, error) {
+	bp.once.Do(func() {
+		bp.transport, bp.err = newBitswapTransport()
+	})
+	return bp.transport, bp.err
+}
+
+// newBitswapTransport returns a TCP transport that secures connections with noise and multiplexes them with yamux.
+func newBitswapTransport() (*tcp.TcpTransport, error) {
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	muxers := []upgrader.StreamMuxer{{ID: yamux.ID, Muxer: yamux.DefaultTransport}}
+	security, err := noise.New(noise.ID, priv, muxers)
+	if err != nil {
+		return nil, err
+	}
+	rcmgr := &network.NullResourceManager{}
+	u, err := upgrader.New([]sec.SecureTransport{security}, muxers, nil, rcmgr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return tcp.NewTCPTransport(u, rcmgr)
+}
+
+// defaultProber returns a BitswapProber, or an HTTPProber if the libp2p client can not be set up.
+func defaultProber(log *slog.Logger) Prober {
+	bp, err := NewBitswapProber(0)
+	if err != nil {
+		log.Warn("probing providers over HTTP only, the bitswap client can not be set up", "err", err)
+		return &HTTPProber{}
+	}
+	return bp
+}
+
+func (bp *BitswapProber) Probe(ctx context.Context, c cid.Cid, p ProviderRecord) ProviderProbe {
+	timeout := bp.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	var httpAddrs []string
+	var libp2pAddrs []probeAddr
+	for _, a := range p.Addrs {
+		pa, ok := parseProbeAddr(a)
+		switch {
+		case !ok:
+		case len(pa.scheme) != 0:
+			httpAddrs = append(httpAddrs, a)
+		case !pa.websocket:
+			libp2pAddrs = append(libp2pAddrs, pa)
+		}
+	}
+
+	out := ProviderProbe{ID: p.ID, Error: "no dialable address"}
+	if len(httpAddrs) != 0 {
+		hp := bp.HTTP
+		if hp == nil {
+			hp = &HTTPProber{Timeout: timeout}
+		}
+		if out = hp.Probe(ctx, c, ProviderRecord{ID: p.ID, Addrs: httpAddrs}); out.Retrieved {
+			return out
+		}
+	}
+	if len(libp2pAddrs) == 0 {
+		return out
+	}
+	pid, err := peer.Decode(p.ID)
+	if err != nil {
+		if !out.Reachable {
+			out.Error = fmt.Sprintf("invalid peer ID: %s", err)
+		}
+		return out
+	}
+
+	for _, a := range libp2pAddrs {
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		r := bp.retrieve(pctx, c, pid, a)
+		cancel()
+		r.ID = p.ID
+		r.Latency = time.Since(start)
+		if r.Reachable || !out.Reachable {
+			out = r
+		}
+		if r.Reachable {
+			break
+		}
+	}
+	return out
+}
+
+// retrieve connects to the provider on the address and asks it for the block over bitswap.
+func (bp *BitswapProber) retrieve(ctx context.Context, c cid.Cid, pid peer.ID, a probeAddr) ProviderProbe {
+	out := ProviderProbe{Addr: a.multiaddr, Protocol: "bitswap"}
+	t, err := bp.tcp()
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	raddrs, err := resolveTCPMultiaddrs(ctx, a.hostPort)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	// the resolved addresses are dialed in turn until one connects
+	var conn network.MuxedConn
+	for _, raddr := range raddrs {
+		if conn, err = t.Dial(ctx, raddr, pid); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer conn.Close()
+	out.Reachable = true
+	out.Libp2p = true
+
+	// the provider answers on streams of its own, which are accepted until the connection is closed
+	answers := make(chan error, 1)
+	go acceptBitswapAnswers(conn, c, answers)
+
+	s, err := conn.OpenStream(ctx)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+	if _, err := multistream.SelectOneOf(bitswapProtocols, s); err != nil {
+		out.Error = fmt.Sprintf("provider does not speak bitswap: %s", err)
+		return out
+	}
+	if err := writeBitswapMessage(s, bitswapWantBlock(c)); err != nil {
+		out.Error = err.Error()
+		return out
+	}
+
+	select {
+	case err = <-answers:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	out.Retrieved = true
+	return out
+}
+
+// acceptBitswapAnswers reads the bitswap messages that the provider sends on the streams it opens, and sends nil
+// once it sent the block or errBitswapDontHave once it answered that it does not have it.
+func acceptBitswapAnswers(conn network.MuxedConn, c cid.Cid, answers chan<- error) {
+	mux := multistream.NewMultistreamMuxer[protocol.ID]()
+	for _, p := range bitswapProtocols {
+		mux.AddHandler(p, nil)
+	}
+	for {
+		s, err := conn.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			// streams of other protocols, e.g. identify, are refused
+			if _, _, err := mux.Negotiate(s); err != nil {
+				s.Reset()
+				return
+			}
+			br := bufio.NewReader(s)
+			for {
+				msg, err := readBitswapMessage(br)
+				if err != nil {
+					return
+				}
+				if ok, err := bitswapAnswer(msg, c); ok {
+					select {
+					case answers <- err:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+}
+
+// bitswapWantBlock encodes a bitswap message that asks for the block of the CID, and for a DONT_HAVE if the peer
+// does not have it.
+func bitswapWantBlock(c cid.Cid) []byte {
+	var entry []byte
+	entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+	entry = protowire.AppendBytes(entry, c.Bytes())
+	entry = protowire.AppendTag(entry, 2, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, 1)
+	entry = protowire.AppendTag(entry, 5, protowire.VarintType)
+	entry = protowire.AppendVarint(entry, 1)
+
+	var wantlist []byte
+	wantlist = protowire.AppendTag(wantlist, 1, protowire.BytesType)
+	wantlist = protowire.AppendBytes(wantlist, entry)
+
+	var msg []byte
+	msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+	return protowire.AppendBytes(msg, wantlist)
+}
+
+// bitswapAnswer reports whether the bitswap message answers the want of the block of the CID, with errBitswapDontHave
+// if it answers that the peer does not have it. Blocks that do not hash to the CID are not answers.
+func bitswapAnswer(msg []byte, c cid.Cid) (bool, error) {
+	dontHave := false
+	err := consumeProtoFields(msg, func(num protowire.Number, v []byte) error {
+		switch num {
+		case 2:
+			// a block of bitswap 1.0.0
+			if verifyRawBlock(v, c).OK() {
+				return errBitswapBlockFound
+			}
+		case 3:
+			// a block of bitswap 1.1.0 or later, with the prefix of its CID
+			return consumeProtoFields(v, func(num protowire.Number, v []byte) error {
+				if num == 2 && verifyRawBlock(v, c).OK() {
+					return errBitswapBlockFound
+				}
+				return nil
+			})
+		case 4:
+			// a block presence of bitswap 1.2.0
+			var presence cid.Cid
+			var typ uint64
+			if err := consumeProtoFields(v, func(num protowire.Number, v []byte) error {
+				switch num {
+				case 1:
+					presence, _ = cid.Cast(v)
+				case 2:
+					typ, _ = protowire.ConsumeVarint(v)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if typ == 1 && presence.Equals(c) {
+				dontHave = true
+			}
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errBitswapBlockFound):
+		return true, nil
+	case dontHave:
+		return true, errBitswapDontHave
+	}
+	return false, nil
+}
+
+// errBitswapBlockFound stops consuming a bitswap message once the block was found.
+var errBitswapBlockFound = errors.New("block found")
+
+// consumeProtoFields calls f with the number of every field of the protobuf message, and with its bytes for
+// length-delimited fields or its encoded varint otherwise.
+func consumeProtoFields(b []byte, f func(num protowire.Number, v []byte) error) error {
+	for len(b) != 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		switch typ {
+		case protowire.BytesType:
+			bz, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			v, b = bz, b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			v, b = b[:n], b[n:]
+		}
+		if err := f(num, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBitswapMessage writes the message prefixed with its length, as bitswap frames messages.
+func writeBitswapMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(append(binary.AppendUvarint(nil, uint64(len(msg))), msg...))
+	return err
+}
+
+// readBitswapMessage reads a message prefixed with its length.
+func readBitswapMessage(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBitswapMessageSize {
+		return nil, fmt.Errorf("bitswap message of %d bytes is too large", n)
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, br, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resolveTCPMultiaddrs resolves the host of the address to all its IP addresses, as the TCP transport only dials IP
+// multiaddrs.
+func resolveTCPMultiaddrs(ctx context.Context, hostPort string) ([]ma.Multiaddr, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []ma.Multiaddr
+	for _, ip := range ips {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip.IP.String(), port))
+		if err != nil {
+			continue
+		}
+		if m, err := manet.FromNetAddr(addr); err == nil {
+			addrs = append(addrs, m)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,151 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+)
+
+// CacheAnomalyKind is the class of a difference between the cold and warm responses of a caching component.
+type CacheAnomalyKind string
+
+const (
+	// CacheCorruption is when the warm response differs from the cold response, i.e. the cache served different
+	// bytes than it was filled with.
+	CacheCorruption CacheAnomalyKind = "corruption"
+	// CacheFailure is when the cold response was read successfully but the warm response was not.
+	CacheFailure CacheAnomalyKind = "failure"
+	// CacheMiss is when the warm response was not faster than the cold response, which suggests that it was not
+	// served from the cache.
+	CacheMiss CacheAnomalyKind = "miss"
+)
+
+// CacheAnomalyKinds are all the kinds of cache anomalies.
+var CacheAnomalyKinds = []CacheAnomalyKind{CacheCorruption, CacheFailure, CacheMiss}
+
+// CacheAnomaly is a difference between the cold and warm responses of a caching component for a path.
+type CacheAnomaly struct {
+	Kind CacheAnomalyKind
+	Cold *Result
+	Warm *Result
+	// Divergence is where the responses first differ for cache corruptions, if their bodies were captured.
+	Divergence *Divergence `json:",omitempty"`
+}
+
+// CacheReads records the comparison of the cold and warm responses of a single caching component.
+type CacheReads struct {
+	TotalMatches int
+
+	Anomalies map[string]*CacheAnomaly
+	// AnomalyPaths is keyed by the kind of anomaly.
+	AnomalyPaths map[CacheAnomalyKind][]string
+}
+
+func newCacheReads() *CacheReads {
+	return &CacheReads{
+		Anomalies:    make(map[string]*CacheAnomaly),
+		AnomalyPaths: make(map[CacheAnomalyKind][]string),
+	}
+}
+
+// warmName is the name under which the warm results of a caching component are recorded.
+func warmName(c Component) string {
+	return c.Name + ":warm"
+}
+
+// coldURLs returns the URLs to test with the cache bust params removed from the URL of the component so that its
+// cache is used.
+func coldURLs(c Component, urls URLsToTest) URLsToTest {
+	bust, err := url.ParseQuery(c.CacheBust)
+	if err != nil || len(bust) == 0 {
+		return urls
+	}
+	u, err := url.Parse(urls.URLs[c.Name])
+	if err != nil {
+		return urls
+	}
+	q := u.Query()
+	for k := range bust {
+		q.Del(k)
+	}
+	u.RawQuery = q.Encode()
+
+	out := make(map[string]string, len(urls.URLs))
+	for name, s := range urls.URLs {
+		out[name] = s
+	}
+	out[c.Name] = u.String()
+	urls.URLs = out
+	return urls
+}
+
+// compareCache compares the cold and warm responses of the caching component. ok is false if the cold response
+// could not be read, in which case there is nothing to compare the warm response with.
+func (pc *pathComparer) compareCache(c Component) (anomaly *CacheAnomaly, ok bool) {
+	cold, warm := pc.rs[c.Name], pc.rs[warmName(c)]
+	if cold == nil || warm == nil || !isReadOK(cold) {
+		return nil, false
+	}
+
+	a := &CacheAnomaly{Cold: cold, Warm: warm}
+	switch {
+	case !isReadOK(warm):
+		a.Kind = CacheFailure
+	case pc.streamed && cold.ResponseDigest != warm.ResponseDigest:
+		a.Kind = CacheCorruption
+	case !pc.streamed && !bytes.Equal(pc.bodies[c.Name], pc.bodies[warmName(c)]):
+		a.Kind = CacheCorruption
+		a.Divergence = newDivergence(pc.bodies[c.Name], pc.bodies[warmName(c)], "body")
+	case warm.Latency >= cold.Latency:
+		a.Kind = CacheMiss
+	default:
+		return nil, true
+	}
+	return a, true
+}
+
+// cacheComponents returns the components whose cold and warm responses are compared.
+func (re *RequestExecutor) cacheComponents() []Component {
+	if !re.opts.CompareCache {
+		return nil
+	}
+	var out []Component
+	for _, c := range re.components {
+		if c.Cache {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// latencyComponents returns the components along with a component named after the warm responses of every caching
+// component so that the latencies of warm responses are summarised separately.
+func (re *RequestExecutor) latencyComponents() []Component {
+	out := append([]Component{}, re.components...)
+	for _, c := range re.cacheComponents() {
+		out = append(out, Component{Name: warmName(c)})
+	}
+	return out
+}
+
+// writeCacheAnomalies writes the cache anomalies of every caching component and prints a summary. The caller must
+// hold the lock.
+func (re *RequestExecutor) writeCacheAnomalies(latency map[string]LatencyStats) {
+	cs := re.cacheComponents()
+	if len(cs) == 0 {
+		return
+	}
+
+	fmt.Println("\n ----------SUMMARY OF CACHE ANOMALIES --------------")
+	for _, c := range cs {
+		cr := re.responseReads.Caches[c.Name]
+		re.writeJSON(cr.Anomalies, re.rrFile(fmt.Sprintf("%s-cache-anomalies.json", c.Name)))
+
+		fmt.Printf("\n Run-%d; %s warm responses matching cold responses: %d", re.n, c.Name, cr.TotalMatches)
+		for _, kind := range CacheAnomalyKinds {
+			fmt.Printf("\n Run-%d; %s cache %s: %d", re.n, c.Name, kind, len(cr.AnomalyPaths[kind]))
+		}
+		fmt.Printf("\n Run-%d; %s p50 cold: %s, p50 warm: %s", re.n, c.Name, latency[c.Name].P50, latency[warmName(c)].P50)
+	}
+	fmt.Println()
+}
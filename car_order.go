@@ -0,0 +1,266 @@
+package onion
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+const (
+	// CarOrderDFS is the depth-first order in which a traversal of the request path and dag-scope visits blocks.
+	CarOrderDFS = "dfs"
+	// CarOrderUnknown is any order.
+	CarOrderUnknown = "unk"
+)
+
+// CarOrderPolicy is the block order and duplicate block policy of a CAR response, as per the order and dups
+// parameters of the application/vnd.ipld.car content type of the trustless gateway spec.
+type CarOrderPolicy struct {
+	// Order is CarOrderDFS or CarOrderUnknown.
+	Order string
+	// Dups is true if a block is sent again every time the traversal visits it, and false if every block is sent
+	// only once.
+	Dups bool
+}
+
+// ParseCarOrderPolicy returns the policy given by the order and dups parameters of a CAR media type, e.g. of an
+// Accept or Content-Type header, using def for the parameters that are not set.
+func ParseCarOrderPolicy(mediaType string, def CarOrderPolicy) CarOrderPolicy {
+	out := def
+	mt, params, err := mime.ParseMediaType(mediaType)
+	if err != nil || mt != carContentType {
+		return out
+	}
+	switch params["order"] {
+	case CarOrderDFS, CarOrderUnknown:
+		out.Order = params["order"]
+	}
+	switch params["dups"] {
+	case "y":
+		out.Dups = true
+	case "n":
+		out.Dups = false
+	}
+	return out
+}
+
+// CarOrderReport describes how a CAR response complies with its block order and duplicate block policy. Blocks
+// outside the dag-scope of the request and blocks missing from the CAR are reported by VerifyDagScope instead and
+// are ignored here.
+type CarOrderReport struct {
+	Policy CarOrderPolicy
+	// Duplicates are blocks sent more than once although the policy does not allow duplicates.
+	Duplicates []string `json:",omitempty"`
+	// Deviation is the first block that is not where the order of the policy expects it.
+	Deviation *OrderDeviation `json:",omitempty"`
+	// Error is set if the CAR could not be verified at all.
+	Error string `json:",omitempty"`
+}
+
+func (r *CarOrderReport) OK() bool {
+	return len(r.Duplicates) == 0 && r.Deviation == nil && len(r.Error) == 0
+}
+
+// OrderDeviation is a block that is not where the expected order puts it.
+type OrderDeviation struct {
+	// Index is the position of the block in the CAR.
+	Index int
+	// Expected is the block expected at the position and Actual the block that was sent, which is empty if the
+	// CAR ended before the expected block, e.g. because duplicates were left out.
+	Expected string
+	Actual   string
+}
+
+// VerifyCarOrder checks that the blocks of the CAR returned for the request url are in the order of the policy,
+// i.e. the depth-first order in which the request path and then the dag-scope of the request are traversed, and
+// that blocks are only repeated if the policy allows duplicates.
+func VerifyCarOrder(carBytes []byte, requestUrl string, policy CarOrderPolicy) *CarOrderReport {
+	report := &CarOrderReport{Policy: policy}
+
+	u, err := url.Parse(requestUrl)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to parse request url: %s", err)
+		return report
+	}
+	scope, err := requestDagScope(u)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	dv, err := newDagVerifier(carBytes)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read car: %s", err)
+		return report
+	}
+
+	if !policy.Dups {
+		seen := make(map[cid.Cid]struct{}, len(dv.seq))
+		reported := make(map[cid.Cid]struct{})
+		for _, c := range dv.seq {
+			if _, ok := seen[c]; !ok {
+				seen[c] = struct{}{}
+				continue
+			}
+			if _, ok := reported[c]; !ok {
+				reported[c] = struct{}{}
+				report.Duplicates = append(report.Duplicates, c.String())
+			}
+		}
+	}
+	if policy.Order != CarOrderDFS {
+		return report
+	}
+
+	terminal, err := dv.resolvePath(requestPathSegments(u.Path))
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	w := &orderWalker{dv: dv, dups: policy.Dups, visited: make(map[cid.Cid]struct{})}
+	for _, c := range dv.path {
+		w.visit(c)
+	}
+	switch scope {
+	case DagScopeBlock:
+		w.visit(terminal)
+	case DagScopeEntity:
+		err = w.entity(terminal)
+	case DagScopeAll:
+		err = w.all(terminal)
+	}
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Deviation = w.deviation()
+	return report
+}
+
+// orderWalker records the blocks of a CAR in the order a depth-first traversal visits them.
+type orderWalker struct {
+	dv   *dagVerifier
+	dups bool
+
+	visited map[cid.Cid]struct{}
+	seq     []cid.Cid
+}
+
+// visit records the block and reports whether its links should be followed, i.e. if it is in the CAR and, unless
+// duplicates are sent, was not visited before.
+func (w *orderWalker) visit(c cid.Cid) bool {
+	if _, ok := w.visited[c]; ok && !w.dups {
+		return false
+	}
+	w.visited[c] = struct{}{}
+	w.seq = append(w.seq, c)
+	_, ok := w.dv.blocks[c]
+	return ok
+}
+
+// all visits the whole DAG under c.
+func (w *orderWalker) all(c cid.Cid) error {
+	if !w.visit(c) {
+		return nil
+	}
+	return w.children(c)
+}
+
+func (w *orderWalker) children(c cid.Cid) error {
+	n, err := w.dv.ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", c, err)
+	}
+	links, err := traversal.SelectLinks(n)
+	if err != nil {
+		return fmt.Errorf("failed to select links of %s: %w", c, err)
+	}
+	for _, l := range links {
+		if err := w.all(l.(cidlink.Link).Cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entity visits the blocks needed to read the entity as per dagVerifier.expectEntity.
+func (w *orderWalker) entity(c cid.Cid) error {
+	if !w.visit(c) || c.Prefix().Codec != cid.DagProtobuf {
+		return nil
+	}
+	pbn, ufs, err := w.dv.loadPB(c)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", c, err)
+	}
+	if ufs == nil {
+		return nil
+	}
+
+	switch ufs.FieldDataType().Int() {
+	case data.Data_File, data.Data_Raw:
+		return w.children(c)
+	case data.Data_HAMTShard:
+		prefixLen := 2
+		if ufs.FieldFanout().Exists() {
+			prefixLen = len(fmt.Sprintf("%X", ufs.FieldFanout().Must().Int()-1))
+		}
+		itr := pbn.FieldLinks().Iterator()
+		for !itr.Done() {
+			_, l := itr.Next()
+			if l.FieldName().Exists() && len(l.FieldName().Must().String()) == prefixLen {
+				if err := w.entity(l.FieldHash().Link().(cidlink.Link).Cid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// deviation compares the blocks of the CAR with the visited blocks. Only blocks that are both in the CAR and
+// visited are compared, so that missing and unexpected blocks, e.g. for entity-bytes ranges, are not mistaken for
+// ordering errors.
+func (w *orderWalker) deviation() *OrderDeviation {
+	var expected []cid.Cid
+	for _, c := range w.seq {
+		if _, ok := w.dv.blocks[c]; ok {
+			expected = append(expected, c)
+		}
+	}
+
+	var actual []cid.Cid
+	var index []int
+	seen := make(map[cid.Cid]struct{})
+	for i, c := range w.dv.seq {
+		if _, ok := w.visited[c]; !ok {
+			continue
+		}
+		// duplicates are reported separately if not allowed
+		if _, ok := seen[c]; ok && !w.dups {
+			continue
+		}
+		seen[c] = struct{}{}
+		actual = append(actual, c)
+		index = append(index, i)
+	}
+
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			return &OrderDeviation{Index: len(w.dv.seq), Expected: expected[i].String()}
+		case i >= len(expected):
+			return &OrderDeviation{Index: index[i], Actual: actual[i].String()}
+		case !expected[i].Equals(actual[i]):
+			return &OrderDeviation{Index: index[i], Expected: expected[i].String(), Actual: actual[i].String()}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Package cardiff computes structural differences between two CARs so that byte mismatches between layers can be
+// triaged without inspecting the CARs by hand.
+package cardiff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+)
+
+// Diff is the structural difference between CAR A and CAR B.
+type Diff struct {
+	RootsA      []string
+	RootsB      []string
+	RootsDiffer bool
+
+	BlockCountA int
+	BlockCountB int
+
+	// ReadErrorA is set if A could only be read partially, e.g. because it is truncated. The diff then only
+	// covers the blocks read before the error.
+	ReadErrorA string `json:",omitempty"`
+	// ReadErrorB is set if B could only be read partially.
+	ReadErrorB string `json:",omitempty"`
+
+	// OnlyInA are blocks in A that are missing from B.
+	OnlyInA []string `json:",omitempty"`
+	// OnlyInB are blocks in B that are missing from A.
+	OnlyInB []string `json:",omitempty"`
+
+	// DuplicatesA are blocks that appear more than once in A.
+	DuplicatesA []string `json:",omitempty"`
+	// DuplicatesB are blocks that appear more than once in B.
+	DuplicatesB []string `json:",omitempty"`
+
+	// DataDiffers are blocks present in both CARs with different data, which means at least one of them is corrupt.
+	DataDiffers []string `json:",omitempty"`
+
+	// OrderDiffers is true if the blocks present in both CARs appear in a different order.
+	OrderDiffers bool
+	// FirstOrderDifference is the index, among the blocks present in both CARs, of the first block that appears
+	// out of order. It is -1 if the order is the same.
+	FirstOrderDifference int
+}
+
+// Equal reports whether the two CARs are structurally the same, i.e. the same roots and blocks in the same order.
+func (d *Diff) Equal() bool {
+	return !d.RootsDiffer && len(d.ReadErrorA) == 0 && len(d.ReadErrorB) == 0 && len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 && len(d.DuplicatesA) == 0 &&
+		len(d.DuplicatesB) == 0 && len(d.DataDiffers) == 0 && !d.OrderDiffers
+}
+
+// carBlocks is the parsed content of a CAR.
+type carBlocks struct {
+	roots []cid.Cid
+	// order is the order in which blocks first appear
+	order []cid.Cid
+	data  map[cid.Cid][]byte
+	dups  []cid.Cid
+	// readErr is the error that stopped reading blocks before the end of the CAR.
+	readErr error
+}
+
+// readCAR reads the blocks of a CAR. An error is only returned if the CAR header can not be read; errors
+// reading blocks are recorded in readErr.
+func readCAR(bz []byte) (*carBlocks, error) {
+	br, err := car.NewBlockReader(bytes.NewReader(bz))
+	if err != nil {
+		return nil, err
+	}
+
+	cb := &carBlocks{
+		roots: br.Roots,
+		data:  make(map[cid.Cid][]byte),
+	}
+	seenDup := make(map[cid.Cid]struct{})
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cb.readErr = err
+			break
+		}
+
+		c := blk.Cid()
+		if _, ok := cb.data[c]; ok {
+			if _, ok := seenDup[c]; !ok {
+				seenDup[c] = struct{}{}
+				cb.dups = append(cb.dups, c)
+			}
+			continue
+		}
+		cb.order = append(cb.order, c)
+		cb.data[c] = blk.RawData()
+	}
+	return cb, nil
+}
+
+// Compare parses both CARs and returns their structural diff.
+func Compare(a, b []byte) (*Diff, error) {
+	ca, err := readCAR(a)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read car A: %w", err)
+	}
+	cb, err := readCAR(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read car B: %w", err)
+	}
+
+	d := &Diff{
+		RootsA:               cidStrings(ca.roots),
+		RootsB:               cidStrings(cb.roots),
+		BlockCountA:          len(ca.order) + len(ca.dups),
+		BlockCountB:          len(cb.order) + len(cb.dups),
+		DuplicatesA:          cidStrings(ca.dups),
+		DuplicatesB:          cidStrings(cb.dups),
+		FirstOrderDifference: -1,
+	}
+	if ca.readErr != nil {
+		d.ReadErrorA = ca.readErr.Error()
+	}
+	if cb.readErr != nil {
+		d.ReadErrorB = cb.readErr.Error()
+	}
+
+	if len(ca.roots) != len(cb.roots) {
+		d.RootsDiffer = true
+	} else {
+		for i := range ca.roots {
+			if !ca.roots[i].Equals(cb.roots[i]) {
+				d.RootsDiffer = true
+			}
+		}
+	}
+
+	var commonA []cid.Cid
+	for _, c := range ca.order {
+		bz, ok := cb.data[c]
+		if !ok {
+			d.OnlyInA = append(d.OnlyInA, c.String())
+			continue
+		}
+		commonA = append(commonA, c)
+		if !bytes.Equal(bz, ca.data[c]) {
+			d.DataDiffers = append(d.DataDiffers, c.String())
+		}
+	}
+
+	var commonB []cid.Cid
+	for _, c := range cb.order {
+		if _, ok := ca.data[c]; !ok {
+			d.OnlyInB = append(d.OnlyInB, c.String())
+			continue
+		}
+		commonB = append(commonB, c)
+	}
+
+	for i := range commonA {
+		if !commonA[i].Equals(commonB[i]) {
+			d.OrderDiffers = true
+			d.FirstOrderDifference = i
+			break
+		}
+	}
+
+	return d, nil
+}
+
+func cidStrings(cs []cid.Cid) []string {
+	if len(cs) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(cs))
+	for _, c := range cs {
+		out = append(out, c.String())
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	car "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+	"github.com/multiformats/go-multihash"
+)
+
+// CarIndexReport describes how the index embedded in a CARv2 response matches the blocks of its data payload.
+type CarIndexReport struct {
+	// IndexCodec is the codec of the index, e.g. car-multihash-index-sorted. It is empty if the CAR has no index.
+	IndexCodec string `json:",omitempty"`
+	// Blocks is the number of blocks in the data payload.
+	Blocks int
+	// Unindexed are the blocks of the data payload that are not in the index. Blocks with identity CIDs are not
+	// indexed and are ignored.
+	Unindexed []string `json:",omitempty"`
+	// BadOffsets are index entries that do not point to the start of a block with their multihash.
+	BadOffsets []IndexEntry `json:",omitempty"`
+	// Error is set if the CARv2 header or the index could not be read.
+	Error string `json:",omitempty"`
+}
+
+func (r *CarIndexReport) OK() bool {
+	return len(r.Unindexed) == 0 && len(r.BadOffsets) == 0 && len(r.Error) == 0
+}
+
+// IndexEntry is an entry of a CARv2 index. Offset is relative to the start of the data payload.
+type IndexEntry struct {
+	Multihash string
+	Offset    uint64
+}
+
+// isCarV2 reports whether the bytes are a CARv2, whose pragma is a CARv1 header with version 2.
+func isCarV2(carBytes []byte) bool {
+	return len(carBytes) >= car.PragmaSize && bytes.Equal(carBytes[:car.PragmaSize], car.Pragma)
+}
+
+// carV1Payload returns the CARv1 data payload of a CARv2 so that CARv2 responses can be compared byte for byte
+// with the CARv1 responses of other components. Other bytes, including CARv2s with a malformed header, are
+// returned as is.
+func carV1Payload(carBytes []byte) []byte {
+	if !isCarV2(carBytes) {
+		return carBytes
+	}
+	var h car.Header
+	if _, err := h.ReadFrom(bytes.NewReader(carBytes[car.PragmaSize:])); err != nil {
+		return carBytes
+	}
+	if h.DataOffset < car.PragmaSize+car.HeaderSize || h.DataOffset+h.DataSize > uint64(len(carBytes)) {
+		return carBytes
+	}
+	return carBytes[h.DataOffset : h.DataOffset+h.DataSize]
+}
+
+// VerifyCarIndex checks that the index of a CARv2 points every block of the data payload at its offset, and only
+// at the offsets of blocks with the same multihash. It returns nil for CARv1s, which have no index.
+func VerifyCarIndex(carBytes []byte) *CarIndexReport {
+	if !isCarV2(carBytes) {
+		return nil
+	}
+	report := &CarIndexReport{}
+
+	cr, err := car.NewReader(bytes.NewReader(carBytes))
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read carv2 header: %s", err)
+		return report
+	}
+	h := cr.Header
+	size := uint64(len(carBytes))
+	switch {
+	case h.DataOffset < car.PragmaSize+car.HeaderSize || h.DataOffset+h.DataSize > size:
+		report.Error = fmt.Sprintf("data payload at %d of size %d is out of bounds of the %d bytes car", h.DataOffset, h.DataSize, size)
+		return report
+	case h.HasIndex() && (h.IndexOffset < h.DataOffset+h.DataSize || h.IndexOffset >= size):
+		report.Error = fmt.Sprintf("index at %d overlaps the data payload or is out of bounds of the %d bytes car", h.IndexOffset, size)
+		return report
+	}
+
+	// block offsets in the index are relative to the start of the data payload
+	br, err := car.NewBlockReader(bytes.NewReader(carV1Payload(carBytes)))
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read data payload: %s", err)
+		return report
+	}
+	var blocks []*car.BlockMetadata
+	digests := make(map[uint64]string)
+	for {
+		b, err := br.SkipNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to read data payload: %s", err)
+			return report
+		}
+		blocks = append(blocks, b)
+		digests[b.Offset] = mhDigest(b.Cid.Hash())
+	}
+	report.Blocks = len(blocks)
+
+	if !h.HasIndex() {
+		return report
+	}
+	ir, err := cr.IndexReader()
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read index: %s", err)
+		return report
+	}
+	idx, err := index.ReadFrom(ir)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read index: %s", err)
+		return report
+	}
+	report.IndexCodec = idx.Codec().String()
+
+	bad := make(map[IndexEntry]struct{})
+	addBad := func(e IndexEntry) {
+		if _, ok := bad[e]; !ok {
+			bad[e] = struct{}{}
+			report.BadOffsets = append(report.BadOffsets, e)
+		}
+	}
+	for _, b := range blocks {
+		if b.Cid.Prefix().MhType == multihash.IDENTITY {
+			continue
+		}
+		found := false
+		err := idx.GetAll(b.Cid, func(offset uint64) bool {
+			if offset == b.Offset {
+				found = true
+			} else if digests[offset] != mhDigest(b.Cid.Hash()) {
+				addBad(IndexEntry{Multihash: b.Cid.Hash().B58String(), Offset: offset})
+			}
+			return true
+		})
+		if err != nil && !errors.Is(err, index.ErrNotFound) {
+			report.Error = fmt.Sprintf("failed to look up %s in index: %s", b.Cid, err)
+			return report
+		}
+		if !found {
+			report.Unindexed = append(report.Unindexed, b.Cid.String())
+		}
+	}
+
+	// iterable indexes can also be checked for entries of blocks that are not in the data payload
+	if it, ok := idx.(index.IterableIndex); ok {
+		err := it.ForEach(func(mh multihash.Multihash, offset uint64) error {
+			if d, ok := digests[offset]; !ok || d != mhDigest(mh) {
+				addBad(IndexEntry{Multihash: mh.B58String(), Offset: offset})
+			}
+			return nil
+		})
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to iterate index: %s", err)
+		}
+	}
+	return report
+}
+
+// mhDigest returns the digest of the multihash, which is all that indexes of the car-index-sorted codec record.
+func mhDigest(mh multihash.Multihash) string {
+	d, err := multihash.Decode(mh)
+	if err != nil {
+		return string(mh)
+	}
+	return string(d.Digest)
+}
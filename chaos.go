@@ -0,0 +1,164 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// defaultChaosTimeout bounds the call to the admin endpoint of a chaos action by default.
+const defaultChaosTimeout = time.Minute
+
+// ChaosAction is a failure injected into the stack under test between runs by calling an admin endpoint, e.g. to
+// restart the shim, flush the nginx cache or drop the peers of lassie, so that the behaviour of the layers can be
+// compared under controlled failure.
+type ChaosAction struct {
+	// Name labels the results of the runs the action is injected before, e.g. "restart-shim".
+	Name string `toml:"name"`
+	// URL is the admin endpoint to call, and Method its method, which defaults to POST.
+	URL    string `toml:"url"`
+	Method string `toml:"method"`
+	// Headers and Body are sent with the call. Values may reference env vars as ${VAR}.
+	Headers map[string]string `toml:"headers"`
+	Body    string            `toml:"body"`
+	// Runs are the numbers of the runs the action is injected before. Defaults to every run but the first, which is
+	// the baseline.
+	Runs []int `toml:"runs"`
+	// Settle is how long to wait after the call before the run starts, e.g. "30s" for a restarted layer to come back.
+	Settle string `toml:"settle"`
+	// Timeout bounds the call. Defaults to 1m.
+	Timeout string `toml:"timeout"`
+}
+
+// Validate checks that the action is well-formed.
+func (a ChaosAction) Validate() error {
+	if len(a.Name) == 0 {
+		return fmt.Errorf("invalid chaos action: name is required")
+	}
+	if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid chaos action %s: invalid url %q", a.Name, a.URL)
+	}
+	for _, d := range []struct{ name, v string }{{"settle", a.Settle}, {"timeout", a.Timeout}} {
+		if len(d.v) == 0 {
+			continue
+		}
+		if v, err := time.ParseDuration(d.v); err != nil || v < 0 {
+			return fmt.Errorf("invalid chaos action %s: invalid %s %q", a.Name, d.name, d.v)
+		}
+	}
+	for _, n := range a.Runs {
+		if n < 1 {
+			return fmt.Errorf("invalid chaos action %s: invalid run %d", a.Name, n)
+		}
+	}
+	return nil
+}
+
+// injectedBefore reports whether the action is injected before run n.
+func (a ChaosAction) injectedBefore(n int) bool {
+	if len(a.Runs) == 0 {
+		return n > 1
+	}
+	for _, r := range a.Runs {
+		if r == n {
+			return true
+		}
+	}
+	return false
+}
+
+// ChaosInjection is the outcome of calling the admin endpoint of a chaos action before a run.
+type ChaosInjection struct {
+	Action string
+	URL    string
+	Time   time.Time
+	// StatusCode is the status the endpoint returned, and Error is set if it could not be called or did not return a
+	// 2xx, in which case the failure was not injected.
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// Injected reports whether the failure was injected.
+func (i ChaosInjection) Injected() bool {
+	return len(i.Error) == 0
+}
+
+// inject calls the admin endpoint of the action and waits for it to settle.
+func (a ChaosAction) inject(ctx context.Context) ChaosInjection {
+	in := ChaosInjection{Action: a.Name, URL: a.URL, Time: time.Now().UTC()}
+	timeout := defaultChaosTimeout
+	if len(a.Timeout) != 0 {
+		timeout, _ = time.ParseDuration(a.Timeout)
+	}
+	method := a.Method
+	if len(method) == 0 {
+		method = http.MethodPost
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(cctx, method, a.URL, strings.NewReader(os.ExpandEnv(a.Body)))
+	if err != nil {
+		in.Error = err.Error()
+		return in
+	}
+	for k, v := range a.Headers {
+		req.Header.Set(k, os.ExpandEnv(v))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		in.Error = err.Error()
+		return in
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	in.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		in.Error = fmt.Sprintf("%s returned %d: %s", a.URL, resp.StatusCode, strings.TrimSpace(string(body)))
+		return in
+	}
+
+	if len(a.Settle) != 0 {
+		settle, _ := time.ParseDuration(a.Settle)
+		select {
+		case <-ctx.Done():
+		case <-time.After(settle):
+		}
+	}
+	return in
+}
+
+// injectChaos injects the chaos actions of run n in order and writes their outcomes to chaos.json in the results
+// directory of the run. It returns the label of the run, which names the injected actions joined by "+", or "" if
+// none was injected. Actions that fail to be injected are logged and left out of the label.
+func (cfg RunConfig) injectChaos(ctx context.Context, n int, dir string, log *slog.Logger) (string, error) {
+	var injections []ChaosInjection
+	var names []string
+	for _, a := range cfg.Chaos {
+		if !a.injectedBefore(n) {
+			continue
+		}
+		log.Info("injecting chaos", "run", n, "action", a.Name, "url", a.URL)
+		in := a.inject(ctx)
+		if !in.Injected() {
+			log.Warn("failed to inject chaos", "run", n, "action", a.Name, "err", in.Error)
+		} else {
+			names = append(names, a.Name)
+		}
+		injections = append(injections, in)
+	}
+	if len(injections) == 0 {
+		return "", nil
+	}
+	if err := cfg.writeReport(dir, "chaos.json", injections); err != nil {
+		return "", err
+	}
+	return strings.Join(names, "+"), nil
+}
@@ -0,0 +1,131 @@
+package onion
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// checkpointEvery is the number of completed paths after which the executor writes a checkpoint.
+var checkpointEvery = 25
+
+const checkpointFile = "checkpoint.json"
+
+// Checkpoint is the state of a run after some of its paths have completed, from which the run can be resumed.
+type Checkpoint struct {
+	RunID uuid.UUID
+	N     int
+
+	// Results are the results of the completed paths.
+	Results       map[string]Results
+	ResponseReads *ResponseBytesMismatch
+}
+
+// ReadCheckpoint reads the checkpoint written to the results directory of a run.
+func ReadCheckpoint(dir string) (*Checkpoint, error) {
+	bz, err := os.ReadFile(filepath.Join(dir, checkpointFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	var cp Checkpoint
+	if err := UnmarshalReport(bz, &cp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal checkpoint: %w", err)
+	}
+	return &cp, nil
+}
+
+// Resume restores the state of the executor from the checkpoint so that Execute only requests the paths that
+// had not completed. The checkpoint must have been written by a run with the same components and comparators.
+func (re *RequestExecutor) Resume(cp *Checkpoint) error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	rr := cp.ResponseReads
+	if rr == nil {
+		return fmt.Errorf("checkpoint has no response reads")
+	}
+	for _, p := range re.pairs {
+		pm, ok := rr.Pairs[p.Name()]
+		if !ok {
+			return fmt.Errorf("checkpoint has no results for pair %s", p.Name())
+		}
+		for _, c := range re.opts.comparators(p) {
+			if _, ok := pm.Comparators[c.Name()]; !ok {
+				return fmt.Errorf("checkpoint has no results for comparator %s of pair %s", c.Name(), p.Name())
+			}
+		}
+		// checkpoints written before redirects were compared have none
+		if pm.RedirectMismatches == nil {
+			pm.RedirectMismatches = make(map[string]*Mismatch)
+		}
+	}
+	for _, c := range re.components {
+		reads, ok := rr.Components[c.Name]
+		if !ok {
+			return fmt.Errorf("checkpoint has no results for component %s", c.Name)
+		}
+		// checkpoints written before CARv2 indexes were verified have none
+		if reads.CarIndexErrors == nil {
+			reads.CarIndexErrors = make(map[string]*CarIndexReport)
+		}
+		// checkpoints written before truncated responses were told apart have none
+		if reads.Truncated == nil {
+			reads.Truncated = make(map[string]*Result)
+		}
+		// checkpoints written before CAR negotiation was verified have none
+		if reads.NegotiationViolations == nil {
+			reads.NegotiationViolations = make(map[string]*NegotiationReport)
+		}
+		// checkpoints written before transfer sizes were checked have none
+		if reads.TransferDiscrepancies == nil {
+			reads.TransferDiscrepancies = make(map[string]*TransferReport)
+		}
+	}
+	for _, c := range re.cacheComponents() {
+		if _, ok := rr.Caches[c.Name]; !ok {
+			return fmt.Errorf("checkpoint has no cache results for component %s", c.Name)
+		}
+	}
+	for _, c := range re.encodingComponents() {
+		if _, ok := rr.Encodings[c.Name]; !ok {
+			return fmt.Errorf("checkpoint has no encoding results for component %s", c.Name)
+		}
+	}
+
+	re.id = cp.RunID
+	re.n = cp.N
+	re.results = cp.Results
+	if re.results == nil {
+		re.results = make(map[string]Results)
+	}
+	re.responseReads = rr
+	re.log = re.opts.Logger.With("run", re.n, "run_id", re.id.String())
+	return nil
+}
+
+// writeCheckpoint writes the state of the run to the results directory. The caller must hold the lock.
+func (re *RequestExecutor) writeCheckpoint() error {
+	bz, err := json.Marshal(ReportV1{ReportVersion: ReportVersion, Report: "checkpoint", Data: Checkpoint{
+		RunID:         re.id,
+		N:             re.n,
+		Results:       re.results,
+		ResponseReads: re.responseReads,
+	}})
+	if err != nil {
+		return err
+	}
+
+	// checkpoints are written to the run directory even if its reports are not
+	if err := os.MkdirAll(re.dir, 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first so that a crash while writing does not corrupt the last checkpoint
+	tmp := filepath.Join(re.dir, checkpointFile+".tmp")
+	if err := os.WriteFile(tmp, bz, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(re.dir, checkpointFile))
+}
@@ -1,26 +1,122 @@
 package onion
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 var cidContactUrl = "https://cid.contact/cid/%s"
 
+var (
+	defaultCidContactConcurrency = 8
+	defaultCidContactMaxRetries  = 5
+	defaultCidContactBackoff     = 1 * time.Second
+	// DefaultCidContactTTL is how long lookups are cached by default.
+	DefaultCidContactTTL = 24 * time.Hour
+)
+
 type CidContactChecker struct {
 	client     http.Client
 	mismatches []string
+
+	concurrency int
+	maxRetries  int
+	backoff     time.Duration
+
+	// Cache caches lookups across checks, if set.
+	Cache *CidContactCache
+	// Rules classify the providers of CIDs. Defaults to DefaultProviderRules.
+	Rules []ProviderRule
 }
 
 type CidContactOutput struct {
-	Status     int
-	Response   string
-	IsDagHouse bool
-	IsPinata   bool
+	Status   int
+	Response string
+	// Records are the providers of the CID as per the cid.contact response.
+	Records []ProviderRecord `json:",omitempty"`
+	// Providers are the names of the rules that match the providers of the CID.
+	Providers []string `json:",omitempty"`
+}
+
+// ProviderRecord is a provider of a CID as advertised to cid.contact.
+type ProviderRecord struct {
+	ID    string
+	Addrs []string `json:",omitempty"`
+}
+
+// ProviderRule names the providers with one of the peer IDs, or one of whose multiaddrs contains one of the addr
+// patterns, e.g. "dag.w3s".
+type ProviderRule struct {
+	Name    string   `toml:"name"`
+	PeerIDs []string `toml:"peerIds"`
+	Addrs   []string `toml:"addrs"`
+}
+
+// DefaultProviderRules classify the providers that most content is pinned with.
+var DefaultProviderRules = []ProviderRule{
+	{Name: "dag.house", Addrs: []string{"dag.w3s", "dag.house"}},
+	{Name: "pinata", Addrs: []string{"pinata.cloud"}},
+}
+
+func (r ProviderRule) matches(p ProviderRecord) bool {
+	for _, id := range r.PeerIDs {
+		if p.ID == id {
+			return true
+		}
+	}
+	for _, pattern := range r.Addrs {
+		for _, a := range p.Addrs {
+			if strings.Contains(a, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// classify returns the names of the rules that match any of the providers, in the order of the rules.
+func classify(rules []ProviderRule, records []ProviderRecord) []string {
+	var out []string
+	for _, r := range rules {
+		for _, p := range records {
+			if r.matches(p) {
+				out = append(out, r.Name)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// CidContactSummary classifies a set of mismatched paths by what cid.contact knows about their CIDs.
+type CidContactSummary struct {
+	NotFoundOnCidContact int
+	// Providers is the number of CIDs provided by every classified provider. CIDs with several classified
+	// providers are counted for each.
+	Providers map[string]int
+	// Others is the number of CIDs none of whose providers are classified.
+	Others int
+	// LookupErrors is the number of CIDs that could not be looked up after all retries.
+	LookupErrors int
+}
+
+func (s CidContactSummary) Print() {
+	fmt.Println("\n--- cid.contact Summary of mismatches---")
+	bz, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		fmt.Printf("failed to encode summary: %s\n", err)
+		return
+	}
+	fmt.Println(string(bz))
 }
 
 func NewCidContactChecker(mismatches []string) *CidContactChecker {
@@ -33,56 +129,108 @@ func NewCidContactChecker(mismatches []string) *CidContactChecker {
 			},
 			Timeout: 3 * time.Minute,
 		},
-		mismatches: mismatches,
+		mismatches:  mismatches,
+		Rules:       DefaultProviderRules,
+		concurrency: defaultCidContactConcurrency,
+		maxRetries:  defaultCidContactMaxRetries,
+		backoff:     defaultCidContactBackoff,
 	}
 }
 
-func (klm *CidContactChecker) Check() {
-	type Summary struct {
-		NotFoundOnCidContact int
-		DAGHouseCid          int
-		PinataCid            int
-		Others               int
-	}
+// Check looks up the CIDs of all mismatched paths on cid.contact using a pool of workers. If the context is
+// cancelled, the summary of the lookups done so far is returned along with the context error.
+func (klm *CidContactChecker) Check(ctx context.Context) (CidContactSummary, error) {
+	var mu sync.Mutex
+	sum := CidContactSummary{Providers: make(map[string]int)}
 
-	sum := Summary{}
+	paths := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < klm.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				// paths are only looked up by their root cid, so unresolved /ipns/ paths count as lookup errors
+				c, err := ParseCidFromPath(path)
+				var cc *CidContactOutput
+				if err == nil {
+					cc, err = klm.getWithRetries(ctx, c)
+				}
 
-	for _, path := range klm.mismatches {
-		// check cid.contact
-		cid := ParseCidFromPath(path)
-		var cc *CidContactOutput
-		var err error
-
-		for {
-			cc, err = klm.GetCidContactResponse(cid)
-			if err != nil {
-				time.Sleep(1 * time.Second)
-				continue
+				// cached lookups are classified again in case the rules changed
+				var providers []string
+				if err == nil {
+					providers = classify(klm.Rules, cc.Records)
+				}
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					sum.LookupErrors++
+				case cc.Status == http.StatusNotFound:
+					sum.NotFoundOnCidContact++
+				case len(providers) == 0:
+					sum.Others++
+				}
+				for _, name := range providers {
+					sum.Providers[name]++
+				}
+				mu.Unlock()
 			}
-			break
-		}
+		}()
+	}
 
-		if cc.Status == http.StatusNotFound {
-			sum.NotFoundOnCidContact++
-		} else if cc.IsDagHouse {
-			sum.DAGHouseCid++
-		} else if cc.IsPinata {
-			sum.PinataCid++
-		} else {
-			sum.Others++
+loop:
+	for _, path := range klm.mismatches {
+		select {
+		case paths <- path:
+		case <-ctx.Done():
+			break loop
 		}
 	}
+	close(paths)
+	wg.Wait()
 
-	fmt.Println("\n--- cid.contact Summary of mismatches---")
-	bz, err := json.MarshalIndent(sum, "", " ")
-	if err != nil {
-		panic(err)
+	return sum, ctx.Err()
+}
+
+// getWithRetries looks up the cid on cid.contact, or in the cache if it was looked up before, retrying with
+// exponential backoff on errors and on responses that indicate that cid.contact is overloaded or failing.
+func (klm *CidContactChecker) getWithRetries(ctx context.Context, cid string) (*CidContactOutput, error) {
+	if cc, ok := klm.Cache.Get(cid); ok {
+		return cc, nil
+	}
+
+	backoff := klm.backoff
+	for attempt := 0; ; attempt++ {
+		cc, err := klm.GetCidContactResponse(ctx, cid)
+		if err == nil && (cc.Status == http.StatusTooManyRequests || cc.Status >= http.StatusInternalServerError) {
+			err = fmt.Errorf("cid.contact returned %d", cc.Status)
+		}
+		if err == nil {
+			klm.Cache.Put(cid, cc)
+			return cc, nil
+		}
+		if attempt >= klm.maxRetries {
+			return nil, fmt.Errorf("failed to look up %s after %d attempts: %w", cid, attempt+1, err)
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
 	}
-	fmt.Println(string(bz))
 }
 
-func (klm *CidContactChecker) GetCidContactResponse(cid string) (*CidContactOutput, error) {
-	resp, err := klm.client.Get(fmt.Sprintf(cidContactUrl, cid))
+func (klm *CidContactChecker) GetCidContactResponse(ctx context.Context, cid string) (*CidContactOutput, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(cidContactUrl, cid), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := klm.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -95,18 +243,146 @@ func (klm *CidContactChecker) GetCidContactResponse(cid string) (*CidContactOutp
 		return out, nil
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		bz, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
+	bz, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	out.Response = string(bz)
+	if out.Records, err = parseProviderRecords(bz); err != nil {
+		return nil, err
+	}
+	out.Providers = classify(klm.Rules, out.Records)
+	return out, nil
+}
+
+// parseProviderRecords returns the distinct providers of a cid.contact find response.
+func parseProviderRecords(bz []byte) ([]ProviderRecord, error) {
+	var resp struct {
+		MultihashResults []struct {
+			ProviderResults []struct {
+				Provider ProviderRecord
+			}
 		}
-		out.Response = string(bz)
+	}
+	if err := json.Unmarshal(bz, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse cid.contact response: %w", err)
+	}
 
-		if strings.Contains(out.Response, "dag.w3s") || strings.Contains(out.Response, "dag.house") {
-			out.IsDagHouse = true
-		} else if strings.Contains(out.Response, "pinata.cloud") {
-			out.IsPinata = true
+	var out []ProviderRecord
+	seen := make(map[string]struct{})
+	for _, mr := range resp.MultihashResults {
+		for _, pr := range mr.ProviderResults {
+			if _, ok := seen[pr.Provider.ID]; ok {
+				continue
+			}
+			seen[pr.Provider.ID] = struct{}{}
+			out = append(out, pr.Provider)
 		}
 	}
 	return out, nil
 }
+
+// CidContactCache caches cid.contact lookups by CID so that CIDs that appear in several mismatch categories or
+// runs are only looked up once per TTL. It is safe for concurrent use, and a nil cache caches nothing.
+type CidContactCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	path    string
+	entries map[string]cidContactEntry
+}
+
+type cidContactEntry struct {
+	// Output is the result of the lookup without the response body, which is not needed to classify the CID.
+	Output    *CidContactOutput
+	FetchedAt time.Time
+}
+
+// NewCidContactCache returns a cache whose lookups expire after ttl. If path is not empty, the unexpired lookups
+// saved there by an earlier run are loaded and Save writes the cache back to it.
+func NewCidContactCache(path string, ttl time.Duration) (*CidContactCache, error) {
+	c := &CidContactCache{
+		ttl:     ttl,
+		path:    path,
+		entries: make(map[string]cidContactEntry),
+	}
+	if len(path) == 0 {
+		return c, nil
+	}
+
+	bz, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bz, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse cid.contact cache %s: %w", path, err)
+	}
+	for cid, e := range c.entries {
+		if c.expired(e) {
+			delete(c.entries, cid)
+		}
+	}
+	return c, nil
+}
+
+func (c *CidContactCache) expired(e cidContactEntry) bool {
+	return e.Output == nil || time.Since(e.FetchedAt) > c.ttl
+}
+
+// Get returns the cached lookup of the cid, if it has not expired.
+func (c *CidContactCache) Get(cid string) (*CidContactOutput, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cid]
+	if !ok || c.expired(e) {
+		return nil, false
+	}
+	out := *e.Output
+	return &out, true
+}
+
+// Put caches the lookup of the cid.
+func (c *CidContactCache) Put(cid string, cc *CidContactOutput) {
+	if c == nil {
+		return
+	}
+	out := *cc
+	out.Response = ""
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cid] = cidContactEntry{Output: &out, FetchedAt: time.Now()}
+}
+
+// Save writes the unexpired lookups to the path of the cache, if any.
+func (c *CidContactCache) Save() error {
+	if c == nil || len(c.path) == 0 {
+		return nil
+	}
+	c.mu.Lock()
+	entries := make(map[string]cidContactEntry, len(c.entries))
+	for cid, e := range c.entries {
+		if !c.expired(e) {
+			entries[cid] = e
+		}
+	}
+	c.mu.Unlock()
+
+	bz, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	// write to a temporary file first so that a crash does not leave a truncated cache behind
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, bz, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/filecoin-saturn/onion/replay"
+)
+
+// runAnonymize implements `onion anonymize`, which turns raw bifrost or nginx access logs into a sanitized replay
+// file that can be shared.
+func runAnonymize(args []string) {
+	fs := flag.NewFlagSet("anonymize", flag.ExitOnError)
+	in := fs.String("f", "", "Raw access log to anonymize, in any replay format")
+	out := fs.String("o", "", "File to write the anonymized replay file to, as newline delimited JSON; defaults to stdout")
+	format := fs.String("format", string(replay.FormatAuto), "Format of the access log: auto, plain, tsv, ndjson or nginx")
+	tsvColumn := fs.Int("tsv-column", 20, "1-based column of the request URL in tsv access logs")
+	keepParams := fs.String("keep-params", strings.Join(replay.DefaultKeepParams, ","), "Comma separated query params to keep; all others are dropped")
+	keepHeaders := fs.String("keep-headers", strings.Join(replay.DefaultKeepHeaders, ","), "Comma separated request headers to keep; all others are dropped")
+	keepReferer := fs.Bool("keep-referer", false, "Keep the origin of the referer of requests, e.g. https://example.com; referers are dropped otherwise")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion anonymize -f=<access log> [-o=<replay file>]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if len(*in) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	entries, err := replay.LoadFile(*in, replay.Options{Format: replay.Format(*format), TSVColumn: *tsvColumn})
+	if err != nil {
+		panic(err)
+	}
+	opts := replay.AnonymizeOptions{KeepParams: splitList(*keepParams), KeepHeaders: splitList(*keepHeaders), KeepReferer: *keepReferer}
+	anonymized := make([]replay.ReplayEntry, 0, len(entries))
+	for _, e := range entries {
+		a, err := replay.Anonymize(e, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s: %s\n", e.URL, err)
+			continue
+		}
+		anonymized = append(anonymized, a)
+	}
+
+	w := os.Stdout
+	if len(*out) != 0 {
+		if w, err = os.Create(*out); err != nil {
+			panic(err)
+		}
+	}
+	bw := bufio.NewWriter(w)
+	if err := replay.WriteNDJSON(bw, anonymized); err != nil {
+		panic(err)
+	}
+	if err := bw.Flush(); err != nil {
+		panic(err)
+	}
+	if len(*out) != 0 {
+		if err := w.Close(); err != nil {
+			panic(err)
+		}
+		fmt.Printf("wrote %d anonymized requests to %s\n", len(anonymized), *out)
+	}
+}
+
+// splitList splits a comma separated list, which is empty if the list is.
+func splitList(s string) []string {
+	out := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) != 0 {
+			out = append(out, v)
+		}
+	}
+	return out
+}
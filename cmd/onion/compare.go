@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/filecoin-saturn/onion"
+	"golang.org/x/exp/slog"
+)
+
+// runCompare implements `onion compare`, which verifies and compares the responses saved by an earlier run, e.g.
+// one run with -fetch-only, with the components and comparators of config.toml, so that improved comparison logic
+// can be run against old fetch data.
+func runCompare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	out := fs.String("o", "", "Results directory to write the comparison to; defaults to the results directory of the run suffixed with -compared")
+	profile := fs.String("profile", os.Getenv("ONION_PROFILE"), "Name of the profile of config.toml to compare with, as with onion -profile; defaults to ONION_PROFILE")
+	pairs := fs.String("pairs", "", "Comma separated names of the pairs of components to compare, e.g. shim-nginx, instead of the default pairs or those of config.toml")
+	disable := fs.String("disable", "", "Comma separated names of components not to compare, in addition to those disabled in config.toml")
+	protocolMatrix := fs.String("protocol-matrix", "", "Comma separated names of components the run requested over both HTTP/1.1 and HTTP/2, as with onion -protocol-matrix")
+	verifyDagScope := fs.Bool("verify-dag-scope", false, "Verify that CAR responses contain exactly the blocks expected for the dag-scope of the request")
+	verifyBlocks := fs.Bool("verify-blocks", false, "Re-hash every block of CAR responses and report blocks whose data does not match their CID")
+	verifyCarOrder := fs.Bool("verify-car-order", false, "Verify that CAR responses are in depth-first block order and follow the duplicate block policy they declare or the request asks for")
+	verifyCarIndex := fs.Bool("verify-car-index", false, "Verify that the index of CARv2 responses points at the blocks of their data payload")
+	carDups := fs.Bool("car-dups", false, "With -verify-car-order, allow CARs that do not declare a duplicate block policy to repeat blocks")
+	compareVerification := fs.Bool("compare-verification", false, "Compare the X-Ipfs-Roots and X-Ipfs-Path headers or trailers of the responses of every pair")
+	concurrency := fs.Int("concurrency", 6, "Number of saved paths to load in parallel")
+	compareConcurrency := fs.Int("compare-concurrency", 0, "Number of paths to verify and compare in parallel; defaults to the number of CPUs")
+	extractTimeout := fs.Duration("extract-timeout", 30*time.Second, "Time allowed to extract the file bytes of every CAR")
+	extractOnDisk := fs.Int64("extract-on-disk-mib", 0, "Extract CARs larger than this many MiB from temporary CARv2 files with an index instead of indexing them in memory; 0 to always extract in memory")
+	artifacts := fs.Bool("artifacts", false, "Save both response bodies of every mismatch, and the file bytes extracted from CAR bodies, to the artifacts directory of the comparison")
+	logLevel := fs.String("log-level", "info", "Log level: debug, info, warn or error")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion compare [-o=<results directory>] <results directory of the run>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	dir := fs.Arg(0)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Printf("invalid log level: %s\n", *logLevel)
+		os.Exit(1)
+	}
+	if len(*out) == 0 {
+		*out = strings.TrimSuffix(dir, string(os.PathSeparator)) + "-compared"
+	}
+
+	saved, err := onion.LoadSavedRun(dir)
+	if err != nil {
+		panic(err)
+	}
+	components, pairNames, comparators, headers, providers, _, _, triage := getConfig(*profile, splitList(*disable), splitList(*protocolMatrix), splitList(*pairs))
+	var pairsToCompare []onion.Pair
+	if len(pairNames) != 0 {
+		if pairsToCompare, err = onion.SelectPairs(components, pairNames); err != nil {
+			panic(fmt.Errorf("invalid pairs: %w", err))
+		}
+	}
+
+	cfg := onion.RunConfig{
+		LogLevel: level,
+		Options: onion.ExecutorOptions{
+			VerifyDagScope:         *verifyDagScope,
+			VerifyBlocks:           *verifyBlocks,
+			VerifyCarIndex:         *verifyCarIndex,
+			Concurrency:            *concurrency,
+			CompareConcurrency:     *compareConcurrency,
+			ExtractTimeout:         *extractTimeout,
+			ExtractOnDiskThreshold: *extractOnDisk << 20,
+			Pairs:                  pairsToCompare,
+			Comparators:            comparators,
+			Headers:                headers,
+			CompareVerification:    *compareVerification,
+			SaveArtifacts:          *artifacts,
+			ProviderRules:          providers,
+			Triage:                 triage,
+		},
+	}
+	if *verifyCarOrder {
+		cfg.Options.CarOrder = &onion.CarOrderPolicy{Order: onion.CarOrderDFS, Dups: *carDups}
+	}
+	fmt.Printf("comparing the %d saved paths of %s\n", len(saved.Requests), dir)
+	if _, err := onion.CompareSaved(saved, components, *out, cfg); err != nil {
+		panic(err)
+	}
+	fmt.Printf("\n wrote the comparison to %s\n", *out)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/filecoin-saturn/onion"
+)
+
+// runDashboard implements `onion dashboard`, which generates a Grafana dashboard of the metrics of onion.
+func runDashboard(args []string) {
+	fs := flag.NewFlagSet("dashboard", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the dashboard JSON to, e.g. into a Grafana dashboard provisioning directory; defaults to stdout")
+	datasource := fs.String("datasource", "prometheus", "UID of the Prometheus datasource that scrapes onion or the pushgateway")
+	title := fs.String("title", "Onion", "Title of the dashboard")
+	uid := fs.String("uid", "onion", "UID of the dashboard")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion dashboard [-o=<file>] [-datasource=<uid>]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	bz, err := onion.GrafanaDashboard(onion.DashboardOptions{Title: *title, UID: *uid, Datasource: *datasource})
+	if err != nil {
+		panic(err)
+	}
+	if len(*out) == 0 {
+		fmt.Println(string(bz))
+		return
+	}
+	if err := os.WriteFile(*out, bz, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("wrote dashboard to %s\n", *out)
+}
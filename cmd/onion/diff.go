@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/filecoin-saturn/onion"
+)
+
+// runDiff implements `onion diff`, which reports how a run differs from an earlier run.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	storeFile := fs.String("store", "", "BoltDB file written with -store; the runs are then given as run IDs instead of results directories")
+	out := fs.String("o", "", "Optional file to write the full diff to as JSON")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion diff [-store=<file>] [-o=<file>] <before> <after>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var before, after *onion.RunSnapshot
+	var err error
+	if len(*storeFile) != 0 {
+		store, err := onion.OpenResultStore(*storeFile)
+		if err != nil {
+			panic(err)
+		}
+		defer store.Close()
+		if before, err = store.LoadRun(fs.Arg(0)); err != nil {
+			panic(err)
+		}
+		if after, err = store.LoadRun(fs.Arg(1)); err != nil {
+			panic(err)
+		}
+	} else {
+		if before, err = onion.LoadRun(fs.Arg(0)); err != nil {
+			panic(err)
+		}
+		if after, err = onion.LoadRun(fs.Arg(1)); err != nil {
+			panic(err)
+		}
+	}
+
+	d := onion.DiffRuns(before, after)
+
+	fmt.Printf("Diff of %s -> %s over %d common paths\n", fs.Arg(0), fs.Arg(1), d.Paths)
+	fmt.Println("\n ----------MISMATCHES --------------")
+	for _, pair := range sortedKeys(d.Pairs) {
+		pd := d.Pairs[pair]
+		for _, kind := range []onion.MismatchKind{onion.MismatchStatus, onion.MismatchBytes, onion.MismatchHeaders, onion.MismatchRedirects, onion.MismatchVerification} {
+			fmt.Printf("\n %s %s mismatches: %d new, %d fixed", pair, kind, len(pd.New[kind]), len(pd.Fixed[kind]))
+			for _, path := range pd.New[kind] {
+				fmt.Printf("\n   + %s", path)
+			}
+			for _, path := range pd.Fixed[kind] {
+				fmt.Printf("\n   - %s", path)
+			}
+		}
+	}
+	fmt.Println()
+
+	fmt.Println("\n ----------CHANGED RESPONSES --------------")
+	for _, c := range sortedKeys(d.Changed) {
+		fmt.Printf("\n %s returned different content for %d paths", c, len(d.Changed[c]))
+		for _, path := range d.Changed[c] {
+			fmt.Printf("\n   ~ %s", path)
+		}
+	}
+	fmt.Println()
+
+	fmt.Println("\n ----------LATENCY DELTAS --------------")
+	for _, c := range sortedKeys(d.Latency) {
+		l := d.Latency[c]
+		fmt.Printf("\n %s p50: %s (%s), p90: %s (%s), p99: %s (%s)", c, l.After.P50, signed(l.P50), l.After.P90, signed(l.P90),
+			l.After.P99, signed(l.P99))
+	}
+	fmt.Println()
+
+	if len(*out) != 0 {
+		bz, err := onion.MarshalReport("diff", d)
+		if err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(*out, bz, 0644); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// signed formats a latency delta with its sign.
+func signed(d time.Duration) string {
+	if d < 0 {
+		return d.String()
+	}
+	return "+" + d.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
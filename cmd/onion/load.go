@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/filecoin-saturn/onion"
+)
+
+// runLoad implements -load, which load tests a single component instead of comparing components, and writes the
+// time series of the load test to load-{component}-{timestamp}.csv in the results directory, along with the full
+// report as JSON.
+func runLoad(cfg onion.RunConfig, opts onion.LoadOptions) {
+	// an interrupted load test still reports the requests sent so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := onion.RunLoad(ctx, cfg, opts)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("\n ----------SUMMARY OF LOAD TEST --------------")
+	t := report.Total
+	fmt.Printf("\n %s: %d requests to %d paths, %d errors, %d dropped; %.1f req/s, %.2f MiB/s; p50: %s, p90: %s, p99: %s, max: %s",
+		report.Component, t.Requests, report.Paths, t.Errors, t.Dropped, t.RequestsPerSecond, t.BytesPerSecond/(1<<20), t.P50, t.P90,
+		t.P99, t.Max)
+	for _, k := range sortedKeys(errorKindCounts(t.ErrorKinds)) {
+		fmt.Printf("\n   %s: %d", k, t.ErrorKinds[onion.ErrorKind(k)])
+	}
+	fmt.Println()
+
+	resultsDir := cfg.ResultsDir
+	if len(resultsDir) == 0 {
+		resultsDir = "results"
+	}
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		panic(err)
+	}
+	name := filepath.Join(resultsDir, fmt.Sprintf("load-%s-%s", report.Component, report.Start.UTC().Format("20060102T150405Z")))
+	f, err := os.Create(name + ".csv")
+	if err != nil {
+		panic(err)
+	}
+	if err := report.WriteCSV(f); err != nil {
+		panic(err)
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+	bz, err := onion.MarshalReport("load", report)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(name+".json", bz, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("\n wrote the load test to %s.csv and %s.json\n", name, name)
+}
+
+// errorKindCounts keys the error counts by the name of their kind.
+func errorKindCounts(kinds map[onion.ErrorKind]int) map[string]int {
+	out := make(map[string]int, len(kinds))
+	for k, n := range kinds {
+		out[string(k)] = n
+	}
+	return out
+}
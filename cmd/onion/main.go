@@ -1,159 +1,463 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/filecoin-saturn/onion"
-	"github.com/google/uuid"
+	"github.com/filecoin-saturn/onion/replay"
 	"github.com/pelletier/go-toml"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
-var (
-	httpResponseStatus = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "http_response_status",
-			Help: "HTTP Response Status",
-		},
-		[]string{"system", "code"},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(httpResponseStatus)
-}
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		runDiff(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dashboard" {
+		runDashboard(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "anonymize" {
+		runAnonymize(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		runVerify(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		runCompare(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		runSchema(os.Args[2:])
+		return
+	}
 
-type Config struct {
-	LassieHostPort  string
-	L1ShimHostPort  string
-	L1NginxHostPort string
-	BifrostHostPort string
-}
+	// onion serve runs the tests like onion does and serves a live web UI of their progress
+	serve := len(os.Args) > 1 && os.Args[1] == "serve"
+	defaultUIAddr := ""
+	if serve {
+		os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		defaultUIAddr = ":8080"
+	}
 
-func main() {
-	fmt.Println("Starting Onion...\n")
+	fmt.Println("Starting Onion...")
 	// Define flags
 	count := flag.Int("c", 0, "Count of requests to send to each component")
-	fileName := flag.String("f", "", "Name of replay file to use")
+	var files replayFiles
+	flag.Var(&files, "f", "Replay file to use; repeat it, or pass a directory or glob, to request several replay files as separately labeled cohorts of every run, e.g. -f=video=video.log -f=nft.log")
+	format := flag.String("format", string(replay.FormatAuto), "Format of the replay file: auto, plain, tsv, ndjson or nginx")
+	sample := flag.String("sample", string(replay.SampleFirst), "How to sample unique paths from the replay file: first, random, codec (stratified by root CID codec) or size (stratified by logged response size)")
+	dedup := flag.String("dedup", string(replay.DedupPath), "Which requests of the replay file are the same request, of which only the first is sampled: path (same URL path and query params, so that e.g. every dag-scope of a path is tested) or url (also the same method and Accept and Range headers, so that e.g. every byte range and negotiated format of a path is tested)")
+	seed := flag.Int64("seed", 1, "Seed for random sampling so that samples are reproducible")
+	tsvColumn := flag.Int("tsv-column", 20, "1-based column of the request url in tsv replay files")
 	nRuns := flag.Int("n_runs", 0, "Number of times to run the test")
+	stream := flag.Bool("stream", false, "Hash response bodies as they arrive instead of buffering them in memory")
+	captureMismatches := flag.Bool("capture-mismatches", false, "With -stream, re-fetch paths whose streamed responses mismatch with full body capture")
+	verifyDagScope := flag.Bool("verify-dag-scope", false, "Verify that CAR responses contain exactly the blocks expected for the dag-scope of the request")
+	verifyBlocks := flag.Bool("verify-blocks", false, "Re-hash every block of CAR responses and report blocks whose data does not match their CID")
+	verifyCarOrder := flag.Bool("verify-car-order", false, "Verify that CAR responses are in depth-first block order and follow the duplicate block policy they declare or the request asks for")
+	verifyCarIndex := flag.Bool("verify-car-index", false, "Verify that the index of CARv2 responses points at the blocks of their data payload")
+	carDups := flag.Bool("car-dups", false, "With -verify-car-order, allow CARs that do not declare a duplicate block policy to repeat blocks")
+	spillThreshold := flag.Int64("spill-threshold-mib", 0, "Spill captured response bodies larger than this many MiB to temporary files instead of holding them in memory; 0 to only spill to stay within -memory-budget-mib")
+	memoryBudget := flag.Int64("memory-budget-mib", 0, "Total MiB of captured response bodies to hold in memory across in-flight requests before spilling them to temporary files; 0 for unlimited")
+	extractOnDisk := flag.Int64("extract-on-disk-mib", 0, "Extract captured CARs larger than this many MiB from temporary CARv2 files with an index instead of indexing them in memory; 0 to always extract in memory")
+	concurrency := flag.Int("concurrency", 6, "Number of paths to request in parallel")
+	compareConcurrency := flag.Int("compare-concurrency", 0, "Number of fetched paths to verify and compare in parallel while further paths are requested; 0 for the number of CPUs")
+	pace := flag.Float64("pace", 0, "Send every path at the time of its original request in the replay file (nginx and ndjson logs), scaled by this factor, e.g. 1 for the original timing or 2 for twice as fast; 0 to send paths as fast as -concurrency allows")
+	timeout := flag.Duration("timeout", 3*time.Minute, "Timeout for a request to a component, unless overridden for the component in config.toml")
+	extractTimeout := flag.Duration("extract-timeout", 30*time.Second, "Time allowed to extract the file bytes of a captured CAR response to compare them; CARs that take longer are reported and not compared by their file bytes")
+	minThroughput := flag.Float64("min-throughput-kib", 0, "Extend the timeout of paths whose response size is recorded in the replay file so that they can be read at this many KiB/sec; 0 to not extend timeouts")
+	slowPercentile := flag.Int("slow-percentile", 0, "Report the requests to every component that are slower than this percentile of its latencies, e.g. 99; 0 to disable")
+	slowThreshold := flag.Duration("slow-threshold", 0, "Report the requests to every component that are slower than this, e.g. 30s; 0 to disable")
+	retries := flag.Int("retries", 0, "Number of times to retry a request on transient errors (failures to send it or read its response, and 5xx), unless overridden for the component in config.toml")
+	retryBackoff := flag.Duration("retry-backoff", time.Second, "Backoff before the first retry, doubled for every following retry and randomised with jitter")
+	throttleRetries := flag.Int("throttle-retries", 2, "Number of times to retry a request on rate limit responses (429, or 503 with Retry-After) after their Retry-After, in addition to -retries; 0 to not retry them")
+	maxRetryAfter := flag.Duration("max-retry-after", 30*time.Second, "Longest Retry-After of rate limit responses to wait for before retrying")
+	referenceCache := flag.String("reference-cache", "", "Optional directory to cache the responses of the reference in across runs, so that it is only requested once per -reference-cache-ttl for every path; empty to disable")
+	referenceCacheTTL := flag.Duration("reference-cache-ttl", onion.DefaultReferenceCacheTTL, "Time after which the responses in the reference cache expire and the reference is requested again")
+	uiAddr := flag.String("ui-addr", defaultUIAddr, "Optional address to serve a live web UI of the progress, success counts and mismatches of the runs on while they run, e.g. :8080; defaults to :8080 with onion serve, which keeps serving once the runs are done until interrupted")
+	metricsAddr := flag.String("metrics-addr", "", "Optional address to expose Prometheus metrics on at /metrics during the runs, e.g. :2112")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Optional OTLP/HTTP endpoint to export a trace of the requests for every path to, e.g. http://localhost:4318 for Jaeger or Tempo")
+	pushGateway := flag.String("pushgateway", onion.DefaultPushGatewayAddr, "Address of the Prometheus pushgateway to push metrics to at the end of every run; empty to disable")
+	pushGatewayUser := flag.String("pushgateway-user", "", "Username for basic auth with the pushgateway; the password is read from ONION_PUSHGATEWAY_PASSWORD")
+	protocolMatrix := flag.String("protocol-matrix", "", "Comma separated names of components to request every path from over both HTTP/1.1 and HTTP/2 and compare, e.g. nginx, in addition to those with protocolMatrix in config.toml")
+	profile := flag.String("profile", os.Getenv("ONION_PROFILE"), "Name of the profile of config.toml to run with, e.g. staging, whose components and settings replace those of the config; defaults to ONION_PROFILE")
+	pairs := flag.String("pairs", "", "Comma separated names of the pairs of components to compare, e.g. shim-nginx, instead of the pairs in config.toml or the reference against every other component and every component against the next")
+	disable := flag.String("disable", "", "Comma separated names of components to skip, e.g. bifrost,nginx, in addition to those disabled in config.toml")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	quiet := flag.Bool("quiet", false, "Do not report progress while paths are requested and only log warnings and errors")
+	progressInterval := flag.Duration("progress-interval", 0, "How often progress is reported; defaults to every second on a single line if stdout is a terminal and to every 30s otherwise")
+	logJSON := flag.Bool("log-json", false, "Also write JSON logs of every run to onion.log.json in its results directory")
+	compareEncoding := flag.Bool("compare-encoding", false, "Request every path from every component both with and without Accept-Encoding: gzip, deflate and compare the decompressed responses with the identity responses")
+	compareVerification := flag.Bool("compare-verification", false, "Compare the X-Ipfs-Roots and X-Ipfs-Path headers or trailers of the responses of every pair")
+	compareConditional := flag.Bool("compare-conditional", false, "Re-request every path from every component with the ETag and Last-Modified of its response as If-None-Match and If-Modified-Since, and compare whether the components answer with 304 Not Modified")
+	compareCache := flag.Bool("compare-cache", false, "Request every path twice from caching components, without their cache bust params, and compare warm with cold responses")
+	cidContactCache := flag.String("cid-contact-cache", "results/cid-contact-cache.json", "File to cache cid.contact lookups in across runs; empty to only cache them in memory")
+	cidContactTTL := flag.Duration("cid-contact-ttl", onion.DefaultCidContactTTL, "How long cid.contact lookups are cached")
+	probe := flag.Bool("probe", false, "Probe the providers of the root CIDs of mismatched paths returned by cid.contact to tell if the content is retrievable at all")
+	probeProviders := flag.Int("probe-providers", 5, "With -probe, the number of providers of a CID to probe")
+	probeTimeout := flag.Duration("probe-timeout", 30*time.Second, "With -probe, the timeout of every probe")
+	reverifyAfter := flag.Duration("reverify-after", 0, "If set, request mismatched paths again after this delay and classify mismatches as persistent or transient")
+	resultsDir := flag.String("results-dir", "results", "Directory to write the results of every run to, with an index.json manifest of all runs")
+	runName := flag.String("run-name", onion.DefaultRunName, "Name of the results directory of every run within -results-dir; {n} is the number of the run, {timestamp} the UTC time it started at, {run_id} its ID and {sha} the -deployment-sha, e.g. {timestamp}-{sha}-{n}")
+	deploymentSHA := flag.String("deployment-sha", "", "Git SHA of the deployment under test, recorded in the index.json manifest")
+	resume := flag.String("resume", "", "Results directory of a run to resume from its last checkpoint, e.g. results/results-3; later runs are started as usual")
+	ipnsResolver := flag.String("ipns-resolver", "", "How to resolve /ipns/ paths before sending them to the components: dns for DNSLink domains or the URL of a gateway, e.g. http://127.0.0.1:8080; empty to send /ipns/ paths as is")
+	storeFile := flag.String("store", "", "Optional BoltDB file to record results, mismatches and read errors of all runs in")
+	every := flag.Duration("every", 0, "If set, keep running and start the test at every multiple of this interval, e.g. 1h, writing the results of every test to results/{UTC timestamp}")
+	alertWebhook := flag.String("alert-webhook", os.Getenv("ONION_ALERT_WEBHOOK"), "Slack or Discord webhook URL to post a summary to when the mismatches of a run exceed -alert-threshold; defaults to ONION_ALERT_WEBHOOK")
+	alertThreshold := flag.Float64("alert-threshold", 0.01, "Fraction of requested paths above which the status or bytes mismatches of a pair are alerted on")
+	upload := flag.String("upload", "", "Bucket to upload the results directory of every run to under its run ID once it is complete, e.g. s3://bucket/onion or gs://bucket/onion; credentials are read from ONION_UPLOAD_ACCESS_KEY_ID, ONION_UPLOAD_SECRET_ACCESS_KEY and ONION_UPLOAD_SESSION_TOKEN, or else from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	uploadEndpoint := flag.String("upload-endpoint", "", "Base URL of an S3 compatible object store to upload to instead of AWS or GCS, e.g. http://127.0.0.1:9000")
+	uploadRegion := flag.String("upload-region", os.Getenv("AWS_REGION"), "Region of the -upload bucket; defaults to AWS_REGION, or else us-east-1 for S3 and auto for GCS")
+	uploadStore := flag.Bool("upload-store", false, "With -upload and -store, also upload a snapshot of the store after every run")
+	keep := flag.Int("keep", 0, "With -every, the number of most recent results directories to keep; 0 to keep all")
+	fetchOnly := flag.Bool("fetch-only", false, "Only request the paths and save their responses to the bodies directory of every run, without verifying or comparing them, so that they can be compared later with onion compare")
+	saveBodies := flag.Bool("save-bodies", false, "Save captured response bodies to the bodies directory of every run so that it can serve as a -golden run compared byte for byte")
+	gatewayVariants := flag.Bool("gateway-variants", false, "Also request variants of every path that exercise gateway features (trailing slash, index.html, _redirects, a missing path and IPNS records) and summarise their mismatches per variant")
+	carNegotiation := flag.Bool("car-negotiation", false, "Also request the CAR of every path that asks for a CAR with Accept headers negotiating every block order and duplicates (application/vnd.ipld.car; version=1; order={dfs|unk}; dups={y|n}, and no params) and verify that the responses of every layer honor them")
+	artifacts := flag.Bool("artifacts", false, "Save both response bodies of every mismatch, and the file bytes extracted from CAR bodies, gzip-compressed to the artifacts directory of every run")
+	artifactMaxMiB := flag.Int64("artifact-max-mib", 16, "With -artifacts, the MiB of every body to save at most")
+	golden := flag.String("golden", "", "Results directory of an earlier run, e.g. results/results-1, whose responses of -golden-component are the ground truth; only the paths it recorded are requested, and only from -target")
+	goldenComponent := flag.String("golden-component", "", "With -golden, the component of the golden run whose responses are the ground truth; defaults to the reference component")
+	load := flag.String("load", "", "Name of a component to load test instead of comparing components: the sampled paths are sent to it in turn at -load-rps or -load-mibps for -load-duration and the latencies, errors and throughput are written as a time series")
+	loadRPS := flag.Float64("load-rps", 0, "With -load, the requests to send per second; 0 to send requests as soon as fewer than -load-concurrency are in flight")
+	loadMiBps := flag.Float64("load-mibps", 0, "With -load, the MiB per second to read response bodies at most; 0 for unlimited")
+	loadDuration := flag.Duration("load-duration", time.Minute, "With -load, how long to send requests for")
+	loadWindow := flag.Duration("load-window", 10*time.Second, "With -load, the time windows to aggregate latencies, errors and throughput over")
+	loadConcurrency := flag.Int("load-concurrency", 64, "With -load, the number of requests in flight at most; requests due at -load-rps beyond it are dropped and counted")
+	target := flag.String("target", "", "With -golden, comma separated names of the components to compare with the golden run; defaults to all other enabled components")
 
 	// Parse the flags
 	flag.Parse()
+	if *throttleRetries == 0 {
+		// the executor retries throttled requests unless told not to
+		*throttleRetries = -1
+	}
 	c := *count
-	f := *fileName
 	n := *nRuns
-	fmt.Printf("count: %d, fileName: %s, nRuns:%d\n", c, f, n)
-	if c == 0 || len(f) == 0 || n == 0 {
+	cohorts, err := files.cohorts()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("count: %d, fileName: %s, nRuns:%d\n", c, files, n)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Printf("invalid log level: %s\n", *logLevel)
+		os.Exit(1)
+	}
+	if *quiet && level < slog.LevelWarn {
+		level = slog.LevelWarn
+	}
+	if c == 0 || len(cohorts) == 0 || (n == 0 && len(*load) == 0) {
 		fmt.Printf("Usage: onion -c=<count> -f=<replay_file> -n_runs=<n_runs>\n")
 		os.Exit(1)
 	}
 
-	cfg := getConfig()
-	fmt.Printf("parsed host:ports are:\n <Lassie> %s \n <L1Shim> %s \n <L1Nginx> %s\n", cfg.LassieHostPort, cfg.L1ShimHostPort, cfg.L1NginxHostPort)
-	reqs := make(map[string]onion.URLsToTest)
-
-	bifrostReqUrls := readBifrostReqURLs(f)
-	ub := onion.NewURLBuilder(cfg.LassieHostPort, cfg.L1ShimHostPort, cfg.L1NginxHostPort, cfg.BifrostHostPort)
-
-	for _, u := range bifrostReqUrls {
-		o := ub.BuildURLsToTest(u)
-		key := o.Path
-		reqs[key] = o
-		if len(reqs) == c {
-			break
+	var disabled, matrix, pairNames []string
+	if len(*disable) != 0 {
+		disabled = strings.Split(*disable, ",")
+	}
+	if len(*protocolMatrix) != 0 {
+		matrix = strings.Split(*protocolMatrix, ",")
+	}
+	if len(*pairs) != 0 {
+		pairNames = strings.Split(*pairs, ",")
+	}
+	components, pairNames, comparators, headers, providers, assertions, chaos, triage := getConfig(*profile, disabled, matrix, pairNames)
+	if len(*golden) != 0 {
+		components = goldenComponents(components, *golden, *goldenComponent, *target)
+	}
+	// pairs are selected from the final components as golden runs replace the golden component
+	var pairsToCompare []onion.Pair
+	if len(pairNames) != 0 {
+		var err error
+		if pairsToCompare, err = onion.SelectPairs(components, pairNames); err != nil {
+			panic(fmt.Errorf("invalid pairs: %w", err))
 		}
 	}
-	if len(reqs) < c {
-		fmt.Printf("Not enough requests to send to components. Requested: %d, Available: %d\n", c, len(reqs))
-		os.Exit(1)
+	fmt.Println("registered components are:")
+	for _, c := range components {
+		fmt.Printf(" <%s> %s (extract: %s, reference: %t, disabled: %t)\n", c.Name, c.Protocol, c.Extract, c.Reference, c.Disabled)
 	}
-
-	err := os.MkdirAll("results", 0755)
-	if err != nil {
-		panic(err)
+	if pairsToCompare != nil {
+		fmt.Println("compared pairs are:")
+		for _, p := range pairsToCompare {
+			fmt.Printf(" <%s>\n", p.Name())
+		}
+	}
+	var resolver onion.Resolver
+	switch *ipnsResolver {
+	case "":
+	case "dns":
+		resolver = onion.DNSLinkResolver{}
+	default:
+		resolver = onion.GatewayResolver{URL: *ipnsResolver, Client: &http.Client{Timeout: time.Minute}}
 	}
 
-	for i := 0; i < n; i++ {
-		dir := fmt.Sprintf("results/results-%d", i+1)
-		err := os.MkdirAll(dir, 0755)
+	var store *onion.ResultStore
+	if len(*storeFile) != 0 {
+		var err error
+		store, err = onion.OpenResultStore(*storeFile)
 		if err != nil {
 			panic(err)
 		}
+		defer store.Close()
+	}
 
-		rrdir := fmt.Sprintf("results/results-%d/response_reads", i+1)
-		err = os.MkdirAll(rrdir, 0755)
-		if err != nil {
-			panic(err)
-		}
+	// the metrics of every run are served with a run_id label
+	var registerer prometheus.Registerer
+	if len(*metricsAddr) != 0 {
+		registry := prometheus.NewRegistry()
+		registerer = registry
+		srv, errCh := onion.ServeMetrics(*metricsAddr, registry)
+		defer srv.Close()
+		go func() {
+			if err := <-errCh; err != nil {
+				fmt.Printf("\n%s\n", err)
+			}
+		}()
+		fmt.Printf("serving metrics on %s/metrics\n", *metricsAddr)
+	}
 
-		id, err := uuid.NewUUID()
+	// every path is traced with the requests to the layers as child spans
+	var tracerProvider trace.TracerProvider
+	shutdownTracing := func() {}
+	if len(*otlpEndpoint) != 0 {
+		tp, err := onion.NewTracerProvider(context.Background(), *otlpEndpoint)
 		if err != nil {
 			panic(err)
 		}
-
-		re := onion.NewRequestExecutor(reqs, i+1, id, dir, rrdir)
-		re.Execute()
-		re.WriteResultsToFile()
-		re.WriteMismatchesToFile()
-		// write metrics
-		if err := onion.PushMetrics(id); err != nil {
-			panic(err)
+		tracerProvider = tp
+		shutdownTracing = func() {
+			if err := tp.Shutdown(context.Background()); err != nil {
+				fmt.Printf("\nfailed to export traces: %s\n", err)
+			}
 		}
+		defer shutdownTracing()
+		fmt.Printf("exporting traces to %s\n", *otlpEndpoint)
 	}
-}
 
-func readBifrostReqURLs(fileName string) []string {
-	file, err := os.Open(fileName)
-	if err != nil {
-		panic(fmt.Errorf("failed to open replay logs: %w", err))
+	var live *onion.Live
+	if len(*uiAddr) != 0 {
+		live = onion.NewLive()
+		srv, errCh := onion.ServeLive(*uiAddr, live)
+		defer srv.Close()
+		go func() {
+			if err := <-errCh; err != nil {
+				fmt.Printf("\n%s\n", err)
+			}
+		}()
+		fmt.Printf("serving the live UI on %s\n", *uiAddr)
 	}
-	defer file.Close()
 
-	var bifrostReqUrls []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		u := line
-		u = strings.Trim(u, "\"")
+	cfg := onion.RunConfig{
+		Components:      components,
+		Assertions:      assertions,
+		Chaos:           chaos,
+		GatewayVariants: *gatewayVariants,
+		CarNegotiation:  *carNegotiation,
+		ReplayFile:      cohorts[0].ReplayFile,
+		Replay:          replay.Options{Format: replay.Format(*format), TSVColumn: *tsvColumn},
+		Sample:          replay.SampleOptions{Strategy: replay.Strategy(*sample), Seed: *seed, Dedup: replay.Dedup(*dedup)},
+		Count:           c,
+		Runs:            n,
+		Resolver:        resolver,
+		Options: onion.ExecutorOptions{
+			Streaming:              *stream,
+			CaptureMismatches:      *captureMismatches,
+			VerifyDagScope:         *verifyDagScope,
+			VerifyBlocks:           *verifyBlocks,
+			VerifyCarIndex:         *verifyCarIndex,
+			Concurrency:            *concurrency,
+			CompareConcurrency:     *compareConcurrency,
+			Pace:                   *pace,
+			Timeout:                *timeout,
+			ExtractTimeout:         *extractTimeout,
+			MinBytesPerSecond:      *minThroughput * 1024,
+			SlowPercentile:         *slowPercentile,
+			SlowThreshold:          *slowThreshold,
+			Retries:                *retries,
+			RetryBackoff:           *retryBackoff,
+			ThrottleRetries:        *throttleRetries,
+			MaxRetryAfter:          *maxRetryAfter,
+			Pairs:                  pairsToCompare,
+			Comparators:            comparators,
+			Headers:                headers,
+			CompareCache:           *compareCache,
+			CompareVerification:    *compareVerification,
+			CompareEncoding:        *compareEncoding,
+			CompareConditional:     *compareConditional,
+			SaveBodies:             *saveBodies,
+			FetchOnly:              *fetchOnly,
+			SaveArtifacts:          *artifacts,
+			ArtifactMaxBytes:       *artifactMaxMiB << 20,
+			ProviderRules:          providers,
+			ProbeProviders:         *probeProviders,
+			SpillThreshold:         *spillThreshold << 20,
+			MemoryBudget:           *memoryBudget << 20,
+			ExtractOnDiskThreshold: *extractOnDisk << 20,
+			TracerProvider:         tracerProvider,
+			Registerer:             registerer,
+		},
+		LogLevel:      level,
+		LogJSON:       *logJSON,
+		ResultsDir:    *resultsDir,
+		RunName:       *runName,
+		DeploymentSHA: *deploymentSHA,
+		ConfigFile:    "config.toml",
+		Profile:       *profile,
+		Resume:        *resume,
+		ReverifyAfter: *reverifyAfter,
+		Store:         store,
+		Live:          live,
+		PushGateway: onion.PushGatewayConfig{
+			Addr:        *pushGateway,
+			Username:    *pushGatewayUser,
+			Password:    os.Getenv("ONION_PUSHGATEWAY_PASSWORD"),
+			BearerToken: os.Getenv("ONION_PUSHGATEWAY_TOKEN"),
+		},
+	}
 
-		if len(u) == 0 {
-			panic(fmt.Errorf("invalid bifrost url: %s", u))
+	cache, err := onion.NewCidContactCache(*cidContactCache, *cidContactTTL)
+	if err != nil {
+		panic(err)
+	}
+	cfg.Options.CidContactCache = cache
+	if len(*referenceCache) != 0 {
+		if cfg.Options.ReferenceCache, err = onion.NewReferenceCache(*referenceCache, *referenceCacheTTL); err != nil {
+			panic(err)
 		}
-
-		if strings.Contains(u, "ipfs-404") {
-			continue
+	}
+	if len(cohorts) > 1 {
+		cfg.Cohorts = cohorts
+	}
+	if *probe || dialsProviders(triage) {
+		prober, err := onion.NewBitswapProber(*probeTimeout)
+		if err != nil {
+			panic(err)
 		}
+		cfg.Options.Prober = prober
+	}
+	cfg.Options.Triage = triage
+	if *verifyCarOrder {
+		cfg.Options.CarOrder = &onion.CarOrderPolicy{Order: onion.CarOrderDFS, Dups: *carDups}
+	}
+	if !*quiet {
+		cfg.Options.Progress = onion.NewProgress()
+		cfg.Options.Progress.Interval = *progressInterval
+	}
+	if len(*alertWebhook) != 0 {
+		cfg.Alert = &onion.AlertConfig{WebhookURL: *alertWebhook, Threshold: *alertThreshold}
+	}
+	if len(*upload) != 0 {
+		cfg.Upload = &onion.UploadConfig{
+			URL:             *upload,
+			Endpoint:        *uploadEndpoint,
+			Region:          *uploadRegion,
+			AccessKeyID:     envOr("ONION_UPLOAD_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: envOr("ONION_UPLOAD_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    envOr("ONION_UPLOAD_SESSION_TOKEN", "AWS_SESSION_TOKEN"),
+			Store:           *uploadStore,
+		}
+		if err := cfg.Upload.Validate(); err != nil {
+			panic(err)
+		}
+	}
 
-		// remove requests as per old format
-		if strings.Contains(u, "car-scope") && !strings.Contains(u, "dag-scope") {
-			continue
+	if len(*load) != 0 {
+		runLoad(cfg, onion.LoadOptions{
+			Component:         *load,
+			RequestsPerSecond: *loadRPS,
+			BytesPerSecond:    *loadMiBps * (1 << 20),
+			Duration:          *loadDuration,
+			Window:            *loadWindow,
+			Concurrency:       *loadConcurrency,
+		})
+		return
+	}
+
+	if *every > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Printf("running every %s until interrupted\n", *every)
+		err := onion.RunDaemon(ctx, cfg, onion.Schedule{Every: *every, Keep: *keep})
+		if err != nil && !errors.Is(err, context.Canceled) {
+			panic(err)
 		}
+		return
+	}
 
-		bifrostReqUrls = append(bifrostReqUrls, u)
+	report, err := onion.Run(context.Background(), cfg)
+	if err != nil {
+		panic(err)
+	}
+	if serve {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		fmt.Printf("runs done; serving the live UI on %s until interrupted\n", *uiAddr)
+		<-ctx.Done()
+	}
+	if report.AssertionsFailed() {
+		fmt.Println("assertions failed; see assertions.json in the results directory of every run")
+		shutdownTracing()
+		os.Exit(1)
 	}
-	return bifrostReqUrls
 }
 
-func getConfig() Config {
+// getConfig reads the components, the names of the pairs of components to compare, the comparators to run for each
+// pair, the headers to compare, the assertions to evaluate at the end of every run, the chaos actions to inject
+// between runs and the steps of the triage pipeline from config.toml, with the sections of the profile, if any, in
+// place of those of the config. The disabled components are disabled in addition to those disabled in the config,
+// the matrix layers are requested over both HTTP/1.1 and HTTP/2 in addition to those configured with
+// protocolMatrix, and the pair names, if any, replace those of the config. No pair names are returned if neither
+// names any, so that the default pairs are compared.
+func getConfig(profile string, disabled []string, matrix []string, pairNames []string) ([]onion.Component, []string, map[string][]onion.Comparator, *onion.HeaderRules, []onion.ProviderRule, []onion.Assertion, []onion.ChaosAction, []onion.TriageStep) {
 	type TomlConfig struct {
-		LassieIP   string
-		LassiePort int64
-
-		L1ShimIP   string
-		L1ShimPort int64
-
-		L1NginxIP   string
-		L1NginxPort int64
-
-		BifrostIP   string
-		BifrostPort int64
+		// Pairs are the names of the pairs of components to compare, e.g. "shim-nginx", which default to
+		// onion.ComparisonPairs.
+		Pairs      []string                `toml:"pairs"`
+		Components []onion.ComponentConfig `toml:"components"`
+		// Comparators maps a pair name, e.g. "lassie-shim", or "default" for all other pairs to comparator names.
+		Comparators map[string][]string `toml:"comparators"`
+		// Headers are the headers to compare, which default to onion.DefaultHeaderRules.
+		Headers *struct {
+			Compare []string `toml:"compare"`
+			Ignore  []string `toml:"ignore"`
+		} `toml:"headers"`
+		// Providers classify the providers of the CIDs of mismatched paths, which default to
+		// onion.DefaultProviderRules.
+		Providers []onion.ProviderRule `toml:"providers"`
+		// Assertions bound metrics of every run, e.g. latency percentiles and mismatch rates; onion exits with
+		// status 1 if any fails.
+		Assertions []onion.Assertion `toml:"assertions"`
+		// Chaos are the failures injected into the stack under test before runs by calling admin endpoints.
+		Chaos []onion.ChaosAction `toml:"chaos"`
+		// Triage are the analyzers applied to the mismatches of every run, in order, which default to
+		// onion.DefaultTriage.
+		Triage []onion.TriageStep `toml:"triage"`
+		// Profiles are named variants of the config, e.g. "staging" or "prod-eu", selected with -profile. The
+		// components of a profile replace those of the config with the same name and are added to the others, and
+		// every other section it sets replaces that of the config.
+		Profiles map[string]TomlConfig `toml:"profiles"`
 	}
 
 	f, err := os.Open("config.toml")
@@ -169,37 +473,332 @@ func getConfig() Config {
 	if err := toml.Unmarshal(bz, &cfg); err != nil {
 		panic(fmt.Errorf("failed to unmarshal config.toml: %s", err))
 	}
+	if len(profile) != 0 {
+		p, ok := cfg.Profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(cfg.Profiles))
+			for name := range cfg.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			panic(fmt.Errorf("unknown profile %s; config.toml has profiles %v", profile, names))
+		}
+		if len(p.Profiles) != 0 {
+			panic(fmt.Errorf("invalid profile %s: profiles can not be nested", profile))
+		}
+		byName := make(map[string]int, len(cfg.Components))
+		for i, cc := range cfg.Components {
+			byName[cc.Name] = i
+		}
+		for _, cc := range p.Components {
+			if i, ok := byName[cc.Name]; ok {
+				cfg.Components[i] = cc
+			} else {
+				cfg.Components = append(cfg.Components, cc)
+			}
+		}
+		if p.Pairs != nil {
+			cfg.Pairs = p.Pairs
+		}
+		if p.Comparators != nil {
+			cfg.Comparators = p.Comparators
+		}
+		if p.Headers != nil {
+			cfg.Headers = p.Headers
+		}
+		if p.Providers != nil {
+			cfg.Providers = p.Providers
+		}
+		if p.Assertions != nil {
+			cfg.Assertions = p.Assertions
+		}
+		if p.Chaos != nil {
+			cfg.Chaos = p.Chaos
+		}
+		if p.Triage != nil {
+			cfg.Triage = p.Triage
+		}
+	}
+
+	known := make(map[string]struct{}, len(cfg.Components))
+	for _, cc := range cfg.Components {
+		known[cc.Name] = struct{}{}
+	}
+	inMatrix := make(map[string]struct{}, len(matrix))
+	for _, name := range matrix {
+		if _, ok := known[name]; !ok {
+			panic(fmt.Errorf("can not request unknown component over both HTTP versions: %s", name))
+		}
+		inMatrix[name] = struct{}{}
+	}
+
+	// layers with several hosts or a protocol matrix are fanned out into a component per node or HTTP version, which
+	// can be disabled by the name of the layer or of the component
+	names := make(map[string]struct{}, len(cfg.Components))
+	components := make([]onion.Component, 0, len(cfg.Components))
+	disabledLayers := make(map[string]bool, len(disabled))
+	for _, name := range disabled {
+		disabledLayers[name] = true
+	}
+	for _, cc := range cfg.Components {
+		if _, ok := inMatrix[cc.Name]; ok {
+			cc.ProtocolMatrix = true
+		}
+		if _, ok := names[cc.Name]; ok {
+			panic(fmt.Errorf("duplicate component: %s", cc.Name))
+		}
+		names[cc.Name] = struct{}{}
+
+		if cc.Orchestrator != nil && (cc.Disabled || disabledLayers[cc.Name]) {
+			// disabled layers are not worth a request to the orchestrator, but their pairs stay known
+			cc = onion.UndiscoveredLayer(cc)
+		} else if cc.Orchestrator != nil {
+			var nodes []onion.OrchestratorNode
+			var err error
+			if cc, nodes, err = onion.DiscoverHosts(context.Background(), cc); err != nil {
+				panic(err)
+			}
+			fmt.Printf("discovered %d nodes of %s from the orchestrator\n", len(nodes), cc.Name)
+			for i, n := range nodes {
+				fmt.Printf("  %s@%d: %s %s (%s, %s, version %s)\n", cc.Name, i+1, n.ID, n.IPAddress, n.Geoloc.Region, n.Geoloc.CountryCode, n.Version)
+			}
+		}
+
+		cs, err := onion.NewComponents(cc)
+		if err != nil {
+			panic(fmt.Errorf("invalid component config: %w", err))
+		}
+		for _, c := range cs {
+			if _, ok := names[c.Name]; ok && c.Name != cc.Name {
+				panic(fmt.Errorf("duplicate component: %s", c.Name))
+			}
+			names[c.Name] = struct{}{}
+		}
+		components = append(components, cs...)
+	}
+
+	for _, name := range disabled {
+		if _, ok := names[name]; !ok {
+			panic(fmt.Errorf("can not disable unknown component: %s", name))
+		}
+		for i := range components {
+			if components[i].Name == name || components[i].Group == name {
+				components[i].Disabled = true
+			}
+		}
+	}
+	if enabled := onion.EnabledComponents(components); len(enabled) < 2 {
+		panic(fmt.Errorf("at least two enabled components are required, got %d", len(enabled)))
+	}
+
+	// comparators may be configured for pairs of disabled components
+	knownPairs := make(map[string]struct{})
+	for _, a := range components {
+		for _, b := range components {
+			knownPairs[onion.Pair{A: a, B: b}.Name()] = struct{}{}
+		}
+	}
+	byName := make(map[string][]onion.Comparator, len(cfg.Comparators))
+	for name, cns := range cfg.Comparators {
+		if _, ok := knownPairs[name]; !ok && name != "default" {
+			panic(fmt.Errorf("comparators configured for unknown pair: %s", name))
+		}
+		for _, cn := range cns {
+			cmp, err := onion.ComparatorByName(cn)
+			if err != nil {
+				panic(fmt.Errorf("invalid comparators config for %s: %w", name, err))
+			}
+			byName[name] = append(byName[name], cmp)
+		}
+	}
+
+	if len(pairNames) == 0 {
+		pairNames = cfg.Pairs
+	}
+	pairs := onion.ComparisonPairs(components)
+	if len(pairNames) != 0 {
+		if pairs, err = onion.SelectPairs(components, pairNames); err != nil {
+			panic(fmt.Errorf("invalid pairs: %w", err))
+		}
+	}
+	comparators := make(map[string][]onion.Comparator, len(pairs))
+	for _, p := range pairs {
+		name := p.Name()
+		if cs, ok := byName[name]; ok {
+			comparators[name] = cs
+		} else if cs, ok := byName["default"]; ok {
+			comparators[name] = cs
+		}
+	}
+
+	headers := onion.DefaultHeaderRules()
+	if cfg.Headers != nil {
+		headers = &onion.HeaderRules{Compare: cfg.Headers.Compare, Ignore: cfg.Headers.Ignore}
+	}
+	if len(headers.Compare) == 0 {
+		headers = nil
+	}
+
+	for _, r := range cfg.Providers {
+		if len(r.Name) == 0 || (len(r.PeerIDs) == 0 && len(r.Addrs) == 0) {
+			panic(fmt.Errorf("invalid providers config: every provider needs a name and peer IDs or addrs"))
+		}
+	}
+
+	for _, a := range cfg.Assertions {
+		if err := a.Validate(); err != nil {
+			panic(err)
+		}
+	}
 
-	if net.ParseIP(cfg.LassieIP) == nil {
-		panic(fmt.Errorf("invalid lassie ip: %s", cfg.LassieIP))
+	for _, a := range cfg.Chaos {
+		if err := a.Validate(); err != nil {
+			panic(err)
+		}
 	}
-	if net.ParseIP(cfg.L1ShimIP) == nil {
-		panic(fmt.Errorf("invalid l1 shim ip: %s", cfg.L1ShimIP))
+
+	for _, s := range cfg.Triage {
+		if err := s.Validate(); err != nil {
+			panic(err)
+		}
 	}
-	if net.ParseIP(cfg.L1NginxIP) == nil {
-		panic(fmt.Errorf("invalid l1 nginx ip: %s", cfg.L1NginxIP))
+
+	return components, pairNames, comparators, headers, cfg.Providers, cfg.Assertions, cfg.Chaos, cfg.Triage
+}
+
+// dialsProviders reports whether any step of the triage pipeline probes providers.
+func dialsProviders(triage []onion.TriageStep) bool {
+	for _, s := range triage {
+		if s.Analyzer == onion.AnalyzerProviderDial {
+			return true
+		}
 	}
-	if net.ParseIP(cfg.BifrostIP) == nil {
-		panic(fmt.Errorf("invalid bifrost ip: %s", cfg.BifrostIP))
+	return false
+}
+
+// envOr returns the value of the first of the env vars that is set.
+func envOr(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); len(v) != 0 {
+			return v
+		}
 	}
+	return ""
+}
+
+// replayFiles are the values of the repeatable -f flag. Every value is a replay file, optionally labeled as in
+// video=video.log, a directory of replay files or a glob.
+type replayFiles []string
 
-	if cfg.LassiePort <= 0 || cfg.LassiePort > 65535 {
-		panic(fmt.Errorf("invalid lassie port: %d", cfg.LassiePort))
+func (rf *replayFiles) String() string {
+	return strings.Join(*rf, ",")
+}
+
+func (rf *replayFiles) Set(v string) error {
+	*rf = append(*rf, v)
+	return nil
+}
+
+// cohorts expands the replay files into cohorts, which are named after the label of the file or its base name
+// without extension.
+func (rf replayFiles) cohorts() ([]onion.Cohort, error) {
+	var out []onion.Cohort
+	names := make(map[string]struct{})
+	add := func(name, file string) error {
+		if len(name) == 0 {
+			name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if _, ok := names[name]; ok {
+			return fmt.Errorf("several replay files are named %s; label them as in -f=name=file", name)
+		}
+		names[name] = struct{}{}
+		out = append(out, onion.Cohort{Name: name, ReplayFile: file})
+		return nil
 	}
-	if cfg.L1ShimPort <= 0 || cfg.L1ShimPort > 65535 {
-		panic(fmt.Errorf("invalid l1 shim port: %d", cfg.L1ShimPort))
+
+	for _, v := range rf {
+		name, file, ok := strings.Cut(v, "=")
+		if !ok {
+			name, file = "", v
+		}
+		if fi, err := os.Stat(file); err == nil && fi.IsDir() {
+			if len(name) != 0 {
+				return nil, fmt.Errorf("can not label the replay files of directory %s as %s", file, name)
+			}
+			entries, err := os.ReadDir(file)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+					continue
+				}
+				if err := add("", filepath.Join(file, e.Name())); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		matches, err := filepath.Glob(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replay file glob %s: %w", file, err)
+		}
+		if len(matches) == 0 {
+			// files that do not exist fail to load with a clearer error
+			matches = []string{file}
+		}
+		if len(matches) > 1 && len(name) != 0 {
+			return nil, fmt.Errorf("can not label the %d replay files of %s as %s", len(matches), file, name)
+		}
+		for _, m := range matches {
+			if err := add(name, m); err != nil {
+				return nil, err
+			}
+		}
 	}
-	if cfg.L1NginxPort <= 0 || cfg.L1NginxPort > 65535 {
-		panic(fmt.Errorf("invalid l1 nginx port: %d", cfg.L1NginxPort))
+	return out, nil
+}
+
+// goldenComponents returns the component that serves the responses of the golden component recorded in the golden
+// run, followed by the target components.
+func goldenComponents(components []onion.Component, dir, name, targets string) []onion.Component {
+	var gc *onion.Component
+	for i, c := range components {
+		if (len(name) == 0 && c.Reference) || c.Name == name {
+			gc = &components[i]
+			break
+		}
 	}
-	if cfg.BifrostPort <= 0 || cfg.BifrostPort > 65535 {
-		panic(fmt.Errorf("invalid bifrost port: %d", cfg.BifrostPort))
+	if gc == nil {
+		panic(fmt.Errorf("unknown golden component %q; pass -golden-component", name))
+	}
+	g, err := onion.LoadGolden(dir, gc.Name)
+	if err != nil {
+		panic(err)
 	}
 
-	return Config{
-		LassieHostPort:  fmt.Sprintf("%s:%d", cfg.LassieIP, cfg.LassiePort),
-		L1ShimHostPort:  fmt.Sprintf("%s:%d", cfg.L1ShimIP, cfg.L1ShimPort),
-		L1NginxHostPort: fmt.Sprintf("%s:%d", cfg.L1NginxIP, cfg.L1NginxPort),
-		BifrostHostPort: fmt.Sprintf("%s:%d", cfg.BifrostIP, cfg.BifrostPort),
+	out := []onion.Component{onion.GoldenComponent(*gc, g)}
+	if len(targets) == 0 {
+		for _, c := range onion.EnabledComponents(components) {
+			if c.Name != gc.Name {
+				c.Reference = false
+				out = append(out, c)
+			}
+		}
+		return out
+	}
+	for _, name := range strings.Split(targets, ",") {
+		found := false
+		for _, c := range components {
+			if c.Name == name || c.Group == name {
+				c.Reference, c.Disabled = false, false
+				out = append(out, c)
+				found = true
+			}
+		}
+		if !found {
+			panic(fmt.Errorf("unknown target component: %s", name))
+		}
 	}
+	return out
 }
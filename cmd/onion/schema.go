@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/filecoin-saturn/onion"
+)
+
+// runSchema implements `onion schema`, which generates the JSON Schema of the versioned JSON reports of onion.
+func runSchema(args []string) {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the JSON Schema to; defaults to stdout")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion schema [-o=<file>]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	bz, err := onion.ReportSchema()
+	if err != nil {
+		panic(err)
+	}
+	if len(*out) == 0 {
+		fmt.Println(string(bz))
+		return
+	}
+	if err := os.WriteFile(*out, append(bz, '\n'), 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("wrote report schema version %d to %s\n", onion.ReportVersion, *out)
+}
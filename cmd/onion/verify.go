@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/filecoin-saturn/onion"
+)
+
+// runVerify implements `onion verify`, which re-validates the CAR bodies saved by an earlier run offline, e.g. once
+// the extraction or a spec-compliance check is fixed.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	out := fs.String("o", "", "File to write the verification report to as JSON; defaults to offline-verification.json in the results directory")
+	extractTimeout := fs.Duration("extract-timeout", 30*time.Second, "Time allowed to extract the file bytes of every CAR")
+	carDups := fs.Bool("car-dups", false, "Allow CARs that do not declare a duplicate block policy to repeat blocks")
+	fs.Usage = func() {
+		fmt.Printf("Usage: onion verify [-o=<file>] <results directory>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	dir := fs.Arg(0)
+
+	v, err := onion.VerifySavedCARs(dir, onion.OfflineVerifyOptions{
+		ExtractTimeout: *extractTimeout,
+		CarOrder:       onion.CarOrderPolicy{Order: onion.CarOrderDFS, Dups: *carDups},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Println("\n ----------SUMMARY OF OFFLINE VERIFICATION --------------")
+	fmt.Printf("\n %d saved CARs: %d passed, %d failed, %d truncated; file bytes changed since the run for %d", len(v.CARs),
+		v.Passed, v.Failed, v.Truncated, v.RawChanged)
+	for _, c := range v.CARs {
+		if c.Truncated || (c.OK() && !c.RawChanged) {
+			continue
+		}
+		var failed []string
+		if len(c.ExtractError) != 0 {
+			failed = append(failed, "extraction: "+c.ExtractError)
+		}
+		if !c.BlockIntegrity.OK() {
+			failed = append(failed, "block integrity")
+		}
+		if !c.DagScope.OK() {
+			failed = append(failed, "dag-scope")
+		}
+		if !c.CarOrder.OK() {
+			failed = append(failed, "block order")
+		}
+		if c.CarIndex != nil && !c.CarIndex.OK() {
+			failed = append(failed, "CARv2 index")
+		}
+		if c.RawChanged {
+			failed = append(failed, "file bytes changed")
+		}
+		fmt.Printf("\n   %s %s: %s", c.Component, c.Path, strings.Join(failed, ", "))
+	}
+	fmt.Println()
+
+	if len(*out) == 0 {
+		*out = filepath.Join(dir, "offline-verification.json")
+	}
+	bz, err := onion.MarshalReport("offline-verification", v)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(*out, bz, 0644); err != nil {
+		panic(err)
+	}
+	fmt.Printf("\n wrote the verification report to %s\n", *out)
+	if v.Failed != 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package onion
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/filecoin-saturn/onion/replay"
+)
+
+// Cohort is a labeled set of requests, e.g. the requests of a replay file of video traffic, that is sampled, requested
+// and summarised separately from the other cohorts of a run so that traffic mixes can be compared.
+type Cohort struct {
+	// Name labels the cohort and names its results directory within the results directory of every run.
+	Name string
+	// ReplayFile is the replay file to load the requests of the cohort from. It is not read if Entries is set.
+	ReplayFile string
+	// Entries are the requests of the cohort instead of those of the replay file, e.g. for tests.
+	Entries []replay.ReplayEntry
+}
+
+// CohortSummary compares the outcome of a cohort with that of the other cohorts of a run.
+type CohortSummary struct {
+	Cohort string
+	RunID  string
+	Paths  int
+	// FailedRequests is the number of failed requests to every component, keyed by component name.
+	FailedRequests map[string]int
+	// StatusMismatches and BytesMismatches are the number of mismatched paths of every pair, keyed by pair name.
+	StatusMismatches map[string]int
+	BytesMismatches  map[string]int
+}
+
+// summarizeCohort summarises the run of a cohort.
+func summarizeCohort(s RunSummary) CohortSummary {
+	cs := CohortSummary{
+		Cohort:           s.Cohort,
+		RunID:            s.RunID.String(),
+		Paths:            len(s.Results),
+		FailedRequests:   make(map[string]int),
+		StatusMismatches: make(map[string]int),
+		BytesMismatches:  make(map[string]int),
+	}
+	for _, rs := range s.Results {
+		for name, r := range rs {
+			if len(r.ErrorKind) != 0 {
+				cs.FailedRequests[name]++
+			}
+		}
+	}
+	for pair, pm := range s.ResponseReads.Pairs {
+		cs.StatusMismatches[pair] = len(s.StatusMismatchPaths[pair])
+		cs.BytesMismatches[pair] = len(pm.MismatchPaths)
+	}
+	return cs
+}
+
+// writeCohortSummaries writes the summaries of the cohorts of a run to cohorts.json in its results directory and
+// prints the mismatch rates of every pair side by side.
+func (cfg RunConfig) writeCohortSummaries(dir string, n int, runs []RunSummary) error {
+	summaries := make([]CohortSummary, 0, len(runs))
+	var pairs []string
+	for _, s := range runs {
+		cs := summarizeCohort(s)
+		summaries = append(summaries, cs)
+		if len(pairs) == 0 {
+			for pair := range cs.BytesMismatches {
+				pairs = append(pairs, pair)
+			}
+			sort.Strings(pairs)
+		}
+	}
+	if err := cfg.writeReport(dir, "cohorts.json", summaries); err != nil {
+		return err
+	}
+
+	fmt.Println("\n ----------SUMMARY OF COHORTS --------------")
+	for _, cs := range summaries {
+		fmt.Printf("\n Run-%d; cohort %s: %d paths", n, cs.Cohort, cs.Paths)
+		for _, pair := range pairs {
+			fmt.Printf("\n Run-%d; cohort %s; %s: status mismatches %d (%.2f%%), bytes mismatches %d (%.2f%%)", n,
+				cs.Cohort, pair, cs.StatusMismatches[pair], percentOf(cs.StatusMismatches[pair], cs.Paths),
+				cs.BytesMismatches[pair], percentOf(cs.BytesMismatches[pair], cs.Paths))
+		}
+	}
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,214 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/filecoin-saturn/onion/cardiff"
+)
+
+// Comparator decides whether the responses of the two components of a pair to a path are equal.
+type Comparator interface {
+	Name() string
+	// Compare reports whether the responses are equal. ok is false if the responses can not be compared with
+	// this comparator, e.g. because a CAR could not be extracted or the bodies were streamed.
+	Compare(a, b Response) (equal bool, ok bool)
+}
+
+var (
+	// Auto is the default comparator. It compares raw blocks for raw block requests, UnixFS content if the two
+	// components return different things or were asked for a range in different ways, and exact bytes (or their
+	// digests if streamed) otherwise.
+	Auto Comparator = autoComparator{}
+	// ExactBytes compares the captured response bodies byte for byte.
+	ExactBytes Comparator = exactBytesComparator{}
+	// CARBlockSet compares the sets of blocks of two CAR responses, ignoring roots, block order and duplicates.
+	CARBlockSet Comparator = carBlockSetComparator{}
+	// UnixFSContent compares the file bytes of the responses, extracting them from CARs.
+	UnixFSContent Comparator = unixFSContentComparator{}
+	// SHA256Digest compares the sha256 digests of the response bodies. Unlike ExactBytes, it also works for
+	// streamed responses.
+	SHA256Digest Comparator = sha256DigestComparator{}
+	// RawBlock compares the blocks returned for a raw block request, taking the requested block out of the CARs
+	// of components that do not support raw blocks.
+	RawBlock Comparator = rawBlockComparator{}
+)
+
+// Comparators are all the built-in comparators.
+var Comparators = []Comparator{Auto, ExactBytes, CARBlockSet, UnixFSContent, SHA256Digest, RawBlock}
+
+// ComparatorByName returns the built-in comparator with the given name.
+func ComparatorByName(name string) (Comparator, error) {
+	for _, c := range Comparators {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown comparator %q", name)
+}
+
+// Response is the response of a component to a path as seen by a Comparator.
+type Response struct {
+	Component Component
+	Result    *Result
+	// Body is the captured response body, sliced to the requested range if the component ignored it and reduced to
+	// the CARv1 data payload of a CARv2.
+	// It is nil if the body was streamed and only its digests are known.
+	Body []byte
+	// Range is the byte range requested for the path, if any.
+	Range *ByteRange
+
+	pc *pathComparer
+}
+
+// Streamed reports whether the body was streamed rather than captured.
+func (r Response) Streamed() bool {
+	return r.pc.streamed
+}
+
+// File returns the file bytes of the response, extracting them from the body of a CAR response. ok is false if
+// the body was streamed or the CAR could not be extracted.
+func (r Response) File() ([]byte, bool) {
+	if r.Streamed() {
+		return nil, false
+	}
+	return r.pc.file(r.Component)
+}
+
+// Block returns the raw block of the response to a raw block request. ok is false if the request was not for a raw
+// block or the block could not be taken out of a CAR.
+func (r Response) Block() ([]byte, bool) {
+	if r.Streamed() || !r.pc.rawBlock {
+		return nil, false
+	}
+	return r.pc.block(r.Component)
+}
+
+// FileDigest returns the hex encoded sha256 of the file bytes of the response.
+func (r Response) FileDigest() (string, bool) {
+	if r.Streamed() {
+		if r.Component.Extract == ExtractCAR {
+			return r.Result.RawDigest, len(r.Result.RawDigest) > 0
+		}
+		return r.Result.ResponseDigest, true
+	}
+	f, ok := r.File()
+	if !ok {
+		return "", false
+	}
+	return sha256Hex(f), true
+}
+
+// Digest returns the hex encoded sha256 of the response body.
+func (r Response) Digest() string {
+	if r.Streamed() {
+		return r.Result.ResponseDigest
+	}
+	return sha256Hex(r.Body)
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+type autoComparator struct{}
+
+func (autoComparator) Name() string { return "auto" }
+
+func (autoComparator) Compare(a, b Response) (bool, bool) {
+	if a.pc.rawBlock {
+		return RawBlock.Compare(a, b)
+	}
+	// only normalise CARs to file bytes if the other side returned file bytes, or if a range was requested
+	// from the two sides in different ways so that their CARs contain different blocks
+	rangeDiffers := a.Range != nil && a.Component.Range != b.Component.Range
+	if a.Component.Extract != b.Component.Extract || rangeDiffers {
+		return UnixFSContent.Compare(a, b)
+	}
+	if a.Streamed() || b.Streamed() {
+		return SHA256Digest.Compare(a, b)
+	}
+	return ExactBytes.Compare(a, b)
+}
+
+type exactBytesComparator struct{}
+
+func (exactBytesComparator) Name() string { return "exact-bytes" }
+
+func (exactBytesComparator) Compare(a, b Response) (bool, bool) {
+	if a.Streamed() || b.Streamed() {
+		return false, false
+	}
+	return bytes.Equal(a.Body, b.Body), true
+}
+
+type sha256DigestComparator struct{}
+
+func (sha256DigestComparator) Name() string { return "sha256-digest" }
+
+func (sha256DigestComparator) Compare(a, b Response) (bool, bool) {
+	return a.Digest() == b.Digest(), true
+}
+
+type unixFSContentComparator struct{}
+
+func (unixFSContentComparator) Name() string { return "unixfs-content" }
+
+func (unixFSContentComparator) Compare(a, b Response) (bool, bool) {
+	if !a.Streamed() && !b.Streamed() {
+		fa, ok := a.File()
+		if !ok {
+			return false, false
+		}
+		fb, ok := b.File()
+		if !ok {
+			return false, false
+		}
+		return bytes.Equal(fa, fb), true
+	}
+
+	da, ok := a.FileDigest()
+	if !ok {
+		return false, false
+	}
+	db, ok := b.FileDigest()
+	if !ok {
+		return false, false
+	}
+	return da == db, true
+}
+
+type carBlockSetComparator struct{}
+
+func (carBlockSetComparator) Name() string { return "car-block-set" }
+
+func (carBlockSetComparator) Compare(a, b Response) (bool, bool) {
+	if a.Streamed() || b.Streamed() || a.Component.Extract != ExtractCAR || b.Component.Extract != ExtractCAR {
+		return false, false
+	}
+	d, err := cardiff.Compare(a.Body, b.Body)
+	if err != nil {
+		return false, false
+	}
+	return len(d.ReadErrorA) == 0 && len(d.ReadErrorB) == 0 && len(d.OnlyInA) == 0 && len(d.OnlyInB) == 0 &&
+		len(d.DataDiffers) == 0, true
+}
+
+type rawBlockComparator struct{}
+
+func (rawBlockComparator) Name() string { return "raw-block" }
+
+func (rawBlockComparator) Compare(a, b Response) (bool, bool) {
+	ba, ok := a.Block()
+	if !ok {
+		return false, false
+	}
+	bb, ok := b.Block()
+	if !ok {
+		return false, false
+	}
+	return bytes.Equal(ba, bb), true
+}
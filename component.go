@@ -0,0 +1,472 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol is the scheme a component is queried over.
+type Protocol string
+
+const (
+	ProtocolHTTP  Protocol = "http"
+	ProtocolHTTPS Protocol = "https"
+)
+
+// HTTPVersion is the HTTP version a component is queried over.
+type HTTPVersion string
+
+const (
+	// HTTPDefault negotiates the HTTP version as the executor's default transport does.
+	HTTPDefault HTTPVersion = ""
+	// HTTP1 forces HTTP/1.1.
+	HTTP1 HTTPVersion = "1.1"
+	// HTTP2 attempts HTTP/2, which is negotiated over TLS and falls back to HTTP/1.1 if the layer does not support
+	// it.
+	HTTP2 HTTPVersion = "2"
+)
+
+// ExtractMode describes what a component returns for a request and therefore how
+// its response bytes must be normalised before they can be compared with another component.
+type ExtractMode string
+
+const (
+	// ExtractRawFile means the component returns the file bytes directly (path gateway behaviour).
+	ExtractRawFile ExtractMode = "raw"
+	// ExtractCAR means the component returns a CAR that needs to be extracted to get the file bytes.
+	ExtractCAR ExtractMode = "car"
+)
+
+// URLBuilderFunc builds the URL to send to a component for a given bifrost request URL. It fails if the bifrost URL
+// is malformed.
+type URLBuilderFunc func(bifrostUrl string) (string, error)
+
+// Component is a single layer of the stack under test.
+type Component struct {
+	Name     string
+	Protocol Protocol
+	Extract  ExtractMode
+	BuildURL URLBuilderFunc
+	// Range is how the component is asked for a byte range of an entity.
+	Range RangeMode
+	// Timeout overrides the executor request timeout for this component if set.
+	Timeout time.Duration
+	// Retries overrides the executor retry count for this component if set.
+	Retries *int
+	// RetryBackoff overrides the executor retry backoff for this component if set.
+	RetryBackoff time.Duration
+	// Verify checks every block of the component's CAR responses against its CID before they are compared,
+	// e.g. to use a trustless gateway as the reference instead of trusting the file bytes of a path gateway.
+	Verify bool
+	// Disabled components are not queried or compared, e.g. because the layer is down.
+	Disabled bool
+	// Cache marks a layer that caches responses, whose warm and cold responses are compared if enabled.
+	Cache bool
+	// CacheBust are the query params appended to URLs to bypass the cache of the component, e.g. "nocache=1".
+	// They are not appended when warm and cold responses are compared.
+	CacheBust string
+	// MaxRequestsPerSecond limits the rate of requests sent to the component if set, e.g. to test a production
+	// layer gently.
+	MaxRequestsPerSecond float64
+	// MaxBytesPerSecond limits the rate at which response bodies are read from the component if set.
+	MaxBytesPerSecond float64
+	// Redirects is how the component's redirects are handled.
+	Redirects RedirectMode
+	// HTTPVersion is the HTTP version the component is queried over.
+	HTTPVersion HTTPVersion
+	// URLStyle is how content paths are sent to the component, and SubdomainHost is the gateway domain that the
+	// roots of content paths are prefixed to for subdomain requests, e.g. localhost or dweb.link.
+	URLStyle      URLStyle
+	SubdomainHost string
+	// Group is the name of the layer the component is a node of, if the layer has several nodes or is queried over
+	// several HTTP versions, and Node is the host of the node.
+	Group string
+	Node  string
+	// Golden serves the responses recorded by an earlier run instead of querying a layer, if set.
+	Golden *Golden
+	// Auth adds the credentials the layer requires to every request, if set.
+	Auth *Authenticator
+	// Resolve maps hosts, or hosts and ports, to the IPs, or IPs and ports, the component connects to instead of
+	// resolving them, and SNI is the server name sent in TLS handshakes instead of the host of the URL, if set.
+	Resolve map[string]string
+	SNI     string
+	// Kubo is the local Kubo node the component is the gateway of, if set.
+	Kubo *Kubo
+	// VersionURL is the endpoint of the layer that reports its version or health, which is recorded in the
+	// run-metadata.json of every run, if set.
+	VersionURL string
+
+	// Reference marks the component that is treated as the ground truth for comparisons.
+	Reference bool
+}
+
+// ComponentConfig is the config.toml representation of a Component.
+type ComponentConfig struct {
+	Name string `toml:"name"`
+	Host string `toml:"host"`
+	// Hosts are the nodes of a layer that has several, e.g. L1 nodes, instead of Host. Every node is requested and
+	// compared with the other nodes.
+	Hosts []string `toml:"hosts"`
+	// Orchestrator discovers the hosts of the layer from the Saturn orchestrator with DiscoverHosts instead.
+	Orchestrator *OrchestratorConfig `toml:"orchestrator"`
+	Protocol     string              `toml:"protocol"`
+	Extract      string              `toml:"extract"`
+
+	// StripQuery removes the query params of the bifrost request url, e.g. for path gateways.
+	StripQuery bool `toml:"stripQuery"`
+	// Params are extra query params to append to the request url, e.g. "nocache=1".
+	Params string `toml:"params"`
+	// Range is one of "header", "entity-bytes" or "none". Defaults to "header" for components that return
+	// file bytes and "entity-bytes" for components that return CARs.
+	Range string `toml:"range"`
+	// Timeout overrides the request timeout for this component, e.g. "10m" for slow origins.
+	Timeout string `toml:"timeout"`
+	// Retries overrides the number of retries on transient errors for this component.
+	Retries *int `toml:"retries"`
+	// RetryBackoff overrides the backoff before the first retry for this component, e.g. "500ms".
+	RetryBackoff string `toml:"retryBackoff"`
+	// Verify checks every block of CAR responses against its CID. Only valid for components that return CARs.
+	Verify bool `toml:"verify"`
+	// Disabled skips the component, e.g. because the layer is down.
+	Disabled bool `toml:"disabled"`
+	// Cache marks a layer that caches responses so that its warm and cold responses can be compared.
+	Cache bool `toml:"cache"`
+	// CacheBust are query params that bypass the cache of the layer, e.g. "nocache=1". They are appended to the
+	// request url like Params, except when warm and cold responses are compared.
+	CacheBust string `toml:"cacheBust"`
+	// MaxRequestsPerSecond limits the rate of requests sent to the layer across all concurrent requests.
+	MaxRequestsPerSecond float64 `toml:"maxRequestsPerSecond"`
+	// MaxBytesPerSecond limits the rate at which response bodies are read from the layer.
+	MaxBytesPerSecond float64 `toml:"maxBytesPerSecond"`
+	// Redirects is "follow" (the default) to follow redirects or "manual" to compare the 3xx responses themselves.
+	Redirects string `toml:"redirects"`
+	// HTTPVersion is "1.1" to force HTTP/1.1 or "2" to enable HTTP/2, which requires https. Defaults to the
+	// executor's transport, which uses HTTP/1.1.
+	HTTPVersion string `toml:"httpVersion"`
+	// ProtocolMatrix requests every path from the layer over both HTTP/1.1 and HTTP/2 as the components
+	// "{name}-h1" and "{name}-h2", whose responses are also compared with each other.
+	ProtocolMatrix bool `toml:"protocolMatrix"`
+	// URLStyle is "path" (the default) to send content paths as URL paths, or "subdomain" to send their root as a
+	// subdomain of SubdomainHost, e.g. {cid}.ipfs.localhost, as subdomain gateways are requested.
+	URLStyle string `toml:"urlStyle"`
+	// SubdomainHost is the gateway domain of subdomain requests. Defaults to the host of the layer, or to
+	// "localhost" if the layer is IP addressed, in which case the subdomain is sent as the Host header.
+	SubdomainHost string `toml:"subdomainHost"`
+	// Auth is the credentials the layer requires, e.g. a JWT or a shared secret header.
+	Auth *AuthConfig `toml:"auth"`
+	// Resolve overrides DNS resolution like a hosts file, e.g. {"strn.pl" = "10.0.0.5"} to request a specific node
+	// behind a load balancer with the production URL and Host header. Keys may include a port, e.g. "strn.pl:443",
+	// and values may include the port to connect to instead.
+	Resolve map[string]string `toml:"resolve"`
+	// SNI is the server name sent in TLS handshakes instead of the host of the URL, e.g. the production domain of a
+	// node that is requested by IP. Only used over https.
+	SNI string `toml:"sni"`
+	// Kubo marks the layer as a locally run Kubo node, which is waited for and optionally primed before the first
+	// run.
+	Kubo *KuboConfig `toml:"kubo"`
+	// VersionPath is the path of an endpoint of the layer that reports its version or health, e.g. "/version",
+	// which is requested from every node of the layer before every run and recorded in its run-metadata.json.
+	// Defaults to the version of the RPC API of Kubo nodes.
+	VersionPath string `toml:"versionPath"`
+
+	Reference bool `toml:"reference"`
+}
+
+func NewComponent(cfg ComponentConfig) (Component, error) {
+	if len(cfg.Name) == 0 {
+		return Component{}, fmt.Errorf("component name is required")
+	}
+	if len(cfg.Host) == 0 {
+		return Component{}, fmt.Errorf("invalid %s host: %q", cfg.Name, cfg.Host)
+	}
+	// the scheme of the requests is that of the protocol, so that a layer can be tested over HTTP and HTTPS by
+	// configuring it twice
+	if strings.Contains(cfg.Host, "://") {
+		return Component{}, fmt.Errorf("invalid %s host: %q; set its scheme with protocol instead", cfg.Name, cfg.Host)
+	}
+
+	protocol := Protocol(cfg.Protocol)
+	if protocol != ProtocolHTTP && protocol != ProtocolHTTPS {
+		return Component{}, fmt.Errorf("invalid %s protocol: %q", cfg.Name, cfg.Protocol)
+	}
+
+	extract := ExtractMode(cfg.Extract)
+	if extract != ExtractRawFile && extract != ExtractCAR {
+		return Component{}, fmt.Errorf("invalid %s extract mode: %q", cfg.Name, cfg.Extract)
+	}
+
+	rangeMode := RangeMode(cfg.Range)
+	switch rangeMode {
+	case "":
+		rangeMode = RangeHeader
+		if extract == ExtractCAR {
+			rangeMode = RangeEntityBytes
+		}
+	case RangeHeader, RangeEntityBytes, RangeNone:
+	default:
+		return Component{}, fmt.Errorf("invalid %s range mode: %q", cfg.Name, cfg.Range)
+	}
+
+	var timeout time.Duration
+	if len(cfg.Timeout) != 0 {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil || timeout <= 0 {
+			return Component{}, fmt.Errorf("invalid %s timeout: %q", cfg.Name, cfg.Timeout)
+		}
+	}
+
+	if cfg.Verify && extract != ExtractCAR {
+		return Component{}, fmt.Errorf("invalid %s config: only components that return CARs can be verified", cfg.Name)
+	}
+
+	if _, err := url.ParseQuery(cfg.CacheBust); err != nil {
+		return Component{}, fmt.Errorf("invalid %s cache bust params: %q", cfg.Name, cfg.CacheBust)
+	}
+
+	if cfg.MaxRequestsPerSecond < 0 {
+		return Component{}, fmt.Errorf("invalid %s max requests per second: %v", cfg.Name, cfg.MaxRequestsPerSecond)
+	}
+	if cfg.MaxBytesPerSecond < 0 {
+		return Component{}, fmt.Errorf("invalid %s max bytes per second: %v", cfg.Name, cfg.MaxBytesPerSecond)
+	}
+
+	redirects := RedirectMode(cfg.Redirects)
+	switch redirects {
+	case "":
+		redirects = RedirectFollow
+	case RedirectFollow, RedirectManual:
+	default:
+		return Component{}, fmt.Errorf("invalid %s redirect mode: %q", cfg.Name, cfg.Redirects)
+	}
+
+	httpVersion := HTTPVersion(cfg.HTTPVersion)
+	switch httpVersion {
+	case HTTPDefault, HTTP1:
+	case HTTP2:
+		if protocol != ProtocolHTTPS {
+			return Component{}, fmt.Errorf("invalid %s config: HTTP/2 is only supported over https", cfg.Name)
+		}
+	default:
+		return Component{}, fmt.Errorf("invalid %s http version: %q", cfg.Name, cfg.HTTPVersion)
+	}
+
+	urlStyle := URLStyle(cfg.URLStyle)
+	switch urlStyle {
+	case "":
+		urlStyle = URLStylePath
+	case URLStylePath, URLStyleSubdomain:
+	default:
+		return Component{}, fmt.Errorf("invalid %s url style: %q", cfg.Name, cfg.URLStyle)
+	}
+	subdomainHost := cfg.SubdomainHost
+	if len(subdomainHost) == 0 {
+		if subdomainHost = (&url.URL{Host: cfg.Host}).Hostname(); net.ParseIP(subdomainHost) != nil {
+			subdomainHost = defaultSubdomainHost
+		}
+	}
+
+	if cfg.Retries != nil && *cfg.Retries < 0 {
+		return Component{}, fmt.Errorf("invalid %s retries: %d", cfg.Name, *cfg.Retries)
+	}
+	var retryBackoff time.Duration
+	if len(cfg.RetryBackoff) != 0 {
+		var err error
+		if retryBackoff, err = time.ParseDuration(cfg.RetryBackoff); err != nil || retryBackoff <= 0 {
+			return Component{}, fmt.Errorf("invalid %s retry backoff: %q", cfg.Name, cfg.RetryBackoff)
+		}
+	}
+
+	resolve, err := parseResolve(cfg.Name, cfg.Resolve)
+	if err != nil {
+		return Component{}, err
+	}
+	if len(cfg.SNI) != 0 && protocol != ProtocolHTTPS {
+		return Component{}, fmt.Errorf("invalid %s config: SNI is only sent over https", cfg.Name)
+	}
+
+	var auth *Authenticator
+	if cfg.Auth != nil {
+		var err error
+		if auth, err = NewAuthenticator(*cfg.Auth); err != nil {
+			return Component{}, fmt.Errorf("invalid %s auth: %w", cfg.Name, err)
+		}
+	}
+
+	var versionURL string
+	if len(cfg.VersionPath) != 0 {
+		if !strings.HasPrefix(cfg.VersionPath, "/") {
+			return Component{}, fmt.Errorf("invalid %s version path: %q", cfg.Name, cfg.VersionPath)
+		}
+		versionURL = fmt.Sprintf("%s://%s%s", protocol, cfg.Host, cfg.VersionPath)
+		if _, err := url.Parse(versionURL); err != nil {
+			return Component{}, fmt.Errorf("invalid %s version path: %q", cfg.Name, cfg.VersionPath)
+		}
+	}
+
+	var kubo *Kubo
+	if cfg.Kubo != nil {
+		var err error
+		gateway := fmt.Sprintf("%s://%s", protocol, cfg.Host)
+		if kubo, err = NewKubo(gateway, *cfg.Kubo); err != nil {
+			return Component{}, fmt.Errorf("invalid %s kubo config: %w", cfg.Name, err)
+		}
+	}
+
+	return Component{
+		Name:                 cfg.Name,
+		Protocol:             protocol,
+		Extract:              extract,
+		BuildURL:             cfg.urlBuilder(),
+		Range:                rangeMode,
+		Timeout:              timeout,
+		Retries:              cfg.Retries,
+		RetryBackoff:         retryBackoff,
+		Verify:               cfg.Verify,
+		Disabled:             cfg.Disabled,
+		Cache:                cfg.Cache,
+		CacheBust:            cfg.CacheBust,
+		MaxRequestsPerSecond: cfg.MaxRequestsPerSecond,
+		MaxBytesPerSecond:    cfg.MaxBytesPerSecond,
+		Redirects:            redirects,
+		HTTPVersion:          httpVersion,
+		URLStyle:             urlStyle,
+		SubdomainHost:        subdomainHost,
+		Auth:                 auth,
+		Resolve:              resolve,
+		SNI:                  cfg.SNI,
+		Kubo:                 kubo,
+		VersionURL:           versionURL,
+		Reference:            cfg.Reference,
+	}, nil
+}
+
+func (cfg ComponentConfig) urlBuilder() URLBuilderFunc {
+	return func(bifrostUrl string) (string, error) {
+		u := bifrostUrl
+		if cfg.StripQuery {
+			u = stripQuery(u)
+		}
+
+		u, err := rewriteURL(u, Protocol(cfg.Protocol), cfg.Host)
+		if err != nil {
+			return "", err
+		}
+
+		for _, params := range []string{cfg.Params, cfg.CacheBust} {
+			if len(params) == 0 {
+				continue
+			}
+			if strings.Contains(u, "?") {
+				u = u + "&" + params
+			} else {
+				u = u + "?" + params
+			}
+		}
+		return u, nil
+	}
+}
+
+// Pair is an ordered pair of components whose responses are compared with each other.
+type Pair struct {
+	A Component
+	B Component
+}
+
+func (p Pair) Name() string {
+	return fmt.Sprintf("%s-%s", p.A.Name, p.B.Name)
+}
+
+// ComparisonPairs returns the pairs of components to compare: the reference component against every
+// other component, followed by every component against the next one in registration order.
+// If no component is marked as the reference, the first component is used. Disabled components are skipped.
+func ComparisonPairs(components []Component) []Pair {
+	components = EnabledComponents(components)
+	if len(components) == 0 {
+		return nil
+	}
+
+	ref := 0
+	for i, c := range components {
+		if c.Reference {
+			ref = i
+			break
+		}
+	}
+
+	var pairs []Pair
+	seen := make(map[string]struct{})
+	addF := func(a, b Component) {
+		p := Pair{A: a, B: b}
+		if _, ok := seen[p.Name()]; ok {
+			return
+		}
+		seen[p.Name()] = struct{}{}
+		pairs = append(pairs, p)
+	}
+
+	for i, c := range components {
+		if i != ref {
+			addF(components[ref], c)
+		}
+	}
+
+	var others []Component
+	for i, c := range components {
+		if i != ref {
+			others = append(others, c)
+		}
+	}
+	for i := 0; i+1 < len(others); i++ {
+		addF(others[i], others[i+1])
+	}
+
+	return pairs
+}
+
+// SelectPairs returns the pairs of enabled components with the given names, e.g. "shim-nginx", in that order, so that
+// only the pairs of interest are compared instead of the ComparisonPairs of the components. Any two enabled
+// components can be paired, with the first one as A.
+func SelectPairs(components []Component, names []string) ([]Pair, error) {
+	components = EnabledComponents(components)
+	byName := make(map[string][]Pair)
+	for _, a := range components {
+		for _, b := range components {
+			if a.Name != b.Name {
+				p := Pair{A: a, B: b}
+				byName[p.Name()] = append(byName[p.Name()], p)
+			}
+		}
+	}
+
+	pairs := make([]Pair, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("duplicate pair: %s", name)
+		}
+		seen[name] = struct{}{}
+		switch ps := byName[name]; len(ps) {
+		case 0:
+			return nil, fmt.Errorf("unknown pair or pair of disabled components: %s", name)
+		case 1:
+			pairs = append(pairs, ps[0])
+		default:
+			return nil, fmt.Errorf("ambiguous pair: %s names more than one pair of components", name)
+		}
+	}
+	return pairs, nil
+}
+
+// EnabledComponents returns the components that are not disabled.
+func EnabledComponents(components []Component) []Component {
+	var out []Component
+	for _, c := range components {
+		if !c.Disabled {
+			out = append(out, c)
+		}
+	}
+	return out
+}
@@ -0,0 +1,159 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ConditionalOutcome is how a component answered the conditional request for a path it had already served.
+type ConditionalOutcome string
+
+const (
+	// ConditionalNotModified is a 304 Not Modified response, as expected for content addressed responses.
+	ConditionalNotModified ConditionalOutcome = "not-modified"
+	// ConditionalIgnored is a full 2xx response, i.e. the validators of the request were ignored.
+	ConditionalIgnored ConditionalOutcome = "ignored"
+	// ConditionalFailed is any other response, or a request that failed.
+	ConditionalFailed ConditionalOutcome = "failed"
+	// ConditionalNoValidator is a response without an ETag or Last-Modified header to make a conditional request
+	// with, so that none was sent.
+	ConditionalNoValidator ConditionalOutcome = "no-validator"
+)
+
+// ConditionalReport is the outcome of re-requesting a path from a component with the validators of its response
+// as If-None-Match and If-Modified-Since.
+type ConditionalReport struct {
+	// ETag and LastModified are the validators of the response that the conditional request was sent with.
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	Outcome      ConditionalOutcome
+	// StatusCode, ResponseETag and ResponseSize are those of the response to the conditional request, if it was
+	// sent. A 304 must carry the ETag of the response it validates and no body.
+	StatusCode   int    `json:",omitempty"`
+	ResponseETag string `json:",omitempty"`
+	ResponseSize uint64 `json:",omitempty"`
+	// ETagChanged is set if the response to the conditional request has a different ETag than the response it
+	// validates, i.e. the ETag of the path is not stable.
+	ETagChanged bool   `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// conditionalURLs returns the URLs to test with the validators of the response set as the conditional headers of
+// the request to the component.
+func conditionalURLs(c Component, urls URLsToTest, etag, lastModified string) URLsToTest {
+	if len(etag) != 0 {
+		urls = withRequestHeader(c, urls, "If-None-Match", etag)
+	}
+	if len(lastModified) != 0 {
+		urls = withRequestHeader(c, urls, "If-Modified-Since", lastModified)
+	}
+	return urls
+}
+
+// conditionalRequest re-requests the path from the component with the validators of its response r, if it has
+// any. It returns nil if r was not read successfully or the request is not a GET or HEAD, which can not be
+// conditional.
+func (re *RequestExecutor) conditionalRequest(ctx context.Context, c Component, urls URLsToTest, r *Result) *ConditionalReport {
+	if r == nil || !isReadOK(r) || (len(urls.Method) != 0 && urls.Method != http.MethodGet && urls.Method != http.MethodHead) {
+		return nil
+	}
+	h := http.Header(r.Headers)
+	report := &ConditionalReport{ETag: h.Get("ETag"), LastModified: h.Get("Last-Modified")}
+	if len(report.ETag) == 0 && len(report.LastModified) == 0 {
+		report.Outcome = ConditionalNoValidator
+		return report
+	}
+
+	cr := re.executeHTTPRequest(ctx, c, conditionalURLs(c, urls, report.ETag, report.LastModified), false)
+	report.StatusCode = cr.StatusCode
+	report.ResponseETag = http.Header(cr.Headers).Get("ETag")
+	report.ResponseSize = cr.ResponseSize
+	switch {
+	case cr.StatusCode == http.StatusNotModified:
+		report.Outcome = ConditionalNotModified
+	case isSuccess(cr.StatusCode):
+		report.Outcome = ConditionalIgnored
+	default:
+		report.Outcome = ConditionalFailed
+		report.Error = cr.ErrorBody
+	}
+	report.ETagChanged = len(report.ETag) != 0 && len(report.ResponseETag) != 0 && report.ETag != report.ResponseETag
+	return report
+}
+
+// ConditionalStats counts the outcomes of the conditional requests of every component and the pairs of components
+// whose outcomes differ for the same path.
+type ConditionalStats struct {
+	// Outcomes and ETagChanged are keyed by component name, and ETagChangedPaths lists the paths of every component.
+	Outcomes         map[string]map[ConditionalOutcome]int
+	ETagChanged      map[string]int
+	ETagChangedPaths map[string][]string `json:",omitempty"`
+	// Disagreements is keyed by pair name, and DisagreementPaths lists the paths of every pair.
+	Disagreements     map[string]int
+	DisagreementPaths map[string][]string `json:",omitempty"`
+}
+
+// conditionalStats counts the outcomes of the conditional requests of the run. The caller must hold the lock.
+func (re *RequestExecutor) conditionalStats() *ConditionalStats {
+	s := &ConditionalStats{
+		Outcomes:          make(map[string]map[ConditionalOutcome]int, len(re.components)),
+		ETagChanged:       make(map[string]int, len(re.components)),
+		ETagChangedPaths:  make(map[string][]string),
+		Disagreements:     make(map[string]int, len(re.pairs)),
+		DisagreementPaths: make(map[string][]string),
+	}
+	for _, c := range re.components {
+		s.Outcomes[c.Name] = make(map[ConditionalOutcome]int)
+	}
+	for path, rs := range re.results {
+		for _, c := range re.components {
+			r := rs[c.Name]
+			if r == nil || r.Conditional == nil {
+				continue
+			}
+			s.Outcomes[c.Name][r.Conditional.Outcome]++
+			if r.Conditional.ETagChanged {
+				s.ETagChanged[c.Name]++
+				s.ETagChangedPaths[c.Name] = append(s.ETagChangedPaths[c.Name], path)
+			}
+		}
+		for _, p := range re.pairs {
+			ra, rb := rs[p.A.Name], rs[p.B.Name]
+			if ra == nil || rb == nil || ra.Conditional == nil || rb.Conditional == nil {
+				continue
+			}
+			if ra.Conditional.Outcome != rb.Conditional.Outcome {
+				s.Disagreements[p.Name()]++
+				s.DisagreementPaths[p.Name()] = append(s.DisagreementPaths[p.Name()], path)
+			}
+		}
+	}
+	for _, paths := range s.ETagChangedPaths {
+		sort.Strings(paths)
+	}
+	for _, paths := range s.DisagreementPaths {
+		sort.Strings(paths)
+	}
+	return s
+}
+
+// writeConditional writes the outcomes of the conditional requests of the run to conditional-requests.json and
+// prints them. The caller must hold the lock.
+func (re *RequestExecutor) writeConditional() {
+	s := re.conditionalStats()
+	re.writeJSON(s, re.rrFile("conditional-requests.json"))
+
+	fmt.Println("\n ----------SUMMARY OF CONDITIONAL REQUESTS --------------")
+	for _, c := range re.components {
+		outcomes := s.Outcomes[c.Name]
+		fmt.Printf("\n Run-%d; %s conditional requests: not modified %d, ignored %d, failed %d, no validator %d; ETag changed %d",
+			re.n, c.Name, outcomes[ConditionalNotModified], outcomes[ConditionalIgnored], outcomes[ConditionalFailed],
+			outcomes[ConditionalNoValidator], s.ETagChanged[c.Name])
+	}
+	for _, p := range re.pairs {
+		fmt.Printf("\n Run-%d; %s %s: %d paths answered differently to conditional requests", re.n, p.A.Name, p.B.Name, s.Disagreements[p.Name()])
+	}
+	fmt.Println()
+}
@@ -0,0 +1,205 @@
+package onion
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnInfo describes the connection the response of a request was received over, so that mismatches and latency
+// spikes can be correlated with connection churn or with the backend that served them.
+type ConnInfo struct {
+	// Reused is true if the connection had been used for an earlier request.
+	Reused bool
+	// WasIdle is true if the connection was taken from the idle pool, and IdleTime is how long it was idle.
+	WasIdle  bool
+	IdleTime time.Duration `json:",omitempty"`
+	// RemoteAddr is the address of the peer of the connection, e.g. one of the IPs behind a load balancer.
+	RemoteAddr string
+	// TLSVersion is the TLS version of the connection, if any, e.g. "TLS 1.3".
+	TLSVersion string `json:",omitempty"`
+	// Proto is the protocol of the response, e.g. "HTTP/2.0".
+	Proto string `json:",omitempty"`
+}
+
+// connRecorder records the connection of the last request sent with its context, i.e. of the final response of a
+// redirect chain.
+type connRecorder struct {
+	mu   sync.Mutex
+	info *ConnInfo
+}
+
+func withConnRecorder(ctx context.Context) (context.Context, *connRecorder) {
+	cr := &connRecorder{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			ci := &ConnInfo{Reused: info.Reused, WasIdle: info.WasIdle, IdleTime: info.IdleTime}
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				ci.RemoteAddr = addr.String()
+			}
+			cr.mu.Lock()
+			cr.info = ci
+			cr.mu.Unlock()
+		},
+	}), cr
+}
+
+// conn returns the connection of the response, if a connection was established.
+func (cr *connRecorder) conn(resp *http.Response) *ConnInfo {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.info == nil {
+		return nil
+	}
+	ci := *cr.info
+	if resp != nil {
+		ci.Proto = resp.Proto
+	}
+	if resp != nil && resp.TLS != nil {
+		ci.TLSVersion = tlsVersionName(resp.TLS.Version)
+	}
+	return &ci
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// ConnStats summarises the connections of the requests to a component across a run.
+type ConnStats struct {
+	// Requests is the number of requests that got a connection, of which Reused reused an earlier connection.
+	Requests int
+	Reused   int
+	// TLSVersions counts the requests by the TLS version of their connection.
+	TLSVersions map[string]int `json:",omitempty"`
+	// Protos counts the requests by the protocol of their response, e.g. HTTP/2.0.
+	Protos map[string]int `json:",omitempty"`
+	// RemoteAddrs is keyed by the remote address of the connections.
+	RemoteAddrs map[string]*RemoteAddrStats
+}
+
+// RemoteAddrStats summarises the requests to a component that were served by a remote address.
+type RemoteAddrStats struct {
+	Requests int
+	Reused   int
+	// Failed is the number of requests whose response was not read successfully.
+	Failed int
+	// Mismatched is the number of paths whose status or response bytes mismatched in a pair of the component.
+	Mismatched int
+	P50        time.Duration
+	P99        time.Duration
+}
+
+// componentConnStats computes the connection stats of every component over the results of a run. mismatched are
+// the paths that mismatched in a pair of the component, keyed by component name.
+func componentConnStats(components []Component, results map[string]Results, mismatched map[string]map[string]struct{}) map[string]*ConnStats {
+	out := make(map[string]*ConnStats, len(components))
+	for _, c := range components {
+		s := &ConnStats{
+			TLSVersions: make(map[string]int),
+			Protos:      make(map[string]int),
+			RemoteAddrs: make(map[string]*RemoteAddrStats),
+		}
+		latencies := make(map[string][]time.Duration)
+		for path, rs := range results {
+			r := rs[c.Name]
+			if r == nil || r.Conn == nil {
+				continue
+			}
+			s.Requests++
+			as := s.RemoteAddrs[r.Conn.RemoteAddr]
+			if as == nil {
+				as = &RemoteAddrStats{}
+				s.RemoteAddrs[r.Conn.RemoteAddr] = as
+			}
+			as.Requests++
+			if r.Conn.Reused {
+				s.Reused++
+				as.Reused++
+			}
+			if len(r.Conn.TLSVersion) != 0 {
+				s.TLSVersions[r.Conn.TLSVersion]++
+			}
+			if len(r.Conn.Proto) != 0 {
+				s.Protos[r.Conn.Proto]++
+			}
+			if !isReadOK(r) {
+				as.Failed++
+			}
+			if _, ok := mismatched[c.Name][path]; ok {
+				as.Mismatched++
+			}
+			latencies[r.Conn.RemoteAddr] = append(latencies[r.Conn.RemoteAddr], r.Latency)
+		}
+		for addr, ls := range latencies {
+			sort.Slice(ls, func(i, j int) bool { return ls[i] < ls[j] })
+			s.RemoteAddrs[addr].P50 = percentile(ls, 50)
+			s.RemoteAddrs[addr].P99 = percentile(ls, 99)
+		}
+		out[c.Name] = s
+	}
+	return out
+}
+
+// mismatchedPaths returns the paths whose status or response bytes mismatched in a pair of every component. The
+// caller must hold the lock.
+func (re *RequestExecutor) mismatchedPaths() map[string]map[string]struct{} {
+	out := make(map[string]map[string]struct{}, len(re.components))
+	add := func(name, path string) {
+		if out[name] == nil {
+			out[name] = make(map[string]struct{})
+		}
+		out[name][path] = struct{}{}
+	}
+	for _, p := range re.pairs {
+		for path, rs := range re.results {
+			_, bytesMismatch := re.responseReads.Pairs[p.Name()].Mismatches[path]
+			if bytesMismatch || isStatusMismatch(rs[p.A.Name], rs[p.B.Name]) {
+				add(p.A.Name, path)
+				add(p.B.Name, path)
+			}
+		}
+	}
+	return out
+}
+
+// writeConnections writes the connection stats of every component and prints a summary. The caller must hold the
+// lock.
+func (re *RequestExecutor) writeConnections() {
+	stats := componentConnStats(re.components, re.results, re.mismatchedPaths())
+	re.writeJSON(stats, re.rrFile("connections.json"))
+
+	fmt.Println("\n ----------SUMMARY OF CONNECTIONS --------------")
+	for _, c := range re.components {
+		s := stats[c.Name]
+		if s.Requests == 0 {
+			continue
+		}
+		fmt.Printf("\n Run-%d; %s reused connections for %d/%d requests over %d remote addresses", re.n, c.Name, s.Reused, s.Requests, len(s.RemoteAddrs))
+		addrs := make([]string, 0, len(s.RemoteAddrs))
+		for addr := range s.RemoteAddrs {
+			addrs = append(addrs, addr)
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			as := s.RemoteAddrs[addr]
+			fmt.Printf("\n Run-%d; %s %s: requests=%d reused=%d failed=%d mismatched=%d p50=%s p99=%s", re.n, c.Name, addr, as.Requests, as.Reused, as.Failed, as.Mismatched, as.P50, as.P99)
+		}
+	}
+	fmt.Println()
+}
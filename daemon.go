@@ -0,0 +1,90 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// daemonDirLayout is the layout of the timestamp that names the results directory of every scheduled test.
+const daemonDirLayout = "20060102T150405Z"
+
+// Schedule configures RunDaemon.
+type Schedule struct {
+	// Every is the interval between tests. Tests start at multiples of the interval, e.g. on the hour for 1h,
+	// except for the first one, which starts immediately.
+	Every time.Duration
+	// Keep is the number of most recent results directories to keep. Older ones are removed after every test.
+	// All are kept if it is zero.
+	Keep int
+}
+
+// RunDaemon runs the test described by the config on the schedule until ctx is done, e.g. to monitor a deployment
+// continuously. The results of every test are written to a directory under cfg.ResultsDir named after the UTC time
+// it started at, e.g. results/20231010T130000Z/results-1. A failed test is reported and does not stop the daemon.
+func RunDaemon(ctx context.Context, cfg RunConfig, s Schedule) error {
+	if s.Every <= 0 {
+		return fmt.Errorf("schedule interval must be positive, got %s", s.Every)
+	}
+	base := cfg.ResultsDir
+	if len(base) == 0 {
+		base = "results"
+	}
+
+	next := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(next)):
+		}
+
+		start := time.Now().UTC()
+		tcfg := cfg
+		tcfg.ResultsDir = filepath.Join(base, start.Format(daemonDirLayout))
+		fmt.Printf("\nstarting scheduled test %s\n", start.Format(daemonDirLayout))
+		if _, err := Run(ctx, tcfg); err != nil {
+			fmt.Printf("\nscheduled test %s failed: %s\n", start.Format(daemonDirLayout), err)
+		}
+		// only the first test resumes an interrupted run
+		cfg.Resume = ""
+
+		if err := rotateResults(base, s.Keep); err != nil {
+			fmt.Printf("\nfailed to rotate results: %s\n", err)
+		}
+
+		next = time.Now().Truncate(s.Every).Add(s.Every)
+	}
+}
+
+// rotateResults removes all but the keep most recent results directories of scheduled tests in base.
+func rotateResults(base string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for _, e := range entries {
+		if _, err := time.Parse(daemonDirLayout, e.Name()); e.IsDir() && err == nil {
+			dirs = append(dirs, e.Name())
+		}
+	}
+	if len(dirs) <= keep {
+		return nil
+	}
+	// the layout sorts chronologically
+	sort.Strings(dirs)
+	for _, d := range dirs[:len(dirs)-keep] {
+		if err := os.RemoveAll(filepath.Join(base, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	car "github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	_ "github.com/ipld/go-ipld-prime/codec/dagcbor"
+	_ "github.com/ipld/go-ipld-prime/codec/dagjson"
+	_ "github.com/ipld/go-ipld-prime/codec/raw"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// DagScope is the dag-scope of a trustless gateway CAR request.
+type DagScope string
+
+const (
+	// DagScopeBlock is only the block of the terminal path element.
+	DagScopeBlock DagScope = "block"
+	// DagScopeEntity is the blocks needed to read the terminal entity: all blocks of a file but only the
+	// directory block (and HAMT shards) of a directory.
+	DagScopeEntity DagScope = "entity"
+	// DagScopeAll is the whole DAG under the terminal path element.
+	DagScopeAll DagScope = "all"
+)
+
+// DagScopeReport describes how the blocks of a CAR response compare to the blocks expected for the dag-scope of
+// the request. The blocks needed to traverse the request path are always expected.
+type DagScopeReport struct {
+	Scope DagScope
+
+	// Missing are blocks that are expected for the scope but are not in the CAR.
+	Missing []string `json:",omitempty"`
+	// Unexpected are blocks in the CAR that are outside the scope.
+	Unexpected []string `json:",omitempty"`
+	// Error is set if the CAR could not be verified at all.
+	Error string `json:",omitempty"`
+}
+
+func (r *DagScopeReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0 && len(r.Error) == 0
+}
+
+// VerifyDagScope checks that the CAR returned for the request url contains exactly the blocks expected for
+// the dag-scope of the request. If the request has an entity-bytes range, only a subset of a file's blocks
+// is expected and missing blocks are not reported.
+func VerifyDagScope(carBytes []byte, requestUrl string) *DagScopeReport {
+	report := &DagScopeReport{Scope: DagScopeAll}
+
+	u, err := url.Parse(requestUrl)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to parse request url: %s", err)
+		return report
+	}
+	if report.Scope, err = requestDagScope(u); err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	ranged := len(u.Query().Get("entity-bytes")) != 0
+
+	dv, err := newDagVerifier(carBytes)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read car: %s", err)
+		return report
+	}
+
+	terminal, err := dv.resolvePath(requestPathSegments(u.Path))
+	if err != nil {
+		report.Error = err.Error()
+	} else {
+		switch report.Scope {
+		case DagScopeBlock:
+			dv.expect(terminal)
+		case DagScopeEntity:
+			err = dv.expectEntity(terminal)
+		case DagScopeAll:
+			err = dv.expectAll(terminal)
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+	}
+
+	for _, c := range dv.order {
+		if _, ok := dv.expected[c]; !ok {
+			report.Unexpected = append(report.Unexpected, c.String())
+		}
+	}
+	for _, c := range dv.missing {
+		if !ranged || report.Scope == DagScopeBlock {
+			report.Missing = append(report.Missing, c.String())
+		}
+	}
+	return report
+}
+
+// requestDagScope returns the dag-scope of the request, which defaults to all.
+func requestDagScope(u *url.URL) (DagScope, error) {
+	scope := DagScopeAll
+	if s := u.Query().Get("dag-scope"); len(s) != 0 {
+		scope = DagScope(s)
+	}
+	if scope != DagScopeBlock && scope != DagScopeEntity && scope != DagScopeAll {
+		return scope, fmt.Errorf("unknown dag-scope %q", scope)
+	}
+	return scope, nil
+}
+
+// requestPathSegments returns the path segments after /ipfs/{cid} or /ipns/{name}.
+func requestPathSegments(path string) []string {
+	_, _, rest, err := splitContentPath(path)
+	if err != nil || len(rest) == 0 {
+		return nil
+	}
+
+	var segs []string
+	for _, s := range strings.Split(rest, "/") {
+		if len(s) != 0 {
+			if us, err := url.PathUnescape(s); err == nil {
+				s = us
+			}
+			segs = append(segs, s)
+		}
+	}
+	return segs
+}
+
+// dagVerifier tracks which of the blocks of a CAR are expected as the DAG is walked.
+type dagVerifier struct {
+	root   cid.Cid
+	blocks map[cid.Cid][]byte
+	// order are the blocks of the CAR in the order they first appear and seq is every block as it appears,
+	// including duplicates.
+	order []cid.Cid
+	seq   []cid.Cid
+	ls    ipld.LinkSystem
+	// path are the blocks resolvePath walked through, in order.
+	path []cid.Cid
+
+	expected map[cid.Cid]struct{}
+	missing  []cid.Cid
+	walked   map[cid.Cid]struct{}
+}
+
+func newDagVerifier(carBytes []byte) (*dagVerifier, error) {
+	br, err := car.NewBlockReader(bytes.NewReader(carBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(br.Roots) == 0 {
+		return nil, errors.New("car has no roots")
+	}
+
+	dv := &dagVerifier{
+		root:     br.Roots[0],
+		blocks:   make(map[cid.Cid][]byte),
+		expected: make(map[cid.Cid]struct{}),
+		walked:   make(map[cid.Cid]struct{}),
+	}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dv.blocks[blk.Cid()]; !ok {
+			dv.order = append(dv.order, blk.Cid())
+		}
+		dv.seq = append(dv.seq, blk.Cid())
+		dv.blocks[blk.Cid()] = blk.RawData()
+	}
+
+	dv.ls = cidlink.DefaultLinkSystem()
+	dv.ls.TrustedStorage = true
+	dv.ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		bz, ok := dv.blocks[l.(cidlink.Link).Cid]
+		if !ok {
+			return nil, fmt.Errorf("block %s not found", l)
+		}
+		return bytes.NewReader(bz), nil
+	}
+	return dv, nil
+}
+
+// expect marks the block as expected and reports whether it is present.
+func (dv *dagVerifier) expect(c cid.Cid) bool {
+	if _, ok := dv.expected[c]; ok {
+		_, present := dv.blocks[c]
+		return present
+	}
+	dv.expected[c] = struct{}{}
+	if _, ok := dv.blocks[c]; !ok {
+		dv.missing = append(dv.missing, c)
+		return false
+	}
+	return true
+}
+
+// loadPB loads a dag-pb block and its UnixFS data, which is nil if the block is not UnixFS.
+func (dv *dagVerifier) loadPB(c cid.Cid) (dagpb.PBNode, data.UnixFSData, error) {
+	n, err := dv.ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, nil, err
+	}
+	pbn := n.(dagpb.PBNode)
+	if !pbn.FieldData().Exists() {
+		return pbn, nil, nil
+	}
+	ufs, err := data.DecodeUnixFSData(pbn.FieldData().Must().Bytes())
+	if err != nil {
+		return pbn, nil, nil
+	}
+	return pbn, ufs, nil
+}
+
+// resolvePath walks the path segments from the root through plain UnixFS directories and returns the terminal
+// element. All blocks on the way are expected.
+func (dv *dagVerifier) resolvePath(segs []string) (cid.Cid, error) {
+	cur := dv.root
+	for _, seg := range segs {
+		dv.path = append(dv.path, cur)
+		if !dv.expect(cur) {
+			return cur, fmt.Errorf("path block %s is missing", cur)
+		}
+		if cur.Prefix().Codec != cid.DagProtobuf {
+			return cur, fmt.Errorf("can not resolve path segment %q in non dag-pb block %s", seg, cur)
+		}
+		pbn, ufs, err := dv.loadPB(cur)
+		if err != nil {
+			return cur, fmt.Errorf("failed to decode path block %s: %w", cur, err)
+		}
+		if ufs == nil || ufs.FieldDataType().Int() != data.Data_Directory {
+			return cur, fmt.Errorf("can not resolve path segment %q in %s: not a plain directory", seg, cur)
+		}
+
+		next, found := cid.Undef, false
+		itr := pbn.FieldLinks().Iterator()
+		for !itr.Done() {
+			_, l := itr.Next()
+			if l.FieldName().Exists() && l.FieldName().Must().String() == seg {
+				next, found = l.FieldHash().Link().(cidlink.Link).Cid, true
+				break
+			}
+		}
+		if !found {
+			return cur, fmt.Errorf("path segment %q not found in %s", seg, cur)
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// expectEntity expects the blocks needed to read the entity: the whole DAG of a file, the directory block
+// and its HAMT shard blocks for a directory and just the block for anything else.
+func (dv *dagVerifier) expectEntity(c cid.Cid) error {
+	if !dv.expect(c) || c.Prefix().Codec != cid.DagProtobuf {
+		return nil
+	}
+	pbn, ufs, err := dv.loadPB(c)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", c, err)
+	}
+	if ufs == nil {
+		return nil
+	}
+
+	switch ufs.FieldDataType().Int() {
+	case data.Data_File, data.Data_Raw:
+		return dv.expectAll(c)
+	case data.Data_HAMTShard:
+		// links to child shards are named with just the hex prefix; longer names are directory entries
+		prefixLen := 2
+		if ufs.FieldFanout().Exists() {
+			prefixLen = len(fmt.Sprintf("%X", ufs.FieldFanout().Must().Int()-1))
+		}
+		itr := pbn.FieldLinks().Iterator()
+		for !itr.Done() {
+			_, l := itr.Next()
+			if l.FieldName().Exists() && len(l.FieldName().Must().String()) == prefixLen {
+				if err := dv.expectEntity(l.FieldHash().Link().(cidlink.Link).Cid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// expectAll expects the whole DAG under c.
+func (dv *dagVerifier) expectAll(c cid.Cid) error {
+	if _, ok := dv.walked[c]; ok {
+		return nil
+	}
+	dv.walked[c] = struct{}{}
+	if !dv.expect(c) {
+		return nil
+	}
+
+	n, err := dv.ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	if err != nil {
+		return fmt.Errorf("failed to decode %s: %w", c, err)
+	}
+	links, err := traversal.SelectLinks(n)
+	if err != nil {
+		return fmt.Errorf("failed to select links of %s: %w", c, err)
+	}
+	for _, l := range links {
+		if err := dv.expectAll(l.(cidlink.Link).Cid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package onion
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DashboardOptions configures the Grafana dashboard generated by GrafanaDashboard.
+type DashboardOptions struct {
+	// Title and UID identify the dashboard in Grafana. They default to "Onion" and "onion".
+	Title string
+	UID   string
+	// Datasource is the UID of the Prometheus datasource that scrapes onion or the pushgateway. Defaults to
+	// "prometheus".
+	Datasource string
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaTarget struct {
+	Expr         string             `json:"expr"`
+	LegendFormat string             `json:"legendFormat"`
+	RefID        string             `json:"refId"`
+	Datasource   *grafanaDatasource `json:"datasource"`
+}
+
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	Description string                 `json:"description,omitempty"`
+	Datasource  *grafanaDatasource     `json:"datasource"`
+	GridPos     map[string]int         `json:"gridPos"`
+	FieldConfig map[string]interface{} `json:"fieldConfig"`
+	Targets     []grafanaTarget        `json:"targets"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Datasource *grafanaDatasource `json:"datasource"`
+	Query      string             `json:"query"`
+	Refresh    int                `json:"refresh"`
+	Multi      bool               `json:"multi"`
+	IncludeAll bool               `json:"includeAll"`
+	AllValue   string             `json:"allValue"`
+	Sort       int                `json:"sort"`
+}
+
+// GrafanaDashboard returns the JSON model of a Grafana dashboard of the metrics that onion exposes and pushes:
+// latency and response size percentiles, success and match rates, failures by error kind and response codes per
+// layer, filterable by layer and run ID. The queries use the names of the metrics as registered so that the
+// dashboard stays in sync with them.
+func GrafanaDashboard(opts DashboardOptions) ([]byte, error) {
+	if len(opts.Title) == 0 {
+		opts.Title = "Onion"
+	}
+	if len(opts.UID) == 0 {
+		opts.UID = "onion"
+	}
+	if len(opts.Datasource) == 0 {
+		opts.Datasource = "prometheus"
+	}
+	ds := &grafanaDatasource{Type: "prometheus", UID: opts.Datasource}
+
+	// metrics scraped from /metrics have no run_id label, which ".*" also matches
+	variable := func(name, label, metric string) grafanaVariable {
+		return grafanaVariable{
+			Name:       name,
+			Label:      label,
+			Type:       "query",
+			Datasource: ds,
+			Query:      fmt.Sprintf("label_values(%s, %s)", metric, name),
+			Refresh:    2,
+			Multi:      true,
+			IncludeAll: true,
+			AllValue:   ".*",
+			Sort:       1,
+		}
+	}
+	variables := []grafanaVariable{
+		variable("layer", "Layer", latencyHistogramName+"_bucket"),
+		variable("run_id", "Run ID", latencyHistogramName+"_bucket"),
+	}
+
+	const layerSel = `layer=~"$layer", run_id=~"$run_id"`
+	const runSel = `run_id=~"$run_id"`
+	quantiles := func(metric string) []grafanaTarget {
+		var out []grafanaTarget
+		for i, q := range []float64{0.5, 0.9, 0.99} {
+			out = append(out, grafanaTarget{
+				Expr:         fmt.Sprintf("histogram_quantile(%g, sum by (le, layer) (%s_bucket{%s}))", q, metric, layerSel),
+				LegendFormat: fmt.Sprintf("{{layer}} p%g", q*100),
+				RefID:        string(rune('A' + i)),
+			})
+		}
+		return out
+	}
+
+	type panelDef struct {
+		title       string
+		description string
+		panelType   string
+		unit        string
+		targets     []grafanaTarget
+	}
+	defs := []panelDef{
+		{
+			title:     "Latency percentiles",
+			panelType: "timeseries",
+			unit:      "s",
+			targets:   quantiles(latencyHistogramName),
+		},
+		{
+			title:     "Response size percentiles",
+			panelType: "timeseries",
+			unit:      "bytes",
+			targets:   quantiles(sizeHistogramName),
+		},
+		{
+			title:       "Success rate",
+			description: "Fraction of paths for which a layer returned a 2xx response that was read successfully",
+			panelType:   "timeseries",
+			unit:        "percentunit",
+			targets: []grafanaTarget{{
+				Expr:         fmt.Sprintf("%s{%s}", layerSuccessRatioName, layerSel),
+				LegendFormat: "{{layer}}",
+				RefID:        "A",
+			}},
+		},
+		{
+			title:       "Match rate",
+			description: "Fraction of paths for which a pair of layers returned the same status code or response bytes",
+			panelType:   "timeseries",
+			unit:        "percentunit",
+			targets: []grafanaTarget{{
+				Expr:         fmt.Sprintf("%s{%s}", pairMatchRatioName, runSel),
+				LegendFormat: "{{pair}} {{kind}}",
+				RefID:        "A",
+			}},
+		},
+		{
+			title:     "Failures by kind",
+			panelType: "timeseries",
+			unit:      "short",
+			targets: []grafanaTarget{{
+				Expr:         fmt.Sprintf("sum by (layer, kind) (%s{%s})", errorKindMetricName, layerSel),
+				LegendFormat: "{{layer}} {{kind}}",
+				RefID:        "A",
+			}},
+		},
+		{
+			title:     "Response codes",
+			panelType: "timeseries",
+			unit:      "short",
+			targets: []grafanaTarget{{
+				Expr:         fmt.Sprintf("sum by (layer, code) (%s{%s})", responseCodeName, layerSel),
+				LegendFormat: "{{layer}} {{code}}",
+				RefID:        "A",
+			}},
+		},
+	}
+
+	// panels are laid out two per row
+	panels := make([]grafanaPanel, 0, len(defs))
+	for i, d := range defs {
+		for j := range d.targets {
+			d.targets[j].Datasource = ds
+		}
+		panels = append(panels, grafanaPanel{
+			ID:          i + 1,
+			Type:        d.panelType,
+			Title:       d.title,
+			Description: d.description,
+			Datasource:  ds,
+			GridPos:     map[string]int{"h": 8, "w": 12, "x": (i % 2) * 12, "y": (i / 2) * 8},
+			FieldConfig: map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": d.unit},
+				"overrides": []interface{}{},
+			},
+			Targets: d.targets,
+		})
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         opts.Title,
+		"uid":           opts.UID,
+		"tags":          []string{"onion"},
+		"schemaVersion": 36,
+		"version":       1,
+		"editable":      true,
+		"refresh":       "1m",
+		"time":          map[string]string{"from": "now-7d", "to": "now"},
+		"templating":    map[string]interface{}{"list": variables},
+		"panels":        panels,
+	}
+	return json.MarshalIndent(dashboard, "", "  ")
+}
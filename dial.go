@@ -0,0 +1,69 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// parseResolve validates the DNS overrides of a component, which map a host, or a host and port, to the IP, or IP
+// and port, to connect to instead of resolving the host, like a hosts file entry.
+func parseResolve(name string, resolve map[string]string) (map[string]string, error) {
+	if len(resolve) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(resolve))
+	for host, addr := range resolve {
+		if len(host) == 0 || strings.ContainsAny(host, "/ ") {
+			return nil, fmt.Errorf("invalid %s resolve host: %q", name, host)
+		}
+		ip := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			ip = h
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid %s resolve address of %s: %q", name, host, addr)
+		}
+		out[strings.ToLower(host)] = addr
+	}
+	return out, nil
+}
+
+// resolveAddr returns the address to dial for the host and port of a request, which is overridden if the host and
+// port, or the host alone, is resolved to an IP by the component.
+func resolveAddr(resolve map[string]string, addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	to, ok := resolve[strings.ToLower(addr)]
+	if !ok {
+		if to, ok = resolve[strings.ToLower(host)]; !ok {
+			return addr
+		}
+	}
+	if _, _, err := net.SplitHostPort(to); err == nil {
+		return to
+	}
+	return net.JoinHostPort(to, port)
+}
+
+// resolveDialer returns a dial function that connects to the overridden addresses of the component, so that a
+// specific node can be requested with the URL, Host header and SNI of production.
+func resolveDialer(resolve map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return d.DialContext(ctx, network, resolveAddr(resolve, addr))
+	}
+}
+
+// clientKey is the key of the HTTP client of the component. Components that are queried over the same HTTP version
+// share a client and its connections, unless they override DNS resolution or SNI, which is specific to them.
+func (c Component) clientKey() string {
+	if len(c.Resolve) == 0 && len(c.SNI) == 0 {
+		return string(c.HTTPVersion)
+	}
+	return string(c.HTTPVersion) + "/" + c.Name
+}
@@ -0,0 +1,260 @@
+package onion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RunSnapshot is the outcome of a run as loaded from its results directory or a ResultStore, to be diffed with
+// another run.
+type RunSnapshot struct {
+	Results map[string]Results
+	// Mismatches maps a pair name and mismatch kind to the paths that mismatched.
+	Mismatches map[string]map[MismatchKind][]string
+}
+
+// LoadRun loads a run from its results directory, e.g. results/results-1.
+func LoadRun(dir string) (*RunSnapshot, error) {
+	s := &RunSnapshot{Mismatches: make(map[string]map[MismatchKind][]string)}
+	if err := readJSONF(filepath.Join(dir, "results.json"), &s.Results); err != nil {
+		return nil, err
+	}
+
+	var rr ResponseBytesMismatch
+	if err := readJSONF(filepath.Join(dir, "response_reads", "response-reads.json"), &rr); err != nil {
+		return nil, err
+	}
+	for pair, pm := range rr.Pairs {
+		var status []string
+		if err := readJSONF(filepath.Join(dir, fmt.Sprintf("%s-mismatch-paths.json", pair)), &status); err != nil {
+			return nil, err
+		}
+		s.Mismatches[pair] = map[MismatchKind][]string{
+			MismatchStatus:    status,
+			MismatchBytes:     pm.MismatchPaths,
+			MismatchHeaders:   pm.HeaderMismatchPaths,
+			MismatchRedirects: pm.RedirectMismatchPaths,
+		}
+		if pm.VerificationMismatches != nil {
+			s.Mismatches[pair][MismatchVerification] = pm.VerificationMismatchPaths
+		}
+	}
+	return s, nil
+}
+
+// LoadRun loads the run with the given ID from the store.
+func (s *ResultStore) LoadRun(runID string) (*RunSnapshot, error) {
+	out := &RunSnapshot{
+		Results:    make(map[string]Results),
+		Mismatches: make(map[string]map[MismatchKind][]string),
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(resultsBucket).ForEach(func(_, v []byte) error {
+			var rr RunResults
+			if err := json.Unmarshal(v, &rr); err != nil {
+				return err
+			}
+			if rr.RunID == runID {
+				out.Results[rr.Path] = rr.Results
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		return tx.Bucket(mismatchesBucket).ForEach(func(_, v []byte) error {
+			var mr MismatchRecord
+			if err := json.Unmarshal(v, &mr); err != nil {
+				return err
+			}
+			if mr.RunID != runID {
+				return nil
+			}
+			pair := Pair{A: Component{Name: mr.A}, B: Component{Name: mr.B}}.Name()
+			if out.Mismatches[pair] == nil {
+				out.Mismatches[pair] = make(map[MismatchKind][]string)
+			}
+			out.Mismatches[pair][mr.Kind] = append(out.Mismatches[pair][mr.Kind], mr.Path)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Results) == 0 {
+		return nil, fmt.Errorf("no results for run %s", runID)
+	}
+	return out, nil
+}
+
+// RunDiff is how a run differs from an earlier run.
+type RunDiff struct {
+	// Paths is the number of paths requested in both runs. Only those paths are diffed.
+	Paths int
+	// Pairs is keyed by pair name.
+	Pairs map[string]*PairDiff
+	// Latency is keyed by component name.
+	Latency map[string]LatencyDelta
+	// Changed are the paths for which a component returned different content in the two runs, keyed by component
+	// name. Only paths whose responses were read successfully in both runs and have digests are compared.
+	Changed map[string][]string
+}
+
+// PairDiff lists the paths whose mismatches between the two components of a pair changed, keyed by mismatch kind.
+type PairDiff struct {
+	// New are the paths that mismatch in the later run but did not in the earlier run.
+	New map[MismatchKind][]string
+	// Fixed are the paths that mismatched in the earlier run but do not in the later run.
+	Fixed map[MismatchKind][]string
+}
+
+// LatencyDelta compares the latencies of a component in two runs. The deltas are positive if the later run was
+// slower.
+type LatencyDelta struct {
+	Before LatencyStats
+	After  LatencyStats
+
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+// DiffRuns reports the paths that newly mismatch or were fixed in the later run, the paths for which a component
+// returned different content and the latency deltas of every component between the runs, e.g. to track regressions
+// across deployments.
+func DiffRuns(before, after *RunSnapshot) *RunDiff {
+	common := make(map[string]Results)
+	for path, rs := range after.Results {
+		if _, ok := before.Results[path]; ok {
+			common[path] = rs
+		}
+	}
+
+	d := &RunDiff{
+		Paths:   len(common),
+		Pairs:   make(map[string]*PairDiff),
+		Latency: make(map[string]LatencyDelta),
+		Changed: make(map[string][]string),
+	}
+
+	pairs := make(map[string]struct{})
+	for pair := range before.Mismatches {
+		pairs[pair] = struct{}{}
+	}
+	for pair := range after.Mismatches {
+		pairs[pair] = struct{}{}
+	}
+	for pair := range pairs {
+		pd := &PairDiff{New: make(map[MismatchKind][]string), Fixed: make(map[MismatchKind][]string)}
+		for _, kind := range []MismatchKind{MismatchStatus, MismatchBytes, MismatchHeaders, MismatchRedirects, MismatchVerification} {
+			b := pathSet(before.Mismatches[pair][kind])
+			a := pathSet(after.Mismatches[pair][kind])
+			for path := range common {
+				_, inB := b[path]
+				_, inA := a[path]
+				switch {
+				case inA && !inB:
+					pd.New[kind] = append(pd.New[kind], path)
+				case inB && !inA:
+					pd.Fixed[kind] = append(pd.Fixed[kind], path)
+				}
+			}
+			sort.Strings(pd.New[kind])
+			sort.Strings(pd.Fixed[kind])
+		}
+		d.Pairs[pair] = pd
+	}
+
+	// only compare latencies over the common paths so that different samples do not skew the deltas
+	beforeCommon := make(map[string]Results, len(common))
+	for path := range common {
+		beforeCommon[path] = before.Results[path]
+	}
+	components := componentNames(common)
+	lb := componentLatencyStats(components, beforeCommon)
+	la := componentLatencyStats(components, common)
+	for _, c := range components {
+		d.Latency[c.Name] = LatencyDelta{
+			Before: lb[c.Name],
+			After:  la[c.Name],
+			P50:    la[c.Name].P50 - lb[c.Name].P50,
+			P90:    la[c.Name].P90 - lb[c.Name].P90,
+			P99:    la[c.Name].P99 - lb[c.Name].P99,
+		}
+	}
+
+	for path, rs := range common {
+		for name, a := range rs {
+			b := before.Results[path][name]
+			if a == nil || b == nil || !isReadOK(a) || !isReadOK(b) {
+				continue
+			}
+			if da, db := contentDigest(a, b), contentDigest(b, a); len(da) != 0 && len(db) != 0 && da != db {
+				d.Changed[name] = append(d.Changed[name], path)
+			}
+		}
+	}
+	for _, paths := range d.Changed {
+		sort.Strings(paths)
+	}
+	return d
+}
+
+// contentDigest returns the digest of the file bytes of the result if both results have one, as CARs with the
+// same file bytes may differ in block order, and otherwise the digest of the response body.
+func contentDigest(r, other *Result) string {
+	if len(r.RawDigest) != 0 && len(other.RawDigest) != 0 {
+		return r.RawDigest
+	}
+	return r.ResponseDigest
+}
+
+// componentNames returns the components that have results, sorted by name.
+func componentNames(results map[string]Results) []Component {
+	seen := make(map[string]struct{})
+	for _, rs := range results {
+		for name := range rs {
+			seen[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]Component, 0, len(names))
+	for _, name := range names {
+		out = append(out, Component{Name: name})
+	}
+	return out
+}
+
+func pathSet(paths []string) map[string]struct{} {
+	out := make(map[string]struct{}, len(paths))
+	for _, p := range paths {
+		out[p] = struct{}{}
+	}
+	return out
+}
+
+func readJSONF(filename string, v interface{}) error {
+	bz, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s not found; is it a results directory?", filename)
+	}
+	if err != nil {
+		return err
+	}
+	if err := UnmarshalReport(bz, v); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package onion
+
+import "encoding/hex"
+
+// divergenceContext is the number of bytes dumped around the first divergence of two mismatching responses.
+var divergenceContext = 64
+
+// Divergence locates where two mismatching responses first differ, so that a truncated tail can be told apart
+// from a differing header or corruption in the middle of the stream.
+type Divergence struct {
+	// Compared is what was compared: the response "body" or the "file" bytes extracted from it.
+	Compared string
+	// Offset is the index of the first byte that differs. If one response is a prefix of the other, it is the
+	// size of the shorter one.
+	Offset int
+	SizeA  int
+	SizeB  int
+
+	// DumpStart is the offset of the first dumped byte; the offsets in the dumps are relative to it.
+	DumpStart int
+	DumpA     string
+	DumpB     string
+}
+
+// FirstDivergence returns the index of the first byte at which a and b differ, or -1 if they are equal.
+func FirstDivergence(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) == len(b) {
+		return -1
+	}
+	return n
+}
+
+// newDivergence returns the divergence of a and b, or nil if they are equal.
+func newDivergence(a, b []byte, compared string) *Divergence {
+	off := FirstDivergence(a, b)
+	if off < 0 {
+		return nil
+	}
+
+	start := off - divergenceContext/2
+	if start < 0 {
+		start = 0
+	}
+	window := func(bz []byte) string {
+		if start >= len(bz) {
+			return ""
+		}
+		end := start + divergenceContext
+		if end > len(bz) {
+			end = len(bz)
+		}
+		return hex.Dump(bz[start:end])
+	}
+
+	return &Divergence{
+		Compared:  compared,
+		Offset:    off,
+		SizeA:     len(a),
+		SizeB:     len(b),
+		DumpStart: start,
+		DumpA:     window(a),
+		DumpB:     window(b),
+	}
+}
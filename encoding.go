@@ -0,0 +1,220 @@
+package onion
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// acceptCompressed is the Accept-Encoding of the requests whose compressed responses are compared with the identity
+// responses.
+const acceptCompressed = "gzip, deflate"
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// EncodingAnomalyKind is the class of a difference between the identity and compressed responses of a component.
+type EncodingAnomalyKind string
+
+const (
+	// EncodingMismatch is when the decompressed response differs from the identity response.
+	EncodingMismatch EncodingAnomalyKind = "mismatch"
+	// EncodingFailure is when the identity response was read successfully but the compressed response was not,
+	// e.g. because it could not be decompressed.
+	EncodingFailure EncodingAnomalyKind = "failure"
+	// EncodingIgnored is when the identity response is compressed although the request only accepted identity.
+	EncodingIgnored EncodingAnomalyKind = "identity-ignored"
+)
+
+// EncodingAnomalyKinds are all the kinds of encoding anomalies.
+var EncodingAnomalyKinds = []EncodingAnomalyKind{EncodingMismatch, EncodingFailure, EncodingIgnored}
+
+// EncodingAnomaly is a difference between the identity and compressed responses of a component for a path.
+type EncodingAnomaly struct {
+	Kind       EncodingAnomalyKind
+	Identity   *Result
+	Compressed *Result
+	// Divergence is where the responses first differ for mismatches, if their bodies were captured.
+	Divergence *Divergence `json:",omitempty"`
+}
+
+// EncodingReads records the comparison of the identity and compressed responses of a single component.
+type EncodingReads struct {
+	TotalMatches int
+
+	Anomalies map[string]*EncodingAnomaly
+	// AnomalyPaths is keyed by the kind of anomaly.
+	AnomalyPaths map[EncodingAnomalyKind][]string
+	// Encodings counts the Content-Encoding of the compressed responses, or "identity" if they were not compressed,
+	// keyed by their Content-Type.
+	Encodings map[string]map[string]int
+}
+
+func newEncodingReads() *EncodingReads {
+	return &EncodingReads{
+		Anomalies:    make(map[string]*EncodingAnomaly),
+		AnomalyPaths: make(map[EncodingAnomalyKind][]string),
+		Encodings:    make(map[string]map[string]int),
+	}
+}
+
+// Inconsistent returns the content types that the component compressed for some responses but not for others.
+func (er *EncodingReads) Inconsistent() []string {
+	var out []string
+	for ct, encodings := range er.Encodings {
+		if _, ok := encodings["identity"]; ok && len(encodings) > 1 {
+			out = append(out, ct)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// compressedName is the name under which the compressed results of a component are recorded.
+func compressedName(c Component) string {
+	return c.Name + ":compressed"
+}
+
+// withAcceptEncoding returns the URLs to test with the Accept-Encoding header of the component set.
+func withAcceptEncoding(c Component, urls URLsToTest, encoding string) URLsToTest {
+	return withRequestHeader(c, urls, "Accept-Encoding", encoding)
+}
+
+// withRequestHeader returns the URLs to test with the header of the request to the component set, leaving the
+// headers of urls untouched.
+func withRequestHeader(c Component, urls URLsToTest, key, value string) URLsToTest {
+	out := make(map[string]http.Header, len(urls.Headers)+1)
+	for name, h := range urls.Headers {
+		out[name] = h
+	}
+	h := urls.Headers[c.Name].Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	h.Set(key, value)
+	out[c.Name] = h
+	urls.Headers = out
+	return urls
+}
+
+// decodeBody decompresses the body as per its Content-Encoding. Bodies that the client already decompressed, or
+// that are not compressed, are returned as is.
+func decodeBody(body io.Reader, resp *http.Response) (io.Reader, error) {
+	if resp.Uncompressed {
+		return body, nil
+	}
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but some servers send raw deflate
+		br := bufio.NewReader(body)
+		if h, err := br.Peek(2); err == nil && h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// contentEncoding returns the encoding of the response, including responses that the client decompressed.
+func contentEncoding(resp *http.Response) string {
+	if resp.Uncompressed {
+		return "gzip"
+	}
+	return resp.Header.Get("Content-Encoding")
+}
+
+// compareEncoding compares the identity and compressed responses of the component. ok is false if the identity
+// response could not be read, in which case there is nothing to compare the compressed response with.
+func (pc *pathComparer) compareEncoding(c Component) (anomaly *EncodingAnomaly, ok bool) {
+	identity, compressed := pc.rs[c.Name], pc.rs[compressedName(c)]
+	if identity == nil || compressed == nil || !isReadOK(identity) {
+		return nil, false
+	}
+
+	a := &EncodingAnomaly{Identity: identity, Compressed: compressed}
+	switch {
+	case len(identity.ContentEncoding) != 0 && !strings.EqualFold(identity.ContentEncoding, "identity"):
+		a.Kind = EncodingIgnored
+	case !isReadOK(compressed):
+		a.Kind = EncodingFailure
+	case pc.streamed && identity.ResponseDigest != compressed.ResponseDigest:
+		a.Kind = EncodingMismatch
+	case !pc.streamed && !bytes.Equal(pc.bodies[c.Name], pc.bodies[compressedName(c)]):
+		a.Kind = EncodingMismatch
+		a.Divergence = newDivergence(pc.bodies[c.Name], pc.bodies[compressedName(c)], "body")
+	default:
+		return nil, true
+	}
+	return a, true
+}
+
+// recordEncoding records the encoding of the compressed response of the component by its content type.
+func (er *EncodingReads) recordEncoding(compressed *Result) {
+	if compressed == nil || !isSuccess(compressed.StatusCode) {
+		return
+	}
+	ct := http.Header(compressed.Headers).Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = mt
+	}
+	encoding := strings.ToLower(compressed.ContentEncoding)
+	if len(encoding) == 0 {
+		encoding = "identity"
+	}
+	if er.Encodings[ct] == nil {
+		er.Encodings[ct] = make(map[string]int)
+	}
+	er.Encodings[ct][encoding]++
+}
+
+// encodingComponents returns the components whose identity and compressed responses are compared. Golden
+// components serve recorded responses and are not compared.
+func (re *RequestExecutor) encodingComponents() []Component {
+	if !re.opts.CompareEncoding {
+		return nil
+	}
+	var out []Component
+	for _, c := range re.components {
+		if c.Golden == nil {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// writeEncodingAnomalies writes the encoding anomalies of every component and prints a summary. The caller must
+// hold the lock.
+func (re *RequestExecutor) writeEncodingAnomalies() {
+	cs := re.encodingComponents()
+	if len(cs) == 0 {
+		return
+	}
+
+	fmt.Println("\n ----------SUMMARY OF CONTENT ENCODING --------------")
+	for _, c := range cs {
+		er := re.responseReads.Encodings[c.Name]
+		re.writeJSON(er.Anomalies, re.rrFile(fmt.Sprintf("%s-encoding-anomalies.json", c.Name)))
+
+		fmt.Printf("\n Run-%d; %s decompressed responses matching identity responses: %d", re.n, c.Name, er.TotalMatches)
+		for _, kind := range EncodingAnomalyKinds {
+			fmt.Printf("\n Run-%d; %s encoding %s: %d", re.n, c.Name, kind, len(er.AnomalyPaths[kind]))
+		}
+		if inconsistent := er.Inconsistent(); len(inconsistent) != 0 {
+			fmt.Printf("\n Run-%d; %s compresses only some responses of: %s", re.n, c.Name, strings.Join(inconsistent, ", "))
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,120 @@
+package onion
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ErrorKind is the class of failure of a request, so that failures can be aggregated across paths.
+type ErrorKind string
+
+const (
+	// ErrorDNS is a failure to resolve the host of the component.
+	ErrorDNS ErrorKind = "dns"
+	// ErrorConnRefused is a connection refused by the component.
+	ErrorConnRefused ErrorKind = "conn-refused"
+	// ErrorTLS is a failed TLS handshake, e.g. because of an invalid certificate.
+	ErrorTLS ErrorKind = "tls"
+	// ErrorTimeout is a request that timed out, before or while the response body was read.
+	ErrorTimeout ErrorKind = "timeout"
+	// ErrorResetMidBody is a connection that was reset or closed before the whole response body was read.
+	ErrorResetMidBody ErrorKind = "reset-mid-body"
+	// ErrorTruncated is a response body that ended before its Content-Length was read, a chunked response body that
+	// ended without its final chunk or a CAR whose last block is cut off.
+	ErrorTruncated ErrorKind = "truncated"
+	// ErrorNon2xx is a response whose status code is neither 200 nor 206.
+	ErrorNon2xx ErrorKind = "non-2xx"
+	// ErrorThrottled is a rate limit response, a 429 or a 503 with a Retry-After header, that was still throttled
+	// after all retries. Throttled responses are not counted as status mismatches.
+	ErrorThrottled ErrorKind = "throttled"
+	// ErrorDecode is a response body that failed verification, e.g. a CAR that could not be decoded or that has
+	// corrupt blocks, or that could not be decompressed.
+	ErrorDecode ErrorKind = "decode"
+	// ErrorOther is any other failure.
+	ErrorOther ErrorKind = "other"
+)
+
+// errorKind returns the class of the error of a request. midBody is true if the error occurred while the response
+// body was read.
+func errorKind(err error, midBody bool) ErrorKind {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var certErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	var corruptErr flate.CorruptInputError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnRefused
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &certErr),
+		errors.As(err, &hostnameErr), strings.Contains(err.Error(), "tls: "):
+		return ErrorTLS
+	case errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum), errors.Is(err, zlib.ErrHeader),
+		errors.Is(err, zlib.ErrChecksum), errors.As(err, &corruptErr), errors.Is(err, errUnsupportedEncoding):
+		return ErrorDecode
+	case midBody && (errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, net.ErrClosed)):
+		return ErrorResetMidBody
+	}
+	return ErrorOther
+}
+
+// ErrorKinds counts the failed requests to every component by kind, keyed by component name. Requests that are
+// still failing after all retries are counted once.
+func ErrorKinds(results map[string]Results) map[string]map[ErrorKind]int {
+	out := make(map[string]map[ErrorKind]int)
+	for _, rs := range results {
+		for name, r := range rs {
+			if len(r.ErrorKind) == 0 {
+				continue
+			}
+			if out[name] == nil {
+				out[name] = make(map[ErrorKind]int)
+			}
+			out[name][r.ErrorKind]++
+		}
+	}
+	return out
+}
+
+// writeErrorKinds writes the number of failed requests to every component by kind and prints a summary. The caller
+// must hold the lock.
+func (re *RequestExecutor) writeErrorKinds() {
+	kinds := ErrorKinds(re.results)
+	re.writeJSON(kinds, re.rrFile("error-kinds.json"))
+
+	fmt.Println("\n ----------SUMMARY OF ERRORS BY KIND --------------")
+	for _, c := range re.components {
+		byKind := kinds[c.Name]
+		names := make([]string, 0, len(byKind))
+		for kind := range byKind {
+			names = append(names, string(kind))
+		}
+		sort.Strings(names)
+		var counts []string
+		for _, kind := range names {
+			counts = append(counts, fmt.Sprintf("%s=%d", kind, byKind[ErrorKind(kind)]))
+		}
+		fmt.Printf("\n Run-%d; %s failed requests: %s", re.n, c.Name, strings.Join(counts, " "))
+	}
+	fmt.Println()
+}
@@ -5,71 +5,586 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+
 	cid "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
 	"github.com/ipfs/go-unixfsnode/file"
+	car "github.com/ipld/go-car/v2"
 	"github.com/ipld/go-car/v2/blockstore"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	ipldmulticodec "github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
 	"github.com/ipld/go-ipld-prime/storage/bsadapter"
-	"io"
+	"github.com/multiformats/go-multicodec"
 )
 
-func ExtractRaw(carBytes []byte) (response []byte, err error) {
-	cr := bytes.NewReader(carBytes)
-	bs, err := blockstore.NewReadOnly(cr, nil)
+// ExtractTimeoutError is returned when the extraction of a CAR is cancelled or does not finish before the deadline
+// of its context, e.g. because the CAR holds a pathological DAG.
+type ExtractTimeoutError struct {
+	// Root is the root CID of the CAR.
+	Root cid.Cid
+	// Err is the error of the context, e.g. context.DeadlineExceeded.
+	Err error
+}
+
+func (e *ExtractTimeoutError) Error() string {
+	return fmt.Sprintf("extraction of car rooted at %s did not finish: %s", e.Root, e.Err)
+}
+
+func (e *ExtractTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// extractError returns an ExtractTimeoutError if the context is done, as the error is then caused by the context
+// no matter where the extraction was interrupted.
+func extractError(ctx context.Context, root cid.Cid, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return &ExtractTimeoutError{Root: root, Err: ctx.Err()}
+	}
+	return err
+}
+
+// withContext makes the loads of the link system fail once the context is done, so that traversing a DAG stops at
+// the deadline of the context however many blocks it links to.
+func withContext(ctx context.Context, ls *ipld.LinkSystem) {
+	open := ls.StorageReadOpener
+	ls.StorageReadOpener = func(lctx ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return open(lctx, l)
+	}
+}
+
+// ctxReader is a reader that fails once its context is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// ExtractRaw extracts the file bytes of the UnixFS file, or the canonical encoding of the dag-cbor or dag-json node,
+// rooted at the CAR root. It returns an ExtractTimeoutError if the extraction does not finish before the deadline of
+// the context.
+func ExtractRaw(ctx context.Context, carBytes []byte) (response []byte, err error) {
+	return ExtractRawPath(ctx, carBytes, "", nil)
+}
+
+// ExtractRawPath extracts the entity at the subpath of the CAR root, e.g. "/dir/file.png" for a request for
+// /ipfs/{cid}/dir/file.png, as a path gateway would return it. The subpath is traversed by name through UnixFS
+// directories, including HAMT sharded ones, and through the fields of dag-cbor and dag-json nodes, so the CAR only
+// needs to contain the blocks on the way and those of the entity. If rng is set, only that byte range of the entity
+// is extracted. It returns an ExtractTimeoutError if the extraction does not finish before the deadline of the
+// context.
+func ExtractRawPath(ctx context.Context, carBytes []byte, subpath string, rng *ByteRange) ([]byte, error) {
+	bs, err := blockstore.NewReadOnly(bytes.NewReader(carBytes), nil)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return extractRawPath(ctx, bs, subpath, rng)
+}
+
+// ExtractRawPathOnDisk is ExtractRawPath for CARs too large to be indexed in memory, e.g. multi-GB responses: the
+// CAR is written to a temporary CARv2 file with an index in dir, or in os.TempDir() if dir is empty, whose blocks are
+// read from the file as they are traversed. The file is removed once the entity is extracted.
+func ExtractRawPathOnDisk(ctx context.Context, carBytes []byte, dir, subpath string, rng *ByteRange) ([]byte, error) {
+	f, err := os.CreateTemp(dir, "onion-extract-*.car")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create car file to extract: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	// CARv1s are wrapped as CARv2s with an index so that their blocks need not be indexed in memory
+	if v, verr := car.ReadVersion(bytes.NewReader(carBytes)); verr == nil && v == 1 {
+		err = car.WrapV1(bytes.NewReader(carBytes), f)
+	} else {
+		_, err = f.Write(carBytes)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write car file to extract: %w", err)
+	}
+
+	bs, err := blockstore.OpenReadOnly(f.Name())
+	if err != nil {
+		return nil, err
 	}
+	defer bs.Close()
+	return extractRawPath(ctx, bs, subpath, rng)
+}
+
+// extractRawPath extracts the entity at the subpath of the root of the CAR of the blockstore.
+func extractRawPath(ctx context.Context, bs *blockstore.ReadOnly, subpath string, rng *ByteRange) ([]byte, error) {
 	roots, err := bs.Roots()
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("car has no roots")
 	}
 
-	bsa := &bsadapter.Adapter{Wrapped: bs}
 	ls := cidlink.DefaultLinkSystem()
 	ls.TrustedStorage = true
-	ls.SetReadStorage(bsa)
+	ls.SetReadStorage(&bsadapter.Adapter{Wrapped: bs})
+	withContext(ctx, &ls)
 
-	if roots[0].Prefix().Codec == cid.Raw {
-		blk, err := bs.Get(context.Background(), roots[0])
+	target, err := resolveSubpath(ctx, &ls, roots[0], subpath)
+	if err != nil {
+		return nil, extractError(ctx, roots[0], err)
+	}
+	if target.Prefix().Codec == cid.Raw {
+		blk, err := bs.Get(ctx, target)
 		if err != nil {
-			panic(err)
+			return nil, extractError(ctx, roots[0], err)
+		}
+		if rng != nil {
+			return rng.Slice(blk.RawData()), nil
 		}
 		return blk.RawData(), nil
 	}
 
-	return extractRoot(&ls, roots[0])
+	var bz []byte
+	if rng != nil {
+		bz, err = extractRange(ctx, &ls, target, *rng)
+	} else {
+		bz, err = extractRoot(ctx, &ls, target)
+	}
+	return bz, extractError(ctx, roots[0], err)
 }
 
-func extractRoot(ls *ipld.LinkSystem, root cid.Cid) (response []byte, err error) {
-	if root.Prefix().Codec == cid.Raw {
+// resolveSubpath returns the CID of the block that the subpath of the root resolves to. Segments that name a field
+// within a dag-cbor or dag-json node rather than a link are traversed within the node, but the subpath must end at
+// a link.
+func resolveSubpath(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, subpath string) (cid.Cid, error) {
+	subpath = strings.Trim(subpath, "/")
+	if len(subpath) == 0 {
+		return root, nil
+	}
+
+	c := root
+	var node ipld.Node
+	segments := strings.Split(subpath, "/")
+	for i, name := range segments {
+		if node == nil {
+			var err error
+			if node, err = loadPathNode(ctx, ls, c); err != nil {
+				return cid.Undef, err
+			}
+		}
+		child, err := node.LookupByString(name)
+		if err != nil {
+			return cid.Undef, fmt.Errorf("failed to resolve /%s: %w", strings.Join(segments[:i+1], "/"), err)
+		}
+		if child.Kind() != datamodel.Kind_Link {
+			node = child
+			continue
+		}
+		l, err := child.AsLink()
+		if err != nil {
+			return cid.Undef, err
+		}
+		cl, ok := l.(cidlink.Link)
+		if !ok {
+			return cid.Undef, fmt.Errorf("failed to resolve /%s: unsupported link %s", strings.Join(segments[:i+1], "/"), l)
+		}
+		c, node = cl.Cid, nil
+	}
+	if node != nil {
+		return cid.Undef, fmt.Errorf("/%s resolves to a value within %s rather than to a block", subpath, c)
+	}
+	return c, nil
+}
+
+// loadPathNode loads the node of a block that a subpath is traversed through: the UnixFS directory of a dag-pb
+// block, or the dag-cbor or dag-json node.
+func loadPathNode(ctx context.Context, ls *ipld.LinkSystem, c cid.Cid) (ipld.Node, error) {
+	lctx := ipld.LinkContext{Ctx: ctx}
+	switch codec := c.Prefix().Codec; {
+	case isDAGCodec(codec):
+		return ls.Load(lctx, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	case codec == cid.DagProtobuf:
+		pbn, err := ls.Load(lctx, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+		if err != nil {
+			return nil, err
+		}
+		pbnode := pbn.(dagpb.PBNode)
+		if !pbnode.FieldData().Exists() {
+			return nil, fmt.Errorf("%s is not a unixfs directory", c)
+		}
+		ufsData, err := data.DecodeUnixFSData(pbnode.FieldData().Must().Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if dt := ufsData.FieldDataType().Int(); dt != data.Data_Directory && dt != data.Data_HAMTShard {
+			return nil, fmt.Errorf("%s is a unixfs %s, not a directory", c, data.DataTypeNames[dt])
+		}
+		return unixfsnode.Reify(lctx, pbnode, ls)
+	default:
+		return nil, fmt.Errorf("can not traverse %s node %s", multicodec.Code(codec), c)
+	}
+}
+
+func extractRoot(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid) (response []byte, err error) {
+	switch codec := root.Prefix().Codec; codec {
+	case cid.Raw:
 		return nil, errors.New("raw cid not supported")
+	case cid.DagCBOR, cid.DagJSON:
+		return extractDAGRoot(ctx, ls, root)
+	case cid.DagProtobuf:
+	default:
+		return nil, fmt.Errorf("unsupported root codec %s", multicodec.Code(codec))
 	}
 
-	pbn, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	pbn, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	pbnode := pbn.(dagpb.PBNode)
 
-	node, err := file.NewUnixFSFileWithPreload(context.Background(), pbnode, ls)
+	node, err := file.NewUnixFSFileWithPreload(ctx, pbnode, ls)
 	if err != nil {
-		fmt.Print("return 1 bye")
 		return nil, err
 	}
 	nlr, err := node.AsLargeBytes()
 	if err != nil {
-		fmt.Print("return 2")
 		return nil, err
 	}
 
 	resp := bytes.NewBuffer(nil)
 
-	_, err = io.Copy(resp, nlr)
+	_, err = io.Copy(resp, ctxReader{ctx: ctx, r: nlr})
 	if err != nil {
-		fmt.Print("return 3")
 		return nil, err
 	}
 	return resp.Bytes(), nil
 }
+
+// extractDAGRoot returns the canonical encoding of the dag-cbor or dag-json root node, which is what a gateway
+// returns for the root without a format. Only the root node is extracted; its links are not followed.
+func extractDAGRoot(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid) ([]byte, error) {
+	data, err := ls.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root})
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalizeDAG(data, root.Prefix().Codec, root.Prefix().Codec)
+}
+
+// isDAGCodec reports whether the codec is dag-cbor or dag-json, whose nodes are compared in their canonical
+// encoding rather than as UnixFS files.
+func isDAGCodec(codec uint64) bool {
+	return codec == cid.DagCBOR || codec == cid.DagJSON
+}
+
+// dagCodecOf returns the codec of a dag-cbor or dag-json response from its Content-Type, or 0 if the Content-Type
+// is not one of them.
+func dagCodecOf(contentType string) uint64 {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch mt {
+	case "application/vnd.ipld.dag-cbor", "application/cbor":
+		return cid.DagCBOR
+	case "application/vnd.ipld.dag-json", "application/json":
+		return cid.DagJSON
+	}
+	return 0
+}
+
+// CanonicalizeDAG decodes data of the from codec, e.g. dag-json, and encodes it in the canonical form of the to
+// codec, e.g. dag-cbor with sorted map keys, so that nodes can be compared byte for byte no matter how they were
+// encoded. Both codecs must be registered IPLD codecs.
+func CanonicalizeDAG(data []byte, from, to uint64) ([]byte, error) {
+	decode, err := ipldmulticodec.LookupDecoder(from)
+	if err != nil {
+		return nil, err
+	}
+	encode, err := ipldmulticodec.LookupEncoder(to)
+	if err != nil {
+		return nil, err
+	}
+
+	nb := basicnode.Prototype.Any.NewBuilder()
+	if err := decode(nb, bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("failed to decode %s node: %w", multicodec.Code(from), err)
+	}
+	var buf bytes.Buffer
+	if err := encode(nb.Build(), &buf); err != nil {
+		return nil, fmt.Errorf("failed to encode %s node: %w", multicodec.Code(to), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// errNotStreamable is returned by StreamExtractRaw when the CAR can not be extracted in a single pass.
+var errNotStreamable = errors.New("car is not streamable")
+
+// StreamExtractRaw extracts the UnixFS file rooted at the CAR root to w in a single pass over r without buffering
+// the CAR. This only works for CARs whose blocks are in DFS order without duplicates being omitted; any other CAR
+// results in an error wrapping errNotStreamable and the caller should fall back to ExtractRaw.
+func StreamExtractRaw(r io.Reader, w io.Writer) error {
+	return StreamExtractRawPath(r, w, "")
+}
+
+// StreamExtractRawPath extracts the UnixFS file at the subpath of the CAR root like StreamExtractRaw. The blocks of
+// the directories on the way must precede those of the file, and only basic UnixFS directories can be traversed;
+// subpaths through HAMT sharded directories or dag-cbor and dag-json nodes result in an error wrapping
+// errNotStreamable, and the caller should fall back to ExtractRawPath.
+func StreamExtractRawPath(r io.Reader, w io.Writer, subpath string) error {
+	var segments []string
+	if subpath = strings.Trim(subpath, "/"); len(subpath) != 0 {
+		segments = strings.Split(subpath, "/")
+	}
+	br, err := car.NewBlockReader(r)
+	if err != nil {
+		return err
+	}
+	if len(br.Roots) == 0 {
+		return fmt.Errorf("%w: no roots", errNotStreamable)
+	}
+
+	// blocks we still expect to see, in DFS order with the next one at the end
+	expected := []cid.Cid{br.Roots[0]}
+	// target is the root of the entity at the subpath
+	target := br.Roots[0]
+	for len(expected) > 0 {
+		blk, err := br.Next()
+		if err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: car ended with %d blocks missing", errNotStreamable, len(expected))
+			}
+			return err
+		}
+
+		next := expected[len(expected)-1]
+		expected = expected[:len(expected)-1]
+		if !blk.Cid().Equals(next) {
+			return fmt.Errorf("%w: expected block %s, got %s", errNotStreamable, next, blk.Cid())
+		}
+
+		if len(segments) != 0 {
+			next, err := streamDirectoryLink(blk.Cid(), blk.RawData(), segments[0])
+			if err != nil {
+				return err
+			}
+			segments = segments[1:]
+			expected = append(expected, next)
+			target = next
+			continue
+		}
+
+		switch codec := blk.Cid().Prefix().Codec; {
+		case isDAGCodec(codec) && blk.Cid().Equals(target):
+			// only the root node of dag-cbor and dag-json entities is extracted
+			bz, err := CanonicalizeDAG(blk.RawData(), codec, codec)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(bz)
+			return err
+		case codec == cid.Raw:
+			if _, err := w.Write(blk.RawData()); err != nil {
+				return err
+			}
+		case codec == cid.DagProtobuf:
+			nb := dagpb.Type.PBNode.NewBuilder()
+			if err := dagpb.DecodeBytes(nb, blk.RawData()); err != nil {
+				return err
+			}
+			pbnode := nb.Build().(dagpb.PBNode)
+
+			if pbnode.FieldData().Exists() {
+				ufsData, err := data.DecodeUnixFSData(pbnode.FieldData().Must().Bytes())
+				if err != nil {
+					return err
+				}
+				dt := ufsData.FieldDataType().Int()
+				if dt != data.Data_File && dt != data.Data_Raw {
+					return fmt.Errorf("%w: unsupported unixfs type %s", errNotStreamable, data.DataTypeNames[dt])
+				}
+				if ufsData.FieldData().Exists() {
+					if _, err := w.Write(ufsData.FieldData().Must().Bytes()); err != nil {
+						return err
+					}
+				}
+			}
+
+			// push links in reverse so that the first link is visited next
+			links := pbnode.FieldLinks()
+			var lcids []cid.Cid
+			itr := links.Iterator()
+			for !itr.Done() {
+				_, l := itr.Next()
+				lcids = append(lcids, l.FieldHash().Link().(cidlink.Link).Cid)
+			}
+			for i := len(lcids) - 1; i >= 0; i-- {
+				expected = append(expected, lcids[i])
+			}
+		default:
+			return fmt.Errorf("%w: unsupported codec %d", errNotStreamable, blk.Cid().Prefix().Codec)
+		}
+	}
+
+	return nil
+}
+
+// streamDirectoryLink returns the CID of the entry of the basic UnixFS directory block that is named name.
+func streamDirectoryLink(c cid.Cid, block []byte, name string) (cid.Cid, error) {
+	if c.Prefix().Codec != cid.DagProtobuf {
+		return cid.Undef, fmt.Errorf("%w: can not traverse %s node %s", errNotStreamable, multicodec.Code(c.Prefix().Codec), c)
+	}
+	nb := dagpb.Type.PBNode.NewBuilder()
+	if err := dagpb.DecodeBytes(nb, block); err != nil {
+		return cid.Undef, err
+	}
+	pbnode := nb.Build().(dagpb.PBNode)
+	if !pbnode.FieldData().Exists() {
+		return cid.Undef, fmt.Errorf("%w: %s is not a unixfs directory", errNotStreamable, c)
+	}
+	ufsData, err := data.DecodeUnixFSData(pbnode.FieldData().Must().Bytes())
+	if err != nil {
+		return cid.Undef, err
+	}
+	if dt := ufsData.FieldDataType().Int(); dt != data.Data_Directory {
+		return cid.Undef, fmt.Errorf("%w: can not traverse unixfs %s %s", errNotStreamable, data.DataTypeNames[dt], c)
+	}
+	itr := pbnode.FieldLinks().Iterator()
+	for !itr.Done() {
+		_, l := itr.Next()
+		if l.FieldName().Exists() && l.FieldName().Must().String() == name {
+			return l.FieldHash().Link().(cidlink.Link).Cid, nil
+		}
+	}
+	return cid.Undef, fmt.Errorf("%w: no entry %q in directory %s", errNotStreamable, name, c)
+}
+
+// ExtractRawRange extracts the given byte range of the UnixFS file rooted at the CAR root. The CAR only needs to
+// contain the blocks that make up the range, as is the case for entity-bytes responses. It returns an
+// ExtractTimeoutError if the extraction does not finish before the deadline of the context.
+func ExtractRawRange(ctx context.Context, carBytes []byte, rng ByteRange) ([]byte, error) {
+	return ExtractRawPath(ctx, carBytes, "", &rng)
+}
+
+func extractRange(ctx context.Context, ls *ipld.LinkSystem, root cid.Cid, rng ByteRange) ([]byte, error) {
+	// ranges of dag-cbor and dag-json roots are byte ranges of their canonical encoding
+	if isDAGCodec(root.Prefix().Codec) {
+		bz, err := extractDAGRoot(ctx, ls, root)
+		if err != nil {
+			return nil, err
+		}
+		return rng.Slice(bz), nil
+	}
+
+	pbn, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, err
+	}
+	node, err := file.NewUnixFSFile(ctx, pbn, ls)
+	if err != nil {
+		return nil, err
+	}
+	nlr, err := node.AsLargeBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := nlr.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	start, end, ok := rng.Bounds(size)
+	if !ok {
+		return nil, fmt.Errorf("range %s not satisfiable for file of %d bytes", rng.Header(), size)
+	}
+	if _, err := nlr.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	resp := bytes.NewBuffer(nil)
+	if _, err := io.CopyN(resp, ctxReader{ctx: ctx, r: nlr}, end-start); err != nil {
+		return nil, err
+	}
+	return resp.Bytes(), nil
+}
+
+// CorruptBlock is a block of a CAR whose data does not hash to its CID.
+type CorruptBlock struct {
+	Cid string
+	// Actual is the CID of the block data, using the same CID prefix as the block.
+	Actual string
+}
+
+// BlockIntegrityReport is the outcome of re-hashing every block of a CAR.
+type BlockIntegrityReport struct {
+	Blocks  int
+	Corrupt []CorruptBlock `json:",omitempty"`
+	// Error is set if the CAR could not be read to the end or a block could not be hashed.
+	Error string `json:",omitempty"`
+}
+
+func (r *BlockIntegrityReport) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Error) == 0
+}
+
+// verifyCarStream reads all blocks of the CAR, checking each one against its CID, and returns the first error.
+func verifyCarStream(r io.Reader) error {
+	br, err := car.NewBlockReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := br.Next(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// VerifyBlocks re-hashes every block of the CAR and reports the blocks whose data does not match their CID.
+// Unlike a missing block, a corrupted block is present in the CAR, so ExtractRaw would silently use its data.
+func VerifyBlocks(carBytes []byte) *BlockIntegrityReport {
+	report := &BlockIntegrityReport{}
+
+	// the block reader stops at the first corrupted block unless it trusts the CAR, so hash blocks ourselves
+	br, err := car.NewBlockReader(bytes.NewReader(carBytes), car.WithTrustedCAR(true))
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to read car: %s", err)
+		return report
+	}
+
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to read block %d: %s", report.Blocks+1, err)
+			break
+		}
+		report.Blocks++
+
+		actual, err := blk.Cid().Prefix().Sum(blk.RawData())
+		if err != nil {
+			report.Error = fmt.Sprintf("failed to hash block %s: %s", blk.Cid(), err)
+			break
+		}
+		if !actual.Equals(blk.Cid()) {
+			report.Corrupt = append(report.Corrupt, CorruptBlock{Cid: blk.Cid().String(), Actual: actual.String()})
+		}
+	}
+	return report
+}
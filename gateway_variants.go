@@ -0,0 +1,185 @@
+package onion
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/filecoin-saturn/onion/replay"
+)
+
+// GatewayVariant is a variant of a replayed path that exercises a gateway feature beyond fetching the path itself.
+type GatewayVariant string
+
+const (
+	// VariantDirSlash requests the path with a trailing slash, which resolves the index.html of a directory or lists
+	// it, and redirects or serves files as is.
+	VariantDirSlash GatewayVariant = "dir-slash"
+	// VariantIndexHTML requests the index.html of the path as a directory.
+	VariantIndexHTML GatewayVariant = "index-html"
+	// VariantRedirectsFile requests the _redirects file at the root of the path. _redirects files are only applied
+	// by gateways that serve the root from an origin of its own, i.e. by components with urlStyle="subdomain";
+	// path gateways serve the file as is.
+	VariantRedirectsFile GatewayVariant = "redirects-file"
+	// VariantMissing requests a path under the root that does not exist, which subdomain gateways answer as per the
+	// _redirects file of the root, if it has one, e.g. with its 404.html, and other gateways with a 404.
+	VariantMissing GatewayVariant = "missing"
+	// VariantIPNSRecord requests the signed IPNS record of /ipns/ paths with ?format=ipns-record and an Accept header
+	// for the record.
+	VariantIPNSRecord GatewayVariant = "ipns-record"
+)
+
+// GatewayVariants are all the gateway variants.
+var GatewayVariants = []GatewayVariant{VariantDirSlash, VariantIndexHTML, VariantRedirectsFile, VariantMissing, VariantIPNSRecord}
+
+// missingName is the name of the path requested under the root of paths by VariantMissing.
+const missingName = "onion-missing-path"
+
+// ipnsRecordContentType is the media type of signed IPNS records.
+const ipnsRecordContentType = "application/vnd.ipfs.ipns-record"
+
+// webVariants are the variants whose responses are web pages, e.g. an index.html or a directory listing, which are
+// requested without the CAR or raw block format of the replayed request.
+var webVariants = map[GatewayVariant]bool{VariantDirSlash: true, VariantIndexHTML: true, VariantMissing: true}
+
+// trustlessParams are the query params that ask for the response in a format of the trustless gateway spec.
+var trustlessParams = []string{"format", "dag-scope", "car-scope"}
+
+// gatewayVariants returns the replayed request for every gateway variant of the entry. Only GET requests for whole
+// entities are varied.
+func gatewayVariants(e replay.ReplayEntry) (map[GatewayVariant]replay.ReplayEntry, error) {
+	if (len(e.Method) != 0 && e.Method != http.MethodGet) || len(e.Range()) != 0 || IsRawBlockRequest(e.URL, e.Headers) {
+		return nil, nil
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+	if len(entityBytes(e.URL)) != 0 {
+		return nil, nil
+	}
+	ns, root, rest, err := splitContentPath(u.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := "/" + ns + "/" + root
+	dir := base + strings.TrimSuffix(rest, "/")
+	paths := map[GatewayVariant]string{
+		VariantDirSlash:      dir + "/",
+		VariantIndexHTML:     dir + "/index.html",
+		VariantRedirectsFile: base + "/_redirects",
+		VariantMissing:       base + "/" + missingName,
+	}
+	out := make(map[GatewayVariant]replay.ReplayEntry, len(paths)+1)
+	for v, p := range paths {
+		vu := *u
+		vu.Path, vu.RawPath = p, ""
+		header := e.Headers
+		if webVariants[v] {
+			q := vu.Query()
+			for _, param := range trustlessParams {
+				q.Del(param)
+			}
+			vu.RawQuery = q.Encode()
+			accept := header.Get("Accept")
+			if strings.Contains(accept, carContentType) || strings.Contains(accept, rawBlockContentType) {
+				header = header.Clone()
+				header.Del("Accept")
+			}
+		}
+		out[v] = replay.ReplayEntry{Method: e.Method, URL: vu.String(), Headers: header}
+	}
+	if ns == "ipns" && len(rest) == 0 {
+		// the record is asked for by its format param and Accept header only
+		vu := *u
+		vu.RawQuery = url.Values{"format": []string{"ipns-record"}}.Encode()
+		header := http.Header{"Accept": []string{ipnsRecordContentType}}
+		out[VariantIPNSRecord] = replay.ReplayEntry{Method: e.Method, URL: vu.String(), Headers: header}
+	}
+	return out, nil
+}
+
+// VariantStats counts the paths of a gateway variant and how many of them mismatched for a pair. Unlike the status
+// mismatches of other paths, a status mismatch is any difference in status, e.g. a 404 and a 200 for a missing path,
+// as neither layer is expected to succeed.
+type VariantStats struct {
+	Paths            int
+	StatusMismatches int
+	BytesMismatches  int
+	MismatchPaths    []string `json:",omitempty"`
+}
+
+// variantStats counts the paths of every gateway variant and their mismatches, keyed by pair name and variant.
+func (re *RequestExecutor) variantStats() map[string]map[GatewayVariant]*VariantStats {
+	out := make(map[string]map[GatewayVariant]*VariantStats, len(re.pairs))
+	for _, p := range re.pairs {
+		stats := make(map[GatewayVariant]*VariantStats)
+		out[p.Name()] = stats
+		stat := func(path string) *VariantStats {
+			v := re.reqs[path].Variant
+			if len(v) == 0 {
+				return nil
+			}
+			if stats[v] == nil {
+				stats[v] = &VariantStats{}
+			}
+			return stats[v]
+		}
+		mismatched := make(map[string]struct{})
+		for path, rs := range re.results {
+			s := stat(path)
+			if s == nil {
+				continue
+			}
+			s.Paths++
+			if ra, rb := rs[p.A.Name], rs[p.B.Name]; ra != nil && rb != nil && ra.StatusCode != rb.StatusCode {
+				s.StatusMismatches++
+				mismatched[path] = struct{}{}
+			}
+		}
+		for _, path := range re.responseReads.Pairs[p.Name()].MismatchPaths {
+			if s := stat(path); s != nil {
+				s.BytesMismatches++
+				mismatched[path] = struct{}{}
+			}
+		}
+		for path := range mismatched {
+			s := stat(path)
+			s.MismatchPaths = append(s.MismatchPaths, path)
+		}
+		for _, s := range stats {
+			sort.Strings(s.MismatchPaths)
+		}
+	}
+	return out
+}
+
+// hasVariants reports whether any of the paths of the run is a gateway variant.
+func (re *RequestExecutor) hasVariants() bool {
+	for _, urls := range re.reqs {
+		if len(urls.Variant) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeVariants writes the mismatches of the gateway variants of every pair to gateway-variants.json and prints
+// them. The caller must hold the lock.
+func (re *RequestExecutor) writeVariants() {
+	stats := re.variantStats()
+	re.writeJSON(stats, re.rrFile("gateway-variants.json"))
+
+	fmt.Println("\n ----------SUMMARY OF GATEWAY VARIANTS --------------")
+	for _, p := range re.pairs {
+		for _, v := range append(append([]GatewayVariant(nil), GatewayVariants...), CarNegotiationVariants...) {
+			if s := stats[p.Name()][v]; s != nil {
+				fmt.Printf("\n Run-%d; %s %s %s: %d paths, %d status mismatches, %d bytes mismatches", re.n, p.A.Name, p.B.Name, v, s.Paths, s.StatusMismatches, s.BytesMismatches)
+			}
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,154 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// goldenBodiesDir is the directory of a results directory that response bodies are saved to by SaveBodies, named
+// after their sha256.
+const goldenBodiesDir = "bodies"
+
+// Golden serves the responses of a component recorded by an earlier run, e.g. of ipfs.io, as the ground truth so
+// that a target component can be regression tested offline without querying the reference layers again.
+type Golden struct {
+	// Component is the name of the component of the earlier run whose responses are served.
+	Component string
+	// Results are the results of the earlier run, keyed by path.
+	Results map[string]Results
+	// Dir is the results directory of the earlier run.
+	Dir string
+}
+
+// LoadGolden loads the responses of the component from the results directory of an earlier run, e.g.
+// results/results-1. Responses are compared by the digests recorded in the results, or byte for byte if the run
+// saved its response bodies with ExecutorOptions.SaveBodies.
+func LoadGolden(dir string, component string) (*Golden, error) {
+	g := &Golden{Component: component, Dir: dir}
+	if err := readJSONF(filepath.Join(dir, "results.json"), &g.Results); err != nil {
+		return nil, err
+	}
+	for _, rs := range g.Results {
+		if _, ok := rs[component]; ok {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("golden run %s has no results for component %s", dir, component)
+}
+
+// GoldenComponent returns the component named "golden" that serves the recorded responses of the component c,
+// which must be the config of the golden component so that its responses are extracted the same way. It is the
+// reference of the comparisons.
+func GoldenComponent(c Component, g *Golden) Component {
+	c.Name = "golden"
+	c.Golden = g
+	c.Reference = true
+	c.Disabled = false
+	c.Cache = false
+	c.Group, c.Node = "", ""
+	c.MaxRequestsPerSecond, c.MaxBytesPerSecond = 0, 0
+	return c
+}
+
+// has reports whether the golden run has a response for the path.
+func (g *Golden) has(path string) bool {
+	_, ok := g.Results[path][g.Component]
+	return ok
+}
+
+// result returns the recorded result of the path. If capture is true, the recorded response body is returned as
+// well, if it was saved.
+func (g *Golden) result(path string, capture bool) Result {
+	r, ok := g.Results[path][g.Component]
+	if !ok || r == nil {
+		return Result{ErrorBody: fmt.Sprintf("path is not in golden run %s", g.Dir), ErrorKind: ErrorOther}
+	}
+	out := *r
+	// no connection was made for the recorded response
+	out.Conn = nil
+	// the recorded response is extracted again if it is compared
+	out.ExtractError = ""
+	// recorded responses are not compared with production
+	out.Production = nil
+	if capture && isReadOK(r) {
+		if body, ok := g.body(r.ResponseDigest); ok {
+			out.ResponseBody = body
+		}
+	}
+	return out
+}
+
+// body returns the saved response body with the digest.
+func (g *Golden) body(digest string) ([]byte, bool) {
+	if len(digest) == 0 {
+		return nil, false
+	}
+	body, err := os.ReadFile(filepath.Join(g.Dir, goldenBodiesDir, digest))
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// hasBody reports whether the response body of the path was saved, so that the path can be compared byte for byte.
+// Paths whose golden response was not read successfully have nothing to compare and count as saved.
+func (g *Golden) hasBody(path string) bool {
+	r, ok := g.Results[path][g.Component]
+	if !ok || r == nil || !isReadOK(r) {
+		return true
+	}
+	if len(r.ResponseDigest) == 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(g.Dir, goldenBodiesDir, r.ResponseDigest))
+	return err == nil
+}
+
+// goldenOf returns the golden of the components, if any.
+func goldenOf(components []Component) *Golden {
+	for _, c := range components {
+		if c.Golden != nil && !c.Disabled {
+			return c.Golden
+		}
+	}
+	return nil
+}
+
+// saveBodies saves the captured response bodies of the path to the bodies directory of the run, named after their
+// digest, so that the run can serve as a golden run that is compared byte for byte.
+func (re *RequestExecutor) saveBodies(pc *pathComparer) error {
+	dir := filepath.Join(re.dir, goldenBodiesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, c := range re.components {
+		r := pc.rs[c.Name]
+		if c.Golden != nil || r == nil || !isReadOK(r) || len(r.ResponseDigest) == 0 {
+			continue
+		}
+		f := filepath.Join(dir, r.ResponseDigest)
+		if _, err := os.Stat(f); err == nil || !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		// bodies are written to a temporary file first so that a crash or a concurrent path with the same body does
+		// not leave a truncated body behind
+		tmp, err := os.CreateTemp(dir, r.ResponseDigest+".*.tmp")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(pc.bodies[c.Name])
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), f)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
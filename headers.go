@@ -0,0 +1,95 @@
+package onion
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderRules decide which response headers are compared between the components of a pair. Patterns are header
+// names, matched case-insensitively, or name prefixes ending with "*", e.g. "X-Ipfs-*".
+type HeaderRules struct {
+	// Compare are the headers that are compared.
+	Compare []string
+	// Ignore are the headers that are never compared, even if they match Compare, e.g. because they differ
+	// on every response.
+	Ignore []string
+}
+
+// DefaultHeaderRules compares the headers that describe the content of a response and ignores those that differ
+// between responses by design.
+func DefaultHeaderRules() *HeaderRules {
+	return &HeaderRules{
+		Compare: []string{"Content-Type", "Content-Length", "Etag", "Cache-Control", "X-Ipfs-*"},
+		Ignore:  []string{"Date", "Server", "X-Request-Id", "X-Ipfs-Pop"},
+	}
+}
+
+// HeaderDiff is a header whose normalised values differ between the two components of a pair. A value is empty if
+// the component did not return the header.
+type HeaderDiff struct {
+	Name string
+	A    string
+	B    string
+}
+
+// Diff returns the compared headers whose normalised values differ, sorted by name.
+func (hr *HeaderRules) Diff(a, b http.Header) []HeaderDiff {
+	names := make(map[string]struct{})
+	for name := range a {
+		names[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+	for name := range b {
+		names[http.CanonicalHeaderKey(name)] = struct{}{}
+	}
+
+	var out []HeaderDiff
+	for name := range names {
+		if !hr.compared(name) {
+			continue
+		}
+		va, vb := normaliseHeader(name, a.Values(name)), normaliseHeader(name, b.Values(name))
+		if va != vb {
+			out = append(out, HeaderDiff{Name: name, A: va, B: vb})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (hr *HeaderRules) compared(name string) bool {
+	return matchHeader(hr.Compare, name) && !matchHeader(hr.Ignore, name)
+}
+
+func matchHeader(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(strings.TrimSuffix(p, "*"))) {
+				return true
+			}
+		} else if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseHeader joins the values of a header, trimming whitespace and the weak validator prefix of etags so that
+// equivalent values compare equal.
+func normaliseHeader(name string, values []string) string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if name == "Etag" {
+			v = strings.TrimPrefix(v, "W/")
+		}
+		out = append(out, v)
+	}
+	return strings.Join(out, ", ")
+}
+
+// headersComparable reports whether the headers of the two components of a pair are expected to be the same,
+// i.e. if they return the same thing for the request.
+func headersComparable(p Pair, rng *ByteRange) bool {
+	return p.A.Extract == p.B.Extract && (rng == nil || p.A.Range == p.B.Range)
+}
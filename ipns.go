@@ -0,0 +1,146 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxDNSLinkDepth is the maximum number of DNSLink records that are followed to resolve a name.
+const maxDNSLinkDepth = 32
+
+// Resolver resolves an IPNS name, i.e. an IPNS key or a DNSLink domain, to an immutable /ipfs/ content path.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (string, error)
+}
+
+// GatewayResolver resolves IPNS names with a gateway that supports /ipns/ paths, e.g. a local Kubo node. It
+// resolves both IPNS keys and DNSLink domains.
+type GatewayResolver struct {
+	// URL is the base URL of the gateway, e.g. "http://127.0.0.1:8080".
+	URL    string
+	Client *http.Client
+}
+
+// Resolve asks the gateway for the root CID of the name, which is the first CID of the X-Ipfs-Roots header.
+func (r GatewayResolver) Resolve(ctx context.Context, name string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.TrimSuffix(r.URL, "/")+"/ipns/"+name, nil)
+	if err != nil {
+		return "", err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %s: gateway returned %d", name, resp.StatusCode)
+	}
+
+	root, _, _ := strings.Cut(resp.Header.Get("X-Ipfs-Roots"), ",")
+	root = strings.TrimSpace(root)
+	if len(root) == 0 {
+		return "", fmt.Errorf("failed to resolve %s: gateway returned no X-Ipfs-Roots", name)
+	}
+	return "/ipfs/" + root, nil
+}
+
+// DNSLinkResolver resolves DNSLink domains with the TXT records of _dnslink.{domain}, falling back to those of the
+// domain itself. It can not resolve IPNS keys.
+type DNSLinkResolver struct {
+	// Resolver is the DNS resolver to use. Defaults to net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+func (r DNSLinkResolver) Resolve(ctx context.Context, name string) (string, error) {
+	path := "/ipns/" + name
+	for i := 0; i < maxDNSLinkDepth; i++ {
+		ns, domain, rest, err := splitContentPath(path)
+		if err != nil {
+			return "", err
+		}
+		if ns == "ipfs" {
+			return path, nil
+		}
+
+		link, err := r.lookup(ctx, domain)
+		if err != nil {
+			return "", err
+		}
+		path = link + rest
+	}
+	return "", fmt.Errorf("failed to resolve %s: too many DNSLink indirections", name)
+}
+
+func (r DNSLinkResolver) lookup(ctx context.Context, domain string) (string, error) {
+	dns := r.Resolver
+	if dns == nil {
+		dns = net.DefaultResolver
+	}
+
+	var lastErr error
+	for _, host := range []string{"_dnslink." + domain, domain} {
+		txts, err := dns.LookupTXT(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, txt := range txts {
+			if strings.HasPrefix(txt, "dnslink=") {
+				return strings.TrimPrefix(txt, "dnslink="), nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", fmt.Errorf("failed to resolve DNSLink of %s: %w", domain, lastErr)
+	}
+	return "", fmt.Errorf("failed to resolve DNSLink of %s: no dnslink TXT record", domain)
+}
+
+// IsIPNSPath reports whether the request path is an /ipns/ path that must be resolved to get its root CID.
+func IsIPNSPath(path string) bool {
+	return strings.HasPrefix(path, "/ipns/")
+}
+
+// ResolvePath resolves an /ipns/ request path to an /ipfs/ path with the same remainder. Other paths are returned
+// as is.
+func ResolvePath(ctx context.Context, r Resolver, path string) (string, error) {
+	if !IsIPNSPath(path) {
+		return path, nil
+	}
+	_, name, rest, err := splitContentPath(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := r.Resolve(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(resolved, "/ipfs/") {
+		return "", fmt.Errorf("failed to resolve %s: resolved to %s, not an /ipfs/ path", name, resolved)
+	}
+	return strings.TrimSuffix(resolved, "/") + rest, nil
+}
+
+// splitContentPath splits a /{namespace}/{root}/{rest} path into its namespace, root and the remainder of the
+// path, which is either empty or starts with a slash.
+func splitContentPath(path string) (ns, root, rest string, err error) {
+	ns, after, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || (ns != "ipfs" && ns != "ipns") {
+		return "", "", "", fmt.Errorf("invalid content path: %q", path)
+	}
+	root, rest, _ = strings.Cut(after, "/")
+	if len(root) == 0 {
+		return "", "", "", fmt.Errorf("invalid content path: %q; no root", path)
+	}
+	if len(rest) != 0 || strings.HasSuffix(after, "/") {
+		rest = "/" + rest
+	}
+	return ns, root, rest, nil
+}
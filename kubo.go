@@ -0,0 +1,287 @@
+package onion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// defaultKuboReadyTimeout is how long a local Kubo node is waited for by default.
+	defaultKuboReadyTimeout = time.Minute
+	// defaultKuboPrimeTimeout bounds the priming of a single path by default.
+	defaultKuboPrimeTimeout = 5 * time.Minute
+	// defaultKuboPrimeConcurrency is the number of paths primed at once by default.
+	defaultKuboPrimeConcurrency = 8
+	// kuboReadyPath is requested from the gateway to check that it is ready. It is the empty identity CID, which a
+	// node serves without fetching anything.
+	kuboReadyPath = "/ipfs/bafkqaaa"
+)
+
+// KuboConfig configures a layer that is a locally run Kubo node, e.g. to use it as the reference instead of ipfs.io
+// so that comparisons do not depend on the load or rate limits of a public gateway.
+type KuboConfig struct {
+	// API is the host:port of the RPC API of the node, e.g. "127.0.0.1:5001".
+	API string `toml:"api"`
+	// ReadyTimeout is how long to wait for the gateway and the RPC API of the node to be ready before the first run.
+	// Defaults to 1m.
+	ReadyTimeout string `toml:"readyTimeout"`
+	// Prime fetches the DAG of every path into the node with /api/v0/refs before the first run, so that its
+	// responses do not depend on how quickly it finds providers.
+	Prime bool `toml:"prime"`
+	// PrimeTimeout bounds the priming of a path. Defaults to 5m.
+	PrimeTimeout string `toml:"primeTimeout"`
+	// PrimeConcurrency is the number of paths primed at once. Defaults to 8.
+	PrimeConcurrency int `toml:"primeConcurrency"`
+}
+
+// Kubo is a locally run Kubo node whose gateway is a layer under test.
+type Kubo struct {
+	// Gateway is the base URL of the gateway of the node, e.g. "http://127.0.0.1:8080", and API that of its RPC API.
+	Gateway string
+	API     string
+
+	ReadyTimeout     time.Duration
+	Prime            bool
+	PrimeTimeout     time.Duration
+	PrimeConcurrency int
+
+	Client *http.Client
+}
+
+// NewKubo returns the node whose gateway is at the base URL gateway.
+func NewKubo(gateway string, cfg KuboConfig) (*Kubo, error) {
+	if len(cfg.API) == 0 {
+		return nil, fmt.Errorf("the RPC API address is required")
+	}
+	api := cfg.API
+	if !strings.Contains(api, "://") {
+		api = "http://" + api
+	}
+	if _, err := url.Parse(api); err != nil {
+		return nil, fmt.Errorf("invalid RPC API address %q: %w", cfg.API, err)
+	}
+	k := &Kubo{
+		Gateway:          strings.TrimSuffix(gateway, "/"),
+		API:              strings.TrimSuffix(api, "/"),
+		ReadyTimeout:     defaultKuboReadyTimeout,
+		Prime:            cfg.Prime,
+		PrimeTimeout:     defaultKuboPrimeTimeout,
+		PrimeConcurrency: cfg.PrimeConcurrency,
+	}
+	for _, d := range []struct {
+		v    string
+		dst  *time.Duration
+		name string
+	}{{cfg.ReadyTimeout, &k.ReadyTimeout, "ready timeout"}, {cfg.PrimeTimeout, &k.PrimeTimeout, "prime timeout"}} {
+		if len(d.v) == 0 {
+			continue
+		}
+		var err error
+		if *d.dst, err = time.ParseDuration(d.v); err != nil || *d.dst <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", d.name, d.v)
+		}
+	}
+	if k.PrimeConcurrency < 0 {
+		return nil, fmt.Errorf("invalid prime concurrency: %d", k.PrimeConcurrency)
+	}
+	if k.PrimeConcurrency == 0 {
+		k.PrimeConcurrency = defaultKuboPrimeConcurrency
+	}
+	return k, nil
+}
+
+func (k *Kubo) client() *http.Client {
+	if k.Client != nil {
+		return k.Client
+	}
+	return http.DefaultClient
+}
+
+// WaitReady polls the RPC API and the gateway of the node every second until both respond, or fails once
+// ReadyTimeout has passed.
+func (k *Kubo) WaitReady(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, k.ReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		err := k.ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("kubo node not ready after %s: %w", k.ReadyTimeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// ready checks that the RPC API returns the identity of the node and that the gateway serves the empty identity CID.
+func (k *Kubo) ready(ctx context.Context) error {
+	checks := []struct {
+		method string
+		url    string
+	}{{http.MethodPost, k.API + "/api/v0/id"}, {http.MethodGet, k.Gateway + kuboReadyPath}}
+	for _, c := range checks {
+		req, err := http.NewRequestWithContext(ctx, c.method, c.url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := k.client().Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %d", c.url, resp.StatusCode)
+		}
+	}
+	return nil
+}
+
+// KuboPrime is the outcome of priming a path.
+type KuboPrime struct {
+	Path string
+	// Refs is the number of blocks of the DAG of the path that the node returned.
+	Refs     int
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+// PrimePaths fetches the DAGs of the content paths into the node with /api/v0/refs, PrimeConcurrency paths at a
+// time, and returns the outcome of every path in the order of paths. Failing to prime a path does not stop the
+// others from being primed.
+func (k *Kubo) PrimePaths(ctx context.Context, paths []string) []KuboPrime {
+	out := make([]KuboPrime, len(paths))
+	sem := make(chan struct{}, k.PrimeConcurrency)
+	var wg sync.WaitGroup
+	for i, p := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, p string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			refs, err := k.refs(ctx, p)
+			out[i] = KuboPrime{Path: p, Refs: refs, Duration: time.Since(start)}
+			if err != nil {
+				out[i].Error = err.Error()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return out
+}
+
+// refs lists the blocks of the DAG of the content path recursively, which makes the node fetch all of them, and
+// returns how many there are.
+func (k *Kubo) refs(ctx context.Context, path string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, k.PrimeTimeout)
+	defer cancel()
+	q := url.Values{"arg": {path}, "recursive": {"true"}, "unique": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.API+"/api/v0/refs?"+q.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := k.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("refs returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	n := 0
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ref struct {
+			Ref string
+			Err string
+		}
+		if err := dec.Decode(&ref); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		if len(ref.Err) != 0 {
+			return n, fmt.Errorf("refs failed: %s", ref.Err)
+		}
+		n++
+	}
+	// errors that occur after the response started are reported in the X-Stream-Error trailer
+	if e := resp.Trailer.Get("X-Stream-Error"); len(e) != 0 {
+		return n, fmt.Errorf("refs failed: %s", e)
+	}
+	return n, nil
+}
+
+// prepareKubos waits for the local Kubo nodes among the components to be ready and primes the paths of the requests
+// of every cohort into those that prime, so that they are not compared before they are up or while they are still
+// finding providers.
+func (cfg RunConfig) prepareKubos(ctx context.Context, reqs []map[string]URLsToTest, log *slog.Logger) error {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, rs := range reqs {
+		for _, req := range rs {
+			p := req.Path
+			if len(req.ResolvedPath) != 0 {
+				p = req.ResolvedPath
+			}
+			p, _, _ = strings.Cut(p, "?")
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	var summaries []string
+	// the components of a layer that is requested over several HTTP versions share its node
+	nodes := make(map[string]bool)
+	for _, c := range EnabledComponents(cfg.Components) {
+		if c.Kubo == nil || c.Golden != nil || nodes[c.Kubo.API] {
+			continue
+		}
+		nodes[c.Kubo.API] = true
+		log.Info("waiting for kubo node", "component", c.Name, "gateway", c.Kubo.Gateway, "api", c.Kubo.API)
+		if err := c.Kubo.WaitReady(ctx); err != nil {
+			return fmt.Errorf("%s: %w", c.Name, err)
+		}
+		if !c.Kubo.Prime {
+			continue
+		}
+		log.Info("priming kubo node", "component", c.Name, "paths", len(paths))
+		primed := c.Kubo.PrimePaths(ctx, paths)
+		var failed, refs int
+		for _, p := range primed {
+			refs += p.Refs
+			if len(p.Error) != 0 {
+				failed++
+				log.Warn("failed to prime path", "component", c.Name, "path", p.Path, "err", p.Error)
+			}
+		}
+		summaries = append(summaries, fmt.Sprintf("%s: primed %d of %d paths (%d blocks), %d failed", c.Name,
+			len(primed)-failed, len(primed), refs, failed))
+	}
+	if len(summaries) != 0 {
+		fmt.Println("\n ----------SUMMARY OF KUBO PRIMING --------------")
+		for _, s := range summaries {
+			fmt.Printf("\n %s", s)
+		}
+		fmt.Println()
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,298 @@
+package onion
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// liveMismatchLimit is the number of mismatches of a run listed in the live state. They are all counted.
+const liveMismatchLimit = 500
+
+// Live tracks the executors of the run in progress so that its progress, the success counts of its components and
+// its mismatches so far can be observed in a web UI while its paths are requested, e.g. with ServeLive. The
+// executors of a run are tracked until the next run starts.
+type Live struct {
+	mu   sync.Mutex
+	n    int
+	runs []*liveRun
+}
+
+type liveRun struct {
+	cohort  string
+	re      *RequestExecutor
+	start   time.Time
+	resumed int
+	// end is when the executor finished requesting the paths, if it did.
+	end time.Time
+}
+
+// NewLive returns a Live that tracks no run yet.
+func NewLive() *Live {
+	return &Live{}
+}
+
+// track adds the executor of a cohort of a run, replacing the executors of earlier runs. It must be called before
+// the executor starts executing.
+func (l *Live) track(cohort string, re *RequestExecutor) {
+	re.mu.Lock()
+	resumed := len(re.results)
+	re.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if re.n != l.n {
+		l.n = re.n
+		l.runs = nil
+	}
+	l.runs = append(l.runs, &liveRun{cohort: cohort, re: re, start: time.Now(), resumed: resumed})
+}
+
+// finish records that the executor finished requesting the paths of its run.
+func (l *Live) finish(re *RequestExecutor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, r := range l.runs {
+		if r.re == re {
+			r.end = time.Now()
+		}
+	}
+}
+
+// LiveRun is the state of a run, or of a cohort of a run, while its paths are requested.
+type LiveRun struct {
+	N      int
+	RunID  string
+	Cohort string `json:",omitempty"`
+	// Paths is the number of paths of the run and Done the number of those that completed.
+	Paths int
+	Done  int
+	// Elapsed is the time the paths have been requested for, and ETA the estimated time until they are all done.
+	Elapsed string
+	ETA     string `json:",omitempty"`
+	// Components are in the order of the components of the run.
+	Components []LiveComponent
+	// Mismatches are the first status and bytes mismatches so far, sorted by pair, kind and path, and
+	// MismatchCount the number of all of them.
+	Mismatches    []LiveMismatch
+	MismatchCount int
+}
+
+// LiveComponent is the outcome of the requests to a component so far.
+type LiveComponent struct {
+	Name string
+	// Completed is the number of paths requested from the component so far, of which Success returned a 2xx with
+	// a successful response read.
+	Completed int
+	Success   int
+	Failed    int
+}
+
+// LiveMismatch is a path that mismatched between the components of a pair so far.
+type LiveMismatch struct {
+	Pair string
+	// Kind is what mismatched, "status" or "bytes".
+	Kind string
+	Path string
+}
+
+// State returns the state of the executors of the current run.
+func (l *Live) State() []LiveRun {
+	l.mu.Lock()
+	runs := make([]liveRun, 0, len(l.runs))
+	for _, r := range l.runs {
+		runs = append(runs, *r)
+	}
+	l.mu.Unlock()
+
+	out := make([]LiveRun, 0, len(runs))
+	for _, r := range runs {
+		out = append(out, r.state())
+	}
+	return out
+}
+
+func (r liveRun) state() LiveRun {
+	re := r.re
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	elapsed := time.Since(r.start)
+	if !r.end.IsZero() {
+		elapsed = r.end.Sub(r.start)
+	}
+	s := LiveRun{
+		N:       re.n,
+		RunID:   re.id.String(),
+		Cohort:  r.cohort,
+		Paths:   len(re.reqs),
+		Done:    len(re.results),
+		Elapsed: elapsed.Round(time.Second).String(),
+	}
+	if fetched := s.Done - r.resumed; fetched > 0 && s.Done < s.Paths {
+		s.ETA = time.Duration(float64(elapsed) / float64(fetched) * float64(s.Paths-s.Done)).Round(time.Second).String()
+	}
+
+	for _, c := range re.components {
+		lc := LiveComponent{Name: c.Name}
+		for _, rs := range re.results {
+			res := rs[c.Name]
+			if res == nil {
+				continue
+			}
+			lc.Completed++
+			if isReadOK(res) {
+				lc.Success++
+			} else {
+				lc.Failed++
+			}
+		}
+		s.Components = append(s.Components, lc)
+	}
+
+	_, statusPaths := re.statusMismatches()
+	for _, p := range re.pairs {
+		for _, path := range statusPaths[p.Name()] {
+			s.Mismatches = append(s.Mismatches, LiveMismatch{Pair: p.Name(), Kind: string(MismatchStatus), Path: path})
+		}
+		if pm := re.responseReads.Pairs[p.Name()]; pm != nil {
+			for _, path := range pm.MismatchPaths {
+				s.Mismatches = append(s.Mismatches, LiveMismatch{Pair: p.Name(), Kind: string(MismatchBytes), Path: path})
+			}
+		}
+	}
+	sort.Slice(s.Mismatches, func(i, j int) bool {
+		a, b := s.Mismatches[i], s.Mismatches[j]
+		if a.Pair != b.Pair {
+			return a.Pair < b.Pair
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Path < b.Path
+	})
+	s.MismatchCount = len(s.Mismatches)
+	if len(s.Mismatches) > liveMismatchLimit {
+		s.Mismatches = s.Mismatches[:liveMismatchLimit]
+	}
+	return s
+}
+
+// Handler serves the web UI at / and the state of the current run as JSON at /api/state.
+func (l *Live) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/state", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(l.State())
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, livePage)
+	})
+	return mux
+}
+
+// ServeLive serves the web UI of the runs tracked by l on addr until the returned server is closed. Errors serving
+// are sent on the returned channel, which is closed once the server stops.
+func ServeLive(addr string, l *Live) (*http.Server, <-chan error) {
+	srv := &http.Server{Addr: addr, Handler: l.Handler()}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("live UI server failed: %w", err)
+		}
+		close(errCh)
+	}()
+	return srv, errCh
+}
+
+// livePage polls /api/state and renders the progress, the success counts of the components and the mismatches of
+// every cohort of the current run.
+const livePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Onion</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+progress { width: 400px; }
+.status { color: #888; }
+</style>
+</head>
+<body>
+<h1>Onion</h1>
+<p class="status" id="status">Waiting for a run to start...</p>
+<div id="runs"></div>
+<script>
+function el(tag, text) {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  return e;
+}
+function table(headers, rows) {
+  const t = el("table");
+  const tr = el("tr");
+  headers.forEach(h => tr.appendChild(el("th", h)));
+  t.appendChild(tr);
+  rows.forEach(row => {
+    const tr = el("tr");
+    row.forEach(v => tr.appendChild(el("td", v)));
+    t.appendChild(tr);
+  });
+  return t;
+}
+function pct(k, n) {
+  return n ? (100 * k / n).toFixed(1) + "%" : "-";
+}
+function render(runs) {
+  const root = document.getElementById("runs");
+  root.replaceChildren();
+  runs.forEach(r => {
+    root.appendChild(el("h2", "Run " + r.N + (r.Cohort ? " (" + r.Cohort + ")" : "")));
+    root.appendChild(el("p", "Run ID " + r.RunID));
+    const p = el("p");
+    const bar = el("progress");
+    bar.max = r.Paths;
+    bar.value = r.Done;
+    p.appendChild(bar);
+    p.appendChild(document.createTextNode(" " + r.Done + "/" + r.Paths + " paths (" + pct(r.Done, r.Paths) +
+      "), elapsed " + r.Elapsed + (r.ETA ? ", ETA " + r.ETA : "")));
+    root.appendChild(p);
+    root.appendChild(table(["Component", "Completed", "2xx with successful response read", "Failed", "Success rate"],
+      r.Components.map(c => [c.Name, c.Completed, c.Success, c.Failed, pct(c.Success, c.Completed)])));
+    let title = "Mismatches: " + r.MismatchCount;
+    if (r.MismatchCount > r.Mismatches.length) title += " (first " + r.Mismatches.length + " listed)";
+    root.appendChild(el("h3", title));
+    root.appendChild(table(["Pair", "Kind", "Path"], r.Mismatches.map(m => [m.Pair, m.Kind, m.Path])));
+  });
+}
+async function poll() {
+  try {
+    const resp = await fetch("api/state", {cache: "no-store"});
+    const runs = await resp.json();
+    if (runs.length) {
+      document.getElementById("status").textContent = "Updated " + new Date().toLocaleTimeString();
+      render(runs);
+    }
+  } catch (e) {
+    document.getElementById("status").textContent = "Onion is not reachable: " + e;
+  }
+  setTimeout(poll, 2000);
+}
+poll();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,313 @@
+package onion
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultLoadWindow is the length of the time windows that load test metrics are aggregated over by default.
+	defaultLoadWindow = 10 * time.Second
+	// defaultLoadConcurrency is the number of requests in flight at most during a load test by default.
+	defaultLoadConcurrency = 64
+)
+
+// LoadOptions configures a load test with RunLoad.
+type LoadOptions struct {
+	// Component is the name of the component to load.
+	Component string
+	// RequestsPerSecond is the rate at which requests are sent, whether or not earlier requests have completed. If
+	// it is zero, requests are sent as soon as fewer than Concurrency are in flight.
+	RequestsPerSecond float64
+	// BytesPerSecond caps the rate at which response bodies are read from the component, if set, so that it is
+	// driven at that bandwidth given enough Concurrency.
+	BytesPerSecond float64
+	// Duration is how long requests are sent for.
+	Duration time.Duration
+	// Window is the length of the time windows that metrics are aggregated over. Defaults to 10 seconds.
+	Window time.Duration
+	// Concurrency is the number of requests in flight at most. Requests that are due at RequestsPerSecond while
+	// Concurrency requests are in flight are dropped and counted. Defaults to 64.
+	Concurrency int
+}
+
+// LoadWindow aggregates the requests of a load test that completed within a time window.
+type LoadWindow struct {
+	// Offset is the start of the window relative to the start of the load test.
+	Offset time.Duration
+	// Requests is the number of requests that completed in the window, and Errors the number of them that failed.
+	Requests int
+	Errors   int
+	// ErrorKinds counts the failed requests by kind of failure.
+	ErrorKinds map[ErrorKind]int `json:",omitempty"`
+	// Dropped is the number of requests that were due in the window but not sent as Concurrency requests were in
+	// flight.
+	Dropped int
+	// Bytes is the total size of the response bodies read.
+	Bytes uint64
+	// RequestsPerSecond and BytesPerSecond are the rates of completed requests and bytes read over the window.
+	RequestsPerSecond float64
+	BytesPerSecond    float64
+	// P50, P90, P99 and Max are the latencies of the requests that completed in the window.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+
+	latencies []time.Duration
+}
+
+// LoadReport is the outcome of a load test.
+type LoadReport struct {
+	Component string
+	Options   LoadOptions
+	Start     time.Time
+	// Paths is the number of paths that were requested in turn.
+	Paths int
+	// Windows are the consecutive time windows of the load test, and Total aggregates all of them.
+	Windows []*LoadWindow
+	Total   *LoadWindow
+}
+
+// RunLoad drives a component with the requests of the replay file of cfg at a target rate of requests or bytes for
+// a duration, cycling through the sampled paths, and aggregates the latencies, errors and throughput of the
+// requests over time windows, so that onion can benchmark an L1 node rather than only compare layers. Responses are
+// not compared, and requests are neither retried nor throttled by the rate limits of the component. Requests are
+// no longer sent once ctx is done.
+func RunLoad(ctx context.Context, cfg RunConfig, opts LoadOptions) (*LoadReport, error) {
+	if opts.Duration <= 0 {
+		return nil, fmt.Errorf("load test duration must be positive, got %s", opts.Duration)
+	}
+	if opts.RequestsPerSecond < 0 || opts.BytesPerSecond < 0 {
+		return nil, fmt.Errorf("load test rates can not be negative")
+	}
+	// requests are sent on the ticks of a ticker, whose interval can not be shorter than a nanosecond
+	if opts.RequestsPerSecond > float64(time.Second) {
+		return nil, fmt.Errorf("load test rate can not exceed %d requests per second, got %g", time.Second, opts.RequestsPerSecond)
+	}
+	if opts.Window <= 0 {
+		opts.Window = defaultLoadWindow
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultLoadConcurrency
+	}
+	var c *Component
+	for i := range cfg.Components {
+		if cfg.Components[i].Name == opts.Component && !cfg.Components[i].Disabled {
+			lc := cfg.Components[i]
+			c = &lc
+		}
+	}
+	if c == nil {
+		return nil, fmt.Errorf("unknown or disabled component to load: %s", opts.Component)
+	}
+	if c.Golden != nil {
+		return nil, fmt.Errorf("can not load %s as it is served from recorded responses", c.Name)
+	}
+	// CARs are not verified so that the client is not the bottleneck
+	c.Verify = false
+	c.MaxRequestsPerSecond, c.MaxBytesPerSecond = 0, opts.BytesPerSecond
+
+	if cfg.Count <= 0 {
+		return nil, fmt.Errorf("count must be positive, got %d", cfg.Count)
+	}
+	skipped := make(map[string]string)
+	reqs, err := cfg.buildRequests(ctx, Cohort{ReplayFile: cfg.ReplayFile, Entries: cfg.Entries}, skipped)
+	if err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, fmt.Errorf("no requests to send to %s", c.Name)
+	}
+	paths := make([]string, 0, len(reqs))
+	for path := range reqs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	re := NewRequestExecutor([]Component{*c}, reqs, 0, uuid.New(), "", "", cfg.Options)
+	lt := &loadTest{
+		start:   time.Now(),
+		window:  opts.Window,
+		windows: make([]*LoadWindow, int((opts.Duration+opts.Window-1)/opts.Window)),
+	}
+	for i := range lt.windows {
+		lt.windows[i] = &LoadWindow{Offset: time.Duration(i) * opts.Window}
+	}
+	re.log.Info("starting load test", "component", c.Name, "paths", len(paths), "rps", opts.RequestsPerSecond,
+		"bytes_per_second", opts.BytesPerSecond, "duration", opts.Duration)
+
+	ctx, cancel := context.WithDeadline(ctx, lt.start.Add(opts.Duration))
+	defer cancel()
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	send := func(path string) {
+		defer wg.Done()
+		defer func() { <-sem }()
+		r := re.doHTTPRequest(context.Background(), *c, reqs[path], false)
+		lt.add(time.Now(), r)
+	}
+
+	var tick <-chan time.Time
+	if opts.RequestsPerSecond > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.RequestsPerSecond))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i := 0; ; i++ {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+			case <-tick:
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			select {
+			case sem <- struct{}{}:
+			default:
+				lt.drop(time.Now())
+				continue
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+			case sem <- struct{}{}:
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		wg.Add(1)
+		go send(paths[i%len(paths)])
+	}
+	wg.Wait()
+
+	report := &LoadReport{Component: c.Name, Options: opts, Start: lt.start, Paths: len(paths), Windows: lt.windows}
+	report.Total = &LoadWindow{}
+	for _, w := range lt.windows {
+		w.summarise(opts.Window)
+		report.Total.merge(w)
+	}
+	report.Total.summarise(time.Since(lt.start))
+	return report, nil
+}
+
+// loadTest records the requests of a load test into the window in which they completed. Requests that complete
+// after the duration of the load test are recorded in the last window.
+type loadTest struct {
+	mu      sync.Mutex
+	start   time.Time
+	window  time.Duration
+	windows []*LoadWindow
+}
+
+func (lt *loadTest) at(t time.Time) *LoadWindow {
+	i := int(t.Sub(lt.start) / lt.window)
+	if i >= len(lt.windows) {
+		i = len(lt.windows) - 1
+	}
+	return lt.windows[i]
+}
+
+func (lt *loadTest) add(t time.Time, r Result) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	w := lt.at(t)
+	w.Requests++
+	w.Bytes += r.ResponseSize
+	w.latencies = append(w.latencies, r.Latency)
+	if len(r.ErrorKind) != 0 {
+		w.Errors++
+		if w.ErrorKinds == nil {
+			w.ErrorKinds = make(map[ErrorKind]int)
+		}
+		w.ErrorKinds[r.ErrorKind]++
+	}
+}
+
+func (lt *loadTest) drop(t time.Time) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.at(t).Dropped++
+}
+
+// merge adds the requests of o to the window.
+func (w *LoadWindow) merge(o *LoadWindow) {
+	w.Requests += o.Requests
+	w.Errors += o.Errors
+	w.Dropped += o.Dropped
+	w.Bytes += o.Bytes
+	w.latencies = append(w.latencies, o.latencies...)
+	for k, n := range o.ErrorKinds {
+		if w.ErrorKinds == nil {
+			w.ErrorKinds = make(map[ErrorKind]int)
+		}
+		w.ErrorKinds[k] += n
+	}
+}
+
+// summarise computes the rates and latency percentiles of the window over its length.
+func (w *LoadWindow) summarise(length time.Duration) {
+	sort.Slice(w.latencies, func(i, j int) bool { return w.latencies[i] < w.latencies[j] })
+	w.P50 = percentile(w.latencies, 50)
+	w.P90 = percentile(w.latencies, 90)
+	w.P99 = percentile(w.latencies, 99)
+	if len(w.latencies) != 0 {
+		w.Max = w.latencies[len(w.latencies)-1]
+	}
+	if length > 0 {
+		w.RequestsPerSecond = float64(w.Requests) / length.Seconds()
+		w.BytesPerSecond = float64(w.Bytes) / length.Seconds()
+	}
+}
+
+// WriteCSV writes the windows of the load test as a time series, with one row per window that has its offset, the
+// number of requests, errors and dropped requests, the rates of requests and MiB, the latency percentiles and the
+// number of errors of every kind that occurred during the load test.
+func (r *LoadReport) WriteCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	var kinds []ErrorKind
+	for k := range r.Total.ErrorKinds {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i] < kinds[j] })
+
+	header := []string{"offset_s", "requests", "errors", "dropped", "requests_per_second", "mib_per_second", "p50_ms", "p90_ms", "p99_ms", "max_ms"}
+	for _, k := range kinds {
+		header = append(header, "errors_"+string(k))
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+	}
+	for _, lw := range r.Windows {
+		row := []string{
+			strconv.FormatFloat(lw.Offset.Seconds(), 'f', -1, 64),
+			strconv.Itoa(lw.Requests),
+			strconv.Itoa(lw.Errors),
+			strconv.Itoa(lw.Dropped),
+			strconv.FormatFloat(lw.RequestsPerSecond, 'f', 3, 64),
+			strconv.FormatFloat(lw.BytesPerSecond/(1<<20), 'f', 3, 64),
+			ms(lw.P50), ms(lw.P90), ms(lw.P99), ms(lw.Max),
+		}
+		for _, k := range kinds {
+			row = append(row, strconv.Itoa(lw.ErrorKinds[k]))
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
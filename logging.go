@@ -0,0 +1,58 @@
+package onion
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/exp/slog"
+)
+
+// NewLogger returns a structured logger that writes human readable logs at the given level to w and, if jsonW is
+// not nil, JSON logs at the same level to jsonW.
+func NewLogger(w io.Writer, level slog.Level, jsonW io.Writer) *slog.Logger {
+	opts := slog.HandlerOptions{Level: level}
+	if jsonW == nil {
+		return slog.New(opts.NewTextHandler(w))
+	}
+	return slog.New(fanoutHandler{opts.NewTextHandler(w), opts.NewJSONHandler(jsonW)})
+}
+
+// fanoutHandler sends every record to all of its handlers.
+type fanoutHandler []slog.Handler
+
+func (fh fanoutHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range fh {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fh fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	var err error
+	for _, h := range fh {
+		if h.Enabled(ctx, r.Level) {
+			if herr := h.Handle(ctx, r.Clone()); herr != nil && err == nil {
+				err = herr
+			}
+		}
+	}
+	return err
+}
+
+func (fh fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanoutHandler, len(fh))
+	for i, h := range fh {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (fh fanoutHandler) WithGroup(name string) slog.Handler {
+	out := make(fanoutHandler, len(fh))
+	for i, h := range fh {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
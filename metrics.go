@@ -1,52 +1,229 @@
 package onion
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
 )
 
-const promPushGwAddr = "http://localhost:9091"
+// DefaultPushGatewayAddr is the address of the pushgateway of the local docker compose setup.
+const DefaultPushGatewayAddr = "http://localhost:9091"
+
+// PushGatewayConfig is where and how metrics are pushed at the end of a run.
+type PushGatewayConfig struct {
+	Addr string
+
+	// Username and Password are used for basic auth if Username is set.
+	Username string
+	Password string
+	// BearerToken is sent as an Authorization header if set.
+	BearerToken string
+}
 
 // Note that the purpose of this module is to be useful for a constrained number of test runs
 // Having all these unconstrained labels (i.e. CID and status code to some extent) will result in high cardinality
 // Keep that in mind when using this in a real system
 var (
+	latencyHistogramName  = prometheus.BuildFQName("onion", "response", "duration_seconds")
+	sizeHistogramName     = prometheus.BuildFQName("onion", "response", "size_bytes")
+	errorKindMetricName   = prometheus.BuildFQName("onion", "response", "errors_total")
+	layerSuccessRatioName = prometheus.BuildFQName("onion", "layer", "success_ratio")
+	pairMatchRatioName    = prometheus.BuildFQName("onion", "pair", "match_ratio")
+	responseCodeName      = prometheus.BuildFQName("onion", "response_code", "value")
+
 	labels     = []string{"cid", "layer"}
 	codeLabels = append(labels, "code")
+)
+
+// executorMetrics are the collectors of the requests of a RequestExecutor. Every executor has its own so that
+// executors, and programs embedding onion, do not share the default registry.
+type executorMetrics struct {
+	responseCode         *prometheus.CounterVec
+	responseCodeMismatch *prometheus.CounterVec
+	responseSizeMismatch *prometheus.CounterVec
+
+	latency    *prometheus.SummaryVec
+	throughput *prometheus.SummaryVec
+
+	// histograms can be aggregated across runs and layers, unlike the summaries above
+	latencyHistogram *prometheus.HistogramVec
+	sizeHistogram    *prometheus.HistogramVec
+	errorKind        *prometheus.CounterVec
+	// transferDiscrepancy counts response bodies that do not match their Content-Length or chunked framing
+	transferDiscrepancy *prometheus.CounterVec
 
-	responseCodeMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: prometheus.BuildFQName("onion", "response_code", "value"),
-		Help: "Response codes for a given CID observed for a layer",
-	}, codeLabels)
-	responseCodeMismatchMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: prometheus.BuildFQName("onion", "response_code", "mismatch"),
-		Help: "Response code mismatches for a given CID observed for a layer",
-	}, labels)
-	responseSizeMismatchMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: prometheus.BuildFQName("onion", "response_size", "mismatch"),
-		Help: "Response size mismatches for a given CID observed for a layer",
-	}, labels)
-
-	metrics = []prometheus.Collector{
-		responseCodeMetric,
-		responseCodeMismatchMetric,
-		responseSizeMismatchMetric,
+	layerSuccessRatio *prometheus.GaugeVec
+	pairMatchRatio    *prometheus.GaugeVec
+}
+
+func newExecutorMetrics() *executorMetrics {
+	return &executorMetrics{
+		responseCode: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: responseCodeName,
+			Help: "Response codes for a given CID observed for a layer",
+		}, codeLabels),
+		responseCodeMismatch: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("onion", "response_code", "mismatch"),
+			Help: "Response code mismatches for a given CID observed for a layer",
+		}, labels),
+		responseSizeMismatch: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("onion", "response_size", "mismatch"),
+			Help: "Response size mismatches for a given CID observed for a layer",
+		}, labels),
+
+		latency: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       prometheus.BuildFQName("onion", "response", "latency_seconds"),
+			Help:       "Time taken to send a request and read the response body observed for a layer",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, []string{"layer"}),
+		throughput: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:       prometheus.BuildFQName("onion", "response", "throughput_bytes_per_second"),
+			Help:       "Rate at which response bodies were read observed for a layer",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}, []string{"layer"}),
+
+		latencyHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    latencyHistogramName,
+			Help:    "Time taken to send a request and read the response body observed for a layer",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, []string{"layer"}),
+		sizeHistogram: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    sizeHistogramName,
+			Help:    "Size of the response bodies that were read successfully observed for a layer",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+		}, []string{"layer"}),
+		errorKind: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: errorKindMetricName,
+			Help: "Failed requests observed for a layer by error kind",
+		}, []string{"layer", "kind"}),
+		transferDiscrepancy: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prometheus.BuildFQName("onion", "response", "transfer_discrepancies_total"),
+			Help: "2xx response bodies that do not match their Content-Length or chunked framing observed for a layer by kind (short, long or chunked-truncated)",
+		}, []string{"layer", "kind"}),
+
+		layerSuccessRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: layerSuccessRatioName,
+			Help: "Fraction of the paths of the last run for which a layer returned a 2xx response that was read successfully",
+		}, []string{"layer"}),
+		pairMatchRatio: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: pairMatchRatioName,
+			Help: "Fraction of the paths of the last run for which a pair of layers returned the same status code (kind=status) or the same response bytes (kind=bytes), out of the paths whose bytes were compared",
+		}, []string{"pair", "kind"}),
 	}
-)
+}
+
+func (m *executorMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.responseCode,
+		m.responseCodeMismatch,
+		m.responseSizeMismatch,
+		m.latency,
+		m.throughput,
+		m.latencyHistogram,
+		m.sizeHistogram,
+		m.errorKind,
+		m.transferDiscrepancy,
+		m.layerSuccessRatio,
+		m.pairMatchRatio,
+	}
+}
+
+// registeredMetrics are the collectors of the last run registered with every registerer of an embedding program, by
+// the registerer they were registered with, so that they can be unregistered when the next run registers its own.
+var registeredMetrics = struct {
+	sync.Mutex
+	runs map[prometheus.Registerer]registeredRun
+}{runs: make(map[prometheus.Registerer]registeredRun)}
+
+type registeredRun struct {
+	labelled   prometheus.Registerer
+	collectors []prometheus.Collector
+}
 
-func PushMetrics(runID uuid.UUID) error {
-	pusher := push.New(promPushGwAddr, "onion")
-	for _, co := range metrics {
-		pusher.Collector(co)
+// register registers the collectors with the registerer of an embedding program, labelled with the run ID so that
+// the collectors of successive runs do not collide. The collectors of the previous run registered with it are
+// unregistered, so that the series of a program running many runs do not grow without bound.
+func (m *executorMetrics) register(r prometheus.Registerer, runID uuid.UUID) error {
+	registeredMetrics.Lock()
+	defer registeredMetrics.Unlock()
+	if prev, ok := registeredMetrics.runs[r]; ok {
+		for _, c := range prev.collectors {
+			prev.labelled.Unregister(c)
+		}
+		delete(registeredMetrics.runs, r)
 	}
-	return pusher.
-		Grouping("run_id", runID.String()).
-		Push()
+
+	labelled := prometheus.WrapRegistererWith(prometheus.Labels{"run_id": runID.String()}, r)
+	var registered []prometheus.Collector
+	for _, c := range m.collectors() {
+		if err := labelled.Register(c); err != nil {
+			for _, rc := range registered {
+				labelled.Unregister(rc)
+			}
+			return fmt.Errorf("failed to register metrics: %w", err)
+		}
+		registered = append(registered, c)
+	}
+	registeredMetrics.runs[r] = registeredRun{labelled: labelled, collectors: registered}
+	return nil
 }
 
-func init() {
-	for _, m := range metrics {
-		prometheus.MustRegister(m)
+// setRatioMetrics sets the gauges of the success rate of every layer and the match rates of every pair to those of
+// the run. The caller must hold the lock.
+func (re *RequestExecutor) setRatioMetrics(result2xx map[string]int, statusMismatchPaths map[string][]string) {
+	if len(re.results) == 0 {
+		return
+	}
+	total := float64(len(re.results))
+	for _, c := range re.components {
+		re.metrics.layerSuccessRatio.WithLabelValues(c.Name).Set(float64(result2xx[c.Name]) / total)
+	}
+	for _, p := range re.pairs {
+		name := p.Name()
+		re.metrics.pairMatchRatio.WithLabelValues(name, "status").Set(1 - float64(len(statusMismatchPaths[name]))/total)
+		pm := re.responseReads.Pairs[name]
+		if compared := pm.TotalMatches + len(pm.MismatchPaths); compared != 0 {
+			re.metrics.pairMatchRatio.WithLabelValues(name, "bytes").Set(float64(pm.TotalMatches) / float64(compared))
+		}
 	}
 }
+
+// PushMetrics pushes the metrics gathered by the registry of a run, grouped by the run ID and cohort name, if any.
+func PushMetrics(runID uuid.UUID, cohort string, g prometheus.Gatherer, cfg PushGatewayConfig) error {
+	pusher := push.New(cfg.Addr, "onion").Gatherer(g)
+	if len(cfg.Username) != 0 {
+		pusher.BasicAuth(cfg.Username, cfg.Password)
+	}
+	if len(cfg.BearerToken) != 0 {
+		pusher.Header(http.Header{"Authorization": []string{"Bearer " + cfg.BearerToken}})
+	}
+	pusher.Grouping("run_id", runID.String())
+	if len(cohort) != 0 {
+		pusher.Grouping("cohort", cohort)
+	}
+	return pusher.Push()
+}
+
+// ServeMetrics exposes the metrics gathered by g on /metrics at the given address so that they can be scraped during
+// long runs, e.g. those of a registry passed as ExecutorOptions.Registerer. Errors other than the server being closed
+// are sent on the returned channel.
+func ServeMetrics(addr string, g prometheus.Gatherer) (*http.Server, <-chan error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- fmt.Errorf("metrics server failed: %w", err)
+		}
+		close(errCh)
+	}()
+	return srv, errCh
+}
@@ -0,0 +1,267 @@
+package onion
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/filecoin-saturn/onion/replay"
+	car "github.com/ipld/go-car/v2"
+)
+
+const (
+	// VariantCarDFSDups requests the CAR of the path in depth-first order with duplicate blocks.
+	VariantCarDFSDups GatewayVariant = "car-dfs-dups"
+	// VariantCarDFSNoDups requests the CAR of the path in depth-first order without duplicate blocks.
+	VariantCarDFSNoDups GatewayVariant = "car-dfs-nodups"
+	// VariantCarUnkDups requests the CAR of the path in any order with duplicate blocks.
+	VariantCarUnkDups GatewayVariant = "car-unk-dups"
+	// VariantCarUnkNoDups requests the CAR of the path in any order without duplicate blocks.
+	VariantCarUnkNoDups GatewayVariant = "car-unk-nodups"
+	// VariantCarDefault requests the CAR of the path without parameters, leaving them to the gateway.
+	VariantCarDefault GatewayVariant = "car-default"
+)
+
+// CarNegotiations are the Accept headers that the CAR of a path is requested with by every CAR negotiation variant.
+var CarNegotiations = map[GatewayVariant]string{
+	VariantCarDFSDups:   carContentType + "; version=1; order=dfs; dups=y",
+	VariantCarDFSNoDups: carContentType + "; version=1; order=dfs; dups=n",
+	VariantCarUnkDups:   carContentType + "; version=1; order=unk; dups=y",
+	VariantCarUnkNoDups: carContentType + "; version=1; order=unk; dups=n",
+	VariantCarDefault:   carContentType,
+}
+
+// CarNegotiationVariants are the CAR negotiation variants, in the order they are summarised in.
+var CarNegotiationVariants = []GatewayVariant{VariantCarDFSDups, VariantCarDFSNoDups, VariantCarUnkDups, VariantCarUnkNoDups, VariantCarDefault}
+
+// isCarNegotiation reports whether the variant is a CAR negotiation variant.
+func isCarNegotiation(v GatewayVariant) bool {
+	_, ok := CarNegotiations[v]
+	return ok
+}
+
+// carNegotiations returns the replayed request for every CAR negotiation variant of the entry, which asks for the
+// CAR by its Accept header rather than its format param. Only GET requests for CARs are varied.
+func carNegotiations(e replay.ReplayEntry) (map[GatewayVariant]replay.ReplayEntry, error) {
+	if (len(e.Method) != 0 && e.Method != http.MethodGet) || replayExtract(e.URL, e.Headers) != ExtractCAR {
+		return nil, nil
+	}
+	u, err := deleteQueryParam(e.URL, "format")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[GatewayVariant]replay.ReplayEntry, len(CarNegotiations))
+	for v, accept := range CarNegotiations {
+		h := e.Headers.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Set("Accept", accept)
+		out[v] = replay.ReplayEntry{Method: e.Method, URL: u, Headers: h}
+	}
+	return out, nil
+}
+
+// addCarNegotiations adds the requests of the CAR negotiation variants of the replayed request, sent at the same
+// offset. They are keyed by the key of the replayed request and the variant, as their path is the same.
+func addCarNegotiations(ctx context.Context, ub *URLBuilder, reqs map[string]URLsToTest, e replay.ReplayEntry, key string, offset time.Duration) {
+	variants, err := carNegotiations(e)
+	if err != nil {
+		fmt.Printf("not negotiating %s: %s\n", e.URL, err)
+		return
+	}
+	for v, ve := range variants {
+		o, err := buildURLsToTest(ub, ve)
+		if err == nil {
+			o, err = ub.Resolve(ctx, o)
+		}
+		if err != nil {
+			fmt.Printf("skipping %s variant of %s: %s\n", v, e.URL, err)
+			continue
+		}
+		o.Key = key + "#" + string(v)
+		o.Variant = v
+		o.Offset = offset
+		reqs[o.Key] = ub.WithRequest(o, ve.Method, ve.Headers, nil)
+	}
+}
+
+// NegotiationReport describes whether a CAR response honors the parameters its request negotiated in its Accept
+// header.
+type NegotiationReport struct {
+	Accept      string
+	ContentType string
+	// Version, Order and Dups are the parameters the Content-Type declares, if any.
+	Version string `json:",omitempty"`
+	Order   string `json:",omitempty"`
+	Dups    string `json:",omitempty"`
+	// CarOrder is the verification of the CAR against the order and duplicate block policy its Content-Type
+	// declares, if its body was captured.
+	CarOrder *CarOrderReport `json:",omitempty"`
+	// Violations describe how the response does not honor the negotiated parameters.
+	Violations []string `json:",omitempty"`
+}
+
+func (r *NegotiationReport) OK() bool {
+	return len(r.Violations) == 0
+}
+
+// negotiated returns the version, order and dups the response declares, with the defaults of the trustless gateway
+// spec for those it does not declare, so that the responses of two layers can be compared.
+func (r *NegotiationReport) negotiated() string {
+	version, order, dups := r.Version, r.Order, r.Dups
+	if len(version) == 0 {
+		version = "1"
+	}
+	if len(order) == 0 {
+		order = CarOrderUnknown
+	}
+	if len(dups) == 0 {
+		dups = "y"
+	}
+	return fmt.Sprintf("version=%s; order=%s; dups=%s", version, order, dups)
+}
+
+// VerifyCarNegotiation checks that the Content-Type of a CAR response to the request url with the Accept header is
+// a CAR that declares the version, order and dups the request asked for, where any order honors order=unk, and, if
+// the body was captured, that the CAR is of the declared version and follows the declared order and duplicate block
+// policy.
+func VerifyCarNegotiation(accept, contentType string, body []byte, requestUrl string) *NegotiationReport {
+	report := &NegotiationReport{Accept: accept, ContentType: contentType}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != carContentType {
+		report.Violations = append(report.Violations, fmt.Sprintf("Content-Type %q is not a CAR", contentType))
+		return report
+	}
+	report.Version, report.Order, report.Dups = params["version"], params["order"], params["dups"]
+
+	_, asked, _ := mime.ParseMediaType(accept)
+	for _, param := range []string{"version", "order", "dups"} {
+		switch want, got := asked[param], params[param]; {
+		case len(want) == 0:
+		case param == "order" && want == CarOrderUnknown:
+			// a request for any order is honored by whichever order the CAR is in
+		case len(got) == 0:
+			report.Violations = append(report.Violations, fmt.Sprintf("Content-Type does not declare the %s=%s asked for", param, want))
+		case got != want:
+			report.Violations = append(report.Violations, fmt.Sprintf("Content-Type declares %s=%s although %s=%s was asked for", param, got, param, want))
+		}
+	}
+	if body == nil {
+		return report
+	}
+
+	version := report.Version
+	if len(version) == 0 {
+		version = "1"
+	}
+	if v, err := car.ReadVersion(bytes.NewReader(body)); err != nil {
+		report.Violations = append(report.Violations, fmt.Sprintf("failed to read car version: %s", err))
+	} else if strconv.FormatUint(v, 10) != version {
+		report.Violations = append(report.Violations, fmt.Sprintf("CAR is version %d although its Content-Type declares version %s", v, version))
+	}
+	report.CarOrder = VerifyCarOrder(body, requestUrl, ParseCarOrderPolicy(contentType, CarOrderPolicy{Order: CarOrderUnknown, Dups: true}))
+	if !report.CarOrder.OK() {
+		report.Violations = append(report.Violations, "CAR does not follow the order and duplicate block policy its Content-Type declares")
+	}
+	return report
+}
+
+// NegotiationStats counts the responses to a CAR negotiation variant that do not honor the negotiated parameters
+// and the pairs whose responses declare different parameters.
+type NegotiationStats struct {
+	// Violations is keyed by component name.
+	Violations map[string]int
+	// Inconsistent is keyed by pair name, and InconsistentPaths lists the paths of every pair.
+	Inconsistent      map[string]int
+	InconsistentPaths map[string][]string `json:",omitempty"`
+}
+
+// negotiationStats counts the negotiation violations and inconsistencies of every CAR negotiation variant. The
+// caller must hold the lock.
+func (re *RequestExecutor) negotiationStats() map[GatewayVariant]*NegotiationStats {
+	out := make(map[GatewayVariant]*NegotiationStats)
+	for path, rs := range re.results {
+		v := re.reqs[path].Variant
+		if !isCarNegotiation(v) {
+			continue
+		}
+		s := out[v]
+		if s == nil {
+			s = &NegotiationStats{
+				Violations:        make(map[string]int),
+				Inconsistent:      make(map[string]int),
+				InconsistentPaths: make(map[string][]string),
+			}
+			out[v] = s
+		}
+		for name, r := range rs {
+			if r != nil && r.Negotiation != nil && !r.Negotiation.OK() {
+				s.Violations[name]++
+			}
+		}
+		for _, p := range re.pairs {
+			ra, rb := rs[p.A.Name], rs[p.B.Name]
+			if ra == nil || rb == nil || ra.Negotiation == nil || rb.Negotiation == nil {
+				continue
+			}
+			if ra.Negotiation.negotiated() != rb.Negotiation.negotiated() {
+				s.Inconsistent[p.Name()]++
+				s.InconsistentPaths[p.Name()] = append(s.InconsistentPaths[p.Name()], path)
+			}
+		}
+	}
+	for _, s := range out {
+		for _, paths := range s.InconsistentPaths {
+			sort.Strings(paths)
+		}
+	}
+	return out
+}
+
+// hasNegotiations reports whether any of the paths of the run is a CAR negotiation variant.
+func (re *RequestExecutor) hasNegotiations() bool {
+	for _, urls := range re.reqs {
+		if isCarNegotiation(urls.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNegotiations writes the responses of every component that do not honor their negotiated parameters and the
+// negotiation stats of every variant to car-negotiation.json, and prints them. The caller must hold the lock.
+func (re *RequestExecutor) writeNegotiations() {
+	stats := re.negotiationStats()
+	re.writeJSON(stats, re.rrFile("car-negotiation.json"))
+
+	fmt.Println("\n ----------SUMMARY OF CAR NEGOTIATION --------------")
+	for _, c := range re.components {
+		if c.Extract != ExtractCAR {
+			continue
+		}
+		reads := re.responseReads.Components[c.Name]
+		re.writeJSON(reads.NegotiationViolations, re.rrFile(fmt.Sprintf("%s-negotiation-violations.json", c.Name)))
+		fmt.Printf("\n Run-%d; %s returned CARs that do not honor the parameters negotiated in their Accept header for %d requests", re.n, c.Name, len(reads.NegotiationViolationPaths))
+	}
+	for _, v := range CarNegotiationVariants {
+		s := stats[v]
+		if s == nil {
+			continue
+		}
+		for _, c := range re.components {
+			if c.Extract == ExtractCAR {
+				fmt.Printf("\n Run-%d; %s %s: %d negotiation violations", re.n, c.Name, v, s.Violations[c.Name])
+			}
+		}
+		for _, p := range re.pairs {
+			fmt.Printf("\n Run-%d; %s %s %s: %d responses declaring different parameters", re.n, p.A.Name, p.B.Name, v, s.Inconsistent[p.Name()])
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,167 @@
+package onion
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NewComponents builds the components of a layer. A layer with several hosts, e.g. the L1 nodes of a deployment,
+// is fanned out into a component per node named "{name}@{n}", whose responses are also compared with each other. A
+// layer with a protocol matrix is fanned out into a component per HTTP version.
+func NewComponents(cfg ComponentConfig) ([]Component, error) {
+	if cfg.Orchestrator != nil {
+		return nil, fmt.Errorf("invalid %s config: the nodes of the orchestrator must be discovered first", cfg.Name)
+	}
+	if cfg.ProtocolMatrix {
+		return protocolMatrix(cfg)
+	}
+	if len(cfg.Hosts) == 0 {
+		c, err := NewComponent(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return []Component{c}, nil
+	}
+	if len(cfg.Host) != 0 {
+		return nil, fmt.Errorf("invalid %s config: only one of host and hosts can be set", cfg.Name)
+	}
+	if cfg.Kubo != nil {
+		return nil, fmt.Errorf("invalid %s config: a kubo node has a single host", cfg.Name)
+	}
+
+	out := make([]Component, 0, len(cfg.Hosts))
+	for i, host := range cfg.Hosts {
+		ncfg := cfg
+		ncfg.Name = fmt.Sprintf("%s@%d", cfg.Name, i+1)
+		ncfg.Host = host
+		ncfg.Hosts = nil
+		c, err := NewComponent(ncfg)
+		if err != nil {
+			return nil, err
+		}
+		c.Group = cfg.Name
+		c.Node = host
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// NodeConsistency records how consistently the nodes of a multi-node layer respond to the same paths.
+type NodeConsistency struct {
+	// TotalConsistent is the number of paths for which all nodes responded the same.
+	TotalConsistent int
+	// Nodes maps a node's component name to its host.
+	Nodes map[string]string
+	// OutlierPaths maps a node's component name to the paths for which it responded differently than the
+	// majority of the nodes. If the nodes responded differently without a majority, all are outliers.
+	OutlierPaths map[string][]string
+	// Outliers are the results of all nodes for the paths with outliers.
+	Outliers map[string]Results
+}
+
+// nodeGroups returns the nodes of every multi-node layer, keyed by layer name.
+func nodeGroups(components []Component) map[string][]Component {
+	out := make(map[string][]Component)
+	for _, c := range components {
+		if len(c.Group) != 0 {
+			out[c.Group] = append(out[c.Group], c)
+		}
+	}
+	return out
+}
+
+// nodeOutliers returns the nodes of a layer whose responses differ from those of the majority of its nodes, i.e.
+// whose status or, if the response was read, body digest differs. All nodes are outliers if they do not all
+// respond the same and there is no majority.
+func (pc *pathComparer) nodeOutliers(nodes []Component) []string {
+	fingerprints := make(map[string]string, len(nodes))
+	counts := make(map[string]int)
+	for _, c := range nodes {
+		r := pc.rs[c.Name]
+		fp := fmt.Sprintf("status:%d", r.StatusCode)
+		if isReadOK(r) {
+			fp = "sha256:" + pc.response(c).Digest()
+		}
+		fingerprints[c.Name] = fp
+		counts[fp]++
+	}
+
+	majority, n := "", 0
+	for fp, count := range counts {
+		if count > n {
+			majority, n = fp, count
+		}
+	}
+	if n == len(nodes) {
+		return nil
+	}
+	if n*2 <= len(nodes) {
+		majority = ""
+	}
+
+	var out []string
+	for _, c := range nodes {
+		if fingerprints[c.Name] != majority {
+			out = append(out, c.Name)
+		}
+	}
+	return out
+}
+
+// writeNodeConsistency writes the outliers of every multi-node layer and prints a summary. The caller must hold
+// the lock.
+func (re *RequestExecutor) writeNodeConsistency() {
+	if len(re.responseReads.Nodes) == 0 {
+		return
+	}
+
+	fmt.Println("\n ----------SUMMARY OF NODE CONSISTENCY --------------")
+	groups := make([]string, 0, len(re.responseReads.Nodes))
+	for group := range re.responseReads.Nodes {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		nc := re.responseReads.Nodes[group]
+		re.writeJSON(nc, re.rrFile(fmt.Sprintf("%s-node-outliers.json", group)))
+
+		fmt.Printf("\n Run-%d; %s paths consistent across %d nodes: %d", re.n, group, len(nc.Nodes), nc.TotalConsistent)
+		for _, c := range nodeGroups(re.components)[group] {
+			fmt.Printf("\n Run-%d; %s (%s) outlier for %d paths", re.n, c.Name, c.Node, len(nc.OutlierPaths[c.Name]))
+		}
+	}
+	fmt.Println()
+}
+
+// protocolMatrix fans the layer out into the components "{name}-h1" and "{name}-h2", which query it over HTTP/1.1
+// and HTTP/2. They are registered next to each other so that they are compared with each other, and are grouped
+// like the nodes of a layer so that their consistency is reported and they can be disabled by the name of the layer.
+func protocolMatrix(cfg ComponentConfig) ([]Component, error) {
+	if len(cfg.Hosts) != 0 {
+		return nil, fmt.Errorf("invalid %s config: only one of hosts and protocolMatrix can be set", cfg.Name)
+	}
+	if len(cfg.HTTPVersion) != 0 {
+		return nil, fmt.Errorf("invalid %s config: only one of httpVersion and protocolMatrix can be set", cfg.Name)
+	}
+
+	var out []Component
+	for _, v := range []struct {
+		suffix  string
+		version HTTPVersion
+	}{{"h1", HTTP1}, {"h2", HTTP2}} {
+		pcfg := cfg
+		pcfg.Name = fmt.Sprintf("%s-%s", cfg.Name, v.suffix)
+		pcfg.HTTPVersion = string(v.version)
+		pcfg.ProtocolMatrix = false
+		c, err := NewComponent(pcfg)
+		if err != nil {
+			return nil, err
+		}
+		c.Group = cfg.Name
+		c.Node = cfg.Host
+		out = append(out, c)
+		// only one of them can be the reference
+		cfg.Reference = false
+	}
+	return out, nil
+}
@@ -0,0 +1,311 @@
+package onion
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// OfflineVerifyOptions configures VerifySavedCARs.
+type OfflineVerifyOptions struct {
+	// ExtractTimeout is the time allowed to extract the file bytes of every CAR. Defaults to 30s.
+	ExtractTimeout time.Duration
+	// CarOrder is the block order and duplicate block policy that CARs are verified against unless the CAR
+	// declares its own in its Content-Type.
+	CarOrder CarOrderPolicy
+}
+
+// SavedCARVerification is the offline verification of a CAR body saved by a run.
+type SavedCARVerification struct {
+	Path      string
+	Component string
+	Url       string
+	// File is the saved body, relative to the results directory.
+	File string
+	// Truncated is set if only part of the body was saved as an artifact, in which case it is not verified.
+	Truncated bool `json:",omitempty"`
+
+	// RawDigest is the hex encoded sha256 of the file bytes extracted from the CAR, and ExtractError is set if they
+	// could not be extracted.
+	RawDigest    string `json:",omitempty"`
+	ExtractError string `json:",omitempty"`
+	// RecordedRawDigest and RecordedExtractError are what the run recorded when it extracted the CAR, if it did.
+	// RawChanged is set if the file bytes extracted now differ from those extracted by the run, e.g. because the
+	// extraction was fixed since.
+	RecordedRawDigest    string `json:",omitempty"`
+	RecordedExtractError string `json:",omitempty"`
+	RawChanged           bool   `json:",omitempty"`
+
+	BlockIntegrity *BlockIntegrityReport `json:",omitempty"`
+	DagScope       *DagScopeReport       `json:",omitempty"`
+	CarOrder       *CarOrderReport       `json:",omitempty"`
+	CarIndex       *CarIndexReport       `json:",omitempty"`
+}
+
+// OK reports whether the CAR passed every check.
+func (v SavedCARVerification) OK() bool {
+	return !v.Truncated && len(v.ExtractError) == 0 && v.BlockIntegrity.OK() && v.DagScope.OK() && v.CarOrder.OK() &&
+		(v.CarIndex == nil || v.CarIndex.OK())
+}
+
+// OfflineVerification is the report of VerifySavedCARs.
+type OfflineVerification struct {
+	Dir  string
+	CARs []SavedCARVerification
+	// Passed, Failed and Truncated count the CARs that passed every check, failed any and were not verified
+	// because they were truncated. RawChanged counts those whose extracted file bytes changed since the run.
+	Passed     int
+	Failed     int
+	Truncated  int
+	RawChanged int
+}
+
+// savedCAR is a CAR body saved by a run along with the result it was returned with.
+type savedCAR struct {
+	path      string
+	component string
+	file      string
+	result    *Result
+	truncated bool
+	// rawDigest is the digest of the file bytes saved as an artifact along with the CAR, if any.
+	rawDigest string
+}
+
+// VerifySavedCARs re-runs the extraction, block integrity, dag-scope, block order and CARv2 index checks on the CAR
+// bodies a run saved to its results directory, both the artifacts of mismatched paths saved with SaveArtifacts and
+// the bodies saved with SaveBodies, so that a run can be re-validated offline, e.g. once the extraction is fixed.
+func VerifySavedCARs(dir string, opts OfflineVerifyOptions) (*OfflineVerification, error) {
+	if opts.ExtractTimeout <= 0 {
+		opts.ExtractTimeout = defaultExtractTimeout
+	}
+	cars, err := artifactCARs(dir)
+	if err != nil {
+		return nil, err
+	}
+	bodies, err := bodyCARs(dir)
+	if err != nil {
+		return nil, err
+	}
+	cars = append(cars, bodies...)
+	if len(cars) == 0 {
+		return nil, fmt.Errorf("no saved CAR bodies in %s; was the run started with -artifacts or -save-bodies?", dir)
+	}
+	sort.Slice(cars, func(i, j int) bool {
+		if cars[i].path != cars[j].path {
+			return cars[i].path < cars[j].path
+		}
+		if cars[i].component != cars[j].component {
+			return cars[i].component < cars[j].component
+		}
+		return cars[i].file < cars[j].file
+	})
+
+	out := &OfflineVerification{Dir: dir}
+	for _, sc := range cars {
+		v, err := verifySavedCAR(dir, sc, opts)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case v.Truncated:
+			out.Truncated++
+		case v.OK():
+			out.Passed++
+		default:
+			out.Failed++
+		}
+		if v.RawChanged {
+			out.RawChanged++
+		}
+		out.CARs = append(out.CARs, v)
+	}
+	return out, nil
+}
+
+// verifySavedCAR reads the saved CAR and checks it.
+func verifySavedCAR(dir string, sc savedCAR, opts OfflineVerifyOptions) (SavedCARVerification, error) {
+	r := sc.result
+	v := SavedCARVerification{
+		Path:                 sc.path,
+		Component:            sc.component,
+		Url:                  r.Url,
+		File:                 sc.file,
+		Truncated:            sc.truncated,
+		RecordedRawDigest:    r.RawDigest,
+		RecordedExtractError: r.ExtractError,
+	}
+	if len(v.RecordedRawDigest) == 0 {
+		v.RecordedRawDigest = sc.rawDigest
+	}
+	if v.Truncated {
+		return v, nil
+	}
+	carBytes, err := readSavedBody(filepath.Join(dir, sc.file))
+	if err != nil {
+		return v, err
+	}
+
+	rng, err := savedRange(r)
+	if err != nil {
+		v.ExtractError = err.Error()
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ExtractTimeout)
+		raw, err := ExtractRawPath(ctx, carBytes, savedSubpath(r), rng)
+		cancel()
+		if err != nil {
+			v.ExtractError = err.Error()
+		} else {
+			v.RawDigest = sha256Hex(raw)
+		}
+	}
+	v.RawChanged = len(v.RecordedRawDigest) != 0 && v.RawDigest != v.RecordedRawDigest
+
+	contentType := http.Header(r.Headers).Get("Content-Type")
+	v.BlockIntegrity = VerifyBlocks(carBytes)
+	v.DagScope = VerifyDagScope(carBytes, r.Url)
+	v.CarOrder = VerifyCarOrder(carBytes, r.Url, ParseCarOrderPolicy(contentType, opts.CarOrder))
+	v.CarIndex = VerifyCarIndex(carBytes)
+	return v, nil
+}
+
+// savedRange returns the byte range of the entity that the result is a response to, if any.
+func savedRange(r *Result) (*ByteRange, error) {
+	if len(r.Range) != 0 {
+		rng, err := ParseRangeHeader(r.Range)
+		return &rng, err
+	}
+	if eb := entityBytes(r.Url); len(eb) != 0 {
+		rng, err := ParseEntityBytes(eb)
+		return &rng, err
+	}
+	return nil, nil
+}
+
+// savedSubpath returns the path of the entity below the root of the content path that the result is a response to.
+// The URLs of subdomain requests only have the subpath.
+func savedSubpath(r *Result) string {
+	u, err := url.Parse(r.Url)
+	if err != nil {
+		return ""
+	}
+	if _, _, rest, err := splitContentPath(u.Path); err == nil {
+		return rest
+	}
+	return u.Path
+}
+
+// isCARResult reports whether the result is a CAR response.
+func isCARResult(r *Result) bool {
+	if r == nil || !isReadOK(r) {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(http.Header(r.Headers).Get("Content-Type"))
+	return err == nil && mt == carContentType
+}
+
+// artifactCARs returns the CAR bodies saved as artifacts of mismatched paths.
+func artifactCARs(dir string) ([]savedCAR, error) {
+	manifests, err := filepath.Glob(filepath.Join(dir, artifactsDir, "*", "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []savedCAR
+	for _, mf := range manifests {
+		var m ArtifactManifest
+		if err := readJSONF(mf, &m); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(dir, filepath.Dir(mf))
+		if err != nil {
+			return nil, err
+		}
+		for c, files := range m.Files {
+			r := m.Results[c]
+			if !isCARResult(r) {
+				continue
+			}
+			var body *ArtifactFile
+			var rawDigest string
+			for i, f := range files {
+				switch f.Kind {
+				case "body":
+					body = &files[i]
+				case "raw":
+					if f.Saved == f.Size {
+						rawDigest = f.Digest
+					}
+				}
+			}
+			if body == nil {
+				continue
+			}
+			out = append(out, savedCAR{
+				path:      m.Path,
+				component: c,
+				file:      filepath.Join(rel, body.Name),
+				result:    r,
+				truncated: body.Saved < body.Size,
+				rawDigest: rawDigest,
+			})
+		}
+	}
+	return out, nil
+}
+
+// bodyCARs returns the CAR bodies saved to the bodies directory, which are named after their digest, for every path
+// whose result recorded a saved body.
+func bodyCARs(dir string) ([]savedCAR, error) {
+	if _, err := os.Stat(filepath.Join(dir, goldenBodiesDir)); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var results map[string]Results
+	if err := readJSONF(filepath.Join(dir, "results.json"), &results); err != nil {
+		return nil, err
+	}
+	var out []savedCAR
+	for path, rs := range results {
+		for c, r := range rs {
+			if !isCARResult(r) || len(r.ResponseDigest) == 0 {
+				continue
+			}
+			file := filepath.Join(goldenBodiesDir, r.ResponseDigest)
+			if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+				continue
+			}
+			out = append(out, savedCAR{path: path, component: c, file: file, result: r})
+		}
+	}
+	return out, nil
+}
+
+// readSavedBody reads a saved body, decompressing gzip-compressed artifacts.
+func readSavedBody(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if filepath.Ext(file) == ".gz" {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	bz, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return bz, nil
+}
@@ -0,0 +1,187 @@
+package onion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultOrchestratorURL is the endpoint of the Saturn orchestrator that lists the nodes of the network.
+	DefaultOrchestratorURL = "https://orchestrator.strn.pl/stats"
+	// defaultOrchestratorTimeout bounds the request to the orchestrator by default.
+	defaultOrchestratorTimeout = 30 * time.Second
+	// orchestratorActive is the state of the nodes that serve traffic.
+	orchestratorActive = "active"
+)
+
+// OrchestratorConfig discovers the nodes of a layer, e.g. the L1 nodes of Saturn, from the orchestrator instead of
+// listing them in hosts.
+type OrchestratorConfig struct {
+	// URL is the endpoint that lists the nodes. Defaults to DefaultOrchestratorURL.
+	URL string `toml:"url"`
+	// Regions, Countries and Versions select the nodes in any of the regions, e.g. "Europe", with any of the
+	// country codes, e.g. "DE", and whose version starts with any of the versions, e.g. "1042". Empty to select
+	// every active node.
+	Regions   []string `toml:"regions"`
+	Countries []string `toml:"countries"`
+	Versions  []string `toml:"versions"`
+	// MaxNodes is the number of selected nodes to test at most, in the order of their IDs. 0 for all.
+	MaxNodes int `toml:"maxNodes"`
+	// Port is the port the nodes are requested on. Defaults to that of the protocol of the layer.
+	Port int `toml:"port"`
+	// Timeout bounds the request to the orchestrator. Defaults to 30s.
+	Timeout string `toml:"timeout"`
+}
+
+// OrchestratorNode is a node listed by the orchestrator.
+type OrchestratorNode struct {
+	ID        string `json:"id"`
+	IPAddress string `json:"ipAddress"`
+	State     string `json:"state"`
+	Version   string `json:"version"`
+	Geoloc    struct {
+		Region      string `json:"region"`
+		Country     string `json:"country"`
+		CountryCode string `json:"countryCode"`
+	} `json:"geoloc"`
+}
+
+// selected reports whether the node is active and matches the filters of the config.
+func (n OrchestratorNode) selected(cfg OrchestratorConfig) bool {
+	if n.State != orchestratorActive || len(n.IPAddress) == 0 {
+		return false
+	}
+	if len(cfg.Regions) != 0 && !containsFold(cfg.Regions, n.Geoloc.Region) {
+		return false
+	}
+	if len(cfg.Countries) != 0 && !containsFold(cfg.Countries, n.Geoloc.CountryCode) && !containsFold(cfg.Countries, n.Geoloc.Country) {
+		return false
+	}
+	if len(cfg.Versions) == 0 {
+		return true
+	}
+	for _, v := range cfg.Versions {
+		if strings.HasPrefix(n.Version, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiscoverNodes lists the active nodes of the orchestrator that match the filters of the config, sorted by ID.
+func DiscoverNodes(ctx context.Context, cfg OrchestratorConfig) ([]OrchestratorNode, error) {
+	endpoint := cfg.URL
+	if len(endpoint) == 0 {
+		endpoint = DefaultOrchestratorURL
+	}
+	timeout := defaultOrchestratorTimeout
+	if len(cfg.Timeout) != 0 {
+		d, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid orchestrator timeout %q: %w", cfg.Timeout, err)
+		}
+		timeout = d
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid orchestrator URL %q: %w", endpoint, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query the orchestrator: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return nil, fmt.Errorf("orchestrator returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var stats struct {
+		Nodes []OrchestratorNode `json:"nodes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, fmt.Errorf("failed to decode the nodes of the orchestrator: %w", err)
+	}
+
+	var out []OrchestratorNode
+	for _, n := range stats.Nodes {
+		if n.selected(cfg) {
+			out = append(out, n)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	if cfg.MaxNodes > 0 && len(out) > cfg.MaxNodes {
+		out = out[:cfg.MaxNodes]
+	}
+	return out, nil
+}
+
+// UndiscoveredLayer returns the config of a disabled layer whose nodes are not discovered, a single disabled component
+// whose host is that of the orchestrator, so that the pairs of the layer stay known without querying the
+// orchestrator.
+func UndiscoveredLayer(cfg ComponentConfig) ComponentConfig {
+	if cfg.Orchestrator == nil {
+		return cfg
+	}
+	endpoint := cfg.Orchestrator.URL
+	if len(endpoint) == 0 {
+		endpoint = DefaultOrchestratorURL
+	}
+	if u, err := url.Parse(endpoint); err == nil && len(u.Host) != 0 {
+		cfg.Host = u.Host
+	} else {
+		cfg.Host = "orchestrator"
+	}
+	cfg.Orchestrator = nil
+	cfg.Disabled = true
+	return cfg
+}
+
+// DiscoverHosts returns the config of the layer with the nodes that its orchestrator config selects as its hosts,
+// so that NewComponents fans it out into a component per node. Configs without an orchestrator are returned as is.
+func DiscoverHosts(ctx context.Context, cfg ComponentConfig) (ComponentConfig, []OrchestratorNode, error) {
+	if cfg.Orchestrator == nil {
+		return cfg, nil, nil
+	}
+	if len(cfg.Host) != 0 || len(cfg.Hosts) != 0 {
+		return cfg, nil, fmt.Errorf("invalid %s config: only one of host, hosts and orchestrator can be set", cfg.Name)
+	}
+	nodes, err := DiscoverNodes(ctx, *cfg.Orchestrator)
+	if err != nil {
+		return cfg, nil, fmt.Errorf("failed to discover the nodes of %s: %w", cfg.Name, err)
+	}
+	if len(nodes) == 0 {
+		return cfg, nil, fmt.Errorf("the orchestrator lists no active nodes of %s that match its filters", cfg.Name)
+	}
+	for _, n := range nodes {
+		host := n.IPAddress
+		if cfg.Orchestrator.Port != 0 {
+			host = net.JoinHostPort(host, strconv.Itoa(cfg.Orchestrator.Port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		cfg.Hosts = append(cfg.Hosts, host)
+	}
+	cfg.Orchestrator = nil
+	return cfg, nodes, nil
+}
@@ -0,0 +1,445 @@
+package onion
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+const (
+	// defaultProbeProviders is the number of providers of a CID that are probed by default.
+	defaultProbeProviders = 5
+	// maxProbeBlockSize is the largest block read from a provider, above the block size limit of bitswap.
+	maxProbeBlockSize = 4 << 20
+	// multistreamProtocol is the header of the multistream-select handshake that libp2p connections start with.
+	multistreamProtocol = "/multistream/1.0.0\n"
+)
+
+// Prober checks whether the root block of a CID can be retrieved from a provider returned by cid.contact. Probers
+// that speak other protocols, e.g. graphsync, can be plugged in by implementing it.
+type Prober interface {
+	Probe(ctx context.Context, c cid.Cid, p ProviderRecord) ProviderProbe
+}
+
+// ProviderProbe is the outcome of probing a provider for a CID.
+type ProviderProbe struct {
+	ID string
+	// Addr is the multiaddr that was probed.
+	Addr string `json:",omitempty"`
+	// Protocol is how the provider was probed, e.g. "http", "bitswap" or "tcp".
+	Protocol string `json:",omitempty"`
+	// Reachable is true if the provider could be connected to, and Retrieved if it returned the root block.
+	Reachable bool
+	Retrieved bool
+	// Libp2p is true if the provider answered the multistream-select handshake of libp2p on a TCP address.
+	Libp2p  bool `json:",omitempty"`
+	Latency time.Duration
+	Error   string `json:",omitempty"`
+}
+
+// ProbeReport records whether the root CID of a mismatched path can be retrieved from its providers at all, to tell
+// content that is missing from the network from content that the layers fail to fetch.
+type ProbeReport struct {
+	Cid       string
+	Providers []ProviderProbe `json:",omitempty"`
+	// Retrievable is true if any provider returned the root block, and Reachable if any could be connected to.
+	Retrievable bool
+	Reachable   bool
+	// Indexed is true if cid.contact returned any provider of the CID.
+	Indexed bool
+	// Error is set if the providers of the CID could not be looked up.
+	Error string `json:",omitempty"`
+}
+
+// ProbeVerdict tells from the probes of the providers of the root CID of a mismatched path whether the path failed
+// because its content can not be retrieved from the network or because of the layers.
+type ProbeVerdict string
+
+const (
+	// ProbeLookupFailed is a root CID whose providers could not be looked up on cid.contact.
+	ProbeLookupFailed ProbeVerdict = "lookup-failed"
+	// ProbeNotIndexed is a root CID that cid.contact has no providers for.
+	ProbeNotIndexed ProbeVerdict = "not-indexed"
+	// ProbeProviderUnreachable is a root CID that is indexed but none of whose probed providers could be connected to.
+	ProbeProviderUnreachable ProbeVerdict = "provider-unreachable"
+	// ProbeLayerFailed is a path that some layers failed to serve although a provider of its root CID was up.
+	ProbeLayerFailed ProbeVerdict = "layer-failed"
+	// ProbeProviderUp is a path that a provider of its root CID was up for and that every layer served, i.e. whose
+	// responses differ in content rather than because a retrieval failed.
+	ProbeProviderUp ProbeVerdict = "provider-up"
+)
+
+// ProbeDiagnosis is the verdict of the probes of the providers of a mismatched path.
+type ProbeDiagnosis struct {
+	Verdict ProbeVerdict
+	// FailedLayers are the components that failed to serve the path although a provider was up.
+	FailedLayers []string `json:",omitempty"`
+}
+
+// HTTPProber retrieves the root block from providers that serve the trustless gateway protocol over HTTP and
+// otherwise only checks that providers accept TCP connections, without speaking bitswap like a BitswapProber.
+type HTTPProber struct {
+	Client *http.Client
+	// Timeout is the timeout of every probe. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+func (hp *HTTPProber) Probe(ctx context.Context, c cid.Cid, p ProviderRecord) ProviderProbe {
+	timeout := hp.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	client := hp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	out := ProviderProbe{ID: p.ID, Error: "no dialable address"}
+	// providers that serve HTTP are probed first as they can actually be retrieved from
+	addrs := make([]probeAddr, 0, len(p.Addrs))
+	for _, a := range p.Addrs {
+		if pa, ok := parseProbeAddr(a); ok && len(pa.scheme) != 0 {
+			addrs = append(addrs, pa)
+		}
+	}
+	for _, a := range p.Addrs {
+		if pa, ok := parseProbeAddr(a); ok && len(pa.scheme) == 0 {
+			addrs = append(addrs, pa)
+		}
+	}
+
+	for _, a := range addrs {
+		pctx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		if len(a.scheme) != 0 {
+			out = hp.retrieve(pctx, client, c, a)
+		} else {
+			out = dialProvider(pctx, a)
+		}
+		cancel()
+		out.ID = p.ID
+		out.Latency = time.Since(start)
+		if out.Reachable {
+			break
+		}
+	}
+	return out
+}
+
+func (hp *HTTPProber) retrieve(ctx context.Context, client *http.Client, c cid.Cid, a probeAddr) ProviderProbe {
+	out := ProviderProbe{Addr: a.multiaddr, Protocol: "http"}
+	u := url.URL{Scheme: a.scheme, Host: a.hostPort, Path: "/ipfs/" + c.String(), RawQuery: "format=raw"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	req.Header.Set("Accept", rawBlockContentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer resp.Body.Close()
+	out.Reachable = true
+
+	if resp.StatusCode != http.StatusOK {
+		out.Error = fmt.Sprintf("provider returned %d", resp.StatusCode)
+		return out
+	}
+	block, err := io.ReadAll(io.LimitReader(resp.Body, maxProbeBlockSize+1))
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	if r := verifyRawBlock(block, c); !r.OK() {
+		out.Error = "provider returned a block that does not match the cid"
+		return out
+	}
+	out.Retrieved = true
+	return out
+}
+
+// dialProvider checks that the provider accepts TCP connections on the address and, unless it serves websockets on
+// it, that it answers the multistream-select handshake that libp2p connections start with.
+func dialProvider(ctx context.Context, a probeAddr) ProviderProbe {
+	out := ProviderProbe{Addr: a.multiaddr, Protocol: "tcp"}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", a.hostPort)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	defer conn.Close()
+	out.Reachable = true
+	if a.websocket {
+		return out
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := multistreamHandshake(conn); err != nil {
+		out.Error = fmt.Sprintf("no libp2p handshake: %s", err)
+		return out
+	}
+	out.Libp2p = true
+	return out
+}
+
+// multistreamHandshake sends the multistream-select header and checks that the peer answers with it too.
+func multistreamHandshake(rw io.ReadWriter) error {
+	msg := []byte(multistreamProtocol)
+	if _, err := rw.Write(append(binary.AppendUvarint(nil, uint64(len(msg))), msg...)); err != nil {
+		return err
+	}
+	br := bufio.NewReader(rw)
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if n > 1024 {
+		return fmt.Errorf("multistream message of %d bytes is too large", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return err
+	}
+	if string(buf) != multistreamProtocol {
+		return fmt.Errorf("unexpected multistream header %q", buf)
+	}
+	return nil
+}
+
+// probeAddr is a multiaddr that can be probed. scheme is "http" or "https" for providers that serve HTTP, and
+// websocket is true for providers that serve libp2p over websockets.
+type probeAddr struct {
+	multiaddr string
+	scheme    string
+	hostPort  string
+	websocket bool
+}
+
+// parseProbeAddr parses TCP multiaddrs, e.g. /ip4/1.2.3.4/tcp/4001 or /dns4/example.com/tcp/443/https. ok is false
+// for other transports, e.g. QUIC.
+func parseProbeAddr(ma string) (probeAddr, bool) {
+	parts := strings.Split(strings.TrimPrefix(ma, "/"), "/")
+	out := probeAddr{multiaddr: ma}
+	var host, port string
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "ip4", "ip6", "dns", "dns4", "dns6":
+			host = parts[i+1]
+		case "tcp":
+			port = parts[i+1]
+		}
+	}
+	for i, part := range parts {
+		switch {
+		case part == "https", part == "http" && i > 0 && parts[i-1] == "tls":
+			out.scheme = "https"
+		case part == "http":
+			out.scheme = "http"
+		case part == "ws", part == "wss":
+			out.websocket = true
+		}
+	}
+	if len(host) == 0 || len(port) == 0 {
+		return out, false
+	}
+	out.hostPort = net.JoinHostPort(host, port)
+	return out, true
+}
+
+// ProbeMismatches looks up the providers of the root CIDs of the paths that mismatched between any pair of
+// components on cid.contact and probes up to ProbeProviders of them with the Prober. The reports are added to the
+// mismatch records. The results of the run are not changed.
+func (re *RequestExecutor) ProbeMismatches(ctx context.Context) {
+	if re.opts.Prober == nil {
+		return
+	}
+	re.probeMismatches(ctx, []TriageCategory{TriageStatus, TriageBytes})
+}
+
+// probeMismatches probes the providers of the paths of the mismatches of the categories.
+func (re *RequestExecutor) probeMismatches(ctx context.Context, categories []TriageCategory) {
+	re.mu.Lock()
+	paths := re.triagePaths(categories)
+	re.mu.Unlock()
+
+	if len(paths) == 0 {
+		return
+	}
+	re.log.Info("probing providers of mismatched paths", "paths", len(paths))
+
+	klm := re.cidContactChecker()
+
+	// paths with the same root are only probed once
+	var mu sync.Mutex
+	byCid := make(map[string]*ProbeReport)
+	sem := make(chan struct{}, re.opts.Concurrency)
+	var wg sync.WaitGroup
+	for _, path := range re.contentPaths(paths) {
+		root, err := ParseCidFromPath(path)
+		if err != nil {
+			continue
+		}
+		mu.Lock()
+		_, ok := byCid[root]
+		if !ok {
+			byCid[root] = nil
+		}
+		mu.Unlock()
+		if ok {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(root string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r := re.probe(ctx, klm, root)
+			mu.Lock()
+			byCid[root] = r
+			mu.Unlock()
+		}(root)
+	}
+	wg.Wait()
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if re.probes == nil {
+		re.probes = make(map[string]*ProbeReport, len(paths))
+		re.diagnoses = make(map[string]*ProbeDiagnosis, len(paths))
+	}
+	for i, path := range re.contentPaths(paths) {
+		root, err := ParseCidFromPath(path)
+		if err != nil {
+			continue
+		}
+		re.probes[paths[i]] = byCid[root]
+		if d := re.diagnose(paths[i], byCid[root]); d != nil {
+			re.diagnoses[paths[i]] = d
+		}
+	}
+	for _, c := range categories {
+		for _, p := range re.pairs {
+			for path, m := range re.mismatchRecords(c, p) {
+				m.Probe = re.probes[path]
+				m.Diagnosis = re.diagnoses[path]
+			}
+		}
+	}
+	re.log.Info("probing done")
+}
+
+// diagnose tells from the probe report of the root CID of the path whether the path mismatched because its content
+// can not be retrieved from its providers or because the layers failed to retrieve it. The caller must hold the
+// lock.
+func (re *RequestExecutor) diagnose(path string, r *ProbeReport) *ProbeDiagnosis {
+	if r == nil {
+		return nil
+	}
+	d := &ProbeDiagnosis{}
+	switch {
+	case len(r.Error) != 0:
+		d.Verdict = ProbeLookupFailed
+	case !r.Indexed:
+		d.Verdict = ProbeNotIndexed
+	case !r.Reachable:
+		d.Verdict = ProbeProviderUnreachable
+	default:
+		for _, c := range re.components {
+			if rr := re.results[path][c.Name]; rr != nil && !isReadOK(rr) {
+				d.FailedLayers = append(d.FailedLayers, c.Name)
+			}
+		}
+		d.Verdict = ProbeProviderUp
+		if len(d.FailedLayers) != 0 {
+			d.Verdict = ProbeLayerFailed
+		}
+	}
+	return d
+}
+
+// probe looks up the providers of the CID and probes them.
+func (re *RequestExecutor) probe(ctx context.Context, klm *CidContactChecker, root string) *ProbeReport {
+	report := &ProbeReport{Cid: root}
+	c, err := cid.Decode(root)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	cc, err := klm.getWithRetries(ctx, root)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	records := cc.Records
+	report.Indexed = len(records) != 0
+	if len(records) > re.opts.ProbeProviders {
+		records = records[:re.opts.ProbeProviders]
+	}
+	for _, p := range records {
+		pp := re.opts.Prober.Probe(ctx, c, p)
+		report.Providers = append(report.Providers, pp)
+		report.Reachable = report.Reachable || pp.Reachable
+		report.Retrievable = report.Retrievable || pp.Retrieved
+	}
+	return report
+}
+
+// writeProbes writes the probe reports of the mismatched paths and prints a summary. The caller must hold the lock.
+func (re *RequestExecutor) writeProbes() {
+	if re.probes == nil {
+		return
+	}
+	re.writeJSON(re.probes, "probes.json")
+	re.writeJSON(re.diagnoses, "probe-diagnoses.json")
+
+	var retrievable, reachable int
+	for _, r := range re.probes {
+		switch {
+		case r == nil || len(r.Error) != 0:
+		case r.Retrievable:
+			retrievable++
+		case r.Reachable:
+			reachable++
+		}
+	}
+	verdicts := make(map[ProbeVerdict]int)
+	layerFailures := make(map[string]int)
+	for _, d := range re.diagnoses {
+		verdicts[d.Verdict]++
+		for _, name := range d.FailedLayers {
+			layerFailures[name]++
+		}
+	}
+	fmt.Println("\n ----------SUMMARY OF PROVIDER PROBES --------------")
+	fmt.Printf("\n Run-%d; mismatched paths retrievable from a provider: %d", re.n, retrievable)
+	fmt.Printf("\n Run-%d; mismatched paths with reachable providers that did not return the root block: %d", re.n, reachable)
+	fmt.Printf("\n Run-%d; mismatched paths indexed on cid.contact without reachable providers: %d", re.n, verdicts[ProbeProviderUnreachable])
+	fmt.Printf("\n Run-%d; mismatched paths not indexed on cid.contact: %d", re.n, verdicts[ProbeNotIndexed])
+	fmt.Printf("\n Run-%d; mismatched paths whose providers could not be looked up: %d", re.n, verdicts[ProbeLookupFailed])
+	fmt.Printf("\n Run-%d; mismatched paths with a provider up that every layer served: %d", re.n, verdicts[ProbeProviderUp])
+	for _, c := range re.components {
+		if n := layerFailures[c.Name]; n != 0 {
+			fmt.Printf("\n Run-%d; mismatched paths with a provider up that %s failed to serve: %d", re.n, c.Name, n)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,167 @@
+package onion
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// nginxClientClosed is the status nginx logs for requests whose client closed the connection before the response
+// was sent. Such requests have no production status to compare with.
+const nginxClientClosed = 499
+
+// ReplayMetadata is what the replay log records about the original request and the response production served
+// for it.
+type ReplayMetadata struct {
+	UserAgent string `json:",omitempty"`
+	Referer   string `json:",omitempty"`
+	// Status is the status code production served for the request, if the log records it.
+	Status int `json:",omitempty"`
+	// Extract is what production returned for the request: a CAR if the request asked for one, else file bytes.
+	Extract ExtractMode
+}
+
+// replayExtract returns whether the request asked for a CAR, by its format param or its Accept header, or for
+// file bytes.
+func replayExtract(u string, header http.Header) ExtractMode {
+	if pu, err := url.Parse(u); err == nil && pu.Query().Get("format") == "car" {
+		return ExtractCAR
+	}
+	if strings.Contains(header.Get("Accept"), carContentType) {
+		return ExtractCAR
+	}
+	return ExtractRawFile
+}
+
+// ProductionDiff compares the response of a component with the response production served for the original
+// request, as recorded by the replay log.
+type ProductionDiff struct {
+	// Status and Size are those production served. Size is 0 if the log does not record it.
+	Status int
+	Size   int64 `json:",omitempty"`
+
+	// StatusMismatch is set if the status codes differ, except that a 206 and a 200 answer range requests alike.
+	StatusMismatch bool `json:",omitempty"`
+	// SizeMismatch is only set if the response was read successfully and is comparable with the response of
+	// production, i.e. it is the full, uncompressed entity in the format the original request asked for.
+	SizeMismatch bool `json:",omitempty"`
+
+	UserAgent string `json:",omitempty"`
+	Referer   string `json:",omitempty"`
+}
+
+// Mismatch reports whether the response differs from the one production served.
+func (d *ProductionDiff) Mismatch() bool {
+	return d.StatusMismatch || d.SizeMismatch
+}
+
+// Transition is the change of status from production to the component, e.g. "200->502", or "200->error" if the
+// request to the component failed.
+func (d *ProductionDiff) Transition(r *Result) string {
+	got := "error"
+	if r.StatusCode != 0 {
+		got = fmt.Sprint(r.StatusCode)
+	}
+	return fmt.Sprintf("%d->%s", d.Status, got)
+}
+
+// ProductionReads records the comparison of the responses of a single component with the responses production
+// served for the original requests.
+type ProductionReads struct {
+	TotalCompared int
+
+	Mismatches     map[string]*Result
+	MismatchPaths  []string
+	StatusMismatch int
+	SizeMismatch   int
+	// Transitions counts the status transitions of the status mismatches, e.g. "200->502".
+	Transitions map[string]int
+}
+
+func newProductionReads() *ProductionReads {
+	return &ProductionReads{
+		Mismatches:  make(map[string]*Result),
+		Transitions: make(map[string]int),
+	}
+}
+
+// compareProduction compares the response of the component with the one production served for the original
+// request. It returns nil if the replay log records neither the status nor the size of the original response.
+func compareProduction(c Component, urls URLsToTest, r *Result) *ProductionDiff {
+	m := urls.Replay
+	if m == nil || (m.Status == 0 && urls.ExpectedSize == 0) || m.Status == nginxClientClosed {
+		return nil
+	}
+
+	d := &ProductionDiff{Status: m.Status, Size: urls.ExpectedSize, UserAgent: m.UserAgent, Referer: m.Referer}
+	if m.Status != 0 {
+		d.StatusMismatch = r.StatusCode != m.Status
+		if urls.Range != nil {
+			d.StatusMismatch = !rangeStatusEqual(r.StatusCode, m.Status)
+		}
+	}
+	comparable := isReadOK(r) && urls.Range == nil && !urls.RawBlock && urls.Method != http.MethodHead &&
+		c.Extract == m.Extract && len(r.ContentEncoding) == 0 && (m.Status == 0 || isSuccess(m.Status))
+	if urls.ExpectedSize > 0 && comparable {
+		d.SizeMismatch = r.ResponseSize != uint64(urls.ExpectedSize)
+	}
+	return d
+}
+
+// rangeStatusEqual reports whether the status codes answer a range request alike: a 206 with the range and a 200,
+// of a layer that ignores the Range header and returns the full body or that takes the range as entity-bytes, are
+// both successful.
+func rangeStatusEqual(a, b int) bool {
+	return a == b || (isSuccess(a) && isSuccess(b))
+}
+
+// record records the comparison of the response of the component with production for the path.
+func (pr *ProductionReads) record(path string, r *Result) {
+	d := r.Production
+	pr.TotalCompared++
+	if !d.Mismatch() {
+		return
+	}
+	pr.Mismatches[path] = r
+	pr.MismatchPaths = append(pr.MismatchPaths, path)
+	if d.StatusMismatch {
+		pr.StatusMismatch++
+		pr.Transitions[d.Transition(r)]++
+	}
+	if d.SizeMismatch {
+		pr.SizeMismatch++
+	}
+}
+
+// hasProduction reports whether the replay log records the status or size of any original response.
+func (re *RequestExecutor) hasProduction() bool {
+	for _, urls := range re.reqs {
+		if urls.Replay != nil && (urls.Replay.Status != 0 || urls.ExpectedSize > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// printProductionSummary prints how many responses of each component differ from the responses production served.
+func (re *RequestExecutor) printProductionSummary() {
+	fmt.Println("\n ----------SUMMARY OF MISMATCHES WITH PRODUCTION --------------")
+	for _, c := range re.components {
+		pr := re.responseReads.Production[c.Name]
+		if pr == nil {
+			continue
+		}
+		fmt.Printf("\n Run-%d; %s returned a different status than production for %d/%d requests and a different size for %d requests",
+			re.n, c.Name, pr.StatusMismatch, pr.TotalCompared, pr.SizeMismatch)
+		transitions := make([]string, 0, len(pr.Transitions))
+		for t := range pr.Transitions {
+			transitions = append(transitions, t)
+		}
+		sort.Strings(transitions)
+		for _, t := range transitions {
+			fmt.Printf("\n Run-%d; %s status %s for %d requests", re.n, c.Name, t, pr.Transitions[t])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package onion
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Progress configures how the progress of a run is reported while its paths are requested.
+type Progress struct {
+	// Writer is where progress is reported to.
+	Writer io.Writer
+	// Line refreshes the progress on a single line, e.g. of a terminal, instead of writing a new line every
+	// Interval.
+	Line bool
+	// Interval is how often progress is reported. Defaults to a second if Line is set and to 30 seconds otherwise.
+	Interval time.Duration
+	// Label prefixes the progress, e.g. with the cohort of the run.
+	Label string
+}
+
+// NewProgress returns a Progress that reports to stdout, on a single line if stdout is a terminal and every
+// interval otherwise.
+func NewProgress() *Progress {
+	p := &Progress{Writer: os.Stdout}
+	if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		p.Line = true
+	}
+	return p
+}
+
+func (p *Progress) interval() time.Duration {
+	switch {
+	case p.Interval > 0:
+		return p.Interval
+	case p.Line:
+		return time.Second
+	}
+	return 30 * time.Second
+}
+
+// reportProgress reports the progress of the run every interval until the returned func is called, which reports
+// the final progress.
+func (re *RequestExecutor) reportProgress() func() {
+	p := re.opts.Progress
+	if p == nil || p.Writer == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	re.mu.Lock()
+	resumed := len(re.results)
+	re.mu.Unlock()
+
+	report := func(end string) {
+		re.mu.Lock()
+		line := re.progressLine(p.Label, resumed, time.Since(start))
+		re.mu.Unlock()
+		if p.Line {
+			// clear the rest of the previous line
+			fmt.Fprintf(p.Writer, "\r%s\x1b[K%s", line, end)
+		} else {
+			fmt.Fprintln(p.Writer, line)
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(p.interval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				report("")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		report("\n")
+	}
+}
+
+// progressLine formats the paths done out of the paths of the run, the estimated time until the run is done and
+// the paths done and error rate of every component. The caller must hold the lock.
+func (re *RequestExecutor) progressLine(label string, resumed int, elapsed time.Duration) string {
+	total := len(re.reqs)
+	done := len(re.results)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Run-%d", re.n)
+	if len(label) != 0 {
+		fmt.Fprintf(&b, " %s", label)
+	}
+	fmt.Fprintf(&b, ": %d/%d paths", done, total)
+	if total > 0 {
+		fmt.Fprintf(&b, " (%.1f%%)", 100*float64(done)/float64(total))
+	}
+	if fetched := done - resumed; fetched > 0 && done < total {
+		eta := time.Duration(float64(elapsed) / float64(fetched) * float64(total-done))
+		fmt.Fprintf(&b, ", ETA %s", eta.Round(time.Second))
+	}
+
+	for _, c := range re.components {
+		var completed, failed int
+		for _, rs := range re.results {
+			r := rs[c.Name]
+			if r == nil {
+				continue
+			}
+			completed++
+			if !isReadOK(r) {
+				failed++
+			}
+		}
+		rate := 0.0
+		if completed > 0 {
+			rate = 100 * float64(failed) / float64(completed)
+		}
+		fmt.Fprintf(&b, " | %s %d/%d %.1f%% errors", c.Name, completed, total, rate)
+	}
+	return b.String()
+}
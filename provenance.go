@@ -0,0 +1,342 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+)
+
+// ProvenanceCause is the most likely reason a CAR differs from the DAG of the reference CAR.
+type ProvenanceCause string
+
+const (
+	// CauseRoot is a CAR with different roots or without the root block, i.e. the path was resolved differently.
+	CauseRoot ProvenanceCause = "root"
+	// CauseCorrupt is a CAR with blocks whose data differs from the reference, which means one of them is corrupt.
+	CauseCorrupt ProvenanceCause = "corrupt"
+	// CauseMissingLeaves is a CAR that lacks leaf blocks of the reference DAG only, e.g. because a provider failed
+	// to serve them.
+	CauseMissingLeaves ProvenanceCause = "missing-leaves"
+	// CauseMissingSubtrees is a CAR that lacks intermediate blocks of the reference DAG, and so whole subtrees.
+	CauseMissingSubtrees ProvenanceCause = "missing-subtrees"
+	// CauseExtraBlocks is a CAR that has every block of the reference DAG but also others.
+	CauseExtraBlocks ProvenanceCause = "extra-blocks"
+)
+
+// ProvenanceBlock is a block of the reference DAG.
+type ProvenanceBlock struct {
+	Cid string
+	// Depth is the number of links from the root to the block, which is at depth 0.
+	Depth int
+	// Size is the size of the block in the reference CAR.
+	Size int
+	// Parent is the block that first links to the block as the DAG is walked, and Name the name of the link if the
+	// parent is a dag-pb block, e.g. the name of a directory entry.
+	Parent string `json:",omitempty"`
+	Name   string `json:",omitempty"`
+	// Leaf is set if the block links to no other block.
+	Leaf bool `json:",omitempty"`
+}
+
+// BlockProvenance locates the blocks of the DAG of a reference CAR that are missing from, or different in, the CAR
+// of another layer, so that missing leaf blocks can be told from a wrong root resolution.
+type BlockProvenance struct {
+	// Reference is the component whose CAR was walked, and Layer the component whose CAR was checked against it.
+	Reference string
+	Layer     string
+	// Root is the root of the reference CAR and Roots are the roots of the CAR of the layer, if they differ.
+	Root        string
+	Roots       []string `json:",omitempty"`
+	RootsDiffer bool     `json:",omitempty"`
+	// Blocks is the number of blocks of the reference DAG that were walked.
+	Blocks int
+
+	// Missing are the blocks of the reference DAG that are not in the CAR of the layer, in the order they were
+	// walked, and Different those that are in it with different data.
+	Missing   []ProvenanceBlock `json:",omitempty"`
+	Different []ProvenanceBlock `json:",omitempty"`
+	// Extra are the blocks of the CAR of the layer that are not part of the reference DAG.
+	Extra []string `json:",omitempty"`
+	// MaxMissingDepth is the depth of the deepest missing block.
+	MaxMissingDepth int `json:",omitempty"`
+
+	Cause ProvenanceCause `json:",omitempty"`
+	// ReadError is set if the CAR of the layer could only be read partially, e.g. because it is truncated, in which
+	// case the blocks after the error are reported missing.
+	ReadError string `json:",omitempty"`
+	// Error is set if the reference CAR could not be walked.
+	Error string `json:",omitempty"`
+}
+
+// provenanceCAR is the content of a CAR, read up to the first error.
+type provenanceCAR struct {
+	roots  []cid.Cid
+	blocks map[cid.Cid][]byte
+	order  []cid.Cid
+	// readErr is the error that stopped reading blocks before the end of the CAR.
+	readErr error
+}
+
+// readProvenanceCAR reads the blocks of a CAR. An error is only returned if the CAR header can not be read.
+func readProvenanceCAR(carBytes []byte) (*provenanceCAR, error) {
+	br, err := car.NewBlockReader(bytes.NewReader(carBytes))
+	if err != nil {
+		return nil, err
+	}
+	pc := &provenanceCAR{roots: br.Roots, blocks: make(map[cid.Cid][]byte)}
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			pc.readErr = err
+			break
+		}
+		if _, ok := pc.blocks[blk.Cid()]; !ok {
+			pc.order = append(pc.order, blk.Cid())
+			pc.blocks[blk.Cid()] = blk.RawData()
+		}
+	}
+	return pc, nil
+}
+
+// CompareProvenance walks the DAG of the reference CAR from its first root, through the blocks the reference CAR
+// holds, and reports which of its blocks are missing from or differ in the CAR of the layer, along with their depth,
+// size and parent.
+func CompareProvenance(reference, layer string, refCAR, layerCAR []byte) *BlockProvenance {
+	bp := &BlockProvenance{Reference: reference, Layer: layer}
+	ref, err := readProvenanceCAR(refCAR)
+	if err != nil {
+		bp.Error = fmt.Sprintf("failed to read %s car: %s", reference, err)
+		return bp
+	}
+	if len(ref.roots) == 0 {
+		bp.Error = fmt.Sprintf("%s car has no roots", reference)
+		return bp
+	}
+	other, err := readProvenanceCAR(layerCAR)
+	if err != nil {
+		bp.Error = fmt.Sprintf("failed to read %s car: %s", layer, err)
+		return bp
+	}
+	if other.readErr != nil {
+		bp.ReadError = other.readErr.Error()
+	}
+
+	root := ref.roots[0]
+	bp.Root = root.String()
+	if len(other.roots) != len(ref.roots) || !sameRoots(other.roots, ref.roots) {
+		bp.RootsDiffer = true
+		for _, r := range other.roots {
+			bp.Roots = append(bp.Roots, r.String())
+		}
+	}
+
+	walked, err := walkProvenance(ref, root)
+	if err != nil {
+		bp.Error = err.Error()
+	}
+	bp.Blocks = len(walked)
+	inDAG := make(map[string]struct{}, len(walked))
+	rootMissing := false
+	for _, b := range walked {
+		inDAG[b.Cid] = struct{}{}
+		c, _ := cid.Decode(b.Cid)
+		data, ok := other.blocks[c]
+		switch {
+		case !ok:
+			bp.Missing = append(bp.Missing, b)
+			if b.Depth == 0 {
+				rootMissing = true
+			}
+			if b.Depth > bp.MaxMissingDepth {
+				bp.MaxMissingDepth = b.Depth
+			}
+		case !bytes.Equal(data, ref.blocks[c]):
+			bp.Different = append(bp.Different, b)
+		}
+	}
+	for _, c := range other.order {
+		if _, ok := inDAG[c.String()]; !ok {
+			bp.Extra = append(bp.Extra, c.String())
+		}
+	}
+
+	switch {
+	case bp.RootsDiffer || rootMissing:
+		bp.Cause = CauseRoot
+	case len(bp.Different) != 0:
+		bp.Cause = CauseCorrupt
+	case len(bp.Missing) != 0:
+		bp.Cause = CauseMissingLeaves
+		for _, b := range bp.Missing {
+			if !b.Leaf {
+				bp.Cause = CauseMissingSubtrees
+				break
+			}
+		}
+	case len(bp.Extra) != 0:
+		bp.Cause = CauseExtraBlocks
+	}
+	return bp
+}
+
+// sameRoots reports whether the roots are the same CIDs in the same order.
+func sameRoots(a, b []cid.Cid) bool {
+	for i := range a {
+		if !a[i].Equals(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// walkProvenance walks the DAG under root breadth-first through the blocks of the CAR, so that every block is
+// reported at its shallowest depth. Links to blocks that are not in the CAR, e.g. because they are outside the
+// dag-scope of the request, are not followed. The blocks walked before an error are returned with it.
+func walkProvenance(pc *provenanceCAR, root cid.Cid) ([]ProvenanceBlock, error) {
+	ls := cidlink.DefaultLinkSystem()
+	ls.TrustedStorage = true
+	ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+		bz, ok := pc.blocks[l.(cidlink.Link).Cid]
+		if !ok {
+			return nil, fmt.Errorf("block %s not found", l)
+		}
+		return bytes.NewReader(bz), nil
+	}
+
+	seen := map[cid.Cid]struct{}{root: {}}
+	queue := []ProvenanceBlock{{Cid: root.String()}}
+	var out []ProvenanceBlock
+	for len(queue) != 0 {
+		b := queue[0]
+		queue = queue[1:]
+		c, _ := cid.Decode(b.Cid)
+		data, ok := pc.blocks[c]
+		if !ok {
+			// only the root can be missing from the reference CAR, as other links are not followed to missing blocks
+			return out, errors.New("root block is missing from the reference car")
+		}
+		b.Size = len(data)
+
+		links, err := provenanceLinks(&ls, c)
+		if err != nil {
+			out = append(out, b)
+			return out, fmt.Errorf("failed to decode %s: %w", c, err)
+		}
+		b.Leaf = len(links) == 0
+		out = append(out, b)
+		for _, l := range links {
+			if _, ok := seen[l.cid]; ok {
+				continue
+			}
+			seen[l.cid] = struct{}{}
+			if _, ok := pc.blocks[l.cid]; !ok {
+				continue
+			}
+			queue = append(queue, ProvenanceBlock{Cid: l.cid.String(), Depth: b.Depth + 1, Parent: b.Cid, Name: l.name})
+		}
+	}
+	return out, nil
+}
+
+// provenanceLink is a link of a block, named if it is a link of a dag-pb block.
+type provenanceLink struct {
+	cid  cid.Cid
+	name string
+}
+
+// provenanceLinks returns the links of the block in the order they appear in it.
+func provenanceLinks(ls *ipld.LinkSystem, c cid.Cid) ([]provenanceLink, error) {
+	var out []provenanceLink
+	if c.Prefix().Codec == cid.DagProtobuf {
+		n, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+		if err != nil {
+			return nil, err
+		}
+		itr := n.(dagpb.PBNode).FieldLinks().Iterator()
+		for !itr.Done() {
+			_, l := itr.Next()
+			pl := provenanceLink{cid: l.FieldHash().Link().(cidlink.Link).Cid}
+			if l.FieldName().Exists() {
+				pl.name = l.FieldName().Must().String()
+			}
+			out = append(out, pl)
+		}
+		return out, nil
+	}
+	if c.Prefix().Codec == cid.Raw {
+		return nil, nil
+	}
+	n, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: c}, basicnode.Prototype.Any)
+	if err != nil {
+		return nil, err
+	}
+	links, err := traversal.SelectLinks(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range links {
+		out = append(out, provenanceLink{cid: l.(cidlink.Link).Cid})
+	}
+	return out, nil
+}
+
+// writeProvenance writes the block provenance of the mismatches of every pair of components that return CARs to
+// {pair}-block-provenance.json, keyed by path, and summarises their causes.
+func (re *RequestExecutor) writeProvenance() {
+	var pairs []Pair
+	for _, p := range re.pairs {
+		if p.A.Extract == ExtractCAR && p.B.Extract == ExtractCAR {
+			pairs = append(pairs, p)
+		}
+	}
+	if len(pairs) == 0 {
+		return
+	}
+
+	fmt.Println("\n ----------SUMMARY OF BLOCK PROVENANCE --------------")
+	for _, p := range pairs {
+		pm := re.responseReads.Pairs[p.Name()]
+		provenance := make(map[string]*BlockProvenance)
+		causes := make(map[string]int)
+		for path, m := range pm.Mismatches {
+			if m.Provenance == nil {
+				continue
+			}
+			provenance[path] = m.Provenance
+			cause := string(m.Provenance.Cause)
+			if len(m.Provenance.Error) != 0 {
+				cause = "error"
+			} else if len(cause) == 0 {
+				cause = "same-blocks"
+			}
+			causes[cause]++
+		}
+		re.writeJSON(provenance, re.rrFile(fmt.Sprintf("%s-block-provenance.json", p.Name())))
+
+		names := make([]string, 0, len(causes))
+		for cause := range causes {
+			names = append(names, cause)
+		}
+		sort.Strings(names)
+		counts := make([]string, 0, len(names))
+		for _, cause := range names {
+			counts = append(counts, fmt.Sprintf("%s: %d", cause, causes[cause]))
+		}
+		fmt.Printf("\n Run-%d; %s %s mismatched CARs: %d (%s)", re.n, p.A.Name, p.B.Name, len(provenance), strings.Join(counts, ", "))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,139 @@
+package onion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RangeMode describes how a component is asked for a byte range of an entity.
+type RangeMode string
+
+const (
+	// RangeHeader sends the range as an HTTP Range header.
+	RangeHeader RangeMode = "header"
+	// RangeEntityBytes sends the range as an entity-bytes query param as per the trustless gateway spec.
+	RangeEntityBytes RangeMode = "entity-bytes"
+	// RangeNone requests the full entity; the requested range is sliced out of the response before comparing.
+	RangeNone RangeMode = "none"
+)
+
+// ByteRange is a single inclusive byte range of an entity. A negative From is a suffix range counted
+// from the end of the entity. To is -1 if the range extends to the end of the entity.
+type ByteRange struct {
+	From int64
+	To   int64
+}
+
+// ParseRangeHeader parses a single range HTTP Range header value, e.g. "bytes=0-1023", "bytes=1024-" or "bytes=-512".
+func ParseRangeHeader(h string) (ByteRange, error) {
+	h = strings.TrimSpace(h)
+	if !strings.HasPrefix(h, "bytes=") {
+		return ByteRange{}, fmt.Errorf("invalid range %q: unsupported unit", h)
+	}
+	spec := strings.TrimPrefix(h, "bytes=")
+	if strings.Contains(spec, ",") {
+		return ByteRange{}, fmt.Errorf("invalid range %q: multiple ranges are not supported", h)
+	}
+
+	from, to, ok := strings.Cut(spec, "-")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid range %q", h)
+	}
+
+	// suffix range
+	if len(from) == 0 {
+		n, err := strconv.ParseInt(to, 10, 64)
+		if err != nil || n <= 0 {
+			return ByteRange{}, fmt.Errorf("invalid range %q", h)
+		}
+		return ByteRange{From: -n, To: -1}, nil
+	}
+
+	f, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || f < 0 {
+		return ByteRange{}, fmt.Errorf("invalid range %q", h)
+	}
+	if len(to) == 0 {
+		return ByteRange{From: f, To: -1}, nil
+	}
+	t, err := strconv.ParseInt(to, 10, 64)
+	if err != nil || t < f {
+		return ByteRange{}, fmt.Errorf("invalid range %q", h)
+	}
+	return ByteRange{From: f, To: t}, nil
+}
+
+// ParseEntityBytes parses an entity-bytes query param value as per the trustless gateway spec, e.g. "0:1023",
+// "1024:*" or "-512:*". A negative to other than -1, which ends at the last byte like "*", is not supported as it
+// can not be requested from components that take the range as a Range header.
+func ParseEntityBytes(v string) (ByteRange, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(v), ":")
+	if !ok {
+		return ByteRange{}, fmt.Errorf("invalid entity-bytes %q", v)
+	}
+	f, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return ByteRange{}, fmt.Errorf("invalid entity-bytes %q", v)
+	}
+	if to == "*" || to == "-1" {
+		return ByteRange{From: f, To: -1}, nil
+	}
+	t, err := strconv.ParseInt(to, 10, 64)
+	switch {
+	case err != nil:
+		return ByteRange{}, fmt.Errorf("invalid entity-bytes %q", v)
+	case t < 0:
+		return ByteRange{}, fmt.Errorf("invalid entity-bytes %q: negative end offsets are not supported", v)
+	case f < 0 || t < f:
+		return ByteRange{}, fmt.Errorf("invalid entity-bytes %q", v)
+	}
+	return ByteRange{From: f, To: t}, nil
+}
+
+// Header returns the range as an HTTP Range header value.
+func (r ByteRange) Header() string {
+	if r.From < 0 {
+		return fmt.Sprintf("bytes=%d", r.From)
+	}
+	if r.To < 0 {
+		return fmt.Sprintf("bytes=%d-", r.From)
+	}
+	return fmt.Sprintf("bytes=%d-%d", r.From, r.To)
+}
+
+// EntityBytes returns the range as an entity-bytes query param value.
+func (r ByteRange) EntityBytes() string {
+	if r.To < 0 {
+		return fmt.Sprintf("%d:*", r.From)
+	}
+	return fmt.Sprintf("%d:%d", r.From, r.To)
+}
+
+// Bounds resolves the range against an entity of the given size and returns the inclusive start and
+// exclusive end offsets. ok is false if the range is not satisfiable.
+func (r ByteRange) Bounds(size int64) (start int64, end int64, ok bool) {
+	start, end = r.From, size
+	if r.From < 0 {
+		start = size + r.From
+		if start < 0 {
+			start = 0
+		}
+	}
+	if r.To >= 0 && r.To+1 < size {
+		end = r.To + 1
+	}
+	if start >= size {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// Slice returns the range of b. It returns nil if the range is not satisfiable.
+func (r ByteRange) Slice(b []byte) []byte {
+	start, end, ok := r.Bounds(int64(len(b)))
+	if !ok {
+		return nil
+	}
+	return b[start:end]
+}
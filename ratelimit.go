@@ -0,0 +1,69 @@
+package onion
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// componentLimiter throttles the requests sent to a component and the response bytes read from it.
+type componentLimiter struct {
+	requests *rate.Limiter
+	bytes    *rate.Limiter
+}
+
+// newComponentLimiter returns the limiter for the rate limits of the component, or nil if it has none.
+func newComponentLimiter(c Component) *componentLimiter {
+	if c.MaxRequestsPerSecond <= 0 && c.MaxBytesPerSecond <= 0 {
+		return nil
+	}
+	l := &componentLimiter{}
+	if c.MaxRequestsPerSecond > 0 {
+		l.requests = rate.NewLimiter(rate.Limit(c.MaxRequestsPerSecond), 1)
+	}
+	if c.MaxBytesPerSecond > 0 {
+		// allow a second worth of bytes to be read at once, but no less than a byte
+		burst := int(c.MaxBytesPerSecond)
+		if burst < 1 {
+			burst = 1
+		}
+		l.bytes = rate.NewLimiter(rate.Limit(c.MaxBytesPerSecond), burst)
+	}
+	return l
+}
+
+// waitRequest blocks until a request can be sent to the component.
+func (l *componentLimiter) waitRequest() {
+	if l == nil || l.requests == nil {
+		return
+	}
+	l.requests.Wait(context.Background())
+}
+
+// reader throttles reads from r to the byte rate limit of the component.
+func (l *componentLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.bytes == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l.bytes}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *rate.Limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > lr.l.Burst() {
+		p = p[:lr.l.Burst()]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		if werr := lr.l.WaitN(lr.ctx, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,100 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	car "github.com/ipld/go-car/v2"
+)
+
+const (
+	rawBlockContentType = "application/vnd.ipld.raw"
+	carContentType      = "application/vnd.ipld.car"
+)
+
+// IsRawBlockRequest reports whether the request asks for a single raw block, i.e. with ?format=raw or
+// Accept: application/vnd.ipld.raw, rather than for a CAR or file bytes.
+func IsRawBlockRequest(u string, header http.Header) bool {
+	if pu, err := url.Parse(u); err == nil && pu.Query().Get("format") == "raw" {
+		return true
+	}
+	return strings.Contains(header.Get("Accept"), rawBlockContentType)
+}
+
+// rawBlock returns the block of a response to a raw block request. Components that do not support raw blocks may
+// return a CAR instead, from which the block with the expected CID, if known, or else the last block is taken, as
+// the requested block is the last one of a CAR for a path.
+func rawBlock(body []byte, contentType string, expected cid.Cid) ([]byte, error) {
+	if !strings.HasPrefix(contentType, carContentType) {
+		return body, nil
+	}
+
+	br, err := car.NewBlockReader(bytes.NewReader(body), car.WithTrustedCAR(true))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read car: %w", err)
+	}
+	var last []byte
+	for {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read car: %w", err)
+		}
+		if expected.Defined() && blk.Cid().Equals(expected) {
+			return blk.RawData(), nil
+		}
+		last = blk.RawData()
+	}
+	if last == nil {
+		return nil, fmt.Errorf("car has no blocks")
+	}
+	return last, nil
+}
+
+// verifyRawBlock checks that the block hashes to the expected CID.
+func verifyRawBlock(block []byte, expected cid.Cid) *BlockIntegrityReport {
+	report := &BlockIntegrityReport{Blocks: 1}
+	actual, err := expected.Prefix().Sum(block)
+	if err != nil {
+		report.Error = fmt.Sprintf("failed to hash block %s: %s", expected, err)
+		return report
+	}
+	if !actual.Equals(expected) {
+		report.Corrupt = append(report.Corrupt, CorruptBlock{Cid: expected.String(), Actual: actual.String()})
+	}
+	return report
+}
+
+// verifyRawBlockResponse checks the block of a response to a raw block request against the expected CID.
+func verifyRawBlockResponse(body []byte, contentType string, expected cid.Cid) *BlockIntegrityReport {
+	block, err := rawBlock(body, contentType, expected)
+	if err != nil {
+		return &BlockIntegrityReport{Error: err.Error()}
+	}
+	return verifyRawBlock(block, expected)
+}
+
+// rawBlockCid returns the CID of the block requested by a raw block request for the path, which is only known if
+// the path has no segments after the root CID.
+func rawBlockCid(urls URLsToTest) cid.Cid {
+	path := urls.Path
+	if len(urls.ResolvedPath) != 0 {
+		path = urls.ResolvedPath
+	}
+	ns, root, rest, err := splitContentPath(path)
+	if err != nil || ns != "ipfs" || strings.Trim(rest, "/") != "" {
+		return cid.Undef
+	}
+	c, err := cid.Decode(root)
+	if err != nil {
+		return cid.Undef
+	}
+	return c
+}
@@ -0,0 +1,124 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RedirectMode is how a component's 3xx redirects are handled.
+type RedirectMode string
+
+const (
+	// RedirectFollow follows redirects, recording every hop.
+	RedirectFollow RedirectMode = "follow"
+	// RedirectManual does not follow redirects; the 3xx response is the result of the request.
+	RedirectManual RedirectMode = "manual"
+)
+
+// maxRedirects is the number of redirects followed before giving up, as for the default http.Client.
+const maxRedirects = 10
+
+// Redirect is a single 3xx response of a redirect chain.
+type Redirect struct {
+	URL        string
+	StatusCode int
+	// Location is the absolute URL the response redirected to.
+	Location string
+}
+
+type redirectsKey struct{}
+
+// redirectRecorder collects the redirect chain of a request through the request context.
+type redirectRecorder struct {
+	mode  RedirectMode
+	chain []Redirect
+}
+
+func withRedirectRecorder(ctx context.Context, mode RedirectMode) (context.Context, *redirectRecorder) {
+	rr := &redirectRecorder{mode: mode}
+	return context.WithValue(ctx, redirectsKey{}, rr), rr
+}
+
+// checkRedirect is the CheckRedirect func of the executor's client. It records every redirect in the recorder of
+// the request and only follows it if the component follows redirects.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	rr, _ := req.Context().Value(redirectsKey{}).(*redirectRecorder)
+	if rr == nil {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+
+	if req.Response != nil {
+		rr.chain = append(rr.chain, Redirect{
+			URL:        via[len(via)-1].URL.String(),
+			StatusCode: req.Response.StatusCode,
+			Location:   req.URL.String(),
+		})
+	}
+	if rr.mode == RedirectManual {
+		return http.ErrUseLastResponse
+	}
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return nil
+}
+
+// redirectsDiffer reports whether the two components were redirected differently. Hosts are normalised so that
+// components on different hosts that redirect to the same path, or to the same subdomain gateway URL, agree. If
+// either component does not follow redirects, only the first redirect is compared.
+func redirectsDiffer(p Pair, a, b *Result) bool {
+	ra, rb := a.Redirects, b.Redirects
+	if p.A.Redirects == RedirectManual || p.B.Redirects == RedirectManual {
+		if len(ra) > 1 {
+			ra = ra[:1]
+		}
+		if len(rb) > 1 {
+			rb = rb[:1]
+		}
+	}
+	if len(ra) != len(rb) {
+		return true
+	}
+	for i := range ra {
+		if ra[i].StatusCode != rb[i].StatusCode || normaliseLocation(ra[i]) != normaliseLocation(rb[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseLocation returns the location of the redirect without its scheme and with the host of the redirecting
+// URL replaced by {host}, keeping the CID and namespace labels of subdomain gateway hosts, e.g.
+// {cid}.ipfs.{host}/index.html.
+func normaliseLocation(r Redirect) string {
+	from, err := url.Parse(r.URL)
+	if err != nil {
+		return r.Location
+	}
+	loc, err := url.Parse(r.Location)
+	if err != nil {
+		return r.Location
+	}
+
+	host := loc.Hostname()
+	switch {
+	case host == from.Hostname():
+		host = "{host}"
+	default:
+		labels := strings.Split(host, ".")
+		for i, l := range labels {
+			if l == "ipfs" || l == "ipns" {
+				host = strings.Join(labels[:i+1], ".") + ".{host}"
+				break
+			}
+		}
+	}
+	loc.Scheme, loc.Host, loc.User = "", "", nil
+	return host + loc.String()
+}
@@ -0,0 +1,308 @@
+package onion
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultReferenceCacheTTL is how long the responses of the reference are cached by default.
+	DefaultReferenceCacheTTL = 24 * time.Hour
+	// referenceCacheEntriesDir and referenceCacheBodiesDir are the directories of a reference cache that the
+	// cached results are written to, named after the hash of their request, and their bodies, named after their
+	// sha256 like the bodies of a golden run.
+	referenceCacheEntriesDir = "entries"
+	referenceCacheBodiesDir  = "bodies"
+)
+
+// ReferenceCache caches the responses of the reference component on disk across runs and restarts, as the bytes
+// of the ground truth for a path rarely change, so that the reference, e.g. a public gateway, is only requested
+// once per TTL. Responses are keyed by the path and query of their request, i.e. its CID and params, its method and
+// its headers, so that the cache outlives changes to the host of the reference. Bodies are stored by their digest.
+// Only responses that were read successfully are cached. It is safe for concurrent use, and a nil cache caches
+// nothing.
+type ReferenceCache struct {
+	dir string
+	ttl time.Duration
+}
+
+// referenceCacheEntry is a cached result, whose body is stored separately by digest, if it was captured.
+type referenceCacheEntry struct {
+	Key       string
+	FetchedAt time.Time
+	Result    *Result
+	// Body is set if the body of the response is stored.
+	Body bool `json:",omitempty"`
+}
+
+// NewReferenceCache returns a cache in dir whose responses expire after ttl. Expired responses and the bodies that
+// are no longer used are removed.
+func NewReferenceCache(dir string, ttl time.Duration) (*ReferenceCache, error) {
+	if len(dir) == 0 {
+		return nil, fmt.Errorf("the directory of the reference cache is required")
+	}
+	if ttl <= 0 {
+		ttl = DefaultReferenceCacheTTL
+	}
+	for _, sub := range []string{referenceCacheEntriesDir, referenceCacheBodiesDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	c := &ReferenceCache{dir: dir, ttl: ttl}
+	if err := c.prune(); err != nil {
+		return nil, fmt.Errorf("failed to prune reference cache %s: %w", dir, err)
+	}
+	return c, nil
+}
+
+// referenceCacheKey returns the key of the request to the component, or false if its responses can not be cached
+// because it is not a GET or HEAD, or has a body.
+func referenceCacheKey(c Component, urls URLsToTest) (string, bool) {
+	method := urls.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	if (method != http.MethodGet && method != http.MethodHead) || len(urls.Body) != 0 {
+		return "", false
+	}
+	u, err := url.Parse(urls.URLs[c.Name])
+	if err != nil {
+		return "", false
+	}
+	var sb strings.Builder
+	sb.WriteString(method + " " + u.RequestURI())
+	h := urls.Headers[c.Name]
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString("\n" + name + ": " + strings.Join(h[name], ", "))
+	}
+	if urls.RawBlock {
+		sb.WriteString("\nAccept: " + rawBlockContentType)
+	}
+	if urls.Range != nil && c.Range == RangeHeader {
+		sb.WriteString("\nRange: " + urls.Range.Header())
+	}
+	return sb.String(), true
+}
+
+func (rc *ReferenceCache) entryFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(rc.dir, referenceCacheEntriesDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (rc *ReferenceCache) bodyFile(digest string) string {
+	return filepath.Join(rc.dir, referenceCacheBodiesDir, digest)
+}
+
+func (rc *ReferenceCache) expired(e *referenceCacheEntry) bool {
+	return e.Result == nil || time.Since(e.FetchedAt) > rc.ttl
+}
+
+// readEntry reads the cache entry in the file.
+func (rc *ReferenceCache) readEntry(filename string) (*referenceCacheEntry, error) {
+	bz, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var e referenceCacheEntry
+	if err := json.Unmarshal(bz, &e); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reference cache entry %s: %w", filename, err)
+	}
+	return &e, nil
+}
+
+// get returns the cached result of the request to the component, if it has not expired. If capture is true, only
+// results whose body is stored are returned, with their body. Entries that can not be read are not returned, with
+// the error.
+func (rc *ReferenceCache) get(c Component, urls URLsToTest, capture bool) (Result, bool, error) {
+	if rc == nil {
+		return Result{}, false, nil
+	}
+	key, ok := referenceCacheKey(c, urls)
+	if !ok {
+		return Result{}, false, nil
+	}
+	e, err := rc.readEntry(rc.entryFile(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return Result{}, false, nil
+	}
+	if err != nil {
+		return Result{}, false, err
+	}
+	if e.Key != key || rc.expired(e) || (capture && !e.Body) {
+		return Result{}, false, nil
+	}
+
+	out := *e.Result
+	out.Url = urls.URLs[c.Name]
+	out.Cached = true
+	if capture {
+		body, err := os.ReadFile(rc.bodyFile(out.ResponseDigest))
+		if errors.Is(err, os.ErrNotExist) {
+			return Result{}, false, nil
+		}
+		if err != nil {
+			return Result{}, false, fmt.Errorf("failed to read cached reference body %s: %w", out.ResponseDigest, err)
+		}
+		if uint64(len(body)) != out.ResponseSize {
+			return Result{}, false, nil
+		}
+		out.ResponseBody = body
+	}
+	return out, true, nil
+}
+
+// put caches the result of the request to the component if it was read successfully, with its body if it was
+// captured.
+func (rc *ReferenceCache) put(c Component, urls URLsToTest, r Result) error {
+	if rc == nil || r.Cached || !isReadOK(&r) || len(r.ResponseDigest) == 0 {
+		return nil
+	}
+	key, ok := referenceCacheKey(c, urls)
+	if !ok {
+		return nil
+	}
+	e := referenceCacheEntry{Key: key, FetchedAt: time.Now()}
+	if r.ResponseBody != nil && uint64(len(r.ResponseBody)) == r.ResponseSize {
+		if err := writeFileAtomic(rc.bodyFile(r.ResponseDigest), r.ResponseBody); err != nil {
+			return err
+		}
+		e.Body = true
+	}
+	// the request specific parts of the result are not cached
+	r.ResponseBody = nil
+	r.Conn = nil
+	r.RequestID, r.RetryRequestIDs = "", nil
+	r.Retries, r.RetryErrors = 0, nil
+	r.Throttles, r.ThrottleWait = 0, 0
+	r.ExtractError = ""
+	r.Production = nil
+	r.Conditional = nil
+	e.Result = &r
+	bz, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(rc.entryFile(key), bz)
+}
+
+// prune removes the expired entries of the cache and the bodies that no entry uses anymore.
+func (rc *ReferenceCache) prune() error {
+	entries, err := os.ReadDir(filepath.Join(rc.dir, referenceCacheEntriesDir))
+	if err != nil {
+		return err
+	}
+	used := make(map[string]struct{})
+	for _, de := range entries {
+		f := filepath.Join(rc.dir, referenceCacheEntriesDir, de.Name())
+		e, err := rc.readEntry(f)
+		if err != nil || rc.expired(e) {
+			if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if e.Body {
+			used[e.Result.ResponseDigest] = struct{}{}
+		}
+	}
+
+	bodies, err := os.ReadDir(filepath.Join(rc.dir, referenceCacheBodiesDir))
+	if err != nil {
+		return err
+	}
+	for _, de := range bodies {
+		if _, ok := used[de.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(rc.bodyFile(de.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+type skipReferenceCacheKey struct{}
+
+// withoutReferenceCache marks the requests of the context to be sent to the reference components even if their
+// responses are cached, e.g. the re-fetches of triage, which must observe the reference anew.
+func withoutReferenceCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, skipReferenceCacheKey{}, true)
+}
+
+// requestReferenceCache returns the cache of the responses of the component to use for the request of the context.
+func (re *RequestExecutor) requestReferenceCache(ctx context.Context, c Component) *ReferenceCache {
+	if skip, _ := ctx.Value(skipReferenceCacheKey{}).(bool); skip {
+		return nil
+	}
+	return re.referenceCache(c)
+}
+
+// referenceCache returns the cache of the responses of the component, which is nil unless the component is a
+// reference whose warm and cold responses are not compared.
+func (re *RequestExecutor) referenceCache(c Component) *ReferenceCache {
+	if !c.Reference || (re.opts.CompareCache && c.Cache) {
+		return nil
+	}
+	return re.opts.ReferenceCache
+}
+
+// writeReferenceCache prints how many responses of every reference component were served from the reference
+// cache. The caller must hold the lock.
+func (re *RequestExecutor) writeReferenceCache() {
+	if re.opts.ReferenceCache == nil {
+		return
+	}
+	fmt.Println("\n ----------SUMMARY OF REFERENCE CACHE --------------")
+	for _, c := range re.components {
+		if re.referenceCache(c) == nil {
+			continue
+		}
+		var cached, total int
+		for _, rs := range re.results {
+			if r := rs[c.Name]; r != nil {
+				total++
+				if r.Cached {
+					cached++
+				}
+			}
+		}
+		fmt.Printf("\n Run-%d; %s responses served from the reference cache: %d of %d", re.n, c.Name, cached, total)
+	}
+	fmt.Println()
+}
+
+// writeFileAtomic writes the file through a temporary file so that a crash or a concurrent write of the same file
+// does not leave a truncated file behind.
+func writeFileAtomic(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,107 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// DefaultKeepParams are the query params that change what a gateway returns and are kept by Anonymize.
+	DefaultKeepParams = []string{"format", "dag-scope", "entity-bytes", "car-scope", "car-version", "car-order", "car-dups"}
+	// DefaultKeepHeaders are the request headers that change what a gateway returns and are kept by Anonymize.
+	DefaultKeepHeaders = []string{"Accept", "Accept-Encoding", "Range", "If-None-Match", "If-Modified-Since"}
+)
+
+// AnonymizeOptions configures what Anonymize keeps of a replayed request.
+type AnonymizeOptions struct {
+	// KeepParams are the query params to keep. Defaults to DefaultKeepParams.
+	KeepParams []string
+	// KeepHeaders are the request headers to keep, matched case-insensitively. Defaults to DefaultKeepHeaders.
+	KeepHeaders []string
+	// KeepReferer keeps the origin of the referer, e.g. https://example.com. The referer is dropped otherwise.
+	KeepReferer bool
+}
+
+// Anonymize strips the entry of what could identify the users or the infrastructure behind the request, so that
+// replay logs can be shared: the host and credentials of the URL are replaced by https://127.0.0.1, query params and
+// headers other than those kept are dropped, the remaining query params are sorted, the body is dropped, the user
+// agent is reduced to its product token, e.g. "Mozilla/5.0", and the referer is dropped. The method, time,
+// status and size of the request are kept as they are needed to replay it.
+func Anonymize(e ReplayEntry, opts AnonymizeOptions) (ReplayEntry, error) {
+	keepParams := opts.KeepParams
+	if keepParams == nil {
+		keepParams = DefaultKeepParams
+	}
+	keepHeaders := opts.KeepHeaders
+	if keepHeaders == nil {
+		keepHeaders = DefaultKeepHeaders
+	}
+
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return ReplayEntry{}, fmt.Errorf("failed to parse url: %w", err)
+	}
+	q := u.Query()
+	kept := make(url.Values)
+	for _, k := range keepParams {
+		if vs, ok := q[k]; ok {
+			kept[k] = vs
+		}
+	}
+	base, _ := url.Parse(defaultBaseURL)
+	u.Scheme, u.Host, u.User = base.Scheme, base.Host, nil
+	u.RawQuery = kept.Encode()
+	u.Fragment, u.RawFragment = "", ""
+
+	out := ReplayEntry{
+		Method:    e.Method,
+		URL:       u.String(),
+		Size:      e.Size,
+		Status:    e.Status,
+		UserAgent: productToken(e.UserAgent),
+		Time:      e.Time,
+	}
+	if opts.KeepReferer {
+		out.Referer = origin(e.Referer)
+	}
+	for _, k := range keepHeaders {
+		if vs := e.Headers.Values(k); len(vs) != 0 {
+			if out.Headers == nil {
+				out.Headers = make(http.Header)
+			}
+			out.Headers[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+	return out, nil
+}
+
+// productToken returns the first product of the user agent, e.g. "curl/7.0" of "curl/7.0 (x86_64-pc-linux-gnu)".
+func productToken(ua string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(ua), " ")
+	return token
+}
+
+// origin returns the scheme and host of the URL, or nothing if it is not an absolute URL.
+func origin(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// WriteNDJSON writes the entries in FormatNDJSON.
+func WriteNDJSON(w io.Writer, entries []ReplayEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return fmt.Errorf("failed to write replay entry: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package replay loads replay logs of bifrost requests in the various formats they are exported in.
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the format of a replay log.
+type Format string
+
+const (
+	// FormatAuto detects the format from the first non empty line of the log.
+	FormatAuto Format = "auto"
+	// FormatPlain is one quoted URL per line, optionally followed by the value of the Range header of the request.
+	FormatPlain Format = "plain"
+	// FormatTSV is tab separated values with the request URL in a configurable column.
+	FormatTSV Format = "tsv"
+	// FormatNDJSON is one JSON encoded ReplayEntry per line: {"method": ..., "url": ..., "headers": {...}, "body": ...,
+	// "time": ..., "status": ..., "size": ..., "user_agent": ..., "referer": ...}.
+	FormatNDJSON Format = "ndjson"
+	// FormatNginx is the nginx combined access log format.
+	FormatNginx Format = "nginx"
+)
+
+var (
+	defaultTSVColumn = 20
+	defaultBaseURL   = "https://127.0.0.1"
+)
+
+// ReplayEntry is a single request from a replay log.
+type ReplayEntry struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+	// Size is the size of the response body bifrost served for the request, if the log records it.
+	Size int64 `json:"size,omitempty"`
+	// Status is the status code bifrost served for the request, if the log records it.
+	Status int `json:"status,omitempty"`
+	// UserAgent and Referer are those of the original request, if the log records them.
+	UserAgent string `json:"user_agent,omitempty"`
+	Referer   string `json:"referer,omitempty"`
+	// Time is when bifrost received the request, if the log records it.
+	Time time.Time `json:"time,omitempty"`
+}
+
+// MarshalJSON omits the time of the entry if the log does not record it, which omitempty does not do for a
+// time.Time.
+func (e ReplayEntry) MarshalJSON() ([]byte, error) {
+	type entry ReplayEntry
+	out := struct {
+		entry
+		Time *time.Time `json:"time,omitempty"`
+	}{entry: entry(e)}
+	if !e.Time.IsZero() {
+		out.Time = &e.Time
+	}
+	return json.Marshal(out)
+}
+
+// Range returns the value of the Range header of the request, if any.
+func (e ReplayEntry) Range() string {
+	return e.Headers.Get("Range")
+}
+
+// Options configures how a replay log is loaded.
+type Options struct {
+	// Format is the format of the log. Defaults to FormatAuto.
+	Format Format
+	// TSVColumn is the 1-based column of the request URL in TSV logs. Defaults to 20.
+	TSVColumn int
+	// BaseURL is prefixed to request paths for logs that do not record the full URL, e.g. nginx access logs.
+	// The host is replaced for every component anyway. Defaults to https://127.0.0.1.
+	BaseURL string
+}
+
+// nginxLine matches the start of the nginx combined log format, e.g.
+// 1.2.3.4 - - [10/Oct/2023:13:55:36 +0000] "GET /ipfs/bafy...?format=car HTTP/1.1" 200 2326 "-" "curl/7.0"
+var nginxLine = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+) [^"]*"(?: (\d{3}) (\d+|-)(?: "([^"]*)" "([^"]*)")?)?`)
+
+// nginxTimeLayout is the layout of the time of nginx access log lines.
+const nginxTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Detect returns the format of the given line of a replay log.
+func Detect(line string) Format {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(line, "{"):
+		return FormatNDJSON
+	case nginxLine.MatchString(line):
+		return FormatNginx
+	case strings.Contains(line, "\t"):
+		return FormatTSV
+	default:
+		return FormatPlain
+	}
+}
+
+// LoadFile loads all entries of the replay log at the given path.
+func LoadFile(path string, opts Options) ([]ReplayEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open replay log: %w", err)
+	}
+	defer f.Close()
+	return Load(f, opts)
+}
+
+// Load loads all entries of the replay log.
+func Load(r io.Reader, opts Options) ([]ReplayEntry, error) {
+	if opts.TSVColumn <= 0 {
+		opts.TSVColumn = defaultTSVColumn
+	}
+	if len(opts.BaseURL) == 0 {
+		opts.BaseURL = defaultBaseURL
+	}
+	format := opts.Format
+	if len(format) == 0 {
+		format = FormatAuto
+	}
+
+	var entries []ReplayEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if format == FormatAuto {
+			format = Detect(line)
+		}
+
+		e, err := parseLine(line, format, opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s replay log line %d: %w", format, n, err)
+		}
+		if len(e.Method) == 0 {
+			e.Method = http.MethodGet
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read replay log: %w", err)
+	}
+	return entries, nil
+}
+
+func parseLine(line string, format Format, opts Options) (ReplayEntry, error) {
+	switch format {
+	case FormatPlain:
+		u, rng, _ := strings.Cut(strings.TrimSpace(line), " ")
+		e := ReplayEntry{URL: strings.Trim(u, "\"")}
+		if rng = strings.Trim(strings.TrimSpace(rng), "\""); len(rng) != 0 {
+			e.Headers = http.Header{"Range": []string{rng}}
+		}
+		return e, validate(e)
+
+	case FormatTSV:
+		fields := strings.Split(line, "\t")
+		if len(fields) < opts.TSVColumn {
+			return ReplayEntry{}, fmt.Errorf("expected at least %d columns, got %d", opts.TSVColumn, len(fields))
+		}
+		e := ReplayEntry{URL: toURL(strings.Trim(strings.TrimSpace(fields[opts.TSVColumn-1]), "\""), opts.BaseURL)}
+		return e, validate(e)
+
+	case FormatNDJSON:
+		var e ReplayEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return ReplayEntry{}, err
+		}
+		e.URL = toURL(e.URL, opts.BaseURL)
+		return e, validate(e)
+
+	case FormatNginx:
+		m := nginxLine.FindStringSubmatch(line)
+		if m == nil {
+			return ReplayEntry{}, fmt.Errorf("not an nginx access log line")
+		}
+		e := ReplayEntry{Method: m[2], URL: toURL(m[3], opts.BaseURL), UserAgent: nginxField(m[7]), Referer: nginxField(m[6])}
+		e.Status, _ = strconv.Atoi(m[4])
+		e.Size, _ = strconv.ParseInt(m[5], 10, 64)
+		e.Time, _ = time.Parse(nginxTimeLayout, m[1])
+		return e, validate(e)
+	}
+
+	return ReplayEntry{}, fmt.Errorf("unknown format %q", format)
+}
+
+// nginxField returns the value of a quoted field of an nginx access log line, which nginx logs as "-" if it is
+// empty.
+func nginxField(v string) string {
+	if v == "-" {
+		return ""
+	}
+	return v
+}
+
+// toURL prefixes the base URL to bare request paths.
+func toURL(u string, baseURL string) string {
+	if strings.HasPrefix(u, "/") {
+		return strings.TrimSuffix(baseURL, "/") + u
+	}
+	return u
+}
+
+func validate(e ReplayEntry) error {
+	if len(e.URL) == 0 {
+		return fmt.Errorf("empty url")
+	}
+	return nil
+}
+
+// Offsets returns when every entry was received relative to the earliest entry that records its time, so that the
+// requests can be replayed with their original inter-arrival times. ok is false if no entry records its time.
+// Entries that do not record their time have no offset.
+func Offsets(entries []ReplayEntry) (offsets []time.Duration, ok bool) {
+	var first time.Time
+	for _, e := range entries {
+		if !e.Time.IsZero() && (first.IsZero() || e.Time.Before(first)) {
+			first = e.Time
+		}
+	}
+	if first.IsZero() {
+		return nil, false
+	}
+	offsets = make([]time.Duration, len(entries))
+	for i, e := range entries {
+		if !e.Time.IsZero() {
+			offsets[i] = e.Time.Sub(first)
+		}
+	}
+	return offsets, true
+}
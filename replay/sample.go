@@ -0,0 +1,197 @@
+package replay
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Strategy is how requests are sampled from a replay log.
+type Strategy string
+
+const (
+	// SampleFirst takes the first unique paths of the log.
+	SampleFirst Strategy = "first"
+	// SampleRandom takes unique paths at random.
+	SampleRandom Strategy = "random"
+	// SampleCodec takes unique paths at random, stratified by the codec of the root CID so that every codec is
+	// represented in proportion to its share of the log.
+	SampleCodec Strategy = "codec"
+	// SampleSize takes unique paths at random, stratified by the order of magnitude of the response size recorded
+	// in the log.
+	SampleSize Strategy = "size"
+)
+
+// Dedup is what makes two requests of a replay log the same request, of which only the first is sampled.
+type Dedup string
+
+const (
+	// DedupPath considers requests for the same URL path and query params the same, whatever their method and
+	// headers, so that e.g. requests for different dag-scopes of a path are all sampled.
+	DedupPath Dedup = "path"
+	// DedupURL considers requests the same only if they also have the same method and Accept and Range headers, so
+	// that e.g. requests for different byte ranges or formats negotiated with the Accept header of a path are all
+	// sampled.
+	DedupURL Dedup = "url"
+)
+
+// keyHeaders are the request headers that change what a gateway returns, which are part of the keys of DedupURL.
+var keyHeaders = []string{"Accept", "Range"}
+
+// SampleOptions configures how requests are sampled from a replay log.
+type SampleOptions struct {
+	Strategy Strategy
+	// Seed seeds the random strategies so that samples are reproducible.
+	Seed int64
+	// Dedup is how duplicate requests are told apart. Defaults to DedupPath.
+	Dedup Dedup
+}
+
+// RequestKey returns the key of the request under dedup, which is unique among the sampled requests: the URL path
+// with its query params sorted, e.g. "/ipfs/{cid}?dag-scope=entity&format=car", and for DedupURL preceded by the
+// method unless it is GET and followed by the Accept and Range headers, if any, e.g.
+// "HEAD /ipfs/{cid} Range: bytes=0-99".
+func RequestKey(e ReplayEntry, dedup Dedup) (string, error) {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %s: %w", e.URL, err)
+	}
+	switch dedup {
+	case "", DedupPath, DedupURL:
+	default:
+		return "", fmt.Errorf("unknown dedup strategy %q", dedup)
+	}
+
+	var b strings.Builder
+	if m := strings.ToUpper(e.Method); dedup == DedupURL && len(m) != 0 && m != "GET" {
+		b.WriteString(m + " ")
+	}
+	b.WriteString(u.Path)
+	// Encode sorts the params by key, keeping the order of the values of a key
+	if q := u.Query().Encode(); len(q) != 0 {
+		b.WriteString("?" + q)
+	}
+	if dedup != DedupURL {
+		return b.String(), nil
+	}
+	for _, h := range keyHeaders {
+		if v := strings.Join(e.Headers.Values(h), ", "); len(v) != 0 {
+			b.WriteString(" " + h + ": " + v)
+		}
+	}
+	return b.String(), nil
+}
+
+// Sample picks n unique entries from the log as per opts.Dedup. The first entry is kept for requests that appear
+// more than once. Fewer than n entries are returned if the log does not have enough unique requests.
+func Sample(entries []ReplayEntry, n int, opts SampleOptions) ([]ReplayEntry, error) {
+	unique := make([]ReplayEntry, 0, len(entries))
+	seen := make(map[string]struct{}, len(entries))
+	for _, e := range entries {
+		key, err := RequestKey(e, opts.Dedup)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, e)
+	}
+	if n >= len(unique) {
+		return unique, nil
+	}
+
+	rnd := rand.New(rand.NewSource(opts.Seed))
+	switch opts.Strategy {
+	case "", SampleFirst:
+		return unique[:n], nil
+	case SampleRandom:
+		rnd.Shuffle(len(unique), func(i, j int) { unique[i], unique[j] = unique[j], unique[i] })
+		return unique[:n], nil
+	case SampleCodec:
+		return stratified(unique, n, rnd, codecStratum), nil
+	case SampleSize:
+		return stratified(unique, n, rnd, sizeStratum), nil
+	}
+	return nil, fmt.Errorf("unknown sampling strategy %q", opts.Strategy)
+}
+
+// stratified samples n entries at random, allocating them to strata in proportion to the size of each stratum
+// with the remainder going to the strata with the largest fractional shares.
+func stratified(entries []ReplayEntry, n int, rnd *rand.Rand, stratum func(ReplayEntry) string) []ReplayEntry {
+	strata := make(map[string][]ReplayEntry)
+	for _, e := range entries {
+		s := stratum(e)
+		strata[s] = append(strata[s], e)
+	}
+	// iterate over strata in a stable order so that samples only depend on the seed
+	names := make([]string, 0, len(strata))
+	for s := range strata {
+		names = append(names, s)
+	}
+	sort.Strings(names)
+
+	type share struct {
+		name string
+		n    int
+		frac float64
+	}
+	shares := make([]share, 0, len(names))
+	allocated := 0
+	for _, s := range names {
+		exact := float64(n) * float64(len(strata[s])) / float64(len(entries))
+		sh := share{name: s, n: int(exact)}
+		sh.frac = exact - float64(sh.n)
+		allocated += sh.n
+		shares = append(shares, sh)
+	}
+	sort.SliceStable(shares, func(i, j int) bool { return shares[i].frac > shares[j].frac })
+	for i := 0; allocated < n; i = (i + 1) % len(shares) {
+		if shares[i].n < len(strata[shares[i].name]) {
+			shares[i].n++
+			allocated++
+		}
+	}
+
+	out := make([]ReplayEntry, 0, n)
+	for _, sh := range shares {
+		es := strata[sh.name]
+		rnd.Shuffle(len(es), func(i, j int) { es[i], es[j] = es[j], es[i] })
+		out = append(out, es[:sh.n]...)
+	}
+	return out
+}
+
+func codecStratum(e ReplayEntry) string {
+	u, err := url.Parse(e.URL)
+	if err != nil {
+		return "unknown"
+	}
+	root, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/ipfs/"), "/")
+	c, err := cid.Decode(root)
+	if err != nil {
+		return "unknown"
+	}
+	return multicodec.Code(c.Prefix().Codec).String()
+}
+
+func sizeStratum(e ReplayEntry) string {
+	switch {
+	case e.Size <= 0:
+		return "unknown"
+	case e.Size < 1<<10:
+		return "<1KiB"
+	case e.Size < 1<<20:
+		return "<1MiB"
+	case e.Size < 100<<20:
+		return "<100MiB"
+	default:
+		return ">=100MiB"
+	}
+}
@@ -0,0 +1,171 @@
+// Package report renders a human readable HTML dashboard for a run so that results can be shared without
+// reading the JSON files written by the executor.
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// Run is the data rendered in the report of a single run.
+type Run struct {
+	RunID string
+	N     int
+	// Paths is the number of unique paths requested in the run.
+	Paths int
+
+	Components []Component
+	Mismatches []MismatchTable
+
+	// ResultsFile is the path of the full results of the run, relative to the report.
+	ResultsFile string
+}
+
+// Component is the outcome of a run for a single component.
+type Component struct {
+	Name string
+	// Success is the number of paths for which the component returned a 2xx with a successful response read.
+	Success   int
+	Latencies []time.Duration
+	// Errors is the number of failed requests by kind of failure, e.g. "timeout".
+	Errors map[string]int
+}
+
+// MismatchTable lists the paths that mismatched between two components.
+type MismatchTable struct {
+	Pair string
+	// Kind is what mismatched, e.g. "status" or "bytes".
+	Kind  string
+	Paths []string
+	// File is the path of the file with the full mismatch records, relative to the report.
+	File string
+	// Persistence maps paths that were requested again to "persistent" if they still mismatched and "transient"
+	// otherwise.
+	Persistence map[string]string
+}
+
+// Count returns the number of paths with the given persistence.
+func (m MismatchTable) Count(persistence string) int {
+	n := 0
+	for _, p := range m.Persistence {
+		if p == persistence {
+			n++
+		}
+	}
+	return n
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets.
+var latencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	1 * time.Minute,
+}
+
+type histogramBucket struct {
+	Label   string
+	Count   int
+	Percent float64
+}
+
+func (c Component) SuccessRate(paths int) float64 {
+	if paths == 0 {
+		return 0
+	}
+	return 100 * float64(c.Success) / float64(paths)
+}
+
+// Histogram buckets the latencies of the component.
+func (c Component) Histogram() []histogramBucket {
+	buckets := make([]histogramBucket, len(latencyBuckets)+1)
+	for i, b := range latencyBuckets {
+		buckets[i].Label = "< " + b.String()
+	}
+	buckets[len(latencyBuckets)].Label = ">= " + latencyBuckets[len(latencyBuckets)-1].String()
+
+	for _, l := range c.Latencies {
+		i := sort.Search(len(latencyBuckets), func(i int) bool { return l < latencyBuckets[i] })
+		buckets[i].Count++
+	}
+	for i := range buckets {
+		if len(c.Latencies) != 0 {
+			buckets[i].Percent = 100 * float64(buckets[i].Count) / float64(len(c.Latencies))
+		}
+	}
+	return buckets
+}
+
+var tmpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(f float64) string { return fmt.Sprintf("%.1f%%", f) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Onion run {{.N}} ({{.RunID}})</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+.bar { background: #4a90d9; height: 12px; }
+.hist td { border: none; padding: 1px 8px; }
+</style>
+</head>
+<body>
+<h1>Onion run {{.N}}</h1>
+<p>Run ID <code>{{.RunID}}</code>; {{.Paths}} unique paths; full results in <a href="{{.ResultsFile}}">{{.ResultsFile}}</a>.</p>
+
+<h2>Success rates</h2>
+<table>
+<tr><th>Component</th><th>2xx with successful response read</th><th>Rate</th><th>Failures by kind</th></tr>
+{{- $paths := .Paths}}
+{{- range .Components}}
+<tr><td>{{.Name}}</td><td>{{.Success}}</td><td>{{pct (.SuccessRate $paths)}}</td><td>{{range $kind, $n := .Errors}}{{$kind}}: {{$n}} {{end}}</td></tr>
+{{- end}}
+</table>
+
+<h2>Mismatches</h2>
+<table>
+<tr><th>Pair</th><th>Kind</th><th>Count</th><th>Persistent</th><th>Transient</th><th>Records</th></tr>
+{{- range .Mismatches}}
+<tr><td>{{.Pair}}</td><td>{{.Kind}}</td><td>{{len .Paths}}</td><td>{{.Count "persistent"}}</td><td>{{.Count "transient"}}</td><td><a href="{{.File}}">{{.File}}</a></td></tr>
+{{- end}}
+</table>
+{{- range .Mismatches}}{{if .Paths}}
+<h3>{{.Pair}} {{.Kind}} mismatches</h3>
+<table>
+<tr><th>Path</th><th>Re-verification</th></tr>
+{{- $persistence := .Persistence}}
+{{- range .Paths}}
+<tr><td><code>{{.}}</code></td><td>{{index $persistence .}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+
+<h2>Latency</h2>
+{{- range .Components}}
+<h3>{{.Name}}</h3>
+<table class="hist">
+{{- range .Histogram}}
+<tr><td>{{.Label}}</td><td>{{.Count}}</td><td style="width: 400px"><div class="bar" style="width: {{pct .Percent}}"></div></td></tr>
+{{- end}}
+</table>
+{{- end}}
+</body>
+</html>
+`))
+
+func WriteHTML(w io.Writer, r Run) error {
+	for i := range r.Mismatches {
+		sort.Strings(r.Mismatches[i].Paths)
+	}
+	return tmpl.Execute(w, r)
+}
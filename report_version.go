@@ -0,0 +1,284 @@
+package onion
+
+//go:generate go run ./cmd/onion schema -o report-schema.json
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReportVersion is the version of the format of the JSON reports. It is bumped whenever a field of a report is
+// removed, renamed or changes type, so that downstream parsers can tell the formats apart; adding a field does not
+// bump it.
+const ReportVersion = 2
+
+// ReportV1 is the envelope of every JSON report onion writes, e.g. results.json or aggregate.json. Data is the
+// report itself, whose type is determined by Report and described by the schema of ReportSchema.
+type ReportV1 struct {
+	ReportVersion int         `json:"report_version"`
+	Report        string      `json:"report"`
+	Data          interface{} `json:"data"`
+}
+
+// reportKinds are the kinds of reports and the types of their data. The kind of a report written to a file is the
+// name of the file without .json and without the name of the component or pair it is about, e.g. the kind of
+// results-1/response_reads/shim-nginx-mismatch-paths.json is mismatch-paths.
+var reportKinds = map[string]reflect.Type{
+	"results":                       reflect.TypeOf(map[string]Results(nil)),
+	"requests":                      reflect.TypeOf(map[string]URLsToTest(nil)),
+	"checkpoint":                    reflect.TypeOf(Checkpoint{}),
+	"top-level-metrics":             reflect.TypeOf(TopLevelMetrics{}),
+	"response-reads":                reflect.TypeOf(&ResponseBytesMismatch{}),
+	"mismatch":                      reflect.TypeOf(map[string]*Mismatch(nil)),
+	"mismatch-paths":                reflect.TypeOf([]string(nil)),
+	"mismatches":                    reflect.TypeOf(map[string]*Mismatch(nil)),
+	"header-mismatches":             reflect.TypeOf(map[string]*Mismatch(nil)),
+	"redirect-mismatches":           reflect.TypeOf(map[string]*Mismatch(nil)),
+	"verification-mismatches":       reflect.TypeOf(map[string]*Mismatch(nil)),
+	"2xx-response-read-error-paths": reflect.TypeOf([]string(nil)),
+	"2xx-response-read-errors":      reflect.TypeOf(map[string]*ReadError(nil)),
+	"truncated-responses":           reflect.TypeOf(map[string]*Result(nil)),
+	"transfer-discrepancies":        reflect.TypeOf(map[string]*TransferReport(nil)),
+	"dag-scope-violations":          reflect.TypeOf(map[string]*DagScopeReport(nil)),
+	"car-order-violations":          reflect.TypeOf(map[string]*CarOrderReport(nil)),
+	"car-index-errors":              reflect.TypeOf(map[string]*CarIndexReport(nil)),
+	"corrupt-blocks":                reflect.TypeOf(map[string]*BlockIntegrityReport(nil)),
+	"block-provenance":              reflect.TypeOf(map[string]*BlockProvenance(nil)),
+	"production-mismatches":         reflect.TypeOf(map[string]*Result(nil)),
+	"cache-anomalies":               reflect.TypeOf(map[string]*CacheAnomaly(nil)),
+	"encoding-anomalies":            reflect.TypeOf(map[string]*EncodingAnomaly(nil)),
+	"node-outliers":                 reflect.TypeOf(&NodeConsistency{}),
+	"slow-requests":                 reflect.TypeOf([]SlowRequest(nil)),
+	"connections":                   reflect.TypeOf(map[string]*ConnStats(nil)),
+	"request-classes":               reflect.TypeOf(map[string]*ClassStats(nil)),
+	"gateway-variants":              reflect.TypeOf(map[string]map[GatewayVariant]*VariantStats(nil)),
+	"car-negotiation":               reflect.TypeOf(map[GatewayVariant]*NegotiationStats(nil)),
+	"negotiation-violations":        reflect.TypeOf(map[string]*NegotiationReport(nil)),
+	"conditional-requests":          reflect.TypeOf(&ConditionalStats{}),
+	"error-kinds":                   reflect.TypeOf(map[string]map[ErrorKind]int(nil)),
+	"throttling":                    reflect.TypeOf(map[string]*ThrottleStats(nil)),
+	"mismatch-providers":            reflect.TypeOf(CidContactSummary{}),
+	"read-error-providers":          reflect.TypeOf(CidContactSummary{}),
+	"probes":                        reflect.TypeOf(map[string]*ProbeReport(nil)),
+	"probe-diagnoses":               reflect.TypeOf(map[string]*ProbeDiagnosis(nil)),
+	"cid-contact-lookups":           reflect.TypeOf(map[string]*CidContactLookup(nil)),
+	"reverification":                reflect.TypeOf(map[string]map[MismatchKind]map[string]Persistence(nil)),
+	"manifest":                      reflect.TypeOf(ArtifactManifest{}),
+	"chaos":                         reflect.TypeOf([]ChaosInjection(nil)),
+	"run-metadata":                  reflect.TypeOf(&RunMetadata{}),
+	"assertions":                    reflect.TypeOf([]AssertionResult(nil)),
+	"cohorts":                       reflect.TypeOf([]CohortSummary(nil)),
+	"index":                         reflect.TypeOf([]IndexedRun(nil)),
+	"aggregate":                     reflect.TypeOf([]*RunsAggregate(nil)),
+	"diff":                          reflect.TypeOf(&RunDiff{}),
+	"offline-verification":          reflect.TypeOf(&OfflineVerification{}),
+	"load":                          reflect.TypeOf(&LoadReport{}),
+}
+
+// reportKind returns the kind of the report written to the file, which is the longest kind the name of the file
+// ends with.
+func reportKind(filename string) (string, error) {
+	base := strings.TrimSuffix(path.Base(filepath.ToSlash(filename)), ".json")
+	kind := ""
+	for k := range reportKinds {
+		if (base == k || strings.HasSuffix(base, "-"+k)) && len(k) > len(kind) {
+			kind = k
+		}
+	}
+	if len(kind) == 0 {
+		return "", fmt.Errorf("no report kind for %s", filename)
+	}
+	return kind, nil
+}
+
+// MarshalReport encodes the data of a report of the kind, e.g. "diff", in its versioned envelope as indented JSON.
+func MarshalReport(kind string, v interface{}) ([]byte, error) {
+	if _, ok := reportKinds[kind]; !ok {
+		return nil, fmt.Errorf("unknown report kind %q", kind)
+	}
+	return json.MarshalIndent(ReportV1{ReportVersion: ReportVersion, Report: kind, Data: v}, "", " ")
+}
+
+// UnmarshalReport decodes the data of a report into v. Reports written before reports were versioned, which are
+// their bare data, are decoded as well; reports of a newer version than ReportVersion are rejected.
+func UnmarshalReport(bz []byte, v interface{}) error {
+	var env struct {
+		ReportVersion *int            `json:"report_version"`
+		Data          json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(bz, &env); err != nil || env.ReportVersion == nil {
+		return json.Unmarshal(bz, v)
+	}
+	if *env.ReportVersion > ReportVersion {
+		return fmt.Errorf("report version %d is newer than the supported version %d", *env.ReportVersion, ReportVersion)
+	}
+	return json.Unmarshal(env.Data, v)
+}
+
+// ReportSchema returns a JSON Schema of the versioned reports generated from the Go types of their data. It has a
+// definition of the envelope of every kind of report, named report-<kind>, and validates reports of any kind.
+func ReportSchema() ([]byte, error) {
+	g := &schemaGen{defs: make(map[string]interface{}), names: make(map[reflect.Type]string)}
+	kinds := make([]string, 0, len(reportKinds))
+	for k := range reportKinds {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	var oneOf []interface{}
+	for _, k := range kinds {
+		g.defs["report-"+k] = map[string]interface{}{
+			"type":     "object",
+			"required": []string{"report_version", "report", "data"},
+			"properties": map[string]interface{}{
+				"report_version": map[string]interface{}{"const": ReportVersion},
+				"report":         map[string]interface{}{"const": k},
+				"data":           g.schema(reportKinds[k]),
+			},
+		}
+		oneOf = append(oneOf, map[string]interface{}{"$ref": "#/$defs/report-" + k})
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   fmt.Sprintf("onion reports, version %d", ReportVersion),
+		"oneOf":   oneOf,
+		"$defs":   g.defs,
+	}, "", "  ")
+}
+
+// schemaGen generates JSON Schemas of Go types as encoding/json encodes them. Named struct types are defined once in
+// defs and referenced, so that recursive types terminate.
+type schemaGen struct {
+	defs  map[string]interface{}
+	names map[reflect.Type]string
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	durationType      = reflect.TypeOf(time.Duration(0))
+	uuidType          = reflect.TypeOf(uuid.UUID{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (g *schemaGen) schema(t reflect.Type) interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	case t == uuidType:
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// encoded by its own MarshalJSON, e.g. CIDs as {"/": "<cid>"}
+		return map[string]interface{}{}
+	case t.Kind() != reflect.String && (t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)):
+		return map[string]interface{}{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Ptr:
+		return nullable(g.schema(t.Elem()))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": []string{"string", "null"}, "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem()), "minItems": t.Len(), "maxItems": t.Len()}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return g.object(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.defName(t)
+			g.names[t] = name
+			g.defs[name] = nil
+			g.defs[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + name}
+	default:
+		// interfaces, which can hold anything
+		return map[string]interface{}{}
+	}
+}
+
+// defName returns the name of the definition of the named type, qualified by its package if another type of the
+// same name is defined already.
+func (g *schemaGen) defName(t reflect.Type) string {
+	if _, taken := g.defs[t.Name()]; !taken {
+		return t.Name()
+	}
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+// object returns the schema of the struct with the exported fields that encoding/json encodes, including those of
+// embedded structs.
+func (g *schemaGen) object(t reflect.Type) interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			ft := f.Type
+			if f.Anonymous && len(name) == 0 {
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					addFields(ft)
+					continue
+				}
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if len(name) == 0 {
+				name = f.Name
+			}
+			properties[name] = g.schema(ft)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	sort.Strings(required)
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// nullable returns the schema that also allows null.
+func nullable(s interface{}) interface{} {
+	return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+}
@@ -0,0 +1,131 @@
+package onion
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ReportWriter receives the results and reports of a run. Files are named by slash-separated paths relative to the
+// results directory of the run, e.g. "response_reads/response-reads.json", whatever the OS.
+type ReportWriter interface {
+	// Create returns a writer for the file, replacing any earlier file of the same name. The file is only
+	// complete once the writer is closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// DirReportWriter writes reports to a directory of the local filesystem, creating the directories of their names as
+// needed.
+type DirReportWriter struct {
+	Dir string
+}
+
+func (w DirReportWriter) Create(name string) (io.WriteCloser, error) {
+	if err := checkReportName(name); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(w.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(p)
+}
+
+// MemoryReportWriter keeps reports in memory, e.g. to check the reports of a run in tests without touching the
+// filesystem.
+type MemoryReportWriter struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemoryReportWriter returns a MemoryReportWriter without reports.
+func NewMemoryReportWriter() *MemoryReportWriter {
+	return &MemoryReportWriter{files: make(map[string][]byte)}
+}
+
+func (w *MemoryReportWriter) Create(name string) (io.WriteCloser, error) {
+	if err := checkReportName(name); err != nil {
+		return nil, err
+	}
+	return &memoryReport{w: w, name: name}, nil
+}
+
+// File returns the contents of the closed report, and false if there is no such report.
+func (w *MemoryReportWriter) File(name string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	bz, ok := w.files[name]
+	return bz, ok
+}
+
+// Files returns the names of the closed reports, sorted.
+func (w *MemoryReportWriter) Files() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	names := make([]string, 0, len(w.files))
+	for name := range w.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memoryReport buffers a report until it is closed.
+type memoryReport struct {
+	bytes.Buffer
+	w    *MemoryReportWriter
+	name string
+}
+
+func (r *memoryReport) Close() error {
+	r.w.mu.Lock()
+	defer r.w.mu.Unlock()
+	r.w.files[r.name] = append([]byte(nil), r.Bytes()...)
+	return nil
+}
+
+// subReportWriter writes reports to a directory of the reports of another writer.
+type subReportWriter struct {
+	w   ReportWriter
+	dir string
+}
+
+func (s subReportWriter) Create(name string) (io.WriteCloser, error) {
+	return s.w.Create(path.Join(s.dir, name))
+}
+
+// checkReportName checks that the report name is a clean slash-separated path within the results directory.
+func checkReportName(name string) error {
+	if len(name) == 0 || path.Clean(name) != name || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") ||
+		strings.Contains(name, `\`) {
+		return fmt.Errorf("invalid report name %q", name)
+	}
+	return nil
+}
+
+// writeReportJSON writes v as indented JSON in its versioned envelope to the report.
+func writeReportJSON(w ReportWriter, name string, v interface{}) error {
+	kind, err := reportKind(name)
+	if err != nil {
+		return err
+	}
+	jsonData, err := MarshalReport(kind, v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+	f, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(jsonData); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
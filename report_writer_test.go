@@ -0,0 +1,108 @@
+package onion
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/filecoin-saturn/onion/replay"
+)
+
+func TestRunWithMemoryReportWriter(t *testing.T) {
+	ref := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ref.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ipfs/b" {
+			w.Write([]byte("mismatch"))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer other.Close()
+
+	var components []Component
+	for _, cfg := range []ComponentConfig{
+		{Name: "ref", Host: ref.Listener.Addr().String(), Protocol: "http", Extract: "raw", Reference: true},
+		{Name: "other", Host: other.Listener.Addr().String(), Protocol: "http", Extract: "raw"},
+	} {
+		c, err := NewComponent(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		components = append(components, c)
+	}
+	var entries []replay.ReplayEntry
+	for _, p := range []string{"a", "b"} {
+		entries = append(entries, replay.ReplayEntry{Method: http.MethodGet, URL: "https://127.0.0.1/ipfs/" + p})
+	}
+
+	reports := NewMemoryReportWriter()
+	resultsDir := filepath.Join(t.TempDir(), "results")
+	report, err := Run(context.Background(), RunConfig{
+		Components: components,
+		Entries:    entries,
+		Count:      len(entries),
+		Runs:       2,
+		ResultsDir: resultsDir,
+		Options:    ExecutorOptions{Reports: reports},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Runs) != 2 {
+		t.Fatalf("expected 2 runs, got %d", len(report.Runs))
+	}
+
+	for _, name := range []string{
+		"results-1/results.json",
+		"results-1/results.csv",
+		"results-1/report.html",
+		"results-1/response_reads/response-reads.json",
+		"results-1/response_reads/ref-other-mismatch-paths.json",
+		"results-1/" + runMetadataFile,
+		"results-2/results.json",
+		runIndexFile,
+		aggregateFile,
+	} {
+		if _, ok := reports.File(name); !ok {
+			t.Errorf("report %s was not written, got %v", name, reports.Files())
+		}
+	}
+
+	// only the checkpoints of the runs are written to disk
+	err = filepath.WalkDir(resultsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if d.Name() != checkpointFile {
+			t.Errorf("expected %s to be written to the report writer, not to disk", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mismatches []string
+	bz, _ := reports.File("results-2/response_reads/ref-other-mismatch-paths.json")
+	if err := UnmarshalReport(bz, &mismatches); err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0] != "/ipfs/b" {
+		t.Errorf("expected /ipfs/b to mismatch, got %v", mismatches)
+	}
+
+	var index []IndexedRun
+	bz, _ = reports.File(runIndexFile)
+	if err := UnmarshalReport(bz, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 2 || index[0].Dir != "results-1" || index[1].Dir != "results-2" {
+		t.Errorf("expected both runs to be indexed, got %+v", index)
+	}
+}
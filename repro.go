@@ -0,0 +1,200 @@
+package onion
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reproSecret replaces the secrets that the auth config of a component holds verbatim in reproductions, so that
+// mismatch records can be shared.
+const reproSecret = "REDACTED"
+
+// repro returns a shell script that sends the requests of the path to the components with curl the way onion sent
+// them, saving every response body to {component}.body and comparing them. Credentials are referenced by the env vars
+// of the auth config of the components, if it references any.
+func (re *RequestExecutor) repro(urls URLsToTest, rs Results, components ...Component) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	var bodies []string
+	for _, c := range components {
+		r := rs[c.Name]
+		if r == nil || len(r.Url) == 0 {
+			continue
+		}
+		if c.Golden != nil {
+			fmt.Fprintf(&b, "\n# %s is served from recorded responses\n", c.Name)
+			continue
+		}
+		body := shellQuote(c.Name + ".body")
+		bodies = append(bodies, body)
+		fmt.Fprintf(&b, "\n# %s\n", c.Name)
+
+		h := http.Header{}
+		for k, vs := range urls.Headers[c.Name] {
+			h[http.CanonicalHeaderKey(k)] = append([]string(nil), vs...)
+		}
+		if urls.RawBlock {
+			h.Set("Accept", rawBlockContentType)
+		}
+		if len(r.Range) != 0 {
+			h.Set("Range", r.Range)
+		}
+		var authArgs []string
+		if c.Auth != nil {
+			var setup string
+			setup, authArgs = c.Auth.reproArgs(c.Name, h)
+			if len(setup) != 0 {
+				b.WriteString(setup + "\n")
+			}
+		}
+
+		args := []string{"curl", "-sS", "-D", "-", "-o", body}
+		method := r.Method
+		switch method {
+		case "", http.MethodGet:
+			method = http.MethodGet
+		case http.MethodHead:
+			args = append(args, "--head")
+		default:
+			args = append(args, "-X", method)
+		}
+		switch c.HTTPVersion {
+		case HTTP1:
+			args = append(args, "--http1.1")
+		case HTTP2:
+			args = append(args, "--http2")
+		}
+		if strings.HasPrefix(r.Url, "https://") {
+			args = append(args, "-k")
+		}
+		if c.Redirects == RedirectFollow {
+			args = append(args, "-L")
+		}
+		args = append(args, connectTo(c.Resolve)...)
+		if len(c.SNI) != 0 {
+			fmt.Fprintf(&b, "# onion sends the SNI %s, which curl can not send for this URL\n", c.SNI)
+		}
+		// the Go client asks for and decompresses gzip responses unless the request asks for an encoding or a range
+		if len(h.Get("Accept-Encoding")) == 0 && len(h.Get("Range")) == 0 && method != http.MethodHead {
+			args = append(args, "--compressed")
+		}
+		args = append(args, "--max-time", fmt.Sprint(re.requestTimeout(c, urls).Seconds()))
+		if len(r.Host) != 0 {
+			args = append(args, "-H", shellQuote("Host: "+r.Host))
+		}
+		keys := make([]string, 0, len(h))
+		for k := range h {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, v := range h[k] {
+				args = append(args, "-H", shellQuote(k+": "+v))
+			}
+		}
+		args = append(args, authArgs...)
+		args = append(args, shellQuote(r.Url))
+
+		line := strings.Join(args, " ")
+		if len(urls.Body) != 0 {
+			line = fmt.Sprintf("printf '%%s' %s | base64 -d | %s --data-binary @-", shellQuote(base64.StdEncoding.EncodeToString(urls.Body)), line)
+		}
+		b.WriteString(line + "\n")
+	}
+	if len(bodies) == 2 {
+		fmt.Fprintf(&b, "\ncmp %s %s\n", bodies[0], bodies[1])
+	}
+	return b.String()
+}
+
+// connectTo returns the curl args that connect to the addresses the DNS overrides of a component resolve hosts to.
+func connectTo(resolve map[string]string) []string {
+	hosts := make([]string, 0, len(resolve))
+	for host := range resolve {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var args []string
+	for _, host := range hosts {
+		// empty ports match any port and keep the port of the URL
+		from, to := host+":", bracketIP(resolve[host])+":"
+		if _, _, err := net.SplitHostPort(host); err == nil {
+			from = host
+		}
+		if _, _, err := net.SplitHostPort(resolve[host]); err == nil {
+			to = resolve[host]
+		}
+		args = append(args, "--connect-to", shellQuote(from+":"+to))
+	}
+	return args
+}
+
+// bracketIP brackets IPv6 addresses as they are written in URLs.
+func bracketIP(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "[" + ip + "]"
+	}
+	return ip
+}
+
+// reproArgs returns the curl args that send the credentials of the authenticator, and the shell command that sets the
+// token of a token command, if any. Credentials that reference env vars reference them in the args as well, while
+// those written verbatim in the config are redacted. The headers the credentials replace are removed from h.
+func (a *Authenticator) reproArgs(name string, h http.Header) (string, []string) {
+	keys := make([]string, 0, len(a.cfg.Headers))
+	for k := range a.cfg.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		h.Del(k)
+		args = append(args, "-H", `"`+shellEscape(http.CanonicalHeaderKey(k)+": ")+reproValue(a.cfg.Headers[k])+`"`)
+	}
+
+	var setup string
+	switch {
+	case len(a.cfg.Bearer) != 0:
+		h.Del("Authorization")
+		args = append(args, "-H", `"Authorization: Bearer `+reproValue(a.cfg.Bearer)+`"`)
+	case len(a.cfg.BasicUser) != 0:
+		h.Del("Authorization")
+		args = append(args, "-u", `"`+shellEscape(a.cfg.BasicUser)+":"+reproValue(a.cfg.BasicPassword)+`"`)
+	case len(a.cfg.TokenCommand) != 0:
+		h.Del("Authorization")
+		token := strings.ToUpper(nonShellName.ReplaceAllString(name, "_")) + "_TOKEN"
+		setup = fmt.Sprintf("%s=$(%s)", token, a.cfg.TokenCommand)
+		args = append(args, "-H", `"Authorization: Bearer ${`+token+`}"`)
+	}
+	return setup, args
+}
+
+// nonShellName matches the characters that can not be part of the name of a shell variable.
+var nonShellName = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// reproValue returns a credential of an auth config to place within double quotes, where the shell expands the env
+// vars it references like NewAuthenticator does. Credentials without env vars are redacted.
+func reproValue(v string) string {
+	if !strings.Contains(v, "$") {
+		if len(v) == 0 {
+			return ""
+		}
+		return reproSecret
+	}
+	return shellEscape(v)
+}
+
+// shellEscape escapes the characters of s that are special within double quotes, except for $.
+func shellEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`").Replace(s)
+}
+
+// shellQuote quotes s for the shell so that it is passed as is.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
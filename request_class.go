@@ -0,0 +1,211 @@
+package onion
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// SizeClass classes requests by the size of their response.
+type SizeClass string
+
+const (
+	// SizeSmall is a response smaller than 1 MiB.
+	SizeSmall SizeClass = "small"
+	// SizeMedium is a response of at least 1 MiB and smaller than 100 MiB.
+	SizeMedium SizeClass = "medium"
+	// SizeLarge is a response of at least 100 MiB.
+	SizeLarge SizeClass = "large"
+	// SizeUnknown is a response whose size is not known, because the replay log does not record it and no
+	// component returned a body for it.
+	SizeUnknown SizeClass = "unknown-size"
+)
+
+const (
+	mediumSize = 1 << 20
+	largeSize  = 100 << 20
+)
+
+// MediaKind classes requests by the extension of the file they ask for.
+type MediaKind string
+
+const (
+	MediaVideo MediaKind = "video"
+	MediaImage MediaKind = "image"
+	// MediaOther is any other file, or a path without an extension, e.g. the root of a DAG.
+	MediaOther MediaKind = "other"
+)
+
+// mediaExtensions maps the lower case extensions of video and image files to their kind.
+var mediaExtensions = map[string]MediaKind{
+	".mp4": MediaVideo, ".m4v": MediaVideo, ".webm": MediaVideo, ".mkv": MediaVideo, ".mov": MediaVideo,
+	".avi": MediaVideo, ".m3u8": MediaVideo, ".ts": MediaVideo, ".mpd": MediaVideo, ".m4s": MediaVideo,
+	".jpg": MediaImage, ".jpeg": MediaImage, ".png": MediaImage, ".gif": MediaImage, ".webp": MediaImage,
+	".avif": MediaImage, ".svg": MediaImage, ".bmp": MediaImage, ".ico": MediaImage, ".tif": MediaImage,
+	".tiff": MediaImage,
+}
+
+// RequestClass is the cohort of a request by the codec of its root CID, the size of its response and the kind of
+// media it asks for, so that e.g. mismatches that cluster on large dag-pb files stand out.
+type RequestClass struct {
+	// Codec is the codec of the root CID of the path, e.g. dag-pb or raw, "ipns" for /ipns/ paths that were not
+	// resolved and "unknown" for paths whose root is not a CID.
+	Codec string
+	Size  SizeClass
+	Media MediaKind
+}
+
+// Name names the class, e.g. dag-pb/large/video.
+func (c RequestClass) Name() string {
+	return fmt.Sprintf("%s/%s/%s", c.Codec, c.Size, c.Media)
+}
+
+// requestClass returns the class of the request. The size of its response is the size the replay log records for
+// it or, if the log does not record sizes, the largest response body any component returned for it.
+func requestClass(urls URLsToTest, rs Results) RequestClass {
+	p := urls.Path
+	if len(urls.ResolvedPath) != 0 {
+		p = urls.ResolvedPath
+	}
+	p, _, _ = strings.Cut(p, "?")
+
+	class := RequestClass{Codec: "unknown", Size: SizeUnknown, Media: MediaOther}
+	if ns, root, _, err := splitContentPath(p); err == nil && ns == "ipns" {
+		class.Codec = "ipns"
+	} else if c, err := cid.Decode(root); err == nil {
+		class.Codec = multicodec.Code(c.Type()).String()
+	}
+
+	size := urls.ExpectedSize
+	if size <= 0 {
+		for _, r := range rs {
+			if r != nil && isReadOK(r) && int64(r.ResponseSize) > size {
+				size = int64(r.ResponseSize)
+			}
+		}
+	}
+	switch {
+	case size <= 0:
+	case size < mediumSize:
+		class.Size = SizeSmall
+	case size < largeSize:
+		class.Size = SizeMedium
+	default:
+		class.Size = SizeLarge
+	}
+
+	if kind, ok := mediaExtensions[strings.ToLower(path.Ext(requestFilename(urls, p)))]; ok {
+		class.Media = kind
+	}
+	return class
+}
+
+// requestFilename returns the filename query parameter of the request, if any, or its path.
+func requestFilename(urls URLsToTest, p string) string {
+	names := make([]string, 0, len(urls.URLs))
+	for name := range urls.URLs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if u, err := url.Parse(urls.URLs[name]); err == nil && len(u.Query().Get("filename")) != 0 {
+			return u.Query().Get("filename")
+		}
+	}
+	return p
+}
+
+// ClassStats summarises the requests of a class.
+type ClassStats struct {
+	Class RequestClass
+	Paths int
+	// FailedRequests is the number of requests to every component whose response was not read successfully, keyed
+	// by component name.
+	FailedRequests map[string]int
+	// StatusMismatches and BytesMismatches are the number of mismatched paths of every pair, keyed by pair name.
+	StatusMismatches map[string]int
+	BytesMismatches  map[string]int
+	// Latency is keyed by component name.
+	Latency map[string]LatencyStats
+}
+
+// classStats summarises the requests of every class of the run, keyed by class name. The caller must hold the lock.
+func (re *RequestExecutor) classStats() map[string]*ClassStats {
+	out := make(map[string]*ClassStats)
+	classes := make(map[string]string, len(re.results))
+	results := make(map[string]map[string]Results)
+	for path, rs := range re.results {
+		class := requestClass(re.reqs[path], rs)
+		s := out[class.Name()]
+		if s == nil {
+			s = &ClassStats{
+				Class:            class,
+				FailedRequests:   make(map[string]int),
+				StatusMismatches: make(map[string]int),
+				BytesMismatches:  make(map[string]int),
+			}
+			out[class.Name()] = s
+			results[class.Name()] = make(map[string]Results)
+		}
+		classes[path] = class.Name()
+		results[class.Name()][path] = rs
+		s.Paths++
+		for name, r := range rs {
+			if r != nil && !isReadOK(r) {
+				s.FailedRequests[name]++
+			}
+		}
+	}
+
+	_, statusPaths := re.statusMismatches()
+	for _, p := range re.pairs {
+		for _, path := range statusPaths[p.Name()] {
+			if class, ok := classes[path]; ok {
+				out[class].StatusMismatches[p.Name()]++
+			}
+		}
+		for _, path := range re.responseReads.Pairs[p.Name()].MismatchPaths {
+			if class, ok := classes[path]; ok {
+				out[class].BytesMismatches[p.Name()]++
+			}
+		}
+	}
+	for class, s := range out {
+		s.Latency = componentLatencyStats(re.components, results[class])
+	}
+	return out
+}
+
+// writeClasses writes the summaries of the classes of the requests of the run to request-classes.json and prints
+// them side by side. The caller must hold the lock.
+func (re *RequestExecutor) writeClasses() {
+	stats := re.classStats()
+	re.writeJSON(stats, re.rrFile("request-classes.json"))
+
+	classes := make([]string, 0, len(stats))
+	for class := range stats {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	fmt.Println("\n ----------SUMMARY OF REQUEST CLASSES --------------")
+	for _, class := range classes {
+		s := stats[class]
+		fmt.Printf("\n Run-%d; class %s: %d paths", re.n, class, s.Paths)
+		for _, c := range re.components {
+			fmt.Printf("\n Run-%d; class %s; %s: failed requests %d (%.2f%%), p50 latency %s", re.n, class, c.Name,
+				s.FailedRequests[c.Name], percentOf(s.FailedRequests[c.Name], s.Paths), s.Latency[c.Name].P50)
+		}
+		for _, p := range re.pairs {
+			fmt.Printf("\n Run-%d; class %s; %s: status mismatches %d (%.2f%%), bytes mismatches %d (%.2f%%)", re.n,
+				class, p.Name(), s.StatusMismatches[p.Name()], percentOf(s.StatusMismatches[p.Name()], s.Paths),
+				s.BytesMismatches[p.Name()], percentOf(s.BytesMismatches[p.Name()], s.Paths))
+		}
+	}
+	fmt.Println()
+}
@@ -2,89 +2,445 @@ package onion
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/filecoin-saturn/onion/cardiff"
+	"github.com/filecoin-saturn/onion/report"
 	"github.com/google/uuid"
+	"github.com/ipfs/go-cid"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/atomic"
+	"golang.org/x/exp/slog"
 )
 
-var defaultConcurrency = 6
-
-type ResponseBytesMismatch struct {
-	KuboLassieMismatches    map[string]Results
-	KuboLassieMismatchPaths []string
-
-	KuboL1ShimMismatches    map[string]Results
-	KuboL1ShimMismatchPaths []string
-
-	KuboL1NginxMismatches    map[string]Results
-	KuboL1NginxMismatchPaths []string
-
-	KuboBifrostMismatches    map[string]Results
-	KuboBifrostMismatchPaths []string
-
-	LassieShimMismatches    map[string]Results
-	LassieShimMismatchPaths []string
-
-	ShimNginxMismatches    map[string]Results
-	ShimNginxMismatchPaths []string
+var (
+	defaultConcurrency    = 6
+	defaultTimeout        = 3 * time.Minute
+	defaultRetryBackoff   = 1 * time.Second
+	defaultExtractTimeout = 30 * time.Second
+	// maxRetryBackoff caps the exponential backoff between retries.
+	maxRetryBackoff = 5 * time.Minute
+)
 
-	NginxBifrostMismatches    map[string]Results
-	NginxBifrostMismatchPaths []string
+// PairMismatches records the response bytes mismatches observed between the two components of a Pair.
+type PairMismatches struct {
+	// Mismatches are the paths for which at least one comparator of the pair found the responses to differ.
+	Mismatches    map[string]*Mismatch
+	MismatchPaths []string
+	TotalMatches  int
+
+	// Comparators is keyed by Comparator.Name().
+	Comparators map[string]*ComparatorTally
+
+	// HeaderMismatches are the paths for which the compared headers of the responses differ, if headers are
+	// compared.
+	HeaderMismatches    map[string]*Mismatch `json:",omitempty"`
+	HeaderMismatchPaths []string             `json:",omitempty"`
+
+	// RedirectMismatches are the paths for which the components were redirected differently.
+	RedirectMismatches    map[string]*Mismatch
+	RedirectMismatchPaths []string
+
+	// VerificationMismatches are the paths for which the VerificationHeaders of the responses differ, if they are
+	// compared.
+	VerificationMismatches    map[string]*Mismatch `json:",omitempty"`
+	VerificationMismatchPaths []string             `json:",omitempty"`
+}
 
-	TotalLassieReadSuccess  int
-	TotalL1ShimReadSuccess  int
-	TotalL1NginxReadSuccess int
-	TotalBifrostReadSuccess int
+// ComparatorTally records the verdicts of a single comparator for a pair.
+type ComparatorTally struct {
+	TotalMatches      int
+	TotalMismatches   int
+	TotalIncomparable int
+	MismatchPaths     []string
+}
 
-	TotalLassieReadError  int
-	TotalL1ShimReadError  int
-	TotalL1NginxReadError int
-	TotalBifrostReadError int
+// Mismatch is a response bytes mismatch between the two components of a pair for a path.
+type Mismatch struct {
+	Results Results
+	// Comparators are the names of the comparators that found the responses to differ.
+	Comparators []string `json:",omitempty"`
+	// CarDiff is the structural diff of the two responses if both components returned CARs.
+	CarDiff *cardiff.Diff `json:",omitempty"`
+	// CarDiffError is set if both components returned CARs but they could not be diffed.
+	CarDiffError string `json:",omitempty"`
+	// Provenance locates the blocks of the DAG of one CAR that are missing from or differ in the other, if both
+	// components returned CARs.
+	Provenance *BlockProvenance `json:",omitempty"`
+	// Divergence is where the responses first differ, if their bodies were captured.
+	Divergence *Divergence `json:",omitempty"`
+	// Persistence is whether the mismatch was still observed when the path was re-verified, if it was.
+	Persistence Persistence `json:",omitempty"`
+	// HeaderDiffs are the compared headers that differ, for header mismatches.
+	HeaderDiffs []HeaderDiff `json:",omitempty"`
+	// Probe is whether the root CID of the path could be retrieved from its providers, if they were probed, and
+	// Diagnosis tells from it whether the path failed because of its providers or because of the layers.
+	Probe     *ProbeReport    `json:",omitempty"`
+	Diagnosis *ProbeDiagnosis `json:",omitempty"`
+	// CidContact is what cid.contact knows about the root CID of the path, if it was looked up.
+	CidContact *CidContactLookup `json:",omitempty"`
+	// Artifacts is the directory of the artifacts directory of the run that the responses were saved to, if they
+	// were.
+	Artifacts string `json:",omitempty"`
+	// Repro is a shell script that sends the requests of the pair with curl to reproduce the mismatch.
+	Repro string `json:",omitempty"`
+}
 
-	LassieReadErrors  map[string]*Result
-	L1ShimReadErrors  map[string]*Result
-	L1NginxReadErrors map[string]*Result
-	BifrostReadErrors map[string]*Result
+// ComponentReads records the outcome of reading 2xx response bodies from a single component.
+type ComponentReads struct {
+	TotalReadSuccess int
+	TotalReadError   int
+
+	ReadErrors     map[string]*Result
+	ReadErrorPaths []string
+	// Truncated are the responses whose body ended before its Content-Length was read or whose CAR ends within a
+	// block. They are not counted as read errors.
+	Truncated      map[string]*Result
+	TruncatedPaths []string
+	// TransferDiscrepancies are the responses whose body does not match its Content-Length or chunked framing, e.g.
+	// a chunked body that ended without its final chunk.
+	TransferDiscrepancies    map[string]*TransferReport
+	TransferDiscrepancyPaths []string
+
+	// DagScopeViolations are CARs that do not contain exactly the blocks expected for the dag-scope of the request.
+	DagScopeViolations     map[string]*DagScopeReport
+	DagScopeViolationPaths []string
+
+	// CorruptBlocks are CARs with blocks whose data does not hash to their CID.
+	CorruptBlocks     map[string]*BlockIntegrityReport
+	CorruptBlockPaths []string
+	// CarOrderViolations are CARs whose blocks are not in the order, or are repeated against the duplicate block
+	// policy, that the CAR declares or the request asks for.
+	CarOrderViolations     map[string]*CarOrderReport
+	CarOrderViolationPaths []string
+	// CarIndexErrors are CARv2s whose index does not match the blocks of their data payload.
+	CarIndexErrors     map[string]*CarIndexReport
+	CarIndexErrorPaths []string
+	// NegotiationViolations are CAR negotiation variants whose response does not honor the parameters negotiated in
+	// their Accept header.
+	NegotiationViolations     map[string]*NegotiationReport
+	NegotiationViolationPaths []string
+	// ExtractTimeoutPaths are the paths whose CAR could not be extracted within the extraction timeout to be
+	// compared.
+	ExtractTimeoutPaths []string `json:",omitempty"`
+}
 
-	LassieReadErrorPaths  []string
-	L1ShimReadErrorPaths  []string
-	L1NginxReadErrorPaths []string
-	BifrostReadErrorPaths []string
+// TopLevelMetrics are the headline numbers of a run: the 2xx responses of every component, the status mismatches
+// of every pair and the latencies of every component.
+type TopLevelMetrics struct {
+	Component2XX     map[string]int
+	PairMismatch     map[string]int
+	ComponentLatency map[string]LatencyStats
+}
 
-	TotalKuboLassieMatches   int
-	TotalKuboL1ShimMatches   int
-	TotalKuboL1NginxMatches  int
-	TotalKuboBifrostMatches  int
-	TotalNginxBifrostMatches int
+type ResponseBytesMismatch struct {
+	// Pairs is keyed by Pair.Name().
+	Pairs map[string]*PairMismatches
+	// Components is keyed by Component.Name.
+	Components map[string]*ComponentReads
+	// Caches is keyed by the Component.Name of caching components, if their warm and cold responses are compared.
+	Caches map[string]*CacheReads `json:",omitempty"`
+	// Encodings is keyed by Component.Name, if the identity and compressed responses of components are compared.
+	Encodings map[string]*EncodingReads `json:",omitempty"`
+	// Nodes is keyed by the name of multi-node layers.
+	Nodes map[string]*NodeConsistency `json:",omitempty"`
+	// Production is keyed by Component.Name, if the replay log records the responses production served.
+	Production map[string]*ProductionReads `json:",omitempty"`
 }
 
 type Result struct {
-	Url        string
+	Url string
+	// Host is the Host header of the request if it differs from the host of Url, e.g. for subdomain requests to IP
+	// addressed components.
+	Host       string `json:",omitempty"`
+	Method     string `json:",omitempty"`
+	Range      string `json:",omitempty"`
 	StatusCode int
 	Headers    map[string][]string
-	ErrorBody  string
+	// Trailers are the trailers sent after the response body, if any.
+	Trailers  map[string][]string `json:",omitempty"`
+	ErrorBody string
 
 	ResponseBodyReadError string
 	ResponseBody          []byte
 	ResponseSize          uint64
+	// ResponseSpilled is true if the captured response body was spilled to disk because of its size or the memory
+	// budget.
+	ResponseSpilled bool `json:",omitempty"`
+	// release releases the captured response body once it is no longer used.
+	release func()
+
+	// Latency is the time taken to send the request and read the response body of the last attempt.
+	Latency time.Duration
+
+	// ResponseDigest is the hex encoded sha256 of the response body, so that responses can be compared across runs
+	// and machines without retaining their bodies.
+	ResponseDigest string `json:",omitempty"`
+	// RawDigest is the hex encoded sha256 of the file bytes extracted from a CAR body. It is set for streamed CARs
+	// and for captured CARs that were extracted to be compared.
+	RawDigest string `json:",omitempty"`
+	// ExtractError is set if the file bytes of a captured CAR body could not be extracted to be compared, e.g.
+	// because the extraction timed out.
+	ExtractError string `json:",omitempty"`
+
+	// Cached is set if the response was served from the ReferenceCache rather than requested, in which case its
+	// Latency is that of the request it was cached from and is not counted in the latency stats.
+	Cached bool `json:",omitempty"`
+
+	// RequestID is the X-Onion-Request-Id header the last attempt of the request was sent with, which correlates it
+	// with the logs of the component.
+	RequestID string `json:",omitempty"`
+
+	// Retries is the number of times the request was retried because of transient errors.
+	Retries int
+	// RetryErrors are the transient errors that caused the request to be retried, and RetryRequestIDs the request
+	// IDs of the attempts that failed with them.
+	RetryErrors     []string `json:",omitempty"`
+	RetryRequestIDs []string `json:",omitempty"`
+	// Throttles is the number of rate limit responses to the request, including the last one if it was still
+	// throttled after all retries, and ThrottleWait the time spent waiting for their Retry-After.
+	Throttles    int           `json:",omitempty"`
+	ThrottleWait time.Duration `json:",omitempty"`
+
+	// DagScope is the verification of a CAR response against the dag-scope of the request, if enabled.
+	DagScope *DagScopeReport `json:",omitempty"`
+	// Redirects is the redirect chain of the request, including the final 3xx response of components that do not
+	// follow redirects.
+	Redirects []Redirect `json:",omitempty"`
+
+	// CarOrder is the verification of the block order and duplicates of a CAR response, if enabled.
+	CarOrder *CarOrderReport `json:",omitempty"`
+	// Negotiation is the verification of the parameters negotiated by a CAR negotiation variant, if it is one.
+	Negotiation *NegotiationReport `json:",omitempty"`
+	// CarIndex is the verification of the index of a CARv2 response, if enabled.
+	CarIndex *CarIndexReport `json:",omitempty"`
+	// BlockIntegrity is the verification of the blocks of a CAR response against their CIDs, if enabled.
+	BlockIntegrity *BlockIntegrityReport `json:",omitempty"`
+	// VerificationError is set if the component verifies its CARs and the response failed verification. Such
+	// responses are not compared.
+	VerificationError string `json:",omitempty"`
+	// ErrorKind is the class of failure of the request, if it failed, i.e. if it could not be sent, its response
+	// body could not be read, it returned a non-2xx or it failed verification.
+	ErrorKind ErrorKind `json:",omitempty"`
+	// Conn is the connection the response was received over, if a connection was established.
+	Conn *ConnInfo `json:",omitempty"`
+	// ContentEncoding is the Content-Encoding of the response, if it was compressed. Compressed bodies are
+	// decompressed before they are compared.
+	ContentEncoding string `json:",omitempty"`
+	// Conditional is the outcome of re-requesting the path with the validators of the response, if conditional
+	// requests are compared.
+	Conditional *ConditionalReport `json:",omitempty"`
+	// Transfer records how the body of a 2xx response was framed and how much of it was read.
+	Transfer *TransferReport `json:",omitempty"`
+	// Production compares the response with the one production served for the original request, if the replay
+	// log records it.
+	Production *ProductionDiff `json:",omitempty"`
+
+	// unsent is set if the request could not be created, e.g. because of an invalid URL, which retrying does not fix.
+	unsent bool
+}
+
+// Results maps a component name to the Result observed for that component.
+type Results map[string]*Result
+
+// ExecutorOptions tunes how a RequestExecutor fetches and compares responses.
+type ExecutorOptions struct {
+	// Streaming hashes response bodies as they arrive instead of buffering them so that peak memory is
+	// bounded. Responses are then compared by digest.
+	Streaming bool
+	// CaptureMismatches re-fetches a path with full body capture if its streamed responses mismatch or
+	// can not be compared. Only used with Streaming.
+	CaptureMismatches bool
+
+	// Concurrency is the number of paths requested in parallel. Defaults to 6.
+	Concurrency int
+	// CompareConcurrency is the number of fetched paths whose responses are verified and compared in parallel,
+	// e.g. by extracting their CARs, while further paths are requested. Defaults to the number of CPUs.
+	CompareConcurrency int
+	// Pace sends every path at the offset of its original request in the replay log, scaled by 1/Pace (e.g. 2
+	// replays twice as fast), so that bursts of the original traffic are reproduced. Paths without an offset are
+	// sent first. Concurrency still bounds the paths in flight, so it must be high enough for the bursts of the log.
+	// Paths are sent as fast as Concurrency allows if it is zero.
+	Pace float64
+	// VerifyDagScope verifies that the CARs returned by components contain exactly the blocks expected for the
+	// dag-scope of the request. CARs are only verified if their bodies were captured.
+	VerifyDagScope bool
+	// VerifyBlocks re-hashes every block of the CARs returned by components and reports blocks whose data does
+	// not match their CID. CARs are only verified if their bodies were captured.
+	VerifyBlocks bool
+	// CarOrder is the block order and duplicate block policy that CARs are verified against unless the CAR
+	// declares its own policy in its Content-Type or the request asks for one in its Accept header. CARs are not
+	// verified if it is nil, and only if their bodies were captured.
+	CarOrder *CarOrderPolicy
+	// VerifyCarIndex verifies that the index of CARv2 responses points at the blocks of their data payload. CARs
+	// are only verified if their bodies were captured.
+	VerifyCarIndex bool
+
+	// Retries is the number of times a request to a component is retried on transient errors, i.e. when it can
+	// not be sent or its response body can not be read, unless the component overrides it.
+	Retries int
+	// RetryBackoff is the backoff before the first retry, doubled for every following retry and randomised with
+	// jitter, unless the component overrides it.
+	RetryBackoff time.Duration
+	// ThrottleRetries is the number of times a request to a component is retried on rate limit responses, after
+	// their Retry-After, independently of Retries. Defaults to 2; negative to not retry throttled requests.
+	ThrottleRetries int
+	// MaxRetryAfter caps the Retry-After of rate limit responses that is waited for. Defaults to 30 seconds.
+	MaxRetryAfter time.Duration
+
+	// ReferenceCache, if set, serves the responses of the reference components that it cached within its TTL, e.g.
+	// in an earlier run, instead of requesting them again.
+	ReferenceCache *ReferenceCache
+
+	// Timeout is the timeout for a request to a component, including reading the response body, unless the
+	// component overrides it. Defaults to 3 minutes.
+	Timeout time.Duration
+	// ExtractTimeout is the time allowed to extract the file bytes of a captured CAR response to compare them, so
+	// that a pathological DAG can not hang the comparison of a path. CARs that are not extracted in time can not be
+	// compared by their file bytes. Defaults to 30 seconds.
+	ExtractTimeout time.Duration
+	// MinBytesPerSecond extends the timeout of requests for paths whose expected size is known so that they are
+	// given the time to be read at this rate, if set. Timeouts are never shortened.
+	MinBytesPerSecond float64
+
+	// SlowPercentile reports the requests to a component that are slower than this percentile, e.g. 99, of the
+	// latencies of the component, if set.
+	SlowPercentile int
+	// SlowThreshold reports the requests that are slower than this, if set. If SlowPercentile is also set, the
+	// lower of the two is the cutoff.
+	SlowThreshold time.Duration
+
+	// Logger is the logger for progress and errors, which is annotated with the run and path. Defaults to info
+	// level logs to stdout.
+	Logger *slog.Logger
+	// Reports receives the results and reports of the run. Defaults to a DirReportWriter of the results directory
+	// of the run. The reports of the runs of Run are named after the directory of the run within the results
+	// directory, e.g. "results-1/results.json".
+	Reports ReportWriter
+	// Progress reports the progress of the run while its paths are requested, if set.
+	Progress *Progress
+	// Registerer is the registerer of a program embedding onion that the metrics of the run are registered with,
+	// labelled with the run ID, in addition to the registry of the run, e.g. to serve them with those of the
+	// program. They replace those of the previous run registered with it. Failing to register them is logged.
+	Registerer prometheus.Registerer
+	// TracerProvider, if set, traces the requests of the run: every path has a span, with the span of the request
+	// to every component as its child, e.g. one returned by NewTracerProvider. The trace context of the request is
+	// sent to the components so that their spans join the trace.
+	TracerProvider trace.TracerProvider
+
+	// OnResult is called with the results of every path as soon as its responses have been compared, e.g. to
+	// stream results into other pipelines while the run is in flight. It is called concurrently for different
+	// paths, so it must be safe for concurrent use, and must not modify the results. It is not called for the
+	// paths restored from a checkpoint.
+	OnResult func(path string, rs Results)
+
+	// Pairs are the pairs of components to compare, e.g. those returned by SelectPairs. Defaults to the
+	// ComparisonPairs of the components. Components that are not part of any pair are requested but not compared,
+	// so their captured CARs are not extracted.
+	Pairs []Pair
+	// Comparators are the comparators to run for a pair, keyed by Pair.Name(). Pairs without comparators are
+	// compared with Auto.
+	Comparators map[string][]Comparator
+
+	// SpillThreshold is the size above which captured response bodies are spilled to temporary files instead of
+	// being held in memory. Zero means bodies are only spilled to stay within the MemoryBudget.
+	SpillThreshold int64
+	// MemoryBudget is the total size of the captured response bodies held in memory by all in-flight requests,
+	// beyond which bodies are spilled to temporary files. Zero means unlimited.
+	MemoryBudget int64
+	// SpillDir is the directory of the temporary files that bodies are spilled to. Defaults to os.TempDir().
+	SpillDir string
+	// ExtractOnDiskThreshold is the size above which captured CARs are written to temporary CARv2 files with an
+	// index in SpillDir to be extracted, rather than indexed in memory. Zero means CARs are always extracted in
+	// memory.
+	ExtractOnDiskThreshold int64
+
+	// Headers decide which response headers are compared between the components of pairs that return the same
+	// thing. Headers are not compared if nil.
+	Headers *HeaderRules
+
+	// SaveBodies saves the captured response bodies to the bodies directory of the run, named after their sha256,
+	// and the requests of the run to requests.json, so that the run can serve as a golden run that is compared byte
+	// for byte or be compared again with CompareSaved. Streamed bodies are not saved.
+	SaveBodies bool
+	// SaveArtifacts saves the captured response bodies of mismatched pairs, and the file bytes extracted from their
+	// CAR bodies, gzip-compressed to a directory per path under the artifacts directory of the run, along with a
+	// manifest.json of the results. Streamed bodies are not saved.
+	SaveArtifacts bool
+	// ArtifactMaxBytes caps how much of every body is saved as an artifact. Defaults to 16 MiB.
+	ArtifactMaxBytes int64
+	// FetchOnly only requests the paths and records their results, saving their captured response bodies as
+	// SaveBodies does, without verifying or comparing them, so that they can be compared later with CompareSaved,
+	// e.g. once the comparison logic improved. Verifications, comparisons and artifacts are disabled.
+	FetchOnly bool
+
+	// CompareEncoding requests every path from every component both with "Accept-Encoding: identity" and with
+	// "Accept-Encoding: gzip, deflate", and compares the decompressed response with the identity response. The
+	// identity response is compared with the other components.
+	CompareEncoding bool
+
+	// CompareCache requests every path twice from components that cache responses, without their cache bust
+	// params, and compares the warm response with the cold one. The cold response is compared with the other
+	// components.
+	CompareCache bool
+
+	// CompareConditional re-requests every path from every component with the ETag and Last-Modified of its response
+	// as If-None-Match and If-Modified-Since, and compares whether the components answer with 304 Not Modified and
+	// keep their ETag stable.
+	CompareConditional bool
+
+	// CompareVerification compares the VerificationHeaders of the responses of every pair, whether they were sent
+	// as headers or trailers, and whatever the components return, as the roots and path are the same for CARs and
+	// file bytes.
+	CompareVerification bool
+
+	// CidContactCache caches the cid.contact lookups of mismatched paths. Defaults to an in-memory cache for the
+	// run; pass the same cache to several runs to share lookups between them.
+	CidContactCache *CidContactCache
+	// ProviderRules classify the providers of the CIDs of mismatched paths. Defaults to DefaultProviderRules.
+	ProviderRules []ProviderRule
+
+	// Prober probes the providers of the root CIDs of mismatched paths in ProbeMismatches, if set, and in the
+	// provider-dial steps of the triage pipeline, where it defaults to a BitswapProber.
+	Prober Prober
+	// ProbeProviders is the number of providers of a CID that are probed. Defaults to 5.
+	ProbeProviders int
+
+	// Triage is the pipeline of analyzers that Triage applies to the mismatches of the run, in order. Defaults to
+	// DefaultTriage without re-fetching or probing.
+	Triage []TriageStep
 }
 
-type Results struct {
-	KuboGWResult  *Result
-	LassieResult  *Result
-	L1ShimResult  *Result
-	L1NginxResult *Result
+func (opts ExecutorOptions) comparators(p Pair) []Comparator {
+	if cs := opts.Comparators[p.Name()]; len(cs) != 0 {
+		return cs
+	}
+	return []Comparator{Auto}
+}
 
-	BifrostResult *Result
+func (opts ExecutorOptions) pairs(components []Component) []Pair {
+	if opts.Pairs != nil {
+		return opts.Pairs
+	}
+	return ComparisonPairs(components)
 }
 
 type RequestExecutor struct {
@@ -94,780 +450,1935 @@ type RequestExecutor struct {
 	id    uuid.UUID
 	reqs  map[string]URLsToTest
 
-	client *http.Client
+	// reports receives the results and reports of the run, in which rrname names the response reads directory.
+	reports ReportWriter
+	rrname  string
+
+	components []Component
+	pairs      []Pair
+	opts       ExecutorOptions
+
+	// clients are keyed by Component.clientKey.
+	clients map[string]*http.Client
+	spill   *spiller
+	// limiters are keyed by component name. Components without rate limits have none.
+	limiters map[string]*componentLimiter
+
+	log *slog.Logger
+	// registry holds the metrics of the run only.
+	registry *prometheus.Registry
+	metrics  *executorMetrics
+	tracer   trace.Tracer
 
 	mu            sync.Mutex
-	results       map[string]*Results
+	results       map[string]Results
 	responseReads *ResponseBytesMismatch
+	// reverified maps a pair name and mismatch kind to the persistence of the mismatch of each re-verified path.
+	reverified map[string]map[MismatchKind]map[string]Persistence
+	// probes are the provider probes of the mismatched paths, if they were probed.
+	probes map[string]*ProbeReport
+	// diagnoses are the verdicts of the probes of the mismatched paths.
+	diagnoses map[string]*ProbeDiagnosis
+	// cidContact are the cid.contact summaries of the mismatches of every triaged category keyed by pair name, or by
+	// component name for read errors, and lookups the lookups of the mismatched paths, if they were looked up.
+	cidContact map[TriageCategory]map[string]CidContactSummary
+	lookups    map[string]*CidContactLookup
+	// writeErr is the first error writing the files of the run since they were last written.
+	writeErr error
 }
 
-func NewRequestExecutor(reqs map[string]URLsToTest, n int, id uuid.UUID, dir string, rrdir string) *RequestExecutor {
-	client := &http.Client{
-		Transport: &http.Transport{
-			MaxConnsPerHost:     1000,
-			MaxIdleConnsPerHost: 1000,
-			MaxIdleConns:        1000,
-			IdleConnTimeout:     5 * time.Minute,
-			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
-		},
-		Timeout: 3 * time.Minute,
+// newHTTPClient returns the client of the component, which components queried over the same HTTP version share
+// unless they override DNS resolution or SNI.
+func newHTTPClient(c Component) *http.Client {
+	t := &http.Transport{
+		MaxConnsPerHost:     1000,
+		MaxIdleConnsPerHost: 1000,
+		MaxIdleConns:        1000,
+		IdleConnTimeout:     5 * time.Minute,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true, ServerName: c.SNI},
+	}
+	if len(c.Resolve) != 0 {
+		t.DialContext = resolveDialer(c.Resolve)
+	}
+	switch c.HTTPVersion {
+	case HTTP1:
+		// a non-nil empty map disables HTTP/2
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case HTTP2:
+		t.ForceAttemptHTTP2 = true
+	}
+	return &http.Client{Transport: t, CheckRedirect: checkRedirect}
+}
+
+func NewRequestExecutor(components []Component, reqs map[string]URLsToTest, n int, id uuid.UUID, dir string, rrdir string, opts ExecutorOptions) *RequestExecutor {
+	// components that are queried over the same HTTP version share a client and its connections
+	clients := make(map[string]*http.Client)
+	for _, c := range components {
+		if _, ok := clients[c.clientKey()]; !ok {
+			clients[c.clientKey()] = newHTTPClient(c)
+		}
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultConcurrency
+	}
+	if opts.CompareConcurrency <= 0 {
+		opts.CompareConcurrency = runtime.NumCPU()
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.ExtractTimeout <= 0 {
+		opts.ExtractTimeout = defaultExtractTimeout
+	}
+	if opts.ArtifactMaxBytes <= 0 {
+		opts.ArtifactMaxBytes = defaultArtifactMaxBytes
+	}
+	if opts.ProbeProviders <= 0 {
+		opts.ProbeProviders = defaultProbeProviders
+	}
+	if opts.Triage == nil {
+		opts.Triage = DefaultTriage(0, false)
+	}
+	if opts.Logger == nil {
+		opts.Logger = NewLogger(os.Stdout, slog.LevelInfo, nil)
+	}
+	for _, s := range opts.Triage {
+		if s.Analyzer == AnalyzerProviderDial && opts.Prober == nil {
+			opts.Prober = defaultProber(opts.Logger)
+		}
+	}
+	if opts.CidContactCache == nil {
+		opts.CidContactCache, _ = NewCidContactCache("", DefaultCidContactTTL)
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = defaultRetryBackoff
+	}
+	if opts.ThrottleRetries == 0 {
+		opts.ThrottleRetries = defaultThrottleRetries
+	}
+	if opts.MaxRetryAfter <= 0 {
+		opts.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if opts.Reports == nil {
+		opts.Reports = DirReportWriter{Dir: dir}
+	}
+	// fetch-only runs save what they fetch to be verified and compared later
+	if opts.FetchOnly {
+		opts.SaveBodies = true
+		opts.SaveArtifacts = false
+		opts.CaptureMismatches = false
+		opts.VerifyDagScope, opts.VerifyBlocks, opts.VerifyCarIndex, opts.CarOrder = false, false, false, nil
+		opts.CompareEncoding, opts.CompareCache, opts.CompareVerification = false, false, false
+		opts.CompareConditional = false
+		opts.Headers = nil
+		opts.Prober = nil
+	}
+	rrname := "response_reads"
+	if rel, err := filepath.Rel(dir, rrdir); err == nil && len(rrdir) != 0 {
+		rrname = filepath.ToSlash(rel)
+	}
+
+	components = EnabledComponents(components)
+	pairs := opts.pairs(components)
+	if opts.FetchOnly {
+		pairs = nil
+	}
+	limiters := make(map[string]*componentLimiter, len(components))
+	for _, c := range components {
+		limiters[c.Name] = newComponentLimiter(c)
+	}
+	responseReads := &ResponseBytesMismatch{
+		Pairs:      make(map[string]*PairMismatches, len(pairs)),
+		Components: make(map[string]*ComponentReads, len(components)),
+	}
+	for _, p := range pairs {
+		pm := &PairMismatches{
+			Mismatches:         make(map[string]*Mismatch),
+			Comparators:        make(map[string]*ComparatorTally),
+			RedirectMismatches: make(map[string]*Mismatch),
+		}
+		if opts.Headers != nil {
+			pm.HeaderMismatches = make(map[string]*Mismatch)
+		}
+		if opts.CompareVerification {
+			pm.VerificationMismatches = make(map[string]*Mismatch)
+		}
+		for _, c := range opts.comparators(p) {
+			pm.Comparators[c.Name()] = &ComparatorTally{}
+		}
+		responseReads.Pairs[p.Name()] = pm
+	}
+	for _, c := range components {
+		responseReads.Components[c.Name] = &ComponentReads{
+			ReadErrors:            make(map[string]*Result),
+			Truncated:             make(map[string]*Result),
+			TransferDiscrepancies: make(map[string]*TransferReport),
+			DagScopeViolations:    make(map[string]*DagScopeReport),
+			CorruptBlocks:         make(map[string]*BlockIntegrityReport),
+			CarOrderViolations:    make(map[string]*CarOrderReport),
+			CarIndexErrors:        make(map[string]*CarIndexReport),
+			NegotiationViolations: make(map[string]*NegotiationReport),
+		}
+		if opts.CompareEncoding && c.Golden == nil {
+			if responseReads.Encodings == nil {
+				responseReads.Encodings = make(map[string]*EncodingReads)
+			}
+			responseReads.Encodings[c.Name] = newEncodingReads()
+		}
+		if opts.CompareCache && c.Cache {
+			if responseReads.Caches == nil {
+				responseReads.Caches = make(map[string]*CacheReads)
+			}
+			responseReads.Caches[c.Name] = newCacheReads()
+			if len(c.CacheBust) == 0 {
+				opts.Logger.Warn("cold responses may be served from the cache, as the component has no cache bust params",
+					"component", c.Name)
+			}
+		}
+	}
+
+	for group, nodes := range nodeGroups(components) {
+		if len(nodes) < 2 || opts.FetchOnly {
+			continue
+		}
+		if responseReads.Nodes == nil {
+			responseReads.Nodes = make(map[string]*NodeConsistency)
+		}
+		nc := &NodeConsistency{
+			Nodes:        make(map[string]string, len(nodes)),
+			OutlierPaths: make(map[string][]string),
+			Outliers:     make(map[string]Results),
+		}
+		for _, c := range nodes {
+			nc.Nodes[c.Name] = c.Node
+		}
+		responseReads.Nodes[group] = nc
+	}
+
+	log := opts.Logger.With("run", n, "run_id", id.String())
+	metrics := newExecutorMetrics()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.collectors()...)
+	if opts.Registerer != nil {
+		if err := metrics.register(opts.Registerer, id); err != nil {
+			log.Warn("metrics of the run are not exposed", "err", err)
+		}
 	}
 
 	return &RequestExecutor{
-		dir:     dir,
-		rrdir:   rrdir,
-		n:       n,
-		id:      id,
-		reqs:    reqs,
-		results: make(map[string]*Results),
-		client:  client,
-		responseReads: &ResponseBytesMismatch{
-			KuboLassieMismatches:   make(map[string]Results),
-			LassieShimMismatches:   make(map[string]Results),
-			ShimNginxMismatches:    make(map[string]Results),
-			NginxBifrostMismatches: make(map[string]Results),
-
-			LassieReadErrors:  make(map[string]*Result),
-			L1ShimReadErrors:  make(map[string]*Result),
-			L1NginxReadErrors: make(map[string]*Result),
-			BifrostReadErrors: make(map[string]*Result),
-
-			KuboL1ShimMismatches:  make(map[string]Results),
-			KuboL1NginxMismatches: make(map[string]Results),
-			KuboBifrostMismatches: make(map[string]Results),
-		},
+		dir:           dir,
+		rrdir:         rrdir,
+		reports:       opts.Reports,
+		rrname:        rrname,
+		n:             n,
+		id:            id,
+		reqs:          reqs,
+		components:    components,
+		pairs:         pairs,
+		opts:          opts,
+		results:       make(map[string]Results),
+		clients:       clients,
+		spill:         newSpiller(opts.SpillThreshold, opts.MemoryBudget, opts.SpillDir),
+		limiters:      limiters,
+		responseReads: responseReads,
+		log:           log,
+		registry:      registry,
+		metrics:       metrics,
+		tracer:        newTracer(opts.TracerProvider),
 	}
 }
 
+// Registry returns the registry of the metrics of the run.
+func (re *RequestExecutor) Registry() *prometheus.Registry {
+	return re.registry
+}
+
+// paceLagWarning is how late a paced path can be sent before the run warns that the replay did not keep up.
+const paceLagWarning = time.Second
+
+// fetchedPath is a path whose responses were fetched and wait to be compared.
+type fetchedPath struct {
+	path  string
+	count int32
+	pc    *pathComparer
+}
+
+// Execute requests every path that has no results yet from all components and compares their responses. Paths are
+// fetched by Concurrency workers and handed over to CompareConcurrency workers that verify and compare them, so
+// that slow CAR extraction does not hold up requests. At most Concurrency fetched paths wait to be compared.
 func (re *RequestExecutor) Execute() {
-	fmt.Printf("\n --------------- Running round %d with uuid %s -------------------------------", re.n, re.id)
-	fmt.Printf("\n Run-%d; Request Executor will execute requests for  %d  unique paths", re.n, len(re.reqs))
+	re.log.Info("starting run", "paths", len(re.reqs))
 
-	sem := make(chan struct{}, defaultConcurrency)
-	count := atomic.NewInt32(0)
+	sem := make(chan struct{}, re.opts.Concurrency)
+	count := atomic.NewInt32(int32(len(re.results)))
 	var wg sync.WaitGroup
 
+	fetched := make(chan fetchedPath, re.opts.Concurrency)
+	var compareWG sync.WaitGroup
+	for i := 0; i < re.opts.CompareConcurrency; i++ {
+		compareWG.Add(1)
+		go func() {
+			defer compareWG.Done()
+			for f := range fetched {
+				re.comparePath(f.path, f.count, f.pc)
+			}
+		}()
+	}
+
+	if len(re.results) != 0 {
+		re.log.Info("resuming from checkpoint", "done", len(re.results))
+	}
+	stopProgress := re.reportProgress()
+
+	pending := make([]URLsToTest, 0, len(re.reqs))
 	for _, req := range re.reqs {
-		path := req.Path
+		if _, ok := re.results[req.key()]; !ok {
+			pending = append(pending, req)
+		}
+	}
+	if re.opts.Pace > 0 {
+		sort.Slice(pending, func(i, j int) bool {
+			if pending[i].Offset != pending[j].Offset {
+				return pending[i].Offset < pending[j].Offset
+			}
+			return pending[i].key() < pending[j].key()
+		})
+	}
+
+	start := time.Now()
+	var maxLag time.Duration
+	for _, req := range pending {
+		path := req.key()
+		if re.opts.Pace > 0 {
+			// offsets are relative to the first pending path so that resumed runs do not wait for the paths that were
+			// already requested
+			at := start.Add(time.Duration(float64(req.Offset-pending[0].Offset) / re.opts.Pace))
+			time.Sleep(time.Until(at))
+			// the path is late if all slots are taken by earlier paths
+			sem <- struct{}{}
+			if lag := time.Since(at); lag > maxLag {
+				maxLag = lag
+			}
+		} else {
+			sem <- struct{}{}
+		}
 		wg.Add(1)
-		sem <- struct{}{}
 		go func(path string) {
 			defer func() {
 				<-sem
 				wg.Done()
 			}()
-			re.executeRequest(path, count.Inc())
+			n := count.Inc()
+			fetched <- fetchedPath{path: path, count: n, pc: re.fetchPath(path, n)}
 		}(path)
 	}
 	wg.Wait()
+	close(fetched)
+	compareWG.Wait()
+	stopProgress()
+	if maxLag > paceLagWarning {
+		re.log.Warn("paced paths were sent late as all slots were taken; raise the concurrency to reproduce the original timing", "max_lag", maxLag)
+	}
+
+	re.mu.Lock()
+	if err := re.writeCheckpoint(); err != nil {
+		re.log.Error("failed to write checkpoint", "err", err)
+	}
+	re.mu.Unlock()
 
-	fmt.Printf("\n  Run-%d; Request Executor is Done", re.n)
+	re.log.Info("run done")
 }
 
-func (re *RequestExecutor) executeRequest(path string, count int32) {
-	fmt.Printf("\n  Run-%d; Request Executor is executing request %d to %s path", re.n, count, path)
-	urls := re.reqs[path]
+// fetchPath requests the path from all components, re-fetching it with full capture if its streamed responses
+// mismatch and CaptureMismatches is set.
+func (re *RequestExecutor) fetchPath(path string, count int32) *pathComparer {
+	log := re.log.With("path", path, "request", count)
+	log.Debug("executing request")
+	ctx, span := re.startPathSpan(path, count)
+	defer span.End()
 
-	var lassieRbs []byte
-	var l1ShimRbs []byte
-	var l1NginxRbs []byte
-	var kuboGWRbs []byte
-	var bifrostRbs []byte
+	streaming := re.streaming(path)
 
-	addResultF := func(result Result, component string) {
-		re.mu.Lock()
-		defer re.mu.Unlock()
-		_, ok := re.results[path]
-		if !ok {
-			re.results[path] = &Results{}
-		}
-		rs := re.results[path]
-
-		switch component {
-		case "lassie":
-			rs.LassieResult = &result
-		case "l1shim":
-			rs.L1ShimResult = &result
-		case "kubogw":
-			rs.KuboGWResult = &result
-		case "l1nginx":
-			rs.L1NginxResult = &result
-		case "bifrost":
-			rs.BifrostResult = &result
-		}
+	pc := re.fetch(ctx, path, count, !streaming)
+	if streaming && re.opts.CaptureMismatches && pc.hasMismatch(re.pairs, re.opts.comparators) {
+		log.Info("streamed responses do not match, re-fetching with full capture")
+		span.AddEvent("re-fetching with full capture")
+		pc.release()
+		pc = re.fetch(ctx, path, count, true)
 	}
+	return pc
+}
 
-	var wg sync.WaitGroup
-	wg.Add(5)
-
-	// Kubo
-	go func() {
-		defer wg.Done()
-		result := re.executeHTTPRequest(urls.KuboGWUrl)
-		kuboGWRbs = result.ResponseBody
-		result.ResponseBody = nil
-		addResultF(result, "kubogw")
-		fmt.Printf("\n  Run-%d; Request Executor is done executing request %d for Kubo", re.n, count)
-	}()
-
-	// Bifrost
-	go func() {
-		defer wg.Done()
-		result := re.executeHTTPRequest(urls.BifrostURL)
-		bifrostRbs = result.ResponseBody
-		fmt.Printf("\n  Run-%d; Got %d bytes from Bifrost for request %d", re.n, len(bifrostRbs), count)
-		result.ResponseBody = nil
-		addResultF(result, "bifrost")
-		fmt.Printf("\n  Run-%d; Request Executor is done executing request %d for Bifrost", re.n, count)
-	}()
+// comparePath verifies and compares the responses fetched for the path and records them. Responses are compared,
+// and CARs extracted, before the lock is taken to record the outcome, so that paths are compared in parallel.
+func (re *RequestExecutor) comparePath(path string, count int32, pc *pathComparer) {
+	log := re.log.With("path", path, "request", count)
+	defer pc.release()
 
-	// Lassie
-	go func() {
-		defer wg.Done()
-		result := re.executeHTTPRequest(urls.Lassie)
-		lassieRbs = result.ResponseBody
-		fmt.Printf("\n  Run-%d; Got %d bytes from Lassie for request %d", re.n, len(lassieRbs), count)
+	if re.opts.SaveBodies && !pc.streamed {
+		if err := re.saveBodies(pc); err != nil {
+			log.Error("failed to save response bodies", "err", err)
+		}
+	}
 
-		result.ResponseBody = nil
-		addResultF(result, "lassie")
-		fmt.Printf("\n  Run-%d; Request Executor is done executing request %d for Lassie", re.n, count)
-	}()
+	if pc.rawBlock {
+		pc.verifyRawBlocks()
+	}
 
-	// L1 Shim
-	go func() {
-		defer wg.Done()
-		result := re.executeHTTPRequest(urls.L1Shim)
+	if re.opts.VerifyDagScope && !pc.streamed && !pc.rawBlock {
+		for _, c := range re.components {
+			if r := pc.rs[c.Name]; c.Extract == ExtractCAR && isReadOK(r) {
+				r.DagScope = VerifyDagScope(pc.bodies[c.Name], r.Url)
+			}
+		}
+	}
 
-		fmt.Printf("\n  Run-%d; Got %d bytes from L1 Shim for request %d", re.n, len(result.ResponseBody), count)
+	if re.opts.CarOrder != nil && !pc.streamed && !pc.rawBlock {
+		urls := re.reqs[path]
+		for _, c := range re.components {
+			if r := pc.rs[c.Name]; c.Extract == ExtractCAR && isReadOK(r) {
+				policy := ParseCarOrderPolicy(urls.Headers[c.Name].Get("Accept"), *re.opts.CarOrder)
+				policy = ParseCarOrderPolicy(http.Header(r.Headers).Get("Content-Type"), policy)
+				r.CarOrder = VerifyCarOrder(pc.bodies[c.Name], r.Url, policy)
+			}
+		}
+	}
 
-		l1ShimRbs = result.ResponseBody
-		result.ResponseBody = nil
-		addResultF(result, "l1shim")
-		fmt.Printf("\n  Run-%d; Request Executor is done executing request %d for L1-Shim", re.n, count)
-	}()
+	// the headers of CAR negotiation variants are verified even if their bodies were not captured
+	if urls := re.reqs[path]; isCarNegotiation(urls.Variant) {
+		for _, c := range re.components {
+			if r := pc.rs[c.Name]; c.Extract == ExtractCAR && isReadOK(r) {
+				var body []byte
+				if !pc.streamed {
+					body = pc.bodies[c.Name]
+				}
+				r.Negotiation = VerifyCarNegotiation(urls.Headers[c.Name].Get("Accept"), http.Header(r.Headers).Get("Content-Type"), body, r.Url)
+			}
+		}
+	}
 
-	// L1 Nginx
-	go func() {
-		defer wg.Done()
-		result := re.executeHTTPRequest(urls.L1Nginx)
+	if re.opts.VerifyCarIndex && !pc.streamed && !pc.rawBlock {
+		for _, c := range re.components {
+			if r := pc.rs[c.Name]; c.Extract == ExtractCAR && isReadOK(r) {
+				r.CarIndex = VerifyCarIndex(pc.bodies[c.Name])
+			}
+		}
+	}
 
-		fmt.Printf("\n  Run-%d; Got %d bytes from L1 Nginx for request %d", re.n, len(result.ResponseBody), count)
+	if re.opts.VerifyBlocks && !pc.streamed && !pc.rawBlock {
+		for _, c := range re.components {
+			if r := pc.rs[c.Name]; c.Extract == ExtractCAR && isReadOK(r) && r.BlockIntegrity == nil {
+				r.BlockIntegrity = VerifyBlocks(pc.bodies[c.Name])
+			}
+		}
+	}
 
-		l1NginxRbs = result.ResponseBody
-		result.ResponseBody = nil
-		addResultF(result, "l1nginx")
-		fmt.Printf("\n  Run-%d; Request Executor is done executing request %d for L1 Nginx", re.n, count)
-	}()
+	// deferred first so that it is called once the lock is released
+	if re.opts.OnResult != nil {
+		defer re.opts.OnResult(path, pc.rs)
+	}
+	// the responses of mismatched pairs are saved once the lock is released too
+	saveArtifacts := re.opts.SaveArtifacts && !pc.streamed
+	var artifactPairs []Pair
+	if saveArtifacts {
+		defer func() {
+			if len(artifactPairs) == 0 {
+				return
+			}
+			if err := re.saveArtifacts(path, pc, artifactPairs); err != nil {
+				log.Error("failed to save mismatch artifacts", "err", err)
+			}
+		}()
+	}
 
-	wg.Wait()
-	fmt.Printf("\n  Run-%d; Request Executor is done executing overall request %d", re.n, count)
+	rs := pc.rs
+	urls := re.reqs[path]
+	cacheAnomalies := make(map[string]*CacheAnomaly)
+	cacheCompared := make(map[string]bool)
+	for _, c := range re.cacheComponents() {
+		cacheAnomalies[c.Name], cacheCompared[c.Name] = pc.compareCache(c)
+	}
+	encodingAnomalies := make(map[string]*EncodingAnomaly)
+	encodingCompared := make(map[string]bool)
+	for _, c := range re.encodingComponents() {
+		encodingAnomalies[c.Name], encodingCompared[c.Name] = pc.compareEncoding(c)
+	}
+	groups := nodeGroups(re.components)
+	outliers := make(map[string][]string, len(groups))
+	for group, nodes := range groups {
+		outliers[group] = pc.nodeOutliers(nodes)
+	}
+	verdicts := make(map[string]pairVerdict, len(re.pairs))
+	for _, p := range re.pairs {
+		if isReadOK(rs[p.A.Name]) && isReadOK(rs[p.B.Name]) {
+			verdicts[p.Name()] = pc.verdict(p, re.opts.comparators(p))
+		}
+	}
+	// CARs that were extracted to be compared also get the digest of their file bytes
+	for _, c := range re.components {
+		if r, raw := rs[c.Name], pc.raws[c.Name]; r != nil && c.Extract == ExtractCAR && len(raw) != 0 {
+			r.RawDigest = sha256Hex(raw)
+		}
+	}
 
 	re.mu.Lock()
 	defer re.mu.Unlock()
 
-	rs := re.results[path]
+	re.results[path] = rs
 	rbm := re.responseReads
 
-	// lassie response read ok ?
-	if rs.LassieResult.StatusCode == http.StatusOK {
-		if len(rs.LassieResult.ResponseBodyReadError) == 0 {
-			rbm.TotalLassieReadSuccess++
+	// response read ok ?
+	for _, c := range re.components {
+		r := rs[c.Name]
+		if r.StatusCode != 0 && !r.Cached {
+			re.metrics.latency.WithLabelValues(c.Name).Observe(r.Latency.Seconds())
+			re.metrics.latencyHistogram.WithLabelValues(c.Name).Observe(r.Latency.Seconds())
+			if r.Latency > 0 && r.ResponseSize > 0 {
+				re.metrics.throughput.WithLabelValues(c.Name).Observe(float64(r.ResponseSize) / r.Latency.Seconds())
+			}
+		}
+		if len(r.ErrorKind) != 0 {
+			re.metrics.errorKind.WithLabelValues(c.Name, string(r.ErrorKind)).Inc()
+		}
+		if !isSuccess(r.StatusCode) {
+			continue
+		}
+		reads := rbm.Components[c.Name]
+		if len(r.ResponseBodyReadError) == 0 {
+			reads.TotalReadSuccess++
+			re.metrics.sizeHistogram.WithLabelValues(c.Name).Observe(float64(r.ResponseSize))
+		} else if r.ErrorKind == ErrorTruncated {
+			reads.Truncated[path] = r
+			reads.TruncatedPaths = append(reads.TruncatedPaths, path)
 		} else {
-			rbm.LassieReadErrors[path] = rs.LassieResult
-			rbm.LassieReadErrorPaths = append(rbm.LassieReadErrorPaths, path)
-			rbm.TotalLassieReadError++
+			reads.ReadErrors[path] = r
+			reads.ReadErrorPaths = append(reads.ReadErrorPaths, path)
+			reads.TotalReadError++
+		}
+		if r.Transfer != nil && len(r.Transfer.Discrepancy) != 0 {
+			reads.TransferDiscrepancies[path] = r.Transfer
+			reads.TransferDiscrepancyPaths = append(reads.TransferDiscrepancyPaths, path)
+			re.metrics.transferDiscrepancy.WithLabelValues(c.Name, string(r.Transfer.Discrepancy)).Inc()
+		}
+
+		if r.DagScope != nil && !r.DagScope.OK() {
+			reads.DagScopeViolations[path] = r.DagScope
+			reads.DagScopeViolationPaths = append(reads.DagScopeViolationPaths, path)
+		}
+
+		if r.CarOrder != nil && !r.CarOrder.OK() {
+			reads.CarOrderViolations[path] = r.CarOrder
+			reads.CarOrderViolationPaths = append(reads.CarOrderViolationPaths, path)
+		}
+
+		if r.Negotiation != nil && !r.Negotiation.OK() {
+			reads.NegotiationViolations[path] = r.Negotiation
+			reads.NegotiationViolationPaths = append(reads.NegotiationViolationPaths, path)
+		}
+
+		if r.CarIndex != nil && !r.CarIndex.OK() {
+			reads.CarIndexErrors[path] = r.CarIndex
+			reads.CarIndexErrorPaths = append(reads.CarIndexErrorPaths, path)
+		}
+
+		if r.BlockIntegrity != nil && !r.BlockIntegrity.OK() {
+			reads.CorruptBlocks[path] = r.BlockIntegrity
+			reads.CorruptBlockPaths = append(reads.CorruptBlockPaths, path)
 		}
 	}
 
-	if rs.L1ShimResult.StatusCode == http.StatusOK {
-		if len(rs.L1ShimResult.ResponseBodyReadError) == 0 {
-			rbm.TotalL1ShimReadSuccess++
-		} else {
-			rbm.L1ShimReadErrors[path] = rs.L1ShimResult
-			rbm.L1ShimReadErrorPaths = append(rbm.L1ShimReadErrorPaths, path)
-			rbm.TotalL1ShimReadError++
+	for _, c := range re.cacheComponents() {
+		if w := rs[warmName(c)]; w.StatusCode != 0 {
+			re.metrics.latency.WithLabelValues(warmName(c)).Observe(w.Latency.Seconds())
+		}
+		a, ok := cacheAnomalies[c.Name], cacheCompared[c.Name]
+		if !ok {
+			continue
 		}
+		cr := rbm.Caches[c.Name]
+		if a == nil {
+			cr.TotalMatches++
+			continue
+		}
+		cr.Anomalies[path] = a
+		cr.AnomalyPaths[a.Kind] = append(cr.AnomalyPaths[a.Kind], path)
+		log.Info("cache anomaly", "component", c.Name, "kind", a.Kind)
 	}
 
-	if rs.L1NginxResult.StatusCode == http.StatusOK {
-		if len(rs.L1NginxResult.ResponseBodyReadError) == 0 {
-			rbm.TotalL1NginxReadSuccess++
-		} else {
-			rbm.L1NginxReadErrors[path] = rs.L1NginxResult
-			rbm.L1NginxReadErrorPaths = append(rbm.L1NginxReadErrorPaths, path)
-			rbm.TotalL1NginxReadError++
+	for _, c := range re.encodingComponents() {
+		er := rbm.Encodings[c.Name]
+		er.recordEncoding(rs[compressedName(c)])
+		a, ok := encodingAnomalies[c.Name], encodingCompared[c.Name]
+		if !ok {
+			continue
 		}
+		if a == nil {
+			er.TotalMatches++
+			continue
+		}
+		er.Anomalies[path] = a
+		er.AnomalyPaths[a.Kind] = append(er.AnomalyPaths[a.Kind], path)
+		log.Info("encoding anomaly", "component", c.Name, "kind", a.Kind)
 	}
 
-	if rs.BifrostResult.StatusCode == http.StatusOK {
-		if len(rs.BifrostResult.ResponseBodyReadError) == 0 {
-			rbm.TotalBifrostReadSuccess++
-		} else {
-			rbm.BifrostReadErrors[path] = rs.BifrostResult
-			rbm.BifrostReadErrorPaths = append(rbm.BifrostReadErrorPaths, path)
-			rbm.TotalBifrostReadError++
+	for _, c := range re.components {
+		r := rs[c.Name]
+		if r == nil || c.Golden != nil {
+			continue
+		}
+		if r.Production = compareProduction(c, re.reqs[path], r); r.Production == nil {
+			continue
+		}
+		if rbm.Production == nil {
+			rbm.Production = make(map[string]*ProductionReads, len(re.components))
 		}
+		pr, ok := rbm.Production[c.Name]
+		if !ok {
+			pr = newProductionReads()
+			rbm.Production[c.Name] = pr
+		}
+		pr.record(path, r)
+	}
+
+	for group, nc := range rbm.Nodes {
+		outliers := outliers[group]
+		if len(outliers) == 0 {
+			nc.TotalConsistent++
+			continue
+		}
+		nodes := make(Results, len(groups[group]))
+		for _, c := range groups[group] {
+			nodes[c.Name] = rs[c.Name]
+		}
+		nc.Outliers[path] = nodes
+		for _, name := range outliers {
+			nc.OutlierPaths[name] = append(nc.OutlierPaths[name], path)
+		}
+		log.Info("node outliers", "layer", group, "nodes", outliers)
 	}
 
 	//  discrepancies
 	// if both are 200 and both were able to give responses -> compare bytes
-	if rs.KuboGWResult.StatusCode == http.StatusOK && rs.LassieResult.StatusCode == http.StatusOK &&
-		len(rs.KuboGWResult.ResponseBodyReadError) == 0 && len(rs.LassieResult.ResponseBodyReadError) == 0 {
-		raw, err := ExtractRaw(lassieRbs)
-		if err == nil && len(raw) > 0 {
-			if !bytes.Equal(kuboGWRbs, raw) {
-				rm := Results{}
-				rm.KuboGWResult = rs.KuboGWResult
-				rm.LassieResult = rs.LassieResult
-				rbm.KuboLassieMismatches[path] = rm
-				rbm.KuboLassieMismatchPaths = append(rbm.KuboLassieMismatchPaths, path)
-
-				responseSizeMismatchMetric.WithLabelValues(path, "kubo-lassie").Inc()
-			} else {
-				rbm.TotalKuboLassieMatches++
+	for _, p := range re.pairs {
+		ra, rb := rs[p.A.Name], rs[p.B.Name]
+		pm := rbm.Pairs[p.Name()]
+		if ra.StatusCode != 0 && rb.StatusCode != 0 && headersComparable(p, pc.rng) && redirectsDiffer(p, ra, rb) {
+			pm.RedirectMismatches[path] = &Mismatch{Results: Results{p.A.Name: ra, p.B.Name: rb}, Repro: re.repro(urls, rs, p.A, p.B)}
+			pm.RedirectMismatchPaths = append(pm.RedirectMismatchPaths, path)
+		}
+
+		if !isReadOK(ra) || !isReadOK(rb) {
+			continue
+		}
+
+		if re.opts.Headers != nil && headersComparable(p, pc.rng) {
+			if diffs := re.opts.Headers.Diff(ra.Headers, rb.Headers); len(diffs) != 0 {
+				pm.HeaderMismatches[path] = &Mismatch{Results: Results{p.A.Name: ra, p.B.Name: rb}, HeaderDiffs: diffs, Repro: re.repro(urls, rs, p.A, p.B)}
+				pm.HeaderMismatchPaths = append(pm.HeaderMismatchPaths, path)
 			}
 		}
-	}
 
-	if rs.KuboGWResult.StatusCode == http.StatusOK && rs.L1ShimResult.StatusCode == http.StatusOK &&
-		len(rs.KuboGWResult.ResponseBodyReadError) == 0 && len(rs.L1ShimResult.ResponseBodyReadError) == 0 {
-		raw, err := ExtractRaw(l1ShimRbs)
-		if err == nil && len(raw) > 0 {
-			if !bytes.Equal(kuboGWRbs, raw) {
-				rm := Results{}
-				rm.KuboGWResult = rs.KuboGWResult
-				rm.L1ShimResult = rs.L1ShimResult
-				rbm.KuboL1ShimMismatches[path] = rm
-				rbm.KuboL1ShimMismatchPaths = append(rbm.KuboL1ShimMismatchPaths, path)
+		if re.opts.CompareVerification {
+			if diffs := verificationDiff(ra, rb); len(diffs) != 0 {
+				pm.VerificationMismatches[path] = &Mismatch{Results: Results{p.A.Name: ra, p.B.Name: rb}, HeaderDiffs: diffs, Repro: re.repro(urls, rs, p.A, p.B)}
+				pm.VerificationMismatchPaths = append(pm.VerificationMismatchPaths, path)
+			}
+		}
 
-				responseSizeMismatchMetric.WithLabelValues(path, "kubo-shim").Inc()
-			} else {
-				rbm.TotalKuboL1ShimMatches++
+		v := verdicts[p.Name()]
+		compared := false
+		var mismatched []string
+		for _, cmp := range v.comparisons {
+			t := pm.Comparators[cmp.comparator]
+			switch {
+			case !cmp.ok:
+				t.TotalIncomparable++
+			case cmp.equal:
+				compared = true
+				t.TotalMatches++
+			default:
+				compared = true
+				t.TotalMismatches++
+				t.MismatchPaths = append(t.MismatchPaths, path)
+				mismatched = append(mismatched, cmp.comparator)
 			}
 		}
-	}
+		if !compared {
+			continue
+		}
 
-	if rs.KuboGWResult.StatusCode == http.StatusOK && rs.L1NginxResult.StatusCode == http.StatusOK &&
-		len(rs.KuboGWResult.ResponseBodyReadError) == 0 && len(rs.L1NginxResult.ResponseBodyReadError) == 0 {
-		raw, err := ExtractRaw(l1NginxRbs)
-		if err == nil && len(raw) > 0 {
-			if !bytes.Equal(kuboGWRbs, raw) {
-				rm := Results{}
-				rm.KuboGWResult = rs.KuboGWResult
-				rm.L1NginxResult = rs.L1NginxResult
-				rbm.KuboL1NginxMismatches[path] = rm
-				rbm.KuboL1NginxMismatchPaths = append(rbm.KuboL1NginxMismatchPaths, path)
+		if len(mismatched) != 0 {
+			m := v.mismatch
+			m.Comparators = mismatched
+			m.Repro = re.repro(urls, rs, p.A, p.B)
+			if saveArtifacts {
+				m.Artifacts = artifactDir(path)
+				artifactPairs = append(artifactPairs, p)
+			}
+			pm.Mismatches[path] = m
+			pm.MismatchPaths = append(pm.MismatchPaths, path)
 
-				responseSizeMismatchMetric.WithLabelValues(path, "kubo-nginx").Inc()
-			} else {
-				rbm.TotalKuboL1NginxMatches++
+			re.metrics.responseSizeMismatch.WithLabelValues(path, p.Name()).Inc()
+		} else {
+			pm.TotalMatches++
+		}
+	}
+
+	for _, c := range re.components {
+		if r, err := rs[c.Name], pc.extractErrs[c.Name]; r != nil && err != nil {
+			r.ExtractError = err.Error()
+			var timeout *ExtractTimeoutError
+			if errors.As(err, &timeout) {
+				reads := rbm.Components[c.Name]
+				reads.ExtractTimeoutPaths = append(reads.ExtractTimeoutPaths, path)
+				log.Warn("car extraction timed out", "component", c.Name, "timeout", re.opts.ExtractTimeout)
 			}
 		}
 	}
 
-	if rs.KuboGWResult.StatusCode == http.StatusOK && rs.BifrostResult.StatusCode == http.StatusOK &&
-		len(rs.KuboGWResult.ResponseBodyReadError) == 0 && len(rs.BifrostResult.ResponseBodyReadError) == 0 {
-		if !bytes.Equal(kuboGWRbs, bifrostRbs) {
-			rm := Results{}
-			rm.KuboGWResult = rs.KuboGWResult
-			rm.BifrostResult = rs.BifrostResult
-			rbm.KuboBifrostMismatches[path] = rm
-			rbm.KuboBifrostMismatchPaths = append(rbm.KuboBifrostMismatchPaths, path)
-		} else {
-			rbm.TotalKuboBifrostMatches++
+	if len(re.results)%checkpointEvery == 0 {
+		if err := re.writeCheckpoint(); err != nil {
+			log.Error("failed to write checkpoint", "err", err)
 		}
 	}
+}
 
-	if rs.LassieResult.StatusCode == http.StatusOK && rs.L1ShimResult.StatusCode == http.StatusOK &&
-		len(rs.LassieResult.ResponseBodyReadError) == 0 && len(rs.L1ShimResult.ResponseBodyReadError) == 0 {
-		if !bytes.Equal(lassieRbs, l1ShimRbs) {
-			rm := Results{}
-			rm.LassieResult = rs.LassieResult
-			rm.L1ShimResult = rs.L1ShimResult
-			rbm.LassieShimMismatches[path] = rm
-			rbm.LassieShimMismatchPaths = append(rbm.LassieShimMismatchPaths, path)
+// streaming reports whether the responses for the path are streamed rather than captured. Range responses are
+// partial and raw blocks are small, so they are always captured.
+func (re *RequestExecutor) streaming(path string) bool {
+	urls := re.reqs[path]
+	// paths whose golden body was not saved can only be compared by digest
+	for _, c := range re.components {
+		if c.Golden != nil && !c.Golden.hasBody(path) {
+			return true
 		}
 	}
+	return re.opts.Streaming && urls.Range == nil && !urls.RawBlock
+}
 
-	// if both are 200 and both were able to give responses -> compare bytes
-	if rs.L1ShimResult.StatusCode == http.StatusOK && rs.L1NginxResult.StatusCode == http.StatusOK &&
-		len(rs.L1ShimResult.ResponseBodyReadError) == 0 && len(rs.L1NginxResult.ResponseBodyReadError) == 0 {
-		if !bytes.Equal(l1ShimRbs, l1NginxRbs) {
-			rm := Results{}
-			rm.L1ShimResult = rs.L1ShimResult
-			rm.L1NginxResult = rs.L1NginxResult
-			rbm.ShimNginxMismatches[path] = rm
-			rbm.ShimNginxMismatchPaths = append(rbm.ShimNginxMismatchPaths, path)
-		}
-	}
-
-	if rs.L1NginxResult.StatusCode == http.StatusOK && rs.BifrostResult.StatusCode == http.StatusOK &&
-		len(rs.L1NginxResult.ResponseBodyReadError) == 0 && len(rs.BifrostResult.ResponseBodyReadError) == 0 {
-		raw, err := ExtractRaw(l1NginxRbs)
-		if err == nil && len(raw) > 0 {
-			if !bytes.Equal(raw, bifrostRbs) {
-				rm := Results{}
-				rm.L1NginxResult = rs.L1NginxResult
-				rm.BifrostResult = rs.BifrostResult
-				rbm.NginxBifrostMismatches[path] = rm
-				rbm.NginxBifrostMismatchPaths = append(rbm.NginxBifrostMismatchPaths, path)
+// fetch sends the request for the given path to all components. If capture is false, response bodies are
+// only hashed as they arrive and are not retained.
+func (re *RequestExecutor) fetch(ctx context.Context, path string, count int32, capture bool) *pathComparer {
+	urls := re.reqs[path]
+	log := re.log.With("path", path, "request", count)
+
+	var mu sync.Mutex
+	pc := &pathComparer{
+		rs:             make(Results, len(re.components)),
+		bodies:         make(map[string][]byte, len(re.components)),
+		raws:           make(map[string][]byte),
+		extractErrs:    make(map[string]error),
+		extractTimeout: re.opts.ExtractTimeout,
+		extractOnDisk:  re.opts.ExtractOnDiskThreshold,
+		extractDir:     re.opts.SpillDir,
+		blocks:         make(map[string][]byte),
+		subpath:        urls.subpath(),
+		rng:            urls.Range,
+		rawBlock:       urls.RawBlock,
+		blockCid:       rawBlockCid(urls),
+		streamed:       !capture,
+		dagDiff:        re.opts.triages(AnalyzerDagDiff, TriageBytes),
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range re.components {
+		wg.Add(1)
+		go func(c Component) {
+			defer wg.Done()
+			urls := urls
+			compareEncoding := re.opts.CompareEncoding && c.Golden == nil
+			if compareEncoding {
+				urls = withAcceptEncoding(c, urls, "identity")
+			}
+
+			if !re.opts.CompareCache || !c.Cache {
+				result := re.executeHTTPRequest(ctx, c, urls, capture)
+				log.Debug("got response", "component", c.Name, "status", result.StatusCode, "bytes", result.ResponseSize,
+					"latency", result.Latency, "retries", result.Retries, "request_id", result.RequestID)
+
+				mu.Lock()
+				pc.add(c.Name, &result)
+				mu.Unlock()
 			} else {
-				rbm.TotalNginxBifrostMatches++
+				// the first request fills the cache and the second one should be served from it
+				cold := re.executeHTTPRequest(ctx, c, coldURLs(c, urls), capture)
+				warm := re.executeHTTPRequest(ctx, c, coldURLs(c, urls), capture)
+				log.Debug("got cold and warm responses", "component", c.Name, "status", cold.StatusCode,
+					"warm_status", warm.StatusCode, "latency", cold.Latency, "warm_latency", warm.Latency)
+
+				mu.Lock()
+				pc.add(c.Name, &cold)
+				pc.add(warmName(c), &warm)
+				mu.Unlock()
 			}
-		}
+
+			if re.opts.CompareConditional && c.Golden == nil {
+				condURLs := urls
+				if re.opts.CompareCache && c.Cache {
+					condURLs = coldURLs(c, urls)
+				}
+				mu.Lock()
+				r := pc.rs[c.Name]
+				mu.Unlock()
+				report := re.conditionalRequest(ctx, c, condURLs, r)
+				log.Debug("got conditional response", "component", c.Name, "report", report)
+
+				mu.Lock()
+				r.Conditional = report
+				mu.Unlock()
+			}
+
+			if compareEncoding {
+				compressed := re.executeHTTPRequest(ctx, c, withAcceptEncoding(c, urls, acceptCompressed), capture)
+				log.Debug("got compressed response", "component", c.Name, "status", compressed.StatusCode,
+					"encoding", compressed.ContentEncoding, "bytes", compressed.ResponseSize)
+
+				mu.Lock()
+				pc.add(compressedName(c), &compressed)
+				mu.Unlock()
+			}
+		}(c)
 	}
+
+	wg.Wait()
+	log.Debug("done executing request")
+
+	return pc
 }
 
-func (re *RequestExecutor) executeHTTPRequest(url string) (result Result) {
-	result = Result{
-		Url: url,
+// pathComparer compares the responses of all components for a single path.
+type pathComparer struct {
+	rs     Results
+	bodies map[string][]byte
+	// CAR responses are extracted at most once per path, no matter how many pairs they are part of.
+	raws map[string][]byte
+	// extractErrs are the errors of the CAR responses that could not be extracted, and extractTimeout is the time
+	// allowed to extract each of them.
+	extractErrs    map[string]error
+	extractTimeout time.Duration
+	// CARs larger than extractOnDisk, if set, are extracted from temporary files in extractDir.
+	extractOnDisk int64
+	extractDir    string
+	// subpath is the path of the requested entity below the root of the content path, which CAR responses are
+	// traversed along to extract the entity, and rng is the byte range requested for the path, if any.
+	subpath string
+	rng     *ByteRange
+	// rawBlock is true if a single raw block was requested for the path, whose CID is blockCid if the path has no
+	// segments after the root CID.
+	rawBlock bool
+	blockCid cid.Cid
+	// blocks are the raw blocks taken from the responses to a raw block request.
+	blocks map[string][]byte
+
+	// streamed is true if bodies were not captured and only digests are available.
+	streamed bool
+	// dagDiff is true if the DAGs of mismatched CAR responses are diffed, as the dag-diff step of the triage
+	// pipeline does.
+	dagDiff bool
+
+	releases []func()
+}
+
+// add records the result of a component, taking over its captured response body.
+func (pc *pathComparer) add(name string, r *Result) {
+	pc.bodies[name] = r.ResponseBody
+	if r.release != nil {
+		pc.releases = append(pc.releases, r.release)
 	}
+	r.ResponseBody, r.release = nil, nil
+	pc.rs[name] = r
+}
 
-	resp, err := re.client.Get(url)
-	if err != nil {
-		result.ErrorBody = fmt.Sprintf("error sending request: %s", err.Error())
-		return
+// release releases the captured response bodies, which must not be used afterwards.
+func (pc *pathComparer) release() {
+	for _, f := range pc.releases {
+		f()
 	}
-	defer resp.Body.Close()
-	defer io.Copy(io.Discard, resp.Body)
+	pc.releases = nil
+	pc.bodies = nil
+	pc.raws = nil
+	pc.extractErrs = nil
+	pc.blocks = nil
+}
 
-	result.Headers = resp.Header
-	result.StatusCode = resp.StatusCode
+// comparison is the verdict of a single comparator for a pair.
+type comparison struct {
+	comparator string
+	equal      bool
+	ok         bool
+}
 
-	if resp.StatusCode == http.StatusOK {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			result.ResponseBodyReadError = fmt.Sprintf("error reading response body: %s", err.Error())
-			return
-		}
-		result.ResponseBody = body
-		result.ResponseSize = uint64(len(body))
+// compare runs the comparators on the responses of the two components of the pair.
+func (pc *pathComparer) compare(p Pair, comparators []Comparator) []comparison {
+	a, b := pc.response(p.A), pc.response(p.B)
+	out := make([]comparison, 0, len(comparators))
+	for _, c := range comparators {
+		equal, ok := c.Compare(a, b)
+		out = append(out, comparison{comparator: c.Name(), equal: equal, ok: ok})
 	}
+	return out
+}
 
-	if resp.StatusCode != http.StatusOK {
-		errBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			result.ErrorBody = fmt.Sprintf("error reading response body: %s", err.Error())
-			return
+// response returns the response of the component as seen by comparators. For range requests, the bodies of
+// components that ignored the range are normalised to the requested range, and CARv2 bodies are normalised to
+// their CARv1 data payload.
+func (pc *pathComparer) response(c Component) Response {
+	r := pc.rs[c.Name]
+	var body []byte
+	if !pc.streamed {
+		body = pc.bodies[c.Name]
+		if c.Extract == ExtractCAR {
+			body = carV1Payload(body)
+		}
+		// components that ignored the range returned the full entity
+		if pc.rng != nil && c.Extract == ExtractRawFile && r.StatusCode == http.StatusOK {
+			body = pc.rng.Slice(body)
 		}
-		result.ErrorBody = string(errBody)
 	}
-	return
+	return Response{Component: c, Result: r, Body: body, Range: pc.rng, pc: pc}
 }
 
-func (re *RequestExecutor) WriteResultsToFile() {
-	re.mu.Lock()
-	defer re.mu.Unlock()
+// file returns the file bytes of the captured response of the component, extracting them from CAR bodies.
+// ok is false if the CAR could not be extracted.
+func (pc *pathComparer) file(c Component) ([]byte, bool) {
+	if c.Extract != ExtractCAR {
+		if pc.blockCid.Defined() && !pc.rawBlock && pc.rng == nil && isDAGCodec(pc.blockCid.Prefix().Codec) {
+			return pc.dagNode(c)
+		}
+		return pc.response(c).Body, true
+	}
+	if raw, ok := pc.raws[c.Name]; ok {
+		return raw, len(raw) > 0
+	}
 
-	// marshal the results to json
-	jsonData, err := json.MarshalIndent(re.results, "", " ")
+	ctx, cancel := context.WithTimeout(context.Background(), pc.extractTimeout)
+	defer cancel()
+	var raw []byte
+	var err error
+	if body := pc.bodies[c.Name]; pc.extractOnDisk > 0 && int64(len(body)) > pc.extractOnDisk {
+		raw, err = ExtractRawPathOnDisk(ctx, body, pc.extractDir, pc.subpath, pc.rng)
+	} else {
+		raw, err = ExtractRawPath(ctx, body, pc.subpath, pc.rng)
+	}
 	if err != nil {
-		panic(err)
+		raw = nil
+		pc.extractErrs[c.Name] = err
 	}
+	pc.raws[c.Name] = raw
+	return raw, len(raw) > 0
+}
 
-	// create a new file and write the json data to it
-	file, err := os.Create(fmt.Sprintf("%s/results.json", re.dir))
+// dagNode returns the response of the component to a request for a dag-cbor or dag-json root in the canonical
+// encoding of the codec of the root, which is what the root node is extracted to from CAR responses. Responses in
+// the other codec, e.g. dag-json for a dag-cbor root, are converted. ok is false if the response could not be
+// decoded.
+func (pc *pathComparer) dagNode(c Component) ([]byte, bool) {
+	if node, ok := pc.raws[c.Name]; ok {
+		return node, node != nil
+	}
+	to := pc.blockCid.Prefix().Codec
+	from := dagCodecOf(http.Header(pc.rs[c.Name].Headers).Get("Content-Type"))
+	if from == 0 {
+		from = to
+	}
+	node, err := CanonicalizeDAG(pc.bodies[c.Name], from, to)
 	if err != nil {
-		panic(err)
+		node = nil
 	}
-	defer file.Close()
+	pc.raws[c.Name] = node
+	return node, node != nil
+}
 
-	_, err = file.Write(jsonData)
+// block returns the raw block of the captured response of the component to a raw block request. ok is false if
+// the component returned a CAR that could not be read.
+func (pc *pathComparer) block(c Component) ([]byte, bool) {
+	if b, ok := pc.blocks[c.Name]; ok {
+		return b, b != nil
+	}
+	b, err := rawBlock(pc.bodies[c.Name], http.Header(pc.rs[c.Name].Headers).Get("Content-Type"), pc.blockCid)
 	if err != nil {
-		panic(err)
+		b = nil
 	}
+	pc.blocks[c.Name] = b
+	return b, b != nil
 }
 
-func (re *RequestExecutor) WriteMismatchesToFile() {
-	re.mu.Lock()
-	defer re.mu.Unlock()
-
-	writeMismatchF := func(mismatch map[string]Results, filename string) {
-		jsonData, err := json.MarshalIndent(mismatch, "", " ")
-		if err != nil {
-			panic(err)
+// verifyRawBlocks checks the raw blocks returned by every component against the requested CID, unless the
+// component already verified its response. Blocks are only verified if the CID is known.
+func (pc *pathComparer) verifyRawBlocks() {
+	if !pc.blockCid.Defined() || pc.streamed {
+		return
+	}
+	for name, r := range pc.rs {
+		if !isReadOK(r) || r.BlockIntegrity != nil {
+			continue
 		}
-
-		// create a new file and write the json data to it
-		file, err := os.Create(filename)
-		if err != nil {
-			panic(err)
+		b, ok := pc.blocks[name]
+		if !ok {
+			var err error
+			if b, err = rawBlock(pc.bodies[name], http.Header(r.Headers).Get("Content-Type"), pc.blockCid); err != nil {
+				r.BlockIntegrity = &BlockIntegrityReport{Error: err.Error()}
+				continue
+			}
+			pc.blocks[name] = b
 		}
-		defer file.Close()
+		r.BlockIntegrity = verifyRawBlock(b, pc.blockCid)
+	}
+}
 
-		_, err = file.Write(jsonData)
-		if err != nil {
-			panic(err)
-		}
+// mismatch builds the mismatch record for the pair. If the bodies were captured, it includes where the responses
+// first diverge and, if both components returned CARs, the structural diff of the CARs and the provenance of the
+// blocks of the CAR of the reference component, or else of the first component, in the other CAR.
+func (pc *pathComparer) mismatch(p Pair) *Mismatch {
+	m := &Mismatch{
+		Results: Results{p.A.Name: pc.rs[p.A.Name], p.B.Name: pc.rs[p.B.Name]},
+	}
+	if pc.streamed {
+		return m
 	}
 
-	writePathsF := func(mismatch []string, filename string) {
-		jsonData, err := json.MarshalIndent(mismatch, "", " ")
-		if err != nil {
-			panic(err)
+	if pc.rawBlock {
+		ba, okA := pc.block(p.A)
+		bb, okB := pc.block(p.B)
+		if okA && okB {
+			m.Divergence = newDivergence(ba, bb, "block")
 		}
-
-		if err := os.WriteFile(filename, jsonData, 0755); err != nil {
-			panic(err)
+		return m
+	}
+
+	// locate the divergence in what the default comparator compares, falling back to the bodies if the file
+	// bytes of a CAR can not be extracted
+	a, b := pc.response(p.A), pc.response(p.B)
+	m.Divergence = newDivergence(a.Body, b.Body, "body")
+	if p.A.Extract != p.B.Extract || (pc.rng != nil && p.A.Range != p.B.Range) {
+		fa, okA := a.File()
+		fb, okB := b.File()
+		if okA && okB {
+			m.Divergence = newDivergence(fa, fb, "file")
 		}
 	}
 
-	res := re.results
-
-	kuboLassieMismatch := make(map[string]Results)
-	lassiShimMismatch := make(map[string]Results)
-	shimNginxMismatch := make(map[string]Results)
+	if !pc.dagDiff || p.A.Extract != ExtractCAR || p.B.Extract != ExtractCAR {
+		return m
+	}
 
-	nginxBifrostMismatch := make(map[string]Results)
-	kuboBifrostMismatch := make(map[string]Results)
+	d, err := cardiff.Compare(pc.bodies[p.A.Name], pc.bodies[p.B.Name])
+	if err != nil {
+		m.CarDiffError = err.Error()
+	} else {
+		m.CarDiff = d
+	}
+	ref, layer := p.A, p.B
+	if p.B.Reference && !p.A.Reference {
+		ref, layer = p.B, p.A
+	}
+	m.Provenance = CompareProvenance(ref.Name, layer.Name, pc.bodies[ref.Name], pc.bodies[layer.Name])
+	return m
+}
 
-	var klMismatchPaths []string
-	var lsMismatchPaths []string
-	var snMismatchPaths []string
-	var nbMismatchPaths []string
-	var kuboBifrostMismatchPaths []string
+// pairVerdict is the outcome of comparing the responses of a pair, which is computed before it is recorded.
+type pairVerdict struct {
+	comparisons []comparison
+	// mismatch is set if any comparator found the responses to differ.
+	mismatch *Mismatch
+}
 
-	type Result2xx struct {
-		kubo    int
-		lassie  int
-		shim    int
-		nginx   int
-		bifrost int
+// verdict runs the comparators on the responses of the pair and builds its mismatch record if they differ.
+func (pc *pathComparer) verdict(p Pair, comparators []Comparator) pairVerdict {
+	v := pairVerdict{comparisons: pc.compare(p, comparators)}
+	for _, cmp := range v.comparisons {
+		if cmp.ok && !cmp.equal {
+			v.mismatch = pc.mismatch(p)
+			break
+		}
 	}
+	return v
+}
 
-	result2xx := Result2xx{}
+// hasMismatch reports whether any comparator of any pair of components that both returned a 2xx can not compare
+// their responses or finds them to differ.
+func (pc *pathComparer) hasMismatch(pairs []Pair, comparators func(Pair) []Comparator) bool {
+	for _, p := range pairs {
+		if !isReadOK(pc.rs[p.A.Name]) || !isReadOK(pc.rs[p.B.Name]) {
+			continue
+		}
+		for _, cmp := range pc.compare(p, comparators(p)) {
+			if !cmp.ok || !cmp.equal {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	for path, results := range res {
-		results := *results
+func isReadOK(r *Result) bool {
+	return isSuccess(r.StatusCode) && len(r.ResponseBodyReadError) == 0 && len(r.VerificationError) == 0
+}
 
-		if results.KuboGWResult.StatusCode == http.StatusOK && len(results.KuboGWResult.ResponseBodyReadError) == 0 {
-			result2xx.kubo++
-			responseCodeMetric.WithLabelValues(path, "kubo", strconv.Itoa(results.KuboGWResult.StatusCode)).Inc()
+// requestIDHeader is the header that every request to a component is sent with a unique ID in, so that the request
+// can be found in the logs of the component.
+const requestIDHeader = "X-Onion-Request-Id"
 
-			if results.LassieResult.StatusCode != http.StatusOK || len(results.LassieResult.ResponseBodyReadError) != 0 {
-				rm := Results{}
-				rm.KuboGWResult = results.KuboGWResult
-				rm.LassieResult = results.LassieResult
-				kuboLassieMismatch[path] = rm
-				klMismatchPaths = append(klMismatchPaths, path)
+// isSuccess reports whether the status code is a successful response for a full or a range request.
+func isSuccess(code int) bool {
+	return code == http.StatusOK || code == http.StatusPartialContent
+}
 
-				responseCodeMismatchMetric.WithLabelValues(path, "kubo-lassie").Inc()
+// executeHTTPRequest sends the request to the component, retrying transient errors as per the retry policy
+// of the component.
+func (re *RequestExecutor) executeHTTPRequest(ctx context.Context, c Component, urls URLsToTest, capture bool) Result {
+	if c.Golden != nil {
+		return c.Golden.result(urls.key(), capture)
+	}
+	cache := re.requestReferenceCache(ctx, c)
+	if r, ok, err := cache.get(c, urls, capture); err != nil {
+		re.log.Error("failed to read cached reference response", "err", err, "component", c.Name, "url", urls.URLs[c.Name])
+	} else if ok {
+		return r
+	}
+	ctx, span := re.startRequestSpan(ctx, c, urls)
+	retries, backoff := re.opts.Retries, re.opts.RetryBackoff
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+	if c.RetryBackoff > 0 {
+		backoff = c.RetryBackoff
+	}
+
+	var retryErrors, retryRequestIDs []string
+	var throttles int
+	var throttleWait time.Duration
+	for attempt := 0; ; {
+		// latencies do not include the time spent waiting for the rate limit
+		re.limiters[c.Name].waitRequest()
+		result := re.doHTTPRequest(ctx, c, urls, capture)
+		if isThrottled(result) {
+			throttles++
+			if throttles <= re.opts.ThrottleRetries {
+				// throttled requests are retried after the Retry-After the component asks for, without using up
+				// the retries of transient errors
+				d := retryAfter(result, withJitter(exponentialBackoff(backoff, throttles-1)), re.opts.MaxRetryAfter)
+				throttleWait += d
+				span.AddEvent("throttled", trace.WithAttributes(attribute.Int("http.status_code", result.StatusCode),
+					attribute.String("onion.request_id", result.RequestID), attribute.String("onion.retry_after", d.String())))
+				time.Sleep(d)
+				continue
 			}
-
-			if results.BifrostResult.StatusCode != http.StatusOK || len(results.BifrostResult.ResponseBodyReadError) != 0 {
-				rm := Results{}
-				rm.KuboGWResult = results.KuboGWResult
-				rm.BifrostResult = results.BifrostResult
-				kuboBifrostMismatch[path] = rm
-				kuboBifrostMismatchPaths = append(kuboBifrostMismatchPaths, path)
+			result.ErrorKind = ErrorThrottled
+		}
+		terr, transient := transientError(result)
+		if !transient || attempt >= retries {
+			result.Retries = attempt
+			result.RetryErrors = retryErrors
+			result.RetryRequestIDs = retryRequestIDs
+			result.Throttles = throttles
+			result.ThrottleWait = throttleWait
+			endRequestSpan(span, result)
+			if err := cache.put(c, urls, result); err != nil {
+				re.log.Error("failed to cache reference response", "err", err, "component", c.Name, "url", result.Url)
 			}
+			return result
 		}
 
-		if results.LassieResult.StatusCode == http.StatusOK && len(results.LassieResult.ResponseBodyReadError) == 0 {
-			result2xx.lassie++
-			responseCodeMetric.WithLabelValues(path, "lassie", strconv.Itoa(results.LassieResult.StatusCode)).Inc()
+		retryErrors = append(retryErrors, terr)
+		retryRequestIDs = append(retryRequestIDs, result.RequestID)
+		span.AddEvent("retry", trace.WithAttributes(attribute.String("error", terr), attribute.String("onion.request_id", result.RequestID)))
+		time.Sleep(withJitter(exponentialBackoff(backoff, attempt)))
+		attempt++
+	}
+}
+
+// isStatusMismatch reports whether the response of a is read successfully while that of b is not. Responses of b
+// that were throttled are not mismatches, as rate limits say nothing about the correctness of b.
+func isStatusMismatch(a, b *Result) bool {
+	return isReadOK(a) && !isReadOK(b) && b.ErrorKind != ErrorThrottled
+}
 
-			if results.L1ShimResult.StatusCode != http.StatusOK || len(results.L1ShimResult.ResponseBodyReadError) != 0 {
-				rm := Results{}
-				rm.LassieResult = results.LassieResult
-				rm.L1ShimResult = results.L1ShimResult
-				lassiShimMismatch[path] = rm
-				lsMismatchPaths = append(lsMismatchPaths, path)
+// transientError returns the error of a request that failed to be sent, whose response body could not be read or
+// that got a 5xx, which are considered transient errors worth retrying. Requests that could not be created are not
+// retried, nor are rate limit responses once their own retries are used up.
+func transientError(r Result) (string, bool) {
+	switch {
+	case r.unsent:
+		return "", false
+	case r.StatusCode == 0 && len(r.ErrorBody) != 0:
+		return r.ErrorBody, true
+	case len(r.ResponseBodyReadError) != 0:
+		return r.ResponseBodyReadError, true
+	case r.StatusCode >= http.StatusInternalServerError && r.ErrorKind != ErrorThrottled:
+		return fmt.Sprintf("status code %d", r.StatusCode), true
+	}
+	return "", false
+}
 
-				responseCodeMismatchMetric.WithLabelValues(path, "lassie-shim").Inc()
-			}
+// exponentialBackoff returns the backoff doubled n times, as long as it does not exceed maxRetryBackoff.
+func exponentialBackoff(backoff time.Duration, n int) time.Duration {
+	for ; n > 0 && backoff <= maxRetryBackoff/2; n-- {
+		backoff *= 2
+	}
+	return backoff
+}
+
+// withJitter returns a random duration in [d/2, d) so that retries of concurrent requests are spread out.
+func withJitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+func (re *RequestExecutor) doHTTPRequest(ctx context.Context, c Component, urls URLsToTest, capture bool) (result Result) {
+	result = Result{
+		Url:    urls.URLs[c.Name],
+		Method: urls.Method,
+	}
+	start := time.Now()
+	defer func() {
+		result.Latency = time.Since(start)
+		switch {
+		case len(result.ErrorKind) != 0:
+		case len(result.VerificationError) != 0:
+			result.ErrorKind = ErrorDecode
+		case result.StatusCode != 0 && !isSuccess(result.StatusCode):
+			result.ErrorKind = ErrorNon2xx
 		}
+	}()
 
-		if results.L1ShimResult.StatusCode == http.StatusOK && len(results.L1ShimResult.ResponseBodyReadError) == 0 {
-			result2xx.shim++
-			responseCodeMetric.WithLabelValues(path, "shim", strconv.Itoa(results.L1ShimResult.StatusCode)).Inc()
+	// the context is only cancelled once the response body has been read
+	ctx, cancel := context.WithTimeout(ctx, re.requestTimeout(c, urls))
+	defer cancel()
+	ctx, redirects := withRedirectRecorder(ctx, c.Redirects)
+	defer func() {
+		result.Redirects = redirects.chain
+	}()
+	ctx, conns := withConnRecorder(ctx)
 
-			if results.L1NginxResult.StatusCode != http.StatusOK || len(results.L1NginxResult.ResponseBodyReadError) != 0 {
-				rm := Results{}
-				rm.L1ShimResult = results.L1ShimResult
-				rm.L1NginxResult = results.L1NginxResult
-				shimNginxMismatch[path] = rm
-				snMismatchPaths = append(snMismatchPaths, path)
+	method := urls.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if len(urls.Body) != 0 {
+		body = bytes.NewReader(urls.Body)
+	}
 
-				responseCodeMismatchMetric.WithLabelValues(path, "shim-nginx").Inc()
-			}
+	if c.URLStyle == URLStyleSubdomain {
+		var err error
+		if result.Url, result.Host, err = subdomainURL(result.Url, c.SubdomainHost); err != nil {
+			result.ErrorBody = fmt.Sprintf("error creating subdomain request: %s", err.Error())
+			result.ErrorKind = ErrorOther
+			result.unsent = true
+			return
 		}
+	}
 
-		if results.L1NginxResult.StatusCode == http.StatusOK && len(results.L1NginxResult.ResponseBodyReadError) == 0 {
-			result2xx.nginx++
-			responseCodeMetric.WithLabelValues(path, "nginx", strconv.Itoa(results.L1NginxResult.StatusCode)).Inc()
+	req, err := http.NewRequestWithContext(ctx, method, result.Url, body)
+	if err != nil {
+		result.ErrorBody = fmt.Sprintf("error creating request: %s", err.Error())
+		result.ErrorKind = errorKind(err, false)
+		result.unsent = true
+		return
+	}
+	if len(result.Host) != 0 {
+		req.Host = result.Host
+	}
+	for k, vs := range urls.Headers[c.Name] {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	injectTraceContext(ctx, req)
+	result.RequestID = uuid.NewString()
+	req.Header.Set(requestIDHeader, result.RequestID)
+	if urls.RawBlock {
+		// path gateways do not get the format query param
+		req.Header.Set("Accept", rawBlockContentType)
+	}
+	if rng := urls.Range; rng != nil && c.Range == RangeHeader {
+		result.Range = rng.Header()
+		req.Header.Set("Range", result.Range)
+	}
+	if c.Auth != nil {
+		if err := c.Auth.Apply(req); err != nil {
+			result.ErrorBody = fmt.Sprintf("error authenticating request: %s", err.Error())
+			result.ErrorKind = ErrorOther
+			result.unsent = true
+			return
+		}
+	}
 
-			if results.BifrostResult.StatusCode != http.StatusOK || len(results.BifrostResult.ResponseBodyReadError) != 0 {
-				rm := Results{}
-				rm.L1NginxResult = results.L1NginxResult
-				rm.BifrostResult = results.BifrostResult
-				nginxBifrostMismatch[path] = rm
-				nbMismatchPaths = append(nbMismatchPaths, path)
+	resp, err := re.clients[c.clientKey()].Do(req)
+	result.Conn = conns.conn(resp)
+	if err != nil {
+		result.ErrorBody = fmt.Sprintf("error sending request: %s", err.Error())
+		result.ErrorKind = errorKind(err, false)
+		return
+	}
+	defer resp.Body.Close()
+	// trailers are only known once the body has been read to its end
+	defer func() {
+		for k, vs := range resp.Trailer {
+			if len(vs) == 0 {
+				continue
 			}
+			if result.Trailers == nil {
+				result.Trailers = make(map[string][]string, len(resp.Trailer))
+			}
+			result.Trailers[k] = vs
 		}
+	}()
+	defer io.Copy(io.Discard, resp.Body)
+	read := &readRecorder{r: re.limiters[c.Name].reader(ctx, resp.Body)}
+	var respBody io.Reader = read
+	if isSuccess(resp.StatusCode) && method != http.MethodHead {
+		// bodies that were not read to their end, e.g. because their extraction failed, are drained first to tell
+		// whether they match their framing
+		defer func() {
+			if !read.eof && read.err == nil {
+				rest := &readRecorder{r: resp.Body}
+				io.Copy(io.Discard, rest)
+				read.n, read.eof, read.err = read.n+rest.n, rest.eof, rest.err
+			}
+			result.Transfer = newTransferReport(resp, read)
+			if result.Transfer.Discrepancy == TransferChunkedTruncated {
+				result.setTruncated(chunkedTruncation(read.n))
+			}
+		}()
+	}
+
+	result.Headers = resp.Header
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode == http.StatusUnauthorized && c.Auth != nil {
+		c.Auth.Rejected()
+	}
+	result.ContentEncoding = contentEncoding(resp)
 
-		if results.BifrostResult.StatusCode == http.StatusOK && len(results.BifrostResult.ResponseBodyReadError) == 0 {
-			result2xx.bifrost++
+	if isSuccess(resp.StatusCode) {
+		if respBody, err = decodeBody(read, resp); err != nil {
+			result.setReadError(resp, read.n, err)
+			return
 		}
 	}
+	// CARs are followed section by section to tell whether they are complete
+	var framer *carFramer
+	if c.Extract == ExtractCAR && !urls.RawBlock && isSuccess(resp.StatusCode) {
+		framer = &carFramer{}
+		respBody = io.TeeReader(respBody, framer)
+	}
 
-	kl := fmt.Sprintf("%s/kubo-lassie-mismatch.json", re.dir)
-	ls := fmt.Sprintf("%s/lassie-shim-mismatch.json", re.dir)
-	sn := fmt.Sprintf("%s/shim-nginx-mismatch.json", re.dir)
-	nb := fmt.Sprintf("%s/nginx-bifrost-mismatch.json", re.dir)
+	if isSuccess(resp.StatusCode) && !capture {
+		if err := streamBody(respBody, c.Extract, c.Verify, urls.subpath(), &result); err != nil {
+			result.setCarReadError(resp, read.n, err, framer)
+		} else if framer != nil {
+			result.setTruncated(framer.truncation())
+		}
+		return
+	}
 
-	writeMismatchF(kuboLassieMismatch, kl)
-	writeMismatchF(lassiShimMismatch, ls)
-	writeMismatchF(shimNginxMismatch, sn)
-	writeMismatchF(nginxBifrostMismatch, nb)
-	writeMismatchF(kuboBifrostMismatch, fmt.Sprintf("%s/kubo-bifrost-mismatch.json", re.dir))
+	if isSuccess(resp.StatusCode) {
+		body, release, spilled, err := re.spill.readBody(respBody)
+		if err != nil {
+			result.setCarReadError(resp, read.n, err, framer)
+			return
+		}
+		result.ResponseBody = body
+		result.ResponseSize = uint64(len(body))
+		result.ResponseDigest = sha256Hex(body)
+		result.ResponseSpilled = spilled
+		result.release = release
+		if framer != nil {
+			result.setTruncated(framer.truncation())
+		}
 
-	bzs, rerr := json.MarshalIndent(re.responseReads, "", " ")
-	if rerr != nil {
-		panic(rerr)
-	}
-	if err := os.WriteFile(fmt.Sprintf("%s/response-reads.json", re.rrdir), bzs, 0755); err != nil {
-		panic(err)
+		if c.Verify && urls.RawBlock {
+			if expected := rawBlockCid(urls); expected.Defined() {
+				result.BlockIntegrity = verifyRawBlockResponse(body, resp.Header.Get("Content-Type"), expected)
+			}
+		} else if c.Verify {
+			result.BlockIntegrity = VerifyBlocks(body)
+		}
+		if result.BlockIntegrity != nil && !result.BlockIntegrity.OK() {
+			result.VerificationError = verificationError(result.BlockIntegrity)
+		}
 	}
 
-	bz, err := json.MarshalIndent(re.responseReads.KuboLassieMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+	if !isSuccess(resp.StatusCode) {
+		errBody, err := io.ReadAll(respBody)
+		if err != nil {
+			result.ErrorBody = fmt.Sprintf("error reading response body: %s", err.Error())
+			return
+		}
+		result.ErrorBody = string(errBody)
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/kubo-lassie-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	return
+}
+
+// verificationError describes why a CAR failed verification.
+func verificationError(r *BlockIntegrityReport) string {
+	if len(r.Error) != 0 {
+		return fmt.Sprintf("car failed verification: %s", r.Error)
 	}
+	return fmt.Sprintf("car failed verification: %d corrupt blocks, first %s", len(r.Corrupt), r.Corrupt[0].Cid)
+}
 
-	bz, err = json.MarshalIndent(re.responseReads.KuboBifrostMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+// streamBody hashes the body as it is read without retaining it. CAR bodies are also extracted on the fly, along
+// the subpath of the request, and the digest of the extracted file bytes is recorded, if the CAR is streamable. If
+// verify is true, every block of a CAR body is also checked against its CID as it is read.
+func streamBody(body io.Reader, extract ExtractMode, verify bool, subpath string, result *Result) error {
+	rr := &readRecorder{r: body}
+	h := sha256.New()
+	var w io.Writer = h
+
+	var verifyErr chan error
+	if verify && extract == ExtractCAR {
+		pr, pw := io.Pipe()
+		w = io.MultiWriter(h, pw)
+		verifyErr = make(chan error, 1)
+		go func() {
+			err := verifyCarStream(pr)
+			// keep draining so that the body can be read to the end
+			io.Copy(io.Discard, pr)
+			verifyErr <- err
+		}()
+		defer func() {
+			pw.Close()
+			if err := <-verifyErr; err != nil && rr.err == nil {
+				result.VerificationError = fmt.Sprintf("car failed verification: %s", err)
+			}
+		}()
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/kubo-bifrost-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	tr := io.TeeReader(rr, w)
+
+	if extract == ExtractCAR {
+		rh := sha256.New()
+		rw := &countingWriter{w: rh}
+		if err := StreamExtractRawPath(tr, rw, subpath); err == nil && rw.n > 0 {
+			result.RawDigest = hex.EncodeToString(rh.Sum(nil))
+		}
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.KuboL1NginxMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+	// drain whatever the extraction did not consume
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return err
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/kubo-l1nginx-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if rr.err != nil {
+		return rr.err
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.KuboL1ShimMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+	result.ResponseSize = rr.n
+	result.ResponseDigest = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// readRecorder counts the bytes read from r and remembers whether r was read to io.EOF and the first read error
+// other than io.EOF.
+type readRecorder struct {
+	r   io.Reader
+	n   uint64
+	eof bool
+	err error
+}
+
+func (rr *readRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.n += uint64(n)
+	if err == io.EOF {
+		rr.eof = true
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/kubo-l1shim-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if err != nil && err != io.EOF && rr.err == nil {
+		rr.err = err
 	}
+	return n, err
+}
 
-	bz, err = json.MarshalIndent(re.responseReads.KuboLassieMismatches, "", " ")
-	if err != nil {
-		panic(err)
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
+func (re *RequestExecutor) WriteResultsToFile() error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	if err := writeReportJSON(re.reports, "results.json", re.results); err != nil {
+		return err
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/kubo-lassie-mismatches.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	// the requests of runs that saved their bodies are written too, so that the runs can be compared again
+	if re.opts.SaveBodies {
+		return writeReportJSON(re.reports, "requests.json", re.reqs)
 	}
+	return nil
+}
 
-	bz, err = json.MarshalIndent(re.responseReads.LassieShimMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+// writeJSON writes v to the report of the run with the name. A report that can not be written does not stop the
+// other reports of the run from being written; the first error is returned by WriteMismatchesToFile. The caller
+// must hold the lock.
+func (re *RequestExecutor) writeJSON(v interface{}, name string) {
+	if err := writeReportJSON(re.reports, name, v); err != nil {
+		re.log.Error("failed to write file", "err", err, "file", name)
+		if re.writeErr == nil {
+			re.writeErr = err
+		}
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/lassie-shim-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+}
+
+// WriteHTMLReport renders the outcome of the run to report.html in the results directory.
+func (re *RequestExecutor) WriteHTMLReport() error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	r := report.Run{
+		RunID:       re.id.String(),
+		N:           re.n,
+		Paths:       len(re.results),
+		ResultsFile: "results.json",
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.ShimNginxMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+	for _, c := range re.latencyComponents() {
+		rc := report.Component{Name: c.Name, Errors: make(map[string]int)}
+		for _, rs := range re.results {
+			res := rs[c.Name]
+			if isReadOK(res) {
+				rc.Success++
+			}
+			if len(res.ErrorKind) != 0 {
+				rc.Errors[string(res.ErrorKind)]++
+			}
+			if res.StatusCode != 0 {
+				rc.Latencies = append(rc.Latencies, res.Latency)
+			}
+		}
+		r.Components = append(r.Components, rc)
+	}
+
+	_, statusMismatchPaths := re.statusMismatches()
+	for _, p := range re.pairs {
+		r.Mismatches = append(r.Mismatches, report.MismatchTable{
+			Pair:        p.Name(),
+			Kind:        string(MismatchStatus),
+			Paths:       append([]string(nil), statusMismatchPaths[p.Name()]...),
+			File:        fmt.Sprintf("%s-mismatch.json", p.Name()),
+			Persistence: re.persistence(MismatchStatus, p),
+		})
+	}
+	for _, p := range re.pairs {
+		r.Mismatches = append(r.Mismatches, report.MismatchTable{
+			Pair:        p.Name(),
+			Kind:        string(MismatchBytes),
+			Paths:       append([]string(nil), re.responseReads.Pairs[p.Name()].MismatchPaths...),
+			File:        re.rrFile(fmt.Sprintf("%s-mismatches.json", p.Name())),
+			Persistence: re.persistence(MismatchBytes, p),
+		})
+	}
+	if re.opts.Headers != nil {
+		for _, p := range re.pairs {
+			r.Mismatches = append(r.Mismatches, report.MismatchTable{
+				Pair:  p.Name(),
+				Kind:  string(MismatchHeaders),
+				Paths: append([]string(nil), re.responseReads.Pairs[p.Name()].HeaderMismatchPaths...),
+				File:  re.rrFile(fmt.Sprintf("%s-header-mismatches.json", p.Name())),
+			})
+		}
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/shim-nginx-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if re.opts.CompareVerification {
+		for _, p := range re.pairs {
+			r.Mismatches = append(r.Mismatches, report.MismatchTable{
+				Pair:  p.Name(),
+				Kind:  string(MismatchVerification),
+				Paths: append([]string(nil), re.responseReads.Pairs[p.Name()].VerificationMismatchPaths...),
+				File:  re.rrFile(fmt.Sprintf("%s-verification-mismatches.json", p.Name())),
+			})
+		}
+	}
+	for _, p := range re.pairs {
+		r.Mismatches = append(r.Mismatches, report.MismatchTable{
+			Pair:  p.Name(),
+			Kind:  string(MismatchRedirects),
+			Paths: append([]string(nil), re.responseReads.Pairs[p.Name()].RedirectMismatchPaths...),
+			File:  re.rrFile(fmt.Sprintf("%s-redirect-mismatches.json", p.Name())),
+		})
+	}
+	for _, c := range re.cacheComponents() {
+		cr := re.responseReads.Caches[c.Name]
+		for _, kind := range CacheAnomalyKinds {
+			r.Mismatches = append(r.Mismatches, report.MismatchTable{
+				Pair:  fmt.Sprintf("%s-%s", c.Name, warmName(c)),
+				Kind:  fmt.Sprintf("cache %s", kind),
+				Paths: append([]string(nil), cr.AnomalyPaths[kind]...),
+				File:  re.rrFile(fmt.Sprintf("%s-cache-anomalies.json", c.Name)),
+			})
+		}
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.LassieShimMismatches, "", " ")
+	f, err := re.reports.Create("report.html")
 	if err != nil {
-		panic(err)
+		return err
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/lassie-shim-mismatches.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if err := report.WriteHTML(f, r); err != nil {
+		f.Close()
+		return err
 	}
+	return f.Close()
+}
 
-	bz, err = json.MarshalIndent(re.responseReads.ShimNginxMismatches, "", " ")
-	if err != nil {
-		panic(err)
+// rrFile returns the name of the report in the response reads directory.
+func (re *RequestExecutor) rrFile(name string) string {
+	return path.Join(re.rrname, name)
+}
+
+// statusMismatches returns the status mismatches and their paths keyed by pair name. A status mismatch is when
+// A returned a 2xx with a successful response read but B did not.
+func (re *RequestExecutor) statusMismatches() (map[string]map[string]Results, map[string][]string) {
+	statusMismatches := make(map[string]map[string]Results, len(re.pairs))
+	statusMismatchPaths := make(map[string][]string, len(re.pairs))
+	for _, p := range re.pairs {
+		statusMismatches[p.Name()] = make(map[string]Results)
+	}
+
+	for path, results := range re.results {
+		for _, p := range re.pairs {
+			ra, rb := results[p.A.Name], results[p.B.Name]
+			if isStatusMismatch(ra, rb) {
+				statusMismatches[p.Name()][path] = Results{p.A.Name: ra, p.B.Name: rb}
+				statusMismatchPaths[p.Name()] = append(statusMismatchPaths[p.Name()], path)
+			}
+		}
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/shim-nginx-mismatches.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	return statusMismatches, statusMismatchPaths
+}
+
+// statusMismatchRecords returns the records of the status mismatches of the pair, keyed by path, along with what
+// triage found out about them and how to reproduce them. The caller must hold the lock.
+func (re *RequestExecutor) statusMismatchRecords(p Pair, mismatches map[string]Results) map[string]*Mismatch {
+	out := make(map[string]*Mismatch, len(mismatches))
+	for path, rs := range mismatches {
+		out[path] = &Mismatch{
+			Results:     rs,
+			Persistence: re.reverified[p.Name()][MismatchStatus][path],
+			Probe:       re.probes[path],
+			Diagnosis:   re.diagnoses[path],
+			CidContact:  re.lookups[path],
+			Repro:       re.repro(re.reqs[path], rs, p.A, p.B),
+		}
 	}
+	return out
+}
 
-	bz, err = json.MarshalIndent(re.responseReads.NginxBifrostMismatches, "", " ")
-	if err != nil {
-		panic(err)
+// WriteResultsToStore records the results, status and bytes mismatches and read errors of the run in the store.
+func (re *RequestExecutor) WriteResultsToStore(store *ResultStore) error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	statusMismatches, _ := re.statusMismatches()
+
+	return store.update(re.id, func(stx *storeTx) error {
+		for path, rs := range re.results {
+			if err := stx.putResults(path, rs); err != nil {
+				return err
+			}
+		}
+
+		for _, p := range re.pairs {
+			for path, m := range re.statusMismatchRecords(p, statusMismatches[p.Name()]) {
+				if err := stx.putMismatch(MismatchStatus, p, path, m); err != nil {
+					return err
+				}
+			}
+			for path, m := range re.responseReads.Pairs[p.Name()].Mismatches {
+				if err := stx.putMismatch(MismatchBytes, p, path, m); err != nil {
+					return err
+				}
+			}
+			for path, m := range re.responseReads.Pairs[p.Name()].HeaderMismatches {
+				if err := stx.putMismatch(MismatchHeaders, p, path, m); err != nil {
+					return err
+				}
+			}
+			for path, m := range re.responseReads.Pairs[p.Name()].RedirectMismatches {
+				if err := stx.putMismatch(MismatchRedirects, p, path, m); err != nil {
+					return err
+				}
+			}
+			for path, m := range re.responseReads.Pairs[p.Name()].VerificationMismatches {
+				if err := stx.putMismatch(MismatchVerification, p, path, m); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, c := range re.components {
+			for path, e := range re.readErrorRecords(c) {
+				if err := stx.putReadError(c.Name, path, e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// WriteMismatchesToFile writes the mismatches and reports of the run and prints their summaries. Files that can not
+// be written do not stop the others from being written, and the first error is returned.
+func (re *RequestExecutor) WriteMismatchesToFile() error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	statusMismatches, statusMismatchPaths := re.statusMismatches()
+	result2xx := make(map[string]int, len(re.components))
+
+	for path, results := range re.results {
+		for _, c := range re.components {
+			r := results[c.Name]
+			if isReadOK(r) {
+				result2xx[c.Name]++
+				re.metrics.responseCode.WithLabelValues(path, c.Name, strconv.Itoa(r.StatusCode)).Inc()
+			}
+		}
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/nginx-bifrost-mismatches.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	for _, p := range re.pairs {
+		for _, path := range statusMismatchPaths[p.Name()] {
+			re.metrics.responseCodeMismatch.WithLabelValues(path, p.Name()).Inc()
+		}
 	}
+	re.setRatioMetrics(result2xx, statusMismatchPaths)
 
-	bz, err = json.MarshalIndent(re.responseReads.NginxBifrostMismatchPaths, "", " ")
-	if err != nil {
-		panic(err)
+	for _, p := range re.pairs {
+		re.writeJSON(re.statusMismatchRecords(p, statusMismatches[p.Name()]), fmt.Sprintf("%s-mismatch.json", p.Name()))
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/nginx-bifrost-mismatch-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+
+	re.writeJSON(re.responseReads, re.rrFile("response-reads.json"))
+
+	for _, p := range re.pairs {
+		pm := re.responseReads.Pairs[p.Name()]
+		re.writeJSON(pm.MismatchPaths, re.rrFile(fmt.Sprintf("%s-mismatch-paths.json", p.Name())))
+		re.writeJSON(pm.Mismatches, re.rrFile(fmt.Sprintf("%s-mismatches.json", p.Name())))
+		if re.opts.Headers != nil {
+			re.writeJSON(pm.HeaderMismatches, re.rrFile(fmt.Sprintf("%s-header-mismatches.json", p.Name())))
+		}
+		re.writeJSON(pm.RedirectMismatches, re.rrFile(fmt.Sprintf("%s-redirect-mismatches.json", p.Name())))
+		if re.opts.CompareVerification {
+			re.writeJSON(pm.VerificationMismatches, re.rrFile(fmt.Sprintf("%s-verification-mismatches.json", p.Name())))
+		}
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.LassieReadErrorPaths, "", " ")
-	if err != nil {
-		panic(err)
+	for _, c := range re.components {
+		reads := re.responseReads.Components[c.Name]
+		re.writeJSON(reads.ReadErrorPaths, re.rrFile(fmt.Sprintf("%s-2xx-response-read-error-paths.json", c.Name)))
+		re.writeJSON(re.readErrorRecords(c), re.rrFile(fmt.Sprintf("%s-2xx-response-read-errors.json", c.Name)))
+		if re.opts.VerifyDagScope && c.Extract == ExtractCAR {
+			re.writeJSON(reads.DagScopeViolations, re.rrFile(fmt.Sprintf("%s-dag-scope-violations.json", c.Name)))
+		}
+		if re.opts.CarOrder != nil && c.Extract == ExtractCAR {
+			re.writeJSON(reads.CarOrderViolations, re.rrFile(fmt.Sprintf("%s-car-order-violations.json", c.Name)))
+		}
+		if re.opts.VerifyCarIndex && c.Extract == ExtractCAR {
+			re.writeJSON(reads.CarIndexErrors, re.rrFile(fmt.Sprintf("%s-car-index-errors.json", c.Name)))
+		}
+		if ((re.opts.VerifyBlocks || c.Verify) && c.Extract == ExtractCAR) || len(reads.CorruptBlockPaths) != 0 {
+			re.writeJSON(reads.CorruptBlocks, re.rrFile(fmt.Sprintf("%s-corrupt-blocks.json", c.Name)))
+		}
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/lassie-2xx-response-read-error-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+
+	for _, p := range re.pairs {
+		re.writeJSON(statusMismatchPaths[p.Name()], fmt.Sprintf("%s-mismatch-paths.json", p.Name()))
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.L1ShimReadErrorPaths, "", " ")
-	if err != nil {
-		panic(err)
+	fmt.Println("\n ------SUMMARY OF SUCCESS------------------")
+	fmt.Printf("\n Run-%d; Total Unique Requests: %d", re.n, len(re.results))
+	for _, c := range re.components {
+		fmt.Printf("\n Run-%d; Total 2xx with successful response reads from %s: %d", re.n, c.Name, result2xx[c.Name])
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/shim-2xx-response-read-error-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	fmt.Println("\n ------------------------")
+
+	for _, p := range re.pairs {
+		fmt.Printf("\n Run-%d; %s <> %s (2xx + successful response read) Mismatch: %d", re.n, p.A.Name, p.B.Name, len(statusMismatches[p.Name()]))
+		re.printCidContactSummary(TriageStatus, p.Name(), fmt.Sprintf("%s-mismatch-providers.json", p.Name()))
 	}
+	fmt.Println("\n----")
 
-	bz, err = json.MarshalIndent(re.responseReads.L1NginxReadErrorPaths, "", " ")
-	if err != nil {
-		panic(err)
+	fmt.Println("\n ----------SUMMARY OF RESPONSE BYTES MISMATCHES --------------")
+	for _, p := range re.pairs {
+		pm := re.responseReads.Pairs[p.Name()]
+		fmt.Printf("\n Run-%d; %s %s response bytes Mismatch: %d", re.n, p.A.Name, p.B.Name, len(pm.MismatchPaths))
+		for _, c := range re.opts.comparators(p) {
+			t := pm.Comparators[c.Name()]
+			fmt.Printf("\n Run-%d;   %s: %d mismatches, %d matches, %d not comparable", re.n, c.Name(), t.TotalMismatches, t.TotalMatches, t.TotalIncomparable)
+		}
+		re.printCidContactSummary(TriageBytes, p.Name(), fmt.Sprintf("%s-bytes-mismatch-providers.json", p.Name()))
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/nginx-2xx-response-read-error-paths.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+
+	if re.opts.Headers != nil {
+		fmt.Println("\n ----------SUMMARY OF HEADER MISMATCHES --------------")
+		for _, p := range re.pairs {
+			pm := re.responseReads.Pairs[p.Name()]
+			fmt.Printf("\n Run-%d; %s %s header Mismatch: %d", re.n, p.A.Name, p.B.Name, len(pm.HeaderMismatchPaths))
+			re.printCidContactSummary(TriageHeaders, p.Name(), fmt.Sprintf("%s-headers-mismatch-providers.json", p.Name()))
+		}
+		fmt.Println()
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.LassieReadErrors, "", " ")
-	if err != nil {
-		panic(err)
+	fmt.Println("\n ----------SUMMARY OF REDIRECT MISMATCHES --------------")
+	for _, p := range re.pairs {
+		pm := re.responseReads.Pairs[p.Name()]
+		fmt.Printf("\n Run-%d; %s %s redirect Mismatch: %d", re.n, p.A.Name, p.B.Name, len(pm.RedirectMismatchPaths))
+		re.printCidContactSummary(TriageRedirects, p.Name(), fmt.Sprintf("%s-redirects-mismatch-providers.json", p.Name()))
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/lassie-2xx-response-read-errors.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	fmt.Println()
+
+	re.writeProvenance()
+
+	if re.opts.CompareVerification {
+		fmt.Println("\n ----------SUMMARY OF VERIFICATION HEADER MISMATCHES --------------")
+		for _, p := range re.pairs {
+			pm := re.responseReads.Pairs[p.Name()]
+			fmt.Printf("\n Run-%d; %s %s verification header Mismatch: %d", re.n, p.A.Name, p.B.Name, len(pm.VerificationMismatchPaths))
+			re.printCidContactSummary(TriageVerification, p.Name(), fmt.Sprintf("%s-verification-mismatch-providers.json", p.Name()))
+		}
+		fmt.Println()
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.L1ShimReadErrors, "", " ")
-	if err != nil {
-		panic(err)
+	fmt.Println("\n ----------SUMMARY OF RESPONSE READ ERRORS --------------")
+	for _, c := range re.components {
+		reads := re.responseReads.Components[c.Name]
+		fmt.Printf("\n Run-%d; %s returned 200 but failed to read responses for %d requests", re.n, c.Name, reads.TotalReadError)
+		re.printCidContactSummary(TriageReadErrors, c.Name, fmt.Sprintf("%s-read-error-providers.json", c.Name))
+		fmt.Println("\n----")
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/shim-2xx-response-read-errors.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	re.writeTruncations()
+	re.writeTransferDiscrepancies()
+
+	if re.hasVariants() {
+		re.writeVariants()
 	}
-	bz, err = json.MarshalIndent(re.responseReads.L1NginxReadErrors, "", " ")
-	if err != nil {
-		panic(err)
+	if re.hasNegotiations() {
+		re.writeNegotiations()
 	}
-	if err := os.WriteFile(fmt.Sprintf("%s/nginx-2xx-response-read-errors.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if re.opts.CompareConditional {
+		re.writeConditional()
 	}
 
-	bz, err = json.MarshalIndent(re.responseReads.BifrostReadErrors, "", " ")
-	if err != nil {
-		panic(err)
-	}
-	if err := os.WriteFile(fmt.Sprintf("%s/bifrost-2xx-response-read-errors.json", re.rrdir), bz, 0755); err != nil {
-		panic(err)
+	if re.hasProduction() {
+		for _, c := range re.components {
+			if pr := re.responseReads.Production[c.Name]; pr != nil {
+				re.writeJSON(pr.Mismatches, re.rrFile(fmt.Sprintf("%s-production-mismatches.json", c.Name)))
+			}
+		}
+		re.printProductionSummary()
+		fmt.Println()
 	}
 
-	writePathsF(klMismatchPaths, fmt.Sprintf("%s/kubo-lassie-mismatch-paths.json", re.dir))
-	writePathsF(lsMismatchPaths, fmt.Sprintf("%s/lassie-shim-mismatch-paths.json", re.dir))
-	writePathsF(snMismatchPaths, fmt.Sprintf("%s/shim-nginx-mismatch-paths.json", re.dir))
-	writePathsF(nbMismatchPaths, fmt.Sprintf("%s/nginx-bifrost-mismatch-paths.json", re.dir))
-	writePathsF(kuboBifrostMismatchPaths, fmt.Sprintf("%s/kubo-bifrost-mismatch-paths.json", re.dir))
+	fmt.Println("\n ----------SUMMARY OF CAR EXTRACTION TIMEOUTS --------------")
+	for _, c := range re.components {
+		if c.Extract == ExtractCAR {
+			fmt.Printf("\n Run-%d; %s returned CARs that could not be extracted within %s for %d requests", re.n, c.Name, re.opts.ExtractTimeout, len(re.responseReads.Components[c.Name].ExtractTimeoutPaths))
+		}
+	}
+	fmt.Println()
 
-	fmt.Println("\n ------SUMMARY OF SUCCESS------------------")
-	fmt.Printf("\n Run-%d; Total Unique Requests: %d", re.n, len(res))
-	fmt.Printf("\n Run-%d; Total 2xx with successful response reads from Kubo GW: %d", re.n, result2xx.kubo)
-	fmt.Printf("\n Run-%d; Total 2xx with successful response reads from Lassie: %d", re.n, result2xx.lassie)
-	fmt.Printf("\n Run-%d; Total 2xx with successful response reads from L1 Shim: %d", re.n, result2xx.shim)
-	fmt.Printf("\n Run-%d; Total 2xx with successful response reads from L1 Nginx: %d", re.n, result2xx.nginx)
-	fmt.Printf("\n Run-%d; Total 2xx with successful response reads from Bifrost: %d", re.n, result2xx.bifrost)
-	fmt.Println("\n ------------------------")
+	if re.opts.VerifyDagScope {
+		fmt.Println("\n ----------SUMMARY OF DAG SCOPE VIOLATIONS --------------")
+		for _, c := range re.components {
+			if c.Extract == ExtractCAR {
+				fmt.Printf("\n Run-%d; %s returned CARs that do not match the requested dag-scope for %d requests", re.n, c.Name, len(re.responseReads.Components[c.Name].DagScopeViolationPaths))
+			}
+		}
+		fmt.Println()
+	}
 
-	fmt.Printf("\n Run-%d; Kubo <> Lassie (2xx + successful response read) Mismatch: %d", re.n, len(kuboLassieMismatch))
-	c := NewCidContactChecker(klMismatchPaths)
-	c.Check()
-	fmt.Printf("\n Run-%d; Lassie <> Shim (2xx + successful response read) Mismatch: %d", re.n, len(lassiShimMismatch))
-	c = NewCidContactChecker(lsMismatchPaths)
-	c.Check()
-	fmt.Printf("\n Run-%d; Shim <> Nginx (2xx + successful response read) Mismatch: %d\n", re.n, len(shimNginxMismatch))
-	c = NewCidContactChecker(snMismatchPaths)
-	c.Check()
-	fmt.Printf("\n Run-%d; L1 Nginx <> Bifrost (2xx + successful response read) Mismatch: %d", re.n, len(nginxBifrostMismatch))
-	c = NewCidContactChecker(nbMismatchPaths)
-	c.Check()
-	fmt.Printf("\n Run-%d; Kubo <> Bifrost (2xx + successful response read) Mismatch: %d", re.n, len(kuboBifrostMismatch))
-	c = NewCidContactChecker(kuboBifrostMismatchPaths)
-	c.Check()
-	fmt.Println("\n----")
+	if re.opts.CarOrder != nil {
+		fmt.Println("\n ----------SUMMARY OF CAR ORDER VIOLATIONS --------------")
+		for _, c := range re.components {
+			if c.Extract == ExtractCAR {
+				fmt.Printf("\n Run-%d; %s returned CARs that do not follow their block order or duplicate block policy for %d requests", re.n, c.Name, len(re.responseReads.Components[c.Name].CarOrderViolationPaths))
+			}
+		}
+		fmt.Println()
+	}
 
-	fmt.Println("\n ----------SUMMARY OF RESPONSE BYTES MISMATCHES --------------")
-	fmt.Printf("\n Run-%d; Kubo Lassie response bytes Mismatch(after extracting Lassie CAR): %d", re.n, len(re.responseReads.KuboLassieMismatchPaths))
-	fmt.Printf("\n Run-%d; Kubo Shim response bytes Mismatch(after extracting Shim CAR): %d", re.n, len(re.responseReads.KuboL1ShimMismatches))
-	fmt.Printf("\n Run-%d; Kubo Nginx response bytes Mismatch(after extracting Nginx CAR): %d", re.n, len(re.responseReads.KuboL1NginxMismatches))
-	fmt.Printf("\n Run-%d; Lassie Shim response bytes Mismatch: %d", re.n, len(re.responseReads.LassieShimMismatchPaths))
-	fmt.Printf("\n Run-%d; Shim Nginx response bytes Mismatch: %d", re.n, len(re.responseReads.ShimNginxMismatchPaths))
-	fmt.Printf("\n Run-%d; Kubo Bifrost response bytes Mismatch: %d", re.n, len(re.responseReads.KuboBifrostMismatches))
-	fmt.Printf("\n Run-%d; Nginx Bifrost response bytes Mismatch: %d", re.n, len(re.responseReads.NginxBifrostMismatchPaths))
+	if re.opts.VerifyCarIndex {
+		fmt.Println("\n ----------SUMMARY OF CAR INDEX ERRORS --------------")
+		for _, c := range re.components {
+			if c.Extract == ExtractCAR {
+				fmt.Printf("\n Run-%d; %s returned CARv2s whose index does not match their blocks for %d requests", re.n, c.Name, len(re.responseReads.Components[c.Name].CarIndexErrorPaths))
+			}
+		}
+		fmt.Println()
+	}
 
-	fmt.Println("\n ----------SUMMARY OF RESPONSE READ ERRORS --------------")
-	fmt.Printf("\n Run-%d; Lassie returned 200 but failed to read responses for %d requests", re.n, re.responseReads.TotalLassieReadError)
-	c = NewCidContactChecker(re.responseReads.LassieReadErrorPaths)
-	c.Check()
-	fmt.Println("\n----")
+	if re.opts.VerifyBlocks {
+		fmt.Println("\n ----------SUMMARY OF CORRUPT BLOCKS --------------")
+		for _, c := range re.components {
+			if c.Extract == ExtractCAR {
+				fmt.Printf("\n Run-%d; %s returned CARs with blocks that do not match their CID for %d requests", re.n, c.Name, len(re.responseReads.Components[c.Name].CorruptBlockPaths))
+			}
+		}
+		fmt.Println()
+	}
 
-	fmt.Printf("\n Run-%d; Shim returned 200 but failed to read responses for %d requests", re.n, re.responseReads.TotalL1ShimReadError)
-	c = NewCidContactChecker(re.responseReads.L1ShimReadErrorPaths)
-	c.Check()
-	fmt.Println("\n----")
+	re.writeErrorKinds()
+	re.writeThrottling()
+	re.writeReferenceCache()
+	re.writeConnections()
+	re.writeClasses()
+	re.writeReverification()
+	re.writeProbes()
+	re.writeTriage()
 
-	fmt.Printf("\n Run-%d; Nginx returned 200 but failed to read responses for %d requests", re.n, re.responseReads.TotalL1NginxReadError)
-	c = NewCidContactChecker(re.responseReads.L1NginxReadErrorPaths)
-	c.Check()
-	fmt.Println("\n----")
+	latencyComponents := re.latencyComponents()
+	latency := componentLatencyStats(latencyComponents, re.results)
+	re.writeCacheAnomalies(latency)
+	re.writeEncodingAnomalies()
+	re.writeSlowRequests()
+	re.writeNodeConsistency()
 
-	fmt.Printf("\n Run-%d; Bifrost returned 200 but failed to read responses for %d requests", re.n, re.responseReads.TotalBifrostReadError)
-	c = NewCidContactChecker(re.responseReads.BifrostReadErrorPaths)
-	c.Check()
-	fmt.Println("\n----")
+	fmt.Println("\n ----------SUMMARY OF LATENCIES --------------")
+	for _, c := range latencyComponents {
+		l := latency[c.Name]
+		fmt.Printf("\n Run-%d; %s p50: %s, p90: %s, p99: %s, throughput: %.0f bytes/sec", re.n, c.Name, l.P50, l.P90, l.P99, l.BytesPerSecond)
+	}
+	fmt.Println()
 
 	fmt.Println("\n ----------DONE; Please see the results/ directory for detailed request logs --------------")
 
-	toplLevel := struct {
-		Kubo2XX    int
-		Lassie2XX  int
-		Shim2XX    int
-		Nginx2XX   int
-		Bifrost2xx int
-
-		KuboLassieMismatch   int
-		LassieShimMismatch   int
-		ShimNginxMismatch    int
-		NginxBifrostMismatch int
-	}{
-		Kubo2XX:    result2xx.kubo,
-		Lassie2XX:  result2xx.lassie,
-		Shim2XX:    result2xx.shim,
-		Nginx2XX:   result2xx.nginx,
-		Bifrost2xx: result2xx.bifrost,
-
-		KuboLassieMismatch:   len(kuboLassieMismatch),
-		LassieShimMismatch:   len(lassiShimMismatch),
-		ShimNginxMismatch:    len(shimNginxMismatch),
-		NginxBifrostMismatch: len(nginxBifrostMismatch),
-	}
-	bz, err = json.MarshalIndent(toplLevel, "", " ")
-	if err != nil {
-		panic(err)
+	mismatches := make(map[string]int, len(re.pairs))
+	for _, p := range re.pairs {
+		mismatches[p.Name()] = len(statusMismatches[p.Name()])
 	}
 
-	if err := os.WriteFile(fmt.Sprintf("%s/top-level-metrics.json", re.dir), bz, 0755); err != nil {
-		panic(err)
+	toplLevel := TopLevelMetrics{
+		Component2XX:     result2xx,
+		PairMismatch:     mismatches,
+		ComponentLatency: latency,
 	}
 
-	// write mismatched paths separately
+	re.writeJSON(toplLevel, "top-level-metrics.json")
+
+	err := re.writeErr
+	re.writeErr = nil
+	return err
+}
+
+// contentPaths returns the paths that were actually requested from the components for the requests, i.e. their
+// URL paths or the resolved /ipfs/ paths of /ipns/ paths.
+func (re *RequestExecutor) contentPaths(paths []string) []string {
+	out := make([]string, 0, len(paths))
+	for _, path := range paths {
+		urls, ok := re.reqs[path]
+		if ok && len(urls.Path) != 0 {
+			path = urls.Path
+		}
+		if resolved := urls.ResolvedPath; len(resolved) != 0 {
+			path = resolved
+		}
+		out = append(out, path)
+	}
+	return out
 }
@@ -0,0 +1,235 @@
+package onion
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	resultsBucket    = []byte("results")
+	mismatchesBucket = []byte("mismatches")
+	readErrorsBucket = []byte("read-errors")
+)
+
+// keys are made of their parts joined by a separator that can not appear in paths or component names
+const keySep = "\x00"
+
+// MismatchKind is the class of a mismatch between two components.
+type MismatchKind string
+
+const (
+	// MismatchStatus is when A returned a 2xx with a successful response read but B did not.
+	MismatchStatus MismatchKind = "status"
+	// MismatchBytes is when both returned a 2xx with a successful response read but the bytes differ.
+	MismatchBytes MismatchKind = "bytes"
+	// MismatchHeaders is when both returned a 2xx with a successful response read but the compared headers differ.
+	MismatchHeaders MismatchKind = "headers"
+	// MismatchRedirects is when the two were redirected differently.
+	MismatchRedirects MismatchKind = "redirects"
+	// MismatchVerification is when both returned a 2xx with a successful response read but their
+	// VerificationHeaders differ.
+	MismatchVerification MismatchKind = "verification"
+)
+
+// RunResults are the results of all components for a path in a single run.
+type RunResults struct {
+	RunID   string
+	Path    string
+	Results Results
+}
+
+// MismatchRecord is a mismatch between components A and B for a path in a single run.
+type MismatchRecord struct {
+	RunID string
+	Path  string
+	A     string
+	B     string
+	Kind  MismatchKind
+
+	Mismatch
+}
+
+// ReadErrorRecord is a 2xx response from a component whose body could not be read.
+type ReadErrorRecord struct {
+	RunID     string
+	Path      string
+	Component string
+
+	ReadError
+}
+
+// ResultStore persists the results, mismatches and read errors of runs in a BoltDB database so that they can be
+// queried across runs.
+type ResultStore struct {
+	db *bolt.DB
+}
+
+func OpenResultStore(file string) (*ResultStore, error) {
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result store %s: %w", file, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{resultsBucket, mismatchesBucket, readErrorsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise result store %s: %w", file, err)
+	}
+
+	return &ResultStore{db: db}, nil
+}
+
+func (s *ResultStore) Close() error {
+	return s.db.Close()
+}
+
+// snapshot writes a consistent copy of the store to a temporary file, e.g. to upload it while the store is open,
+// and returns the name of the file.
+func (s *ResultStore) snapshot() (string, error) {
+	f, err := os.CreateTemp("", "onion-store-*.db")
+	if err != nil {
+		return "", err
+	}
+	err = s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(f)
+		return err
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to snapshot result store: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// storeTx batches writes for a run into a single transaction.
+type storeTx struct {
+	tx    *bolt.Tx
+	runID string
+}
+
+func (s *ResultStore) update(runID uuid.UUID, f func(stx *storeTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return f(&storeTx{tx: tx, runID: runID.String()})
+	})
+}
+
+func (stx *storeTx) putResults(path string, rs Results) error {
+	return putJSON(stx.tx.Bucket(resultsBucket), storeKey(path, stx.runID), RunResults{
+		RunID:   stx.runID,
+		Path:    path,
+		Results: rs,
+	})
+}
+
+func (stx *storeTx) putMismatch(kind MismatchKind, p Pair, path string, m *Mismatch) error {
+	return putJSON(stx.tx.Bucket(mismatchesBucket), storeKey(p.A.Name, p.B.Name, stx.runID, path, string(kind)), MismatchRecord{
+		RunID:    stx.runID,
+		Path:     path,
+		A:        p.A.Name,
+		B:        p.B.Name,
+		Kind:     kind,
+		Mismatch: *m,
+	})
+}
+
+func (stx *storeTx) putReadError(component string, path string, e *ReadError) error {
+	return putJSON(stx.tx.Bucket(readErrorsBucket), storeKey(component, stx.runID, path), ReadErrorRecord{
+		RunID:     stx.runID,
+		Path:      path,
+		Component: component,
+		ReadError: *e,
+	})
+}
+
+// ResultsForPath returns the results recorded for the path across all runs.
+func (s *ResultStore) ResultsForPath(path string) ([]RunResults, error) {
+	var out []RunResults
+	err := s.scan(resultsBucket, storeKey(path, ""), func(v []byte) error {
+		var rr RunResults
+		if err := json.Unmarshal(v, &rr); err != nil {
+			return err
+		}
+		out = append(out, rr)
+		return nil
+	})
+	return out, err
+}
+
+// MismatchesBetween returns the mismatches recorded between components a and b across all runs, in either order.
+func (s *ResultStore) MismatchesBetween(a, b string) ([]MismatchRecord, error) {
+	var out []MismatchRecord
+	collectF := func(v []byte) error {
+		var mr MismatchRecord
+		if err := json.Unmarshal(v, &mr); err != nil {
+			return err
+		}
+		out = append(out, mr)
+		return nil
+	}
+
+	if err := s.scan(mismatchesBucket, storeKey(a, b, ""), collectF); err != nil {
+		return nil, err
+	}
+	if a == b {
+		return out, nil
+	}
+	if err := s.scan(mismatchesBucket, storeKey(b, a, ""), collectF); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReadErrorsFor returns the read errors recorded for the component across all runs.
+func (s *ResultStore) ReadErrorsFor(component string) ([]ReadErrorRecord, error) {
+	var out []ReadErrorRecord
+	err := s.scan(readErrorsBucket, storeKey(component, ""), func(v []byte) error {
+		var rr ReadErrorRecord
+		if err := json.Unmarshal(v, &rr); err != nil {
+			return err
+		}
+		out = append(out, rr)
+		return nil
+	})
+	return out, err
+}
+
+func (s *ResultStore) scan(bucket []byte, prefix []byte, f func(v []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if err := f(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func storeKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, keySep))
+}
+
+func putJSON(b *bolt.Bucket, key []byte, v interface{}) error {
+	bz, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, bz)
+}
@@ -0,0 +1,82 @@
+package onion
+
+import (
+	"encoding/csv"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// WriteResultsCSV writes the results of the run to results.csv in the results directory, with one row per path
+// that has the class of the request, the status, size, latency, whether the response was read, the kind of failure,
+// the digest of the response body and the remote address and reuse of the connection for every component and
+// whether the statuses and response bytes of every pair mismatch, so that the results can be pivoted in a
+// spreadsheet.
+func (re *RequestExecutor) WriteResultsCSV() error {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	f, err := re.reports.Create("results.csv")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := csv.NewWriter(f)
+
+	header := []string{"path", "class"}
+	for _, c := range re.components {
+		header = append(header, c.Name+"_status", c.Name+"_size", c.Name+"_latency_ms", c.Name+"_read_ok", c.Name+"_error_kind", c.Name+"_digest", c.Name+"_remote_addr", c.Name+"_conn_reused", c.Name+"_request_id")
+	}
+	for _, p := range re.pairs {
+		header = append(header, p.Name()+"_status_mismatch", p.Name()+"_bytes_mismatch")
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(re.results))
+	for path := range re.results {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		rs := re.results[path]
+		row := []string{path, requestClass(re.reqs[path], rs).Name()}
+		for _, c := range re.components {
+			res := rs[c.Name]
+			if res == nil {
+				row = append(row, "", "", "", "", "", "", "", "", "")
+				continue
+			}
+			row = append(row,
+				strconv.Itoa(res.StatusCode),
+				strconv.FormatUint(res.ResponseSize, 10),
+				strconv.FormatFloat(float64(res.Latency)/float64(time.Millisecond), 'f', 3, 64),
+				strconv.FormatBool(isReadOK(res)),
+				string(res.ErrorKind),
+				res.ResponseDigest,
+			)
+			if res.Conn != nil {
+				row = append(row, res.Conn.RemoteAddr, strconv.FormatBool(res.Conn.Reused))
+			} else {
+				row = append(row, "", "")
+			}
+			row = append(row, res.RequestID)
+		}
+		for _, p := range re.pairs {
+			statusMismatch := isStatusMismatch(rs[p.A.Name], rs[p.B.Name])
+			_, bytesMismatch := re.responseReads.Pairs[p.Name()].Mismatches[path]
+			row = append(row, strconv.FormatBool(statusMismatch), strconv.FormatBool(bytesMismatch))
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
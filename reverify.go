@@ -0,0 +1,148 @@
+package onion
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/atomic"
+)
+
+// Persistence classifies a mismatch by whether it is still observed when the path is requested again.
+type Persistence string
+
+const (
+	// Persistent mismatches are still observed when the path is requested again.
+	Persistent Persistence = "persistent"
+	// Transient mismatches are gone when the path is requested again, e.g. because a cache was warming up or a
+	// provider was flaky.
+	Transient Persistence = "transient"
+)
+
+// Reverify requests the paths that mismatched between any pair of components again after the delay and classifies
+// every status and bytes mismatch as persistent or transient. The results of the run are not changed.
+func (re *RequestExecutor) Reverify(delay time.Duration) {
+	re.reverify(delay, []TriageCategory{TriageStatus, TriageBytes})
+}
+
+// reverify re-verifies the status and bytes mismatches of the categories.
+func (re *RequestExecutor) reverify(delay time.Duration, categories []TriageCategory) {
+	re.mu.Lock()
+	statusMismatches, _ := re.statusMismatches()
+	paths := re.triagePaths(categories)
+	re.mu.Unlock()
+	status, bytes := containsCategory(categories, TriageStatus), containsCategory(categories, TriageBytes)
+
+	if len(paths) == 0 {
+		return
+	}
+	re.log.Info("re-verifying mismatched paths", "paths", len(paths), "delay", delay)
+	time.Sleep(delay)
+
+	sem := make(chan struct{}, re.opts.Concurrency)
+	count := atomic.NewInt32(0)
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			re.reverifyPath(path, statusMismatches, status, bytes, count.Inc())
+		}(path)
+	}
+	wg.Wait()
+
+	re.log.Info("re-verification done")
+}
+
+// reverifyPath requests the path again and classifies its status mismatches, if status is set, and its bytes
+// mismatches, if bytes is set.
+func (re *RequestExecutor) reverifyPath(path string, statusMismatches map[string]map[string]Results, status, bytes bool, count int32) {
+	ctx, span := re.startPathSpan(path, count)
+	span.SetAttributes(attribute.Bool("onion.reverify", true))
+	defer span.End()
+	pc := re.fetch(withoutReferenceCache(ctx), path, count, !re.streaming(path))
+	defer pc.release()
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	for _, p := range re.pairs {
+		ra, rb := pc.rs[p.A.Name], pc.rs[p.B.Name]
+
+		if _, ok := statusMismatches[p.Name()][path]; ok && status {
+			persistence := Transient
+			if isStatusMismatch(ra, rb) {
+				persistence = Persistent
+			}
+			re.setPersistence(MismatchStatus, p, path, persistence)
+		}
+
+		if m, ok := re.responseReads.Pairs[p.Name()].Mismatches[path]; ok && bytes {
+			// a mismatch is only transient if all comparators now agree that the responses are equal
+			persistence := Transient
+			if !isReadOK(ra) || !isReadOK(rb) {
+				persistence = Persistent
+			} else {
+				for _, cmp := range pc.compare(p, re.opts.comparators(p)) {
+					if !cmp.ok || !cmp.equal {
+						persistence = Persistent
+					}
+				}
+			}
+			m.Persistence = persistence
+			re.setPersistence(MismatchBytes, p, path, persistence)
+		}
+	}
+}
+
+// setPersistence records the persistence of a mismatch. The caller must hold the lock.
+func (re *RequestExecutor) setPersistence(kind MismatchKind, p Pair, path string, persistence Persistence) {
+	if re.reverified == nil {
+		re.reverified = make(map[string]map[MismatchKind]map[string]Persistence)
+	}
+	byKind, ok := re.reverified[p.Name()]
+	if !ok {
+		byKind = make(map[MismatchKind]map[string]Persistence)
+		re.reverified[p.Name()] = byKind
+	}
+	if byKind[kind] == nil {
+		byKind[kind] = make(map[string]Persistence)
+	}
+	byKind[kind][path] = persistence
+}
+
+// persistence returns the persistence of the re-verified mismatches of the kind for the pair, keyed by path, as
+// rendered in the report. The caller must hold the lock.
+func (re *RequestExecutor) persistence(kind MismatchKind, p Pair) map[string]string {
+	out := make(map[string]string)
+	for path, persistence := range re.reverified[p.Name()][kind] {
+		out[path] = string(persistence)
+	}
+	return out
+}
+
+// writeReverification writes the persistence of the re-verified mismatches and prints a summary. The caller must
+// hold the lock.
+func (re *RequestExecutor) writeReverification() {
+	if re.reverified == nil {
+		return
+	}
+	re.writeJSON(re.reverified, "reverification.json")
+
+	fmt.Println("\n ----------SUMMARY OF RE-VERIFIED MISMATCHES --------------")
+	for _, p := range re.pairs {
+		for _, kind := range []MismatchKind{MismatchStatus, MismatchBytes} {
+			counts := make(map[Persistence]int)
+			for _, persistence := range re.reverified[p.Name()][kind] {
+				counts[persistence]++
+			}
+			fmt.Printf("\n Run-%d; %s %s mismatches: %d persistent, %d transient", re.n, p.Name(), kind, counts[Persistent], counts[Transient])
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,686 @@
+package onion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/filecoin-saturn/onion/replay"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+)
+
+// RunConfig configures a programmatic Onion test with Run.
+type RunConfig struct {
+	// Components are the layers under test, including disabled ones, which are not queried.
+	Components []Component
+
+	// ReplayFile is the replay file to load requests from. It is not read if Entries is set.
+	ReplayFile string
+	// Replay configures how the replay file is parsed.
+	Replay replay.Options
+	// Entries are the requests to replay instead of those of the replay file, e.g. for tests.
+	Entries []replay.ReplayEntry
+	// Cohorts are requested instead of the requests of ReplayFile or Entries, if set. Count requests are sampled from
+	// every cohort and the cohorts of a run are requested in parallel, each with Options.Concurrency workers and
+	// its own rate limits, and written to a directory named after the cohort within the results directory of
+	// the run, e.g. results/results-1/video.
+	Cohorts []Cohort
+	// Sample configures how Count requests with unique paths are sampled from the replayed requests.
+	Sample replay.SampleOptions
+	// Count is the number of unique paths to request in every run.
+	Count int
+	// Runs is the number of times to request the paths.
+	Runs int
+
+	// Resolver resolves /ipns/ paths before they are sent to the components, if set. Requests whose path can not
+	// be resolved are skipped.
+	Resolver Resolver
+
+	// Options configure the executor of every run. If Options.Logger is nil, logs are written to stdout at LogLevel
+	// and, if LogJSON is set, as JSON to onion.log.json in the results directory of every run.
+	Options  ExecutorOptions
+	LogLevel slog.Level
+	LogJSON  bool
+
+	// ResultsDir is the directory under which the results of every run are written. Defaults to "results". Every
+	// run is listed with its parameters in the index.json manifest of the directory.
+	ResultsDir string
+	// RunName is the template of the name of the results directory of every run within ResultsDir, which may
+	// contain {n}, the number of the run, {timestamp}, the UTC time the run started at, {run_id} and {sha}, the
+	// DeploymentSHA. Defaults to DefaultRunName.
+	RunName string
+	// DeploymentSHA is the git SHA of the deployment under test, if known. It is recorded in the manifest.
+	DeploymentSHA string
+	// ConfigFile is the config file the components were loaded from, if any, whose hash is recorded in the
+	// run-metadata.json of every run.
+	ConfigFile string
+	// Profile is the profile of the config file the components were loaded from, if any. It is recorded in the
+	// manifest.
+	Profile string
+	// Resume is the results directory of a run to resume from its last checkpoint. Later runs are started as usual.
+	Resume string
+	// ReverifyAfter requests mismatched paths again after this delay to classify mismatches as persistent or
+	// transient, if set.
+	ReverifyAfter time.Duration
+	// Store records the results of every run, if set.
+	Store *ResultStore
+	// PushGateway is where metrics are pushed at the end of every run. Metrics are not pushed if its Addr is empty.
+	PushGateway PushGatewayConfig
+	// Live tracks the progress and mismatches of every run while its paths are requested, e.g. to serve them in a
+	// web UI, if set.
+	Live *Live
+	// Upload uploads the results directory of every run to an S3 or GCS bucket once the run is complete, if set.
+	// Failing to upload does not fail the run.
+	Upload *UploadConfig
+	// Alert posts a summary of every run whose mismatches exceed a threshold to a webhook, if set. Failing to post
+	// an alert does not fail the run.
+	Alert *AlertConfig
+	// GatewayVariants also requests variants of every replayed path that exercise gateway features, e.g. _redirects
+	// files, index.html resolution and directory listings, whose mismatches are summarised per variant.
+	GatewayVariants bool
+	// CarNegotiation also requests the CAR of every replayed CAR request with Accept headers that negotiate every
+	// combination of block order and duplicates, and verifies that the responses honor the negotiated parameters.
+	CarNegotiation bool
+	// Assertions are evaluated at the end of every run and written to assertions.json in its results directory.
+	// They do not fail the run; see RunReport.AssertionsFailed.
+	Assertions []Assertion
+	// Chaos are the failures injected into the stack under test before runs. The results of every run are labelled
+	// with the actions injected before it.
+	Chaos []ChaosAction
+}
+
+// RunReport is the outcome of Run.
+type RunReport struct {
+	Runs []RunSummary
+	// Aggregates consolidate the runs of every cohort if there was more than one run.
+	Aggregates []*RunsAggregate `json:",omitempty"`
+	// Skipped maps the URLs of requests that were not replayed to the reason they were skipped.
+	Skipped map[string]string
+}
+
+// RunSummary is the outcome of a single run.
+type RunSummary struct {
+	N     int
+	RunID uuid.UUID
+	// Cohort is the name of the cohort of the run, if the run has cohorts.
+	Cohort string
+	// Dir is the results directory of the run.
+	Dir           string
+	Results       map[string]Results
+	ResponseReads *ResponseBytesMismatch
+	// StatusMismatchPaths are keyed by pair name.
+	StatusMismatchPaths map[string][]string
+	// Assertions are the outcomes of the assertions of the run, if any.
+	Assertions []AssertionResult `json:",omitempty"`
+	// Chaos names the chaos actions injected before the run joined by "+", if any.
+	Chaos string `json:",omitempty"`
+}
+
+// Run loads and samples the requests to replay, sends them to the components and writes the results, mismatches
+// and reports of every run, like the onion command does. Runs that have not started yet are skipped once ctx is
+// done.
+func Run(ctx context.Context, cfg RunConfig) (RunReport, error) {
+	report := RunReport{Skipped: make(map[string]string)}
+	if cfg.Count <= 0 || cfg.Runs <= 0 {
+		return report, fmt.Errorf("count and runs must be positive, got %d and %d", cfg.Count, cfg.Runs)
+	}
+	if enabled := EnabledComponents(cfg.Components); len(enabled) < 2 {
+		return report, fmt.Errorf("at least two enabled components are required, got %d", len(enabled))
+	}
+	for _, a := range cfg.Assertions {
+		if err := a.Validate(); err != nil {
+			return report, err
+		}
+		if err := a.validateSubjects(cfg.Components, cfg.Options.pairs(cfg.Components)); err != nil {
+			return report, err
+		}
+	}
+	for _, a := range cfg.Chaos {
+		if err := a.Validate(); err != nil {
+			return report, err
+		}
+	}
+	if cfg.Upload != nil {
+		if err := cfg.Upload.Validate(); err != nil {
+			return report, err
+		}
+	}
+	resultsDir := cfg.ResultsDir
+	if len(resultsDir) == 0 {
+		resultsDir = "results"
+	}
+	if len(cfg.RunName) == 0 {
+		cfg.RunName = DefaultRunName
+	}
+	if err := validateRunName(cfg.RunName, cfg.DeploymentSHA); err != nil {
+		return report, err
+	}
+	// runs share cid.contact lookups
+	if cfg.Options.CidContactCache == nil {
+		cfg.Options.CidContactCache, _ = NewCidContactCache("", DefaultCidContactTTL)
+	}
+
+	// a run without cohorts requests a single unnamed cohort, whose results are written to the run directory
+	cohorts := cfg.Cohorts
+	if len(cohorts) == 0 {
+		cohorts = []Cohort{{ReplayFile: cfg.ReplayFile, Entries: cfg.Entries}}
+	} else if err := validateCohorts(cohorts); err != nil {
+		return report, err
+	}
+
+	reqs := make([]map[string]URLsToTest, len(cohorts))
+	for i, c := range cohorts {
+		var err error
+		if reqs[i], err = cfg.buildRequests(ctx, c, report.Skipped); err != nil {
+			return report, err
+		}
+		if len(reqs[i]) < cfg.Count {
+			return report, fmt.Errorf("not enough requests to send to components%s; requested: %d, available: %d",
+				cohortLabel(c), cfg.Count, len(reqs[i]))
+		}
+	}
+
+	log := cfg.Options.Logger
+	if log == nil {
+		log = NewLogger(os.Stdout, cfg.LogLevel, nil)
+	}
+	if err := cfg.prepareKubos(ctx, reqs, log); err != nil {
+		return report, fmt.Errorf("failed to prepare kubo nodes: %w", err)
+	}
+
+	var cps map[string]*Checkpoint
+	start := 0
+	if len(cfg.Resume) != 0 {
+		var n int
+		var err error
+		if cps, n, err = readCheckpoints(cfg.Resume, cohorts); err != nil {
+			return report, err
+		}
+		if n < 1 || n > cfg.Runs {
+			return report, fmt.Errorf("can not resume run %d of %d runs", n, cfg.Runs)
+		}
+		start = n - 1
+	}
+
+	var index []IndexedRun
+	for i := start; i < cfg.Runs; i++ {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		var err error
+		ids := make([]uuid.UUID, len(cohorts))
+		for j, c := range cohorts {
+			if cp := cps[c.Name]; cp != nil {
+				ids[j] = cp.RunID
+			} else if ids[j], err = uuid.NewUUID(); err != nil {
+				return report, err
+			}
+		}
+
+		runStart := time.Now()
+		dir := filepath.Join(resultsDir, runName(cfg.RunName, i+1, runStart, ids[0], cfg.DeploymentSHA))
+		if cps != nil && i == start {
+			dir = cfg.Resume
+		}
+
+		// a resumed run was injected with its chaos and its environment was captured before it was interrupted, and
+		// is labelled with the chaos recorded in its metadata
+		var chaos string
+		if cps == nil {
+			if chaos, err = cfg.injectChaos(ctx, i+1, dir, log); err != nil {
+				return report, fmt.Errorf("failed to inject chaos before run %d: %w", i+1, err)
+			}
+			if err := cfg.writeRunMetadata(ctx, i+1, ids[0], runStart, chaos, dir, log); err != nil {
+				return report, fmt.Errorf("failed to write the metadata of run %d: %w", i+1, err)
+			}
+		} else if len(cfg.Chaos) != 0 {
+			md, err := ReadRunMetadata(dir)
+			if err != nil {
+				log.Warn("resumed run is not labelled with its chaos", "run", i+1, "err", err)
+			} else {
+				chaos = md.Chaos
+			}
+		}
+
+		ss, err := cfg.run(cohorts, reqs, i+1, ids, dir, cps)
+		if err != nil {
+			return report, fmt.Errorf("run %d failed: %w", i+1, err)
+		}
+		for j := range ss {
+			ss[j].Chaos = chaos
+		}
+		cps = nil
+		report.Runs = append(report.Runs, ss...)
+
+		run := cfg.indexedRun(ss, dir, runStart)
+		if index, err = cfg.indexRun(resultsDir, index, run); err != nil {
+			return report, fmt.Errorf("failed to index run %d: %w", i+1, err)
+		}
+		if cfg.Upload != nil {
+			cfg.uploadRun(ctx, resultsDir, dir, run, log)
+		}
+	}
+
+	if len(report.Runs) > len(cohorts) {
+		report.Aggregates = AggregateRuns(report.Runs)
+		if err := cfg.writeAggregates(resultsDir, report.Aggregates); err != nil {
+			return report, fmt.Errorf("failed to write the aggregate of the runs: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// indexedRun returns the manifest entry of a run written to dir.
+func (cfg RunConfig) indexedRun(ss []RunSummary, dir string, start time.Time) IndexedRun {
+	run := IndexedRun{
+		N:             ss[0].N,
+		RunID:         ss[0].RunID,
+		Dir:           dir,
+		Start:         start.UTC(),
+		End:           time.Now().UTC(),
+		DeploymentSHA: cfg.DeploymentSHA,
+		Chaos:         ss[0].Chaos,
+		Params:        cfg.params(),
+	}
+	for i, c := range cfg.Cohorts {
+		run.Cohorts = append(run.Cohorts, IndexedCohort{Name: c.Name, RunID: ss[i].RunID, ReplayFile: c.ReplayFile})
+	}
+	return run
+}
+
+// validateCohorts checks that every cohort has a distinct name that can name a directory.
+func validateCohorts(cohorts []Cohort) error {
+	names := make(map[string]struct{}, len(cohorts))
+	for _, c := range cohorts {
+		if len(c.Name) == 0 || c.Name != filepath.Base(c.Name) || c.Name == "." || c.Name == ".." ||
+			c.Name == "response_reads" {
+			return fmt.Errorf("invalid cohort name %q", c.Name)
+		}
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("duplicate cohort: %s", c.Name)
+		}
+		names[c.Name] = struct{}{}
+	}
+	return nil
+}
+
+// cohortLabel describes the cohort in messages, if it is named.
+func cohortLabel(c Cohort) string {
+	if len(c.Name) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" of cohort %s", c.Name)
+}
+
+// readCheckpoints reads the checkpoints of the cohorts of the run written to dir, keyed by cohort name, and returns
+// the number of the run. Cohorts that had not written a checkpoint yet are started from scratch.
+func readCheckpoints(dir string, cohorts []Cohort) (map[string]*Checkpoint, int, error) {
+	cps := make(map[string]*Checkpoint, len(cohorts))
+	n := 0
+	for _, c := range cohorts {
+		cp, err := ReadCheckpoint(filepath.Join(dir, c.Name))
+		if errors.Is(err, os.ErrNotExist) && len(cohorts) > 1 {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if n != 0 && cp.N != n {
+			return nil, 0, fmt.Errorf("checkpoints of cohorts are of different runs: %d and %d", n, cp.N)
+		}
+		n = cp.N
+		cps[c.Name] = cp
+	}
+	if len(cps) == 0 {
+		return nil, 0, fmt.Errorf("no checkpoint of any cohort in %s", dir)
+	}
+	return cps, n, nil
+}
+
+// run executes a single run of the cohorts in parallel and writes their results to dir, resuming every cohort from
+// its checkpoint, if any. The results of the cohorts are written one after the other so that their summaries are
+// not interleaved.
+func (cfg RunConfig) run(cohorts []Cohort, reqs []map[string]URLsToTest, n int, ids []uuid.UUID, dir string, cps map[string]*Checkpoint) ([]RunSummary, error) {
+	res := make([]*RequestExecutor, len(cohorts))
+	closers := make([]func(), len(cohorts))
+	errs := make([]error, len(cohorts))
+	var wg sync.WaitGroup
+	for i, c := range cohorts {
+		wg.Add(1)
+		go func(i int, c Cohort) {
+			defer wg.Done()
+			res[i], closers[i], errs[i] = cfg.execute(c, reqs[i], n, ids[i], filepath.Join(dir, c.Name), cps[c.Name])
+		}(i, c)
+	}
+	wg.Wait()
+	defer func() {
+		for _, closeF := range closers {
+			if closeF != nil {
+				closeF()
+			}
+		}
+	}()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute requests%s: %w", cohortLabel(cohorts[i]), err)
+		}
+	}
+
+	summaries := make([]RunSummary, 0, len(cohorts))
+	for i, re := range res {
+		if len(cohorts[i].Name) != 0 {
+			fmt.Printf("\n ========== COHORT %s ==========\n", cohorts[i].Name)
+		}
+		s, err := cfg.write(re)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write results%s: %w", cohortLabel(cohorts[i]), err)
+		}
+		s.Cohort = cohorts[i].Name
+		summaries = append(summaries, s)
+	}
+	if len(cfg.Cohorts) != 0 {
+		if err := cfg.writeCohortSummaries(dir, n, summaries); err != nil {
+			return nil, fmt.Errorf("failed to write cohort summaries: %w", err)
+		}
+	}
+
+	if len(cfg.Assertions) != 0 {
+		var results []AssertionResult
+		for i := range summaries {
+			summaries[i].Assertions = EvaluateAssertions(cfg.Assertions, cfg.Components, summaries[i])
+			results = append(results, summaries[i].Assertions...)
+		}
+		if err := cfg.writeAssertions(dir, n, results); err != nil {
+			return nil, fmt.Errorf("failed to write assertions: %w", err)
+		}
+	}
+
+	if len(cfg.PushGateway.Addr) != 0 {
+		for i, re := range res {
+			if err := PushMetrics(summaries[i].RunID, cohorts[i].Name, re.Registry(), cfg.PushGateway); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.Alert != nil {
+		for i, s := range summaries {
+			if alerted, err := cfg.Alert.Alert(s); err != nil {
+				fmt.Printf("\n%s\n", err)
+			} else if alerted {
+				fmt.Printf("\nposted mismatch alert for run %d%s\n", n, cohortLabel(cohorts[i]))
+			}
+		}
+	}
+	return summaries, nil
+}
+
+// execute requests the paths of a cohort of a run, resuming from the checkpoint if it is not nil. The returned
+// function closes the JSON log of the run, if any, once its results are written.
+func (cfg RunConfig) execute(c Cohort, reqs map[string]URLsToTest, n int, id uuid.UUID, dir string, cp *Checkpoint) (*RequestExecutor, func(), error) {
+	rrdir := filepath.Join(dir, "response_reads")
+	if cfg.Options.Reports == nil {
+		if err := os.MkdirAll(rrdir, 0755); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	closeF := func() {}
+	opts := cfg.Options
+	// the reports of every run and cohort are named after their directory within the results directory
+	if opts.Reports != nil {
+		opts.Reports = subReportWriter{w: opts.Reports, dir: cfg.reportDir(dir)}
+	}
+	if opts.Logger == nil {
+		opts.Logger = NewLogger(os.Stdout, cfg.LogLevel, nil)
+		if cfg.LogJSON {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return nil, nil, err
+			}
+			jsonLog, err := os.Create(filepath.Join(dir, "onion.log.json"))
+			if err != nil {
+				return nil, nil, err
+			}
+			closeF = func() { jsonLog.Close() }
+			opts.Logger = NewLogger(os.Stdout, cfg.LogLevel, jsonLog)
+		}
+	}
+	if len(c.Name) != 0 {
+		opts.Logger = opts.Logger.With("cohort", c.Name)
+	}
+	if opts.Progress != nil {
+		p := *opts.Progress
+		p.Label = c.Name
+		// cohorts are requested in parallel, so their progress can not share a line
+		if len(cfg.Cohorts) > 1 {
+			p.Line = false
+		}
+		opts.Progress = &p
+	}
+
+	if opts.Triage == nil {
+		opts.Triage = DefaultTriage(cfg.ReverifyAfter, opts.Prober != nil)
+	}
+	re := NewRequestExecutor(cfg.Components, reqs, n, id, dir, rrdir, opts)
+	if cp != nil {
+		if err := re.Resume(cp); err != nil {
+			closeF()
+			return nil, nil, err
+		}
+	}
+	if cfg.Live != nil {
+		cfg.Live.track(c.Name, re)
+	}
+	re.Execute()
+	if cfg.Live != nil {
+		cfg.Live.finish(re)
+	}
+	re.Triage(context.Background())
+	return re, closeF, nil
+}
+
+// reportDir returns the slash-separated name of the directory of a run within the results directory. Resumed runs
+// outside of it are named after their directory.
+func (cfg RunConfig) reportDir(dir string) string {
+	resultsDir := cfg.ResultsDir
+	if len(resultsDir) == 0 {
+		resultsDir = "results"
+	}
+	rel, err := filepath.Rel(resultsDir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Base(dir)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// writeReport writes v to the report with the name in dir, the results directory or that of a run, through
+// Options.Reports if it is set.
+func (cfg RunConfig) writeReport(dir, name string, v interface{}) error {
+	if cfg.Options.Reports == nil {
+		return writeReportJSON(DirReportWriter{Dir: dir}, name, v)
+	}
+	return writeReportJSON(cfg.Options.Reports, path.Join(cfg.reportDir(dir), name), v)
+}
+
+// write writes the results, mismatches and reports of an executed run. A file or report that can not be written
+// does not stop the others from being written, and the first error is returned.
+func (cfg RunConfig) write(re *RequestExecutor) (RunSummary, error) {
+	writers := []func() error{re.WriteResultsToFile, re.WriteResultsCSV, re.WriteMismatchesToFile, re.WriteHTMLReport}
+	if cfg.Store != nil {
+		writers = append(writers, func() error { return re.WriteResultsToStore(cfg.Store) })
+	}
+	var werr error
+	for _, write := range writers {
+		if err := write(); err != nil && werr == nil {
+			werr = err
+		}
+	}
+	if werr != nil {
+		return RunSummary{}, werr
+	}
+
+	_, statusMismatchPaths := re.statusMismatches()
+	return RunSummary{
+		N:                   re.n,
+		RunID:               re.id,
+		Dir:                 re.dir,
+		Results:             re.results,
+		ResponseReads:       re.responseReads,
+		StatusMismatchPaths: statusMismatchPaths,
+	}, nil
+}
+
+// buildRequests loads, samples and resolves the requests of the cohort to replay, keyed by path. Requests that are
+// malformed or can not be resolved are recorded in skipped.
+func (cfg RunConfig) buildRequests(ctx context.Context, c Cohort, skipped map[string]string) (map[string]URLsToTest, error) {
+	entries := c.Entries
+	if entries == nil {
+		var err error
+		if entries, err = replay.LoadFile(c.ReplayFile, cfg.Replay); err != nil {
+			return nil, err
+		}
+	}
+
+	golden := goldenOf(cfg.Components)
+	var valid []replay.ReplayEntry
+	for _, e := range entries {
+		u := e.URL
+
+		// only requests recorded by the golden run can be compared with it
+		if golden != nil {
+			if key, err := replay.RequestKey(e, cfg.Sample.Dedup); err != nil || !golden.has(key) {
+				continue
+			}
+		}
+
+		if strings.Contains(u, "ipfs-404") {
+			continue
+		}
+
+		// remove requests as per old format
+		if strings.Contains(u, "car-scope") && !strings.Contains(u, "dag-scope") {
+			continue
+		}
+		valid = append(valid, e)
+	}
+
+	sampled, err := replay.Sample(valid, cfg.Count, cfg.Sample)
+	if err != nil {
+		return nil, err
+	}
+
+	ub := NewURLBuilder(cfg.Components)
+	ub.Resolver = cfg.Resolver
+	reqs := make(map[string]URLsToTest, len(sampled))
+	offsets, ok := replay.Offsets(sampled)
+	if !ok && cfg.Options.Pace > 0 {
+		fmt.Printf("replay log%s records no request times; its paths are not paced\n", cohortLabel(c))
+	}
+	for i, e := range sampled {
+		// the value of the Range header or entity-bytes param, if any, is used to request the same byte range from
+		// all components; the method, other headers and body are replayed as is. Malformed URLs and ranges are
+		// skipped rather than failing the run.
+		o, err := buildURLsToTest(ub, e)
+		if err == nil {
+			o, err = ub.Resolve(ctx, o)
+		}
+		if err != nil {
+			fmt.Printf("skipping %s: %s\n", e.URL, err)
+			skipped[e.URL] = err.Error()
+			continue
+		}
+		if o.Key, err = replay.RequestKey(e, cfg.Sample.Dedup); err != nil {
+			return nil, err
+		}
+		o.ExpectedSize = e.Size
+		o.Replay = replayMetadata(e)
+		if offsets != nil {
+			o.Offset = offsets[i]
+		}
+		reqs[o.Key] = ub.WithRequest(o, e.Method, e.Headers, []byte(e.Body))
+		if cfg.GatewayVariants {
+			addGatewayVariants(ctx, ub, reqs, e, o.Offset, cfg.Sample.Dedup)
+		}
+		if cfg.CarNegotiation {
+			addCarNegotiations(ctx, ub, reqs, e, o.Key, o.Offset)
+		}
+	}
+	return reqs, nil
+}
+
+// addGatewayVariants adds the requests of the gateway variants of the replayed request, sent at the same offset.
+// Variants whose request is sent anyway are not added again.
+func addGatewayVariants(ctx context.Context, ub *URLBuilder, reqs map[string]URLsToTest, e replay.ReplayEntry, offset time.Duration, dedup replay.Dedup) {
+	variants, err := gatewayVariants(e)
+	if err != nil {
+		fmt.Printf("not varying %s: %s\n", e.URL, err)
+		return
+	}
+	for v, ve := range variants {
+		o, err := buildURLsToTest(ub, ve)
+		if err == nil && v != VariantIPNSRecord {
+			o, err = ub.Resolve(ctx, o)
+		}
+		if err != nil {
+			fmt.Printf("skipping %s variant of %s: %s\n", v, e.URL, err)
+			continue
+		}
+		if v == VariantIPNSRecord {
+			// the record is requested for the same path as the name itself
+			o.Path += "?format=ipns-record"
+		}
+		if o.Key, err = replay.RequestKey(ve, dedup); err != nil {
+			continue
+		}
+		if _, ok := reqs[o.Key]; ok {
+			continue
+		}
+		o.Variant = v
+		o.Offset = offset
+		reqs[o.Key] = ub.WithRequest(o, ve.Method, ve.Headers, nil)
+	}
+}
+
+// replayMetadata returns what the replay log records about the original request and the response production served
+// for it, if anything.
+func replayMetadata(e replay.ReplayEntry) *ReplayMetadata {
+	ua := e.UserAgent
+	if len(ua) == 0 {
+		ua = e.Headers.Get("User-Agent")
+	}
+	referer := e.Referer
+	if len(referer) == 0 {
+		referer = e.Headers.Get("Referer")
+	}
+	if e.Status == 0 && e.Size == 0 && len(ua) == 0 && len(referer) == 0 {
+		return nil
+	}
+	return &ReplayMetadata{UserAgent: ua, Referer: referer, Status: e.Status, Extract: replayExtract(e.URL, e.Headers)}
+}
+
+// buildURLsToTest builds the URLs to test for the replayed request, for the byte range of its Range header or
+// entity-bytes param if it has one.
+func buildURLsToTest(ub *URLBuilder, e replay.ReplayEntry) (URLsToTest, error) {
+	if rangeHeader := e.Range(); len(rangeHeader) != 0 {
+		rng, err := ParseRangeHeader(rangeHeader)
+		if err != nil {
+			return URLsToTest{}, fmt.Errorf("invalid range: %w", err)
+		}
+		return ub.BuildRangeURLsToTest(e.URL, rng)
+	}
+	if eb := entityBytes(e.URL); len(eb) != 0 {
+		rng, err := ParseEntityBytes(eb)
+		if err != nil {
+			return URLsToTest{}, err
+		}
+		return ub.BuildRangeURLsToTest(e.URL, rng)
+	}
+	return ub.BuildURLsToTest(e.URL)
+}
@@ -0,0 +1,168 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/filecoin-saturn/onion/replay"
+	"github.com/google/uuid"
+)
+
+// DefaultRunName is the template of the names of the results directories of runs unless RunConfig.RunName is set.
+const DefaultRunName = "results-{n}"
+
+// runIndexFile is the manifest of the runs in a results directory.
+const runIndexFile = "index.json"
+
+// runNameLayout is the layout of the {timestamp} of run names.
+const runNameLayout = "20060102T150405Z"
+
+// runName expands the run name template. It supports {n}, the number of the run, {timestamp}, the UTC time the run
+// started at, {run_id} and {sha}, the git SHA of the deployment under test.
+func runName(tmpl string, n int, start time.Time, id uuid.UUID, sha string) string {
+	return strings.NewReplacer(
+		"{n}", strconv.Itoa(n),
+		"{timestamp}", start.UTC().Format(runNameLayout),
+		"{run_id}", id.String(),
+		"{sha}", sha,
+	).Replace(tmpl)
+}
+
+// validateRunName checks that the run name template names a directory within the results directory that differs
+// between runs.
+func validateRunName(tmpl string, sha string) error {
+	if !strings.Contains(tmpl, "{n}") && !strings.Contains(tmpl, "{timestamp}") && !strings.Contains(tmpl, "{run_id}") {
+		return fmt.Errorf("run name %q must contain {n}, {timestamp} or {run_id} to tell runs apart", tmpl)
+	}
+	if strings.Contains(tmpl, "{sha}") && len(sha) == 0 {
+		return fmt.Errorf("run name %q contains {sha} but the deployment SHA is not set", tmpl)
+	}
+	name := filepath.Clean(runName(tmpl, 1, time.Time{}, uuid.UUID{}, sha))
+	if filepath.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("run name %q must be a relative path within the results directory", tmpl)
+	}
+	return nil
+}
+
+// IndexedRun is a run listed in the index.json manifest of a results directory.
+type IndexedRun struct {
+	N int
+	// RunID is the ID of the run, or of its first cohort if it has cohorts.
+	RunID uuid.UUID
+	// Dir is the results directory of the run, relative to the directory of the manifest.
+	Dir   string
+	Start time.Time
+	End   time.Time
+	// DeploymentSHA is the git SHA of the deployment under test, if known.
+	DeploymentSHA string `json:",omitempty"`
+	// Chaos names the chaos actions injected before the run, if any.
+	Chaos string `json:",omitempty"`
+	// Cohorts are the cohorts of the run, if it has cohorts.
+	Cohorts []IndexedCohort `json:",omitempty"`
+	Params  RunParams
+}
+
+// IndexedCohort is a cohort of an indexed run.
+type IndexedCohort struct {
+	Name       string
+	RunID      uuid.UUID
+	ReplayFile string `json:",omitempty"`
+}
+
+// RunParams are the parameters a run was started with.
+type RunParams struct {
+	ReplayFile string `json:",omitempty"`
+	// Profile is the profile of the config file the run was configured with, if any.
+	Profile string `json:",omitempty"`
+	Count   int
+	Runs    int
+	Sample  replay.SampleOptions
+	// Components are the names of the enabled components.
+	Components  []string
+	Streaming   bool
+	Concurrency int
+	// Pace is the scale of the original request timing that paths were sent at, if the run was paced.
+	Pace float64 `json:",omitempty"`
+	// GatewayVariants is set if variants of every path exercising gateway features were requested too.
+	GatewayVariants bool `json:",omitempty"`
+	// CarNegotiation is set if the CARs of every path were requested with every negotiated block order and
+	// duplicates too.
+	CarNegotiation bool `json:",omitempty"`
+	Timeout        time.Duration
+	Retries        int
+}
+
+// params returns the parameters of the runs of the config.
+func (cfg RunConfig) params() RunParams {
+	p := RunParams{
+		ReplayFile:      cfg.ReplayFile,
+		Profile:         cfg.Profile,
+		Count:           cfg.Count,
+		Runs:            cfg.Runs,
+		Sample:          cfg.Sample,
+		Streaming:       cfg.Options.Streaming,
+		Concurrency:     cfg.Options.Concurrency,
+		Pace:            cfg.Options.Pace,
+		GatewayVariants: cfg.GatewayVariants,
+		CarNegotiation:  cfg.CarNegotiation,
+		Timeout:         cfg.Options.Timeout,
+		Retries:         cfg.Options.Retries,
+	}
+	if len(cfg.Cohorts) != 0 {
+		p.ReplayFile = ""
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultConcurrency
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultTimeout
+	}
+	for _, c := range EnabledComponents(cfg.Components) {
+		p.Components = append(p.Components, c.Name)
+	}
+	return p
+}
+
+// ReadRunIndex reads the manifest of the runs in a results directory, e.g. results. It is empty if no run was
+// written to the directory yet.
+func ReadRunIndex(dir string) ([]IndexedRun, error) {
+	var runs []IndexedRun
+	err := readJSONF(filepath.Join(dir, runIndexFile), &runs)
+	if _, serr := os.Stat(filepath.Join(dir, runIndexFile)); errors.Is(serr, os.ErrNotExist) {
+		return nil, nil
+	}
+	return runs, err
+}
+
+// indexRun adds the run to the manifest of the results directory, replacing an earlier entry of the same directory,
+// e.g. of a resumed run, and returns the runs of the manifest. As manifests can not be read back from
+// Options.Reports, the run is added to the runs indexed earlier by this Run if it is set, and to the manifest on
+// disk otherwise.
+func (cfg RunConfig) indexRun(resultsDir string, runs []IndexedRun, run IndexedRun) ([]IndexedRun, error) {
+	if cfg.Options.Reports == nil {
+		var err error
+		if runs, err = ReadRunIndex(resultsDir); err != nil {
+			return nil, err
+		}
+	}
+	if rel, err := filepath.Rel(resultsDir, run.Dir); err == nil {
+		run.Dir = rel
+	}
+
+	replaced := false
+	for i := range runs {
+		if runs[i].Dir == run.Dir {
+			runs[i] = run
+			replaced = true
+		}
+	}
+	if !replaced {
+		runs = append(runs, run)
+	}
+	return runs, cfg.writeReport(resultsDir, runIndexFile, runs)
+}
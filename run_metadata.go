@@ -0,0 +1,273 @@
+package onion
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// runMetadataFile is written to the results directory of every run.
+	runMetadataFile = "run-metadata.json"
+	// versionTimeout bounds the request to the version endpoint of a layer.
+	versionTimeout = 10 * time.Second
+	// maxVersionBody is the number of bytes of the response of a version endpoint that are recorded.
+	maxVersionBody = 4 << 10
+)
+
+// RunMetadata records the environment a run was started in, so that its results can be reproduced and attributed
+// to the versions of the layers and of onion that produced them.
+type RunMetadata struct {
+	N     int
+	RunID uuid.UUID
+	Start time.Time
+	// DeploymentSHA is the git SHA of the deployment under test, if known.
+	DeploymentSHA string `json:",omitempty"`
+	// Chaos names the chaos actions injected before the run joined by "+", if any, so that a resumed run is
+	// labelled with them again.
+	Chaos string `json:",omitempty"`
+	Onion OnionBuild
+	// Components are the layers under test as they were configured, including disabled ones.
+	Components []ComponentMetadata
+	Params     RunParams
+	// ConfigFile is the config file the run was configured with, if any, and ConfigSHA256 its hash.
+	ConfigFile   string `json:",omitempty"`
+	ConfigSHA256 string `json:",omitempty"`
+	// ReplayFiles are the replay files the requests of the run were loaded from, one per cohort if the run has
+	// cohorts.
+	ReplayFiles []ReplayFileMetadata `json:",omitempty"`
+}
+
+// OnionBuild is the build of onion that ran, as recorded in its binary.
+type OnionBuild struct {
+	// Module and Version are those of the main module, which is "(devel)" for binaries built from a checkout.
+	Module    string `json:",omitempty"`
+	Version   string `json:",omitempty"`
+	GoVersion string
+	// Revision and Time are those of the commit onion was built from, and Modified is set if the checkout had
+	// uncommitted changes.
+	Revision string `json:",omitempty"`
+	Time     string `json:",omitempty"`
+	Modified bool   `json:",omitempty"`
+}
+
+// ComponentMetadata is a layer under test and, if it has a version endpoint, the version it reported before the run.
+type ComponentMetadata struct {
+	Name        string
+	Group       string `json:",omitempty"`
+	Node        string `json:",omitempty"`
+	Protocol    Protocol
+	Extract     ExtractMode
+	Range       RangeMode
+	HTTPVersion HTTPVersion `json:",omitempty"`
+	URLStyle    URLStyle
+	Verify      bool `json:",omitempty"`
+	Cache       bool `json:",omitempty"`
+	Disabled    bool `json:",omitempty"`
+	Reference   bool `json:",omitempty"`
+	// Golden is set if the component served the responses of an earlier run instead of querying a layer.
+	Golden  bool              `json:",omitempty"`
+	Version *ComponentVersion `json:",omitempty"`
+}
+
+// ComponentVersion is the response of the version or health endpoint of a layer.
+type ComponentVersion struct {
+	URL        string
+	StatusCode int `json:",omitempty"`
+	// Server is the Server header of the response, which often names the version of the layer too.
+	Server string `json:",omitempty"`
+	// Body is the start of the body of the response.
+	Body  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// ReplayFileMetadata identifies a replay file by its content.
+type ReplayFileMetadata struct {
+	Cohort string `json:",omitempty"`
+	Path   string
+	Size   int64  `json:",omitempty"`
+	SHA256 string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// onionBuild returns the build of the running binary.
+func onionBuild() OnionBuild {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return OnionBuild{GoVersion: "unknown"}
+	}
+	b := OnionBuild{Module: info.Main.Path, Version: info.Main.Version, GoVersion: info.GoVersion}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			b.Revision = s.Value
+		case "vcs.time":
+			b.Time = s.Value
+		case "vcs.modified":
+			b.Modified = s.Value == "true"
+		}
+	}
+	return b
+}
+
+// versionRequest returns the request for the version of the component, or nil if it has no version endpoint. Kubo
+// nodes report their version on their RPC API unless a version endpoint is configured.
+func (c Component) versionRequest(ctx context.Context) (*http.Request, error) {
+	switch {
+	case len(c.VersionURL) != 0:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.VersionURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if c.Auth != nil {
+			if err := c.Auth.Apply(req); err != nil {
+				return nil, err
+			}
+		}
+		return req, nil
+	case c.Kubo != nil:
+		return http.NewRequestWithContext(ctx, http.MethodPost, c.Kubo.API+"/api/v0/version", nil)
+	}
+	return nil, nil
+}
+
+// fetchVersion requests the version endpoint of the component, if it has one.
+func fetchVersion(ctx context.Context, c Component) *ComponentVersion {
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+	req, err := c.versionRequest(ctx)
+	if req == nil && err == nil {
+		return nil
+	}
+	if err != nil {
+		return &ComponentVersion{URL: c.VersionURL, Error: err.Error()}
+	}
+
+	v := &ComponentVersion{URL: req.URL.String()}
+	client := newHTTPClient(c)
+	if c.Kubo != nil && len(c.VersionURL) == 0 {
+		client = c.Kubo.client()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	defer resp.Body.Close()
+	v.StatusCode = resp.StatusCode
+	v.Server = resp.Header.Get("Server")
+	bz, err := io.ReadAll(io.LimitReader(resp.Body, maxVersionBody))
+	if err != nil {
+		v.Error = fmt.Sprintf("failed to read response: %s", err)
+	}
+	v.Body = strings.TrimSpace(string(bz))
+	return v
+}
+
+// hashFile returns the size and SHA-256 of the file.
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// runMetadata captures the environment of run n: the versions reported by the layers under test, the build of
+// onion, the config of the run and the hashes of its replay files. Layers whose version can not be fetched are
+// logged and recorded with the error.
+func (cfg RunConfig) runMetadata(ctx context.Context, n int, id uuid.UUID, start time.Time, chaos string, log *slog.Logger) *RunMetadata {
+	md := &RunMetadata{
+		N:             n,
+		RunID:         id,
+		Start:         start.UTC(),
+		DeploymentSHA: cfg.DeploymentSHA,
+		Chaos:         chaos,
+		Onion:         onionBuild(),
+		Params:        cfg.params(),
+		ConfigFile:    cfg.ConfigFile,
+	}
+	for _, c := range cfg.Components {
+		cm := ComponentMetadata{
+			Name:        c.Name,
+			Group:       c.Group,
+			Node:        c.Node,
+			Protocol:    c.Protocol,
+			Extract:     c.Extract,
+			Range:       c.Range,
+			HTTPVersion: c.HTTPVersion,
+			URLStyle:    c.URLStyle,
+			Verify:      c.Verify,
+			Cache:       c.Cache,
+			Disabled:    c.Disabled,
+			Reference:   c.Reference,
+			Golden:      c.Golden != nil,
+		}
+		if !c.Disabled && c.Golden == nil {
+			cm.Version = fetchVersion(ctx, c)
+			if cm.Version != nil && len(cm.Version.Error) != 0 {
+				log.Warn("failed to fetch component version", "run", n, "component", c.Name, "url", cm.Version.URL, "err", cm.Version.Error)
+			}
+		}
+		md.Components = append(md.Components, cm)
+	}
+
+	if len(cfg.ConfigFile) != 0 {
+		if _, sum, err := hashFile(cfg.ConfigFile); err != nil {
+			log.Warn("failed to hash config file", "file", cfg.ConfigFile, "err", err)
+		} else {
+			md.ConfigSHA256 = sum
+		}
+	}
+	replays := []ReplayFileMetadata{{Path: cfg.ReplayFile}}
+	if len(cfg.Cohorts) != 0 {
+		replays = replays[:0]
+		for _, c := range cfg.Cohorts {
+			replays = append(replays, ReplayFileMetadata{Cohort: c.Name, Path: c.ReplayFile})
+		}
+	}
+	for _, r := range replays {
+		// requests replayed from entries have no file
+		if len(r.Path) == 0 {
+			continue
+		}
+		var err error
+		if r.Size, r.SHA256, err = hashFile(r.Path); err != nil {
+			r.Error = err.Error()
+		}
+		md.ReplayFiles = append(md.ReplayFiles, r)
+	}
+	return md
+}
+
+// writeRunMetadata captures the environment of run n and writes it to run-metadata.json in the results directory of
+// the run, through Options.Reports if it is set.
+func (cfg RunConfig) writeRunMetadata(ctx context.Context, n int, id uuid.UUID, start time.Time, chaos, dir string, log *slog.Logger) error {
+	return cfg.writeReport(dir, runMetadataFile, cfg.runMetadata(ctx, n, id, start, chaos, log))
+}
+
+// ReadRunMetadata reads the metadata of the run whose results were written to dir.
+func ReadRunMetadata(dir string) (*RunMetadata, error) {
+	var md RunMetadata
+	if err := readJSONF(filepath.Join(dir, runMetadataFile), &md); err != nil {
+		return nil, err
+	}
+	return &md, nil
+}
@@ -0,0 +1,105 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// SavedRun is what a run that saved its response bodies, e.g. with ExecutorOptions.FetchOnly, recorded of its
+// requests and responses, from which the responses can be verified and compared again without requesting them.
+type SavedRun struct {
+	// Dir is the results directory of the run.
+	Dir   string
+	N     int
+	RunID uuid.UUID
+	// Requests are the requests of the run and Results their results, keyed by path.
+	Requests map[string]URLsToTest
+	Results  map[string]Results
+}
+
+// LoadSavedRun loads the requests and results saved to the results directory of a run, e.g. results/results-1.
+func LoadSavedRun(dir string) (*SavedRun, error) {
+	s := &SavedRun{Dir: dir, N: 1}
+	if _, err := os.Stat(filepath.Join(dir, "requests.json")); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("run %s did not save its requests; run it with -fetch-only or -save-bodies", dir)
+	}
+	if err := readJSONF(filepath.Join(dir, "requests.json"), &s.Requests); err != nil {
+		return nil, err
+	}
+	if err := readJSONF(filepath.Join(dir, "results.json"), &s.Results); err != nil {
+		return nil, err
+	}
+	// runs are numbered by their checkpoint, which every run writes once its paths are requested
+	if cp, err := ReadCheckpoint(dir); err == nil {
+		s.N, s.RunID = cp.N, cp.RunID
+	}
+	return s, nil
+}
+
+// Components returns the components that serve the recorded responses of the run in place of the layers of the
+// components, which are configured like the layers of the run so that their responses are extracted and compared
+// the same way. Components that the run did not request are disabled.
+func (s *SavedRun) Components(components []Component) []Component {
+	recorded := make(map[string]bool)
+	for _, rs := range s.Results {
+		for name := range rs {
+			recorded[name] = true
+		}
+	}
+	out := make([]Component, 0, len(components))
+	for _, c := range components {
+		c.Golden = &Golden{Component: c.Name, Results: s.Results, Dir: s.Dir}
+		c.Disabled = c.Disabled || !recorded[c.Name]
+		// the recorded responses are served without querying the layer
+		c.Kubo = nil
+		c.MaxRequestsPerSecond, c.MaxBytesPerSecond = 0, 0
+		out = append(out, c)
+	}
+	return out
+}
+
+// CompareSaved verifies and compares the recorded responses of the saved run as the run would have, had it not only
+// fetched them, and writes the results, mismatches and reports to the results directory dir, e.g. to compare old
+// fetch data with improved comparators. The options, logging and results store of cfg configure the comparison as
+// they configure a run. Responses whose bodies were not saved are compared by digest, and encoded, warm cache and
+// conditional responses are not compared, as the run did not record them.
+func CompareSaved(s *SavedRun, components []Component, dir string, cfg RunConfig) (RunSummary, error) {
+	cfg.Components = s.Components(components)
+	if enabled := EnabledComponents(cfg.Components); len(enabled) < 2 {
+		return RunSummary{}, fmt.Errorf("at least two components recorded by run %s are required, got %d", s.Dir, len(enabled))
+	}
+	cfg.Options.FetchOnly = false
+	cfg.Options.SaveBodies = false
+	cfg.Options.CompareEncoding, cfg.Options.CompareCache, cfg.Options.CompareConditional = false, false, false
+	cfg.Options.Pace = 0
+	// re-verifying mismatches would serve the same recorded responses again
+	cfg.ReverifyAfter = 0
+	if cfg.Options.Triage == nil {
+		cfg.Options.Triage = DefaultTriage(0, cfg.Options.Prober != nil)
+	}
+	triage := make([]TriageStep, 0, len(cfg.Options.Triage))
+	for _, s := range cfg.Options.Triage {
+		if s.Analyzer != AnalyzerRefetch {
+			triage = append(triage, s)
+		}
+	}
+	cfg.Options.Triage = triage
+
+	id := s.RunID
+	if id == uuid.Nil {
+		var err error
+		if id, err = uuid.NewUUID(); err != nil {
+			return RunSummary{}, err
+		}
+	}
+	re, closeF, err := cfg.execute(Cohort{}, s.Requests, s.N, id, dir, nil)
+	if err != nil {
+		return RunSummary{}, err
+	}
+	defer closeF()
+	return cfg.write(re)
+}
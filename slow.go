@@ -0,0 +1,88 @@
+package onion
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SlowRequest is a request whose latency exceeded the slow request percentile or threshold of its component.
+type SlowRequest struct {
+	Path         string
+	Latency      time.Duration
+	StatusCode   int
+	ResponseSize uint64
+	// ExpectedSize is the size of the response bifrost served for the path, if the replay log records it.
+	ExpectedSize int64 `json:",omitempty"`
+}
+
+// requestTimeout returns the timeout for the request to the component, which is the component or executor timeout
+// extended for paths that are expected to be large so that they are read at no less than MinBytesPerSecond.
+func (re *RequestExecutor) requestTimeout(c Component, urls URLsToTest) time.Duration {
+	timeout := re.opts.Timeout
+	if c.Timeout > 0 {
+		timeout = c.Timeout
+	}
+	if re.opts.MinBytesPerSecond > 0 && urls.ExpectedSize > 0 {
+		if d := time.Duration(float64(urls.ExpectedSize) / re.opts.MinBytesPerSecond * float64(time.Second)); d > timeout {
+			timeout = d
+		}
+	}
+	return timeout
+}
+
+// slowRequests returns the requests to the component whose latency is above the cutoff, slowest first. The cutoff
+// is the lower of the SlowThreshold and the SlowPercentile latency of the component, whichever are set. The caller
+// must hold the lock.
+func (re *RequestExecutor) slowRequests(c Component) ([]SlowRequest, time.Duration) {
+	var latencies []time.Duration
+	for _, rs := range re.results {
+		if r := rs[c.Name]; r != nil && r.StatusCode != 0 {
+			latencies = append(latencies, r.Latency)
+		}
+	}
+	if len(latencies) == 0 {
+		return nil, 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	cutoff := re.opts.SlowThreshold
+	if re.opts.SlowPercentile > 0 {
+		if p := percentile(latencies, re.opts.SlowPercentile); cutoff <= 0 || p < cutoff {
+			cutoff = p
+		}
+	}
+
+	var out []SlowRequest
+	for path, rs := range re.results {
+		r := rs[c.Name]
+		if r == nil || r.StatusCode == 0 || r.Latency <= cutoff {
+			continue
+		}
+		out = append(out, SlowRequest{
+			Path:         path,
+			Latency:      r.Latency,
+			StatusCode:   r.StatusCode,
+			ResponseSize: r.ResponseSize,
+			ExpectedSize: re.reqs[path].ExpectedSize,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Latency > out[j].Latency })
+	return out, cutoff
+}
+
+// writeSlowRequests writes the slow requests of every component and prints a summary, if slow requests are
+// reported. The caller must hold the lock.
+func (re *RequestExecutor) writeSlowRequests() {
+	if re.opts.SlowPercentile <= 0 && re.opts.SlowThreshold <= 0 {
+		return
+	}
+
+	fmt.Println("\n ----------SUMMARY OF SLOW REQUESTS --------------")
+	for _, c := range re.components {
+		slow, cutoff := re.slowRequests(c)
+		re.writeJSON(slow, re.rrFile(fmt.Sprintf("%s-slow-requests.json", c.Name)))
+		fmt.Printf("\n Run-%d; %s requests slower than %s: %d", re.n, c.Name, cutoff, len(slow))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,88 @@
+package onion
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"go.uber.org/atomic"
+)
+
+// spiller reads captured response bodies into memory as long as they are small and the memory budget allows it,
+// and spills them to temporary files otherwise. Spilled bodies are memory-mapped so that comparisons can read them
+// like in-memory bodies while the kernel pages them in from disk as needed.
+type spiller struct {
+	// threshold is the size above which bodies are spilled.
+	threshold int64
+	// budget is the total size of the bodies held in memory by all in-flight requests. Zero means unlimited.
+	budget int64
+	dir    string
+
+	inMemory *atomic.Int64
+}
+
+func newSpiller(threshold, budget int64, dir string) *spiller {
+	if threshold <= 0 && budget <= 0 {
+		return nil
+	}
+	if threshold <= 0 || (budget > 0 && threshold > budget) {
+		threshold = budget
+	}
+	return &spiller{threshold: threshold, budget: budget, dir: dir, inMemory: atomic.NewInt64(0)}
+}
+
+// readBody reads the body and returns it along with a func to release it once it is no longer used, after which
+// the returned bytes must not be accessed. spilled is true if the body was spilled to disk.
+func (s *spiller) readBody(r io.Reader) (body []byte, release func(), spilled bool, err error) {
+	noop := func() {}
+	if s == nil {
+		body, err := io.ReadAll(r)
+		return body, noop, false, err
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r, s.threshold+1))
+	if err != nil {
+		return nil, noop, false, err
+	}
+	if n := int64(len(buf)); n <= s.threshold && s.reserve(n) {
+		return buf, func() { s.inMemory.Sub(n) }, false, nil
+	}
+
+	f, err := os.CreateTemp(s.dir, "onion-body-*")
+	if err != nil {
+		return nil, noop, false, fmt.Errorf("failed to create spill file: %w", err)
+	}
+	// the mapping outlives the file
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(buf); err != nil {
+		return nil, noop, false, fmt.Errorf("failed to write spill file: %w", err)
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return nil, noop, false, err
+	}
+	body, release, err = mapFile(f, int64(len(buf))+n)
+	if err != nil {
+		return nil, noop, false, fmt.Errorf("failed to map spill file: %w", err)
+	}
+	return body, release, true, nil
+}
+
+// reserve reserves n bytes of the memory budget. It returns false if the budget does not allow it.
+func (s *spiller) reserve(n int64) bool {
+	if s.budget <= 0 {
+		s.inMemory.Add(n)
+		return true
+	}
+	for {
+		cur := s.inMemory.Load()
+		if cur+n > s.budget {
+			return false
+		}
+		if s.inMemory.CompareAndSwap(cur, cur+n) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package onion
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of the file back into memory on platforms without mmap support, so spilling
+// only bounds memory while the body is being read.
+func mapFile(f *os.File, size int64) ([]byte, func(), error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, size), data); err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
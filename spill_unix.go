@@ -0,0 +1,21 @@
+//go:build unix
+
+package onion
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the first size bytes of the file into memory read-only. The mapping stays valid after the file is
+// closed and removed, until it is released.
+func mapFile(f *os.File, size int64) ([]byte, func(), error) {
+	if size == 0 {
+		return nil, func() {}, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,63 @@
+package onion
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyStats summarises the latencies and throughput of the responses of a component across a run.
+type LatencyStats struct {
+	// Count is the number of requests that got a response.
+	Count int
+	P50   time.Duration
+	P90   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	// BytesPerSecond is the total size of the response bodies read divided by the total latency.
+	BytesPerSecond float64
+}
+
+// componentLatencyStats computes the latency stats of every component over the results of a run.
+func componentLatencyStats(components []Component, results map[string]Results) map[string]LatencyStats {
+	out := make(map[string]LatencyStats, len(components))
+	for _, c := range components {
+		var latencies []time.Duration
+		var total time.Duration
+		var size uint64
+		for _, rs := range results {
+			r := rs[c.Name]
+			if r == nil || r.StatusCode == 0 || r.Cached {
+				continue
+			}
+			latencies = append(latencies, r.Latency)
+			total += r.Latency
+			size += r.ResponseSize
+		}
+
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		s := LatencyStats{
+			Count: len(latencies),
+			P50:   percentile(latencies, 50),
+			P90:   percentile(latencies, 90),
+			P95:   percentile(latencies, 95),
+			P99:   percentile(latencies, 99),
+		}
+		if total > 0 {
+			s.BytesPerSecond = float64(size) / total.Seconds()
+		}
+		out[c.Name] = s
+	}
+	return out
+}
+
+// percentile returns the nearest-rank percentile p of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,81 @@
+package onion
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multibase"
+	"github.com/multiformats/go-multihash"
+)
+
+// URLStyle is how the content path of a request is sent to a component.
+type URLStyle string
+
+const (
+	// URLStylePath sends the content path as the path of the URL, e.g. https://gw/ipfs/{cid}/a.txt.
+	URLStylePath URLStyle = "path"
+	// URLStyleSubdomain sends the root of the content path as a subdomain of the gateway, e.g.
+	// https://{cid}.ipfs.gw/a.txt, as browsers request subdomain gateways.
+	URLStyleSubdomain URLStyle = "subdomain"
+)
+
+// defaultSubdomainHost is the gateway domain of subdomain requests to IP addressed components.
+const defaultSubdomainHost = "localhost"
+
+// subdomainURL turns the path gateway URL into the URL of a subdomain gateway on the domain, e.g. localhost or
+// dweb.link. If the host of the URL is not the domain, e.g. because the component is IP addressed, the URL keeps
+// its host and the subdomain host is returned as the Host header to send instead.
+func subdomainURL(s string, domain string) (out string, host string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse url: %w", err)
+	}
+	ns, root, rest, err := splitContentPath(u.Path)
+	if err != nil {
+		return "", "", err
+	}
+	label, err := subdomainLabel(ns, root)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(rest) == 0 {
+		rest = "/"
+	}
+	u.Path = rest
+	u.RawPath = ""
+	vhost := label + "." + ns + "." + domain
+	if !strings.EqualFold(u.Hostname(), domain) {
+		return u.String(), vhost, nil
+	}
+	u.Host = vhost
+	if port := u.Port(); len(port) != 0 {
+		u.Host = net.JoinHostPort(vhost, port)
+	}
+	return u.String(), "", nil
+}
+
+// subdomainLabel returns the DNS label of the root of a content path on a subdomain gateway: CIDs are
+// case-insensitive base32 CIDv1s, IPNS keys base36 libp2p-key CIDv1s and DNSLink names are inlined into a single
+// label, e.g. en.wikipedia-on-ipfs.org becomes en-wikipedia--on--ipfs-org.
+func subdomainLabel(ns, root string) (string, error) {
+	if ns == "ipfs" {
+		c, err := cid.Decode(root)
+		if err != nil {
+			return "", fmt.Errorf("invalid cid %q: %w", root, err)
+		}
+		return cid.NewCidV1(c.Type(), c.Hash()).String(), nil
+	}
+
+	if c, err := cid.Decode(root); err == nil {
+		return cid.NewCidV1(cid.Libp2pKey, c.Hash()).StringOfBase(multibase.Base36)
+	}
+	// peer IDs that are not CIDs are base58 multihashes, e.g. 12D3KooW...
+	if mh, err := multihash.FromB58String(root); err == nil {
+		return cid.NewCidV1(cid.Libp2pKey, mh).StringOfBase(multibase.Base36)
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(root, "-", "--"), ".", "-"), nil
+}
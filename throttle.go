@@ -0,0 +1,103 @@
+package onion
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultThrottleRetries is the number of times a throttled request is retried after its Retry-After.
+	defaultThrottleRetries = 2
+	// defaultMaxRetryAfter caps the Retry-After of throttled responses that is waited for before retrying.
+	defaultMaxRetryAfter = 30 * time.Second
+)
+
+// isThrottled reports whether the response is a rate limit response: a 429, or a 503 with a Retry-After header, as
+// public gateways send when they shed load.
+func isThrottled(r Result) bool {
+	if r.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return r.StatusCode == http.StatusServiceUnavailable && len(http.Header(r.Headers).Get("Retry-After")) != 0
+}
+
+// retryAfter returns the delay of the Retry-After header of the throttled response, in seconds or as an HTTP date,
+// capped at max. It returns fallback if the response has no valid Retry-After header.
+func retryAfter(r Result, fallback, max time.Duration) time.Duration {
+	d := fallback
+	if v := http.Header(r.Headers).Get("Retry-After"); len(v) != 0 {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			d = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			d = time.Until(t)
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// ThrottleStats counts the rate limit responses of a component.
+type ThrottleStats struct {
+	// Responses is the number of throttled responses, including those that were retried.
+	Responses int
+	// Requests is the number of requests that were throttled at least once, and Recovered the number of those that
+	// succeeded once retried.
+	Requests  int
+	Recovered int
+	// Waited is the time spent waiting for the Retry-After of throttled responses.
+	Waited time.Duration
+	// Paths are the paths that were still throttled after all retries, which are not counted as mismatches.
+	Paths []string `json:",omitempty"`
+}
+
+// throttleStats counts the throttled responses of every component. The caller must hold the lock.
+func (re *RequestExecutor) throttleStats() map[string]*ThrottleStats {
+	out := make(map[string]*ThrottleStats, len(re.components))
+	for _, c := range re.components {
+		out[c.Name] = &ThrottleStats{}
+	}
+	for path, rs := range re.results {
+		for _, c := range re.components {
+			r := rs[c.Name]
+			if r == nil || r.Throttles == 0 {
+				continue
+			}
+			s := out[c.Name]
+			s.Responses += r.Throttles
+			s.Requests++
+			s.Waited += r.ThrottleWait
+			if r.ErrorKind == ErrorThrottled {
+				s.Paths = append(s.Paths, path)
+			} else if isReadOK(r) {
+				s.Recovered++
+			}
+		}
+	}
+	for _, s := range out {
+		sort.Strings(s.Paths)
+	}
+	return out
+}
+
+// writeThrottling writes the throttled responses of every component to throttling.json and prints a summary. The
+// caller must hold the lock.
+func (re *RequestExecutor) writeThrottling() {
+	stats := re.throttleStats()
+	re.writeJSON(stats, re.rrFile("throttling.json"))
+
+	fmt.Println("\n ----------SUMMARY OF THROTTLING --------------")
+	for _, c := range re.components {
+		s := stats[c.Name]
+		fmt.Printf("\n Run-%d; %s throttled %d responses of %d requests, %d recovered after waiting %s in total; %d still throttled",
+			re.n, c.Name, s.Responses, s.Requests, s.Recovered, s.Waited.Round(time.Millisecond), len(s.Paths))
+	}
+	fmt.Println()
+}
@@ -0,0 +1,114 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans of onion.
+const tracerName = "github.com/filecoin-saturn/onion"
+
+// NewTracerProvider returns a tracer provider that batches spans and exports them over OTLP/HTTP to the endpoint,
+// e.g. http://localhost:4318 for a local Jaeger or Tempo. The scheme of the endpoint selects whether spans are
+// exported over TLS, and its path, if any, replaces the default /v1/traces. The provider must be shut down to
+// export the spans that are still batched.
+func NewTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q; expected http(s)://host:port", endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(strings.TrimSuffix(u.Path, "/")) != 0 {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	build := onionBuild()
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "onion"),
+		attribute.String("service.version", build.Version),
+	)
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// newTracer returns the tracer of the executor, which records nothing if no tracer provider is set.
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startPathSpan starts the span of the requests for a path, which the span of every component request is a child
+// of.
+func (re *RequestExecutor) startPathSpan(path string, count int32) (context.Context, trace.Span) {
+	return re.tracer.Start(context.Background(), "path", trace.WithAttributes(
+		attribute.String("onion.path", path),
+		attribute.Int("onion.request", int(count)),
+		attribute.Int("onion.run", re.n),
+		attribute.String("onion.run_id", re.id.String()),
+	))
+}
+
+// startRequestSpan starts the span of a request to the component, including its retries.
+func (re *RequestExecutor) startRequestSpan(ctx context.Context, c Component, urls URLsToTest) (context.Context, trace.Span) {
+	method := urls.Method
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("onion.component", c.Name),
+		attribute.String("http.method", method),
+		attribute.String("http.url", urls.URLs[c.Name]),
+	}
+	// the variants of a request to the same component are told apart by the headers they are sent with
+	for _, h := range []string{"Accept-Encoding", "If-None-Match"} {
+		if v := urls.Headers[c.Name].Get(h); len(v) != 0 {
+			attrs = append(attrs, attribute.String("http.request.header."+strings.ToLower(h), v))
+		}
+	}
+	return re.tracer.Start(ctx, c.Name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endRequestSpan records the outcome of the request in its span and ends it.
+func endRequestSpan(span trace.Span, r Result) {
+	span.SetAttributes(
+		attribute.Int("http.status_code", r.StatusCode),
+		attribute.Int64("onion.response_size", int64(r.ResponseSize)),
+		attribute.Int("onion.retries", r.Retries),
+		attribute.String("onion.request_id", r.RequestID),
+	)
+	if len(r.ErrorKind) != 0 {
+		span.SetAttributes(attribute.String("onion.error_kind", string(r.ErrorKind)))
+	}
+	switch {
+	case len(r.ResponseBodyReadError) != 0:
+		span.SetStatus(codes.Error, r.ResponseBodyReadError)
+	case r.StatusCode == 0 && len(r.ErrorBody) != 0:
+		span.SetStatus(codes.Error, r.ErrorBody)
+	}
+	span.End()
+}
+
+// injectTraceContext sets the traceparent header of the request to that of the span of its context, if it is
+// traced, so that the spans of the layers are children of the span of the request.
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
@@ -0,0 +1,134 @@
+package onion
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// TransferFraming is how the end of a response body is delimited.
+type TransferFraming string
+
+const (
+	// FramingContentLength is a body of the length advertised by its Content-Length.
+	FramingContentLength TransferFraming = "content-length"
+	// FramingChunked is an HTTP/1.1 body sent in chunks, which ends with an empty chunk.
+	FramingChunked TransferFraming = "chunked"
+	// FramingClose is an HTTP/1.x body without a Content-Length that ends when the connection is closed, so that a
+	// truncated body can not be told apart from a complete one.
+	FramingClose TransferFraming = "close"
+	// FramingStream is an HTTP/2 body without a Content-Length, which ends with the end of its stream.
+	FramingStream TransferFraming = "stream"
+)
+
+// TransferDiscrepancy is how a response body does not match its framing.
+type TransferDiscrepancy string
+
+const (
+	// TransferShort is a body that ended before its Content-Length was read.
+	TransferShort TransferDiscrepancy = "short"
+	// TransferLong is a body longer than its Content-Length.
+	TransferLong TransferDiscrepancy = "long"
+	// TransferChunkedTruncated is a chunked body that ended without its final empty chunk, e.g. because the server
+	// closed the connection when its upstream failed.
+	TransferChunkedTruncated TransferDiscrepancy = "chunked-truncated"
+)
+
+// TransferDiscrepancies are the kinds of transfer discrepancies, in the order they are summarised in.
+var TransferDiscrepancies = []TransferDiscrepancy{TransferShort, TransferLong, TransferChunkedTruncated}
+
+// TransferReport records how the body of a 2xx response was framed and how much of it was read, so that bodies
+// that do not match their advertised length are reported as such rather than as byte mismatches.
+type TransferReport struct {
+	Framing TransferFraming
+	// ContentLength is the advertised Content-Length of the body, or -1 if it was not advertised.
+	ContentLength int64
+	// BodyBytes is the number of bytes of the body that were read, before its Content-Encoding, if any, was
+	// decoded.
+	BodyBytes uint64
+	// Complete is true if the body was read to its end as delimited by its framing.
+	Complete bool
+	// Discrepancy is set if the body does not match its framing.
+	Discrepancy TransferDiscrepancy `json:",omitempty"`
+}
+
+// newTransferReport returns how the body of the response was framed and how much of it was read.
+func newTransferReport(resp *http.Response, read *readRecorder) *TransferReport {
+	t := &TransferReport{ContentLength: resp.ContentLength, BodyBytes: read.n, Complete: read.eof && read.err == nil}
+	switch {
+	case resp.ContentLength >= 0:
+		t.Framing = FramingContentLength
+	case isChunked(resp):
+		t.Framing = FramingChunked
+	case resp.ProtoMajor >= 2:
+		t.Framing = FramingStream
+	default:
+		t.Framing = FramingClose
+	}
+
+	switch {
+	case errors.Is(read.err, io.ErrUnexpectedEOF) && t.Framing == FramingChunked:
+		t.Discrepancy = TransferChunkedTruncated
+	case errors.Is(read.err, io.ErrUnexpectedEOF) && t.Framing == FramingContentLength && read.n < uint64(resp.ContentLength):
+		t.Discrepancy = TransferShort
+	// HTTP/2 bodies that are longer than their Content-Length are cut off at it with this error
+	case read.err != nil && strings.Contains(read.err.Error(), "more than declared Content-Length"):
+		t.Discrepancy = TransferLong
+	case t.Complete && t.Framing == FramingContentLength && read.n < uint64(resp.ContentLength):
+		t.Discrepancy = TransferShort
+	case t.Complete && t.Framing == FramingContentLength && read.n > uint64(resp.ContentLength):
+		t.Discrepancy = TransferLong
+	}
+	return t
+}
+
+// isChunked reports whether the body of the response was sent with chunked transfer encoding.
+func isChunked(resp *http.Response) bool {
+	for _, te := range resp.TransferEncoding {
+		if strings.EqualFold(te, "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkedTruncation describes a chunked response body that ended without its final chunk. Such bodies are truncated
+// rather than failed reads, whether or not what was read of them could be decoded or extracted.
+func chunkedTruncation(read uint64) string {
+	return fmt.Sprintf("response body is truncated: its chunked transfer ended without its final chunk after %d bytes", read)
+}
+
+// writeTransferDiscrepancies writes the responses of every component that do not match their framing and prints a
+// summary of the framing of the responses of every component. The caller must hold the lock.
+func (re *RequestExecutor) writeTransferDiscrepancies() {
+	fmt.Println("\n ----------SUMMARY OF TRANSFER SIZES --------------")
+	for _, c := range re.components {
+		framings := make(map[TransferFraming]int)
+		for _, rs := range re.results {
+			if r := rs[c.Name]; r != nil && r.Transfer != nil {
+				framings[r.Transfer.Framing]++
+			}
+		}
+		reads := re.responseReads.Components[c.Name]
+		re.writeJSON(reads.TransferDiscrepancies, re.rrFile(fmt.Sprintf("%s-transfer-discrepancies.json", c.Name)))
+
+		byKind := make(map[TransferDiscrepancy]int)
+		for _, t := range reads.TransferDiscrepancies {
+			byKind[t.Discrepancy]++
+		}
+		var kinds []string
+		for _, kind := range TransferDiscrepancies {
+			if byKind[kind] != 0 {
+				kinds = append(kinds, fmt.Sprintf("%s: %d", kind, byKind[kind]))
+			}
+		}
+		fmt.Printf("\n Run-%d; %s responses with content-length: %d, chunked: %d, close-delimited: %d, http/2 stream: %d",
+			re.n, c.Name, framings[FramingContentLength], framings[FramingChunked], framings[FramingClose],
+			framings[FramingStream])
+		fmt.Printf("\n Run-%d; %s responses that do not match their framing: %d %v", re.n, c.Name,
+			len(reads.TransferDiscrepancyPaths), kinds)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,409 @@
+package onion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Analyzer names an analyzer of the triage pipeline, which contributes its findings about the mismatches of a run
+// to their records.
+type Analyzer string
+
+const (
+	// AnalyzerCidContact looks up the providers of the root CIDs of the mismatched paths on cid.contact and
+	// classifies them with the ProviderRules. It contributes Mismatch.CidContact and the provider summaries of
+	// every pair or layer.
+	AnalyzerCidContact Analyzer = "cid-contact"
+	// AnalyzerProviderDial probes the providers of the root CIDs of the mismatched paths with the Prober, which
+	// defaults to a BitswapProber. It contributes Mismatch.Probe and Mismatch.Diagnosis.
+	AnalyzerProviderDial Analyzer = "provider-dial"
+	// AnalyzerDagDiff diffs mismatched CARs and locates the blocks of the layer in the DAG of the reference. It
+	// contributes Mismatch.CarDiff and Mismatch.Provenance, and runs as the responses are compared, while their
+	// bodies are captured.
+	AnalyzerDagDiff Analyzer = "dag-diff"
+	// AnalyzerRefetch requests the mismatched paths again after the delay of its step to tell persistent mismatches
+	// from transient ones. It contributes Mismatch.Persistence.
+	AnalyzerRefetch Analyzer = "re-fetch"
+)
+
+// TriageCategory is a category of mismatches that an analyzer is applied to: one of the kinds of mismatches between
+// the components of a pair, or the responses a layer failed to read.
+type TriageCategory string
+
+const (
+	TriageStatus       = TriageCategory(MismatchStatus)
+	TriageBytes        = TriageCategory(MismatchBytes)
+	TriageHeaders      = TriageCategory(MismatchHeaders)
+	TriageRedirects    = TriageCategory(MismatchRedirects)
+	TriageVerification = TriageCategory(MismatchVerification)
+	TriageReadErrors   = TriageCategory("read-errors")
+)
+
+// analyzerCategories are the categories every analyzer can be applied to, which it is applied to by default.
+var analyzerCategories = map[Analyzer][]TriageCategory{
+	AnalyzerCidContact:   {TriageStatus, TriageBytes, TriageHeaders, TriageRedirects, TriageVerification, TriageReadErrors},
+	AnalyzerProviderDial: {TriageStatus, TriageBytes, TriageHeaders, TriageRedirects, TriageVerification, TriageReadErrors},
+	// only the bodies of byte mismatches are compared
+	AnalyzerDagDiff: {TriageBytes},
+	// only status and byte mismatches can be compared again
+	AnalyzerRefetch: {TriageStatus, TriageBytes},
+}
+
+// TriageStep applies an analyzer to categories of mismatches.
+type TriageStep struct {
+	Analyzer Analyzer `toml:"analyzer"`
+	// Categories are the categories of mismatches the analyzer is applied to. Defaults to every category the
+	// analyzer can be applied to.
+	Categories []TriageCategory `toml:"categories"`
+	// Delay is how long the re-fetch analyzer waits before requesting the paths again, e.g. "5m".
+	Delay string `toml:"delay"`
+}
+
+// Validate checks that the step is well-formed.
+func (s TriageStep) Validate() error {
+	supported, ok := analyzerCategories[s.Analyzer]
+	if !ok {
+		return fmt.Errorf("invalid triage step: unknown analyzer %q", s.Analyzer)
+	}
+	for _, c := range s.Categories {
+		if !containsCategory(supported, c) {
+			return fmt.Errorf("invalid triage step %s: can not be applied to %q", s.Analyzer, c)
+		}
+	}
+	if len(s.Delay) != 0 {
+		if s.Analyzer != AnalyzerRefetch {
+			return fmt.Errorf("invalid triage step %s: only re-fetch has a delay", s.Analyzer)
+		}
+		if d, err := time.ParseDuration(s.Delay); err != nil || d < 0 {
+			return fmt.Errorf("invalid triage step %s: invalid delay %q", s.Analyzer, s.Delay)
+		}
+	}
+	return nil
+}
+
+func (s TriageStep) categories() []TriageCategory {
+	if len(s.Categories) == 0 {
+		return analyzerCategories[s.Analyzer]
+	}
+	return s.Categories
+}
+
+func (s TriageStep) delay() time.Duration {
+	d, _ := time.ParseDuration(s.Delay)
+	return d
+}
+
+func containsCategory(categories []TriageCategory, c TriageCategory) bool {
+	for _, cc := range categories {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultTriage is the triage pipeline of runs that do not configure one: the providers of status mismatches and
+// read errors are looked up on cid.contact and mismatched CARs are diffed, and, if reverifyAfter is set, status and
+// byte mismatches are fetched again after it and, if probe is set, their providers are probed.
+func DefaultTriage(reverifyAfter time.Duration, probe bool) []TriageStep {
+	steps := []TriageStep{{Analyzer: AnalyzerDagDiff}}
+	if reverifyAfter > 0 {
+		steps = append(steps, TriageStep{Analyzer: AnalyzerRefetch, Delay: reverifyAfter.String()})
+	}
+	if probe {
+		steps = append(steps, TriageStep{Analyzer: AnalyzerProviderDial, Categories: []TriageCategory{TriageStatus, TriageBytes}})
+	}
+	return append(steps, TriageStep{Analyzer: AnalyzerCidContact, Categories: []TriageCategory{TriageStatus, TriageReadErrors}})
+}
+
+// triages reports whether the analyzer is applied to the category by any step of the pipeline.
+func (opts ExecutorOptions) triages(a Analyzer, c TriageCategory) bool {
+	for _, s := range opts.Triage {
+		if s.Analyzer == a && containsCategory(s.categories(), c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Triage applies the analyzers of the triage pipeline to the mismatches of the run, in the order of its steps. The
+// results of the run are not changed.
+func (re *RequestExecutor) Triage(ctx context.Context) {
+	for _, s := range re.opts.Triage {
+		switch s.Analyzer {
+		case AnalyzerRefetch:
+			re.reverify(s.delay(), s.categories())
+		case AnalyzerProviderDial:
+			re.probeMismatches(ctx, s.categories())
+		case AnalyzerCidContact:
+			re.lookUpMismatches(ctx, s.categories())
+		}
+		// mismatched CARs are diffed as they are compared, as their bodies are released afterwards
+	}
+}
+
+// mismatchPaths returns the sorted paths of the mismatches of the category keyed by pair name, or by component name
+// for read errors. The caller must hold the lock.
+func (re *RequestExecutor) mismatchPaths(c TriageCategory) map[string][]string {
+	out := make(map[string][]string)
+	if c == TriageReadErrors {
+		for _, comp := range re.components {
+			if paths := re.responseReads.Components[comp.Name].ReadErrorPaths; len(paths) != 0 {
+				out[comp.Name] = append([]string(nil), paths...)
+				sort.Strings(out[comp.Name])
+			}
+		}
+		return out
+	}
+	if c == TriageStatus {
+		_, paths := re.statusMismatches()
+		for name, ps := range paths {
+			if len(ps) != 0 {
+				out[name] = append([]string(nil), ps...)
+				sort.Strings(out[name])
+			}
+		}
+		return out
+	}
+	for _, p := range re.pairs {
+		var paths []string
+		for path := range re.mismatchRecords(c, p) {
+			paths = append(paths, path)
+		}
+		if len(paths) != 0 {
+			sort.Strings(paths)
+			out[p.Name()] = paths
+		}
+	}
+	return out
+}
+
+// mismatchRecords returns the mismatch records of the category for the pair, keyed by path, or nil for status
+// mismatches and read errors, whose records are only made when they are written, from the outputs of triage keyed
+// by path. The caller must hold the lock.
+func (re *RequestExecutor) mismatchRecords(c TriageCategory, p Pair) map[string]*Mismatch {
+	pm := re.responseReads.Pairs[p.Name()]
+	switch c {
+	case TriageBytes:
+		return pm.Mismatches
+	case TriageHeaders:
+		return pm.HeaderMismatches
+	case TriageRedirects:
+		return pm.RedirectMismatches
+	case TriageVerification:
+		return pm.VerificationMismatches
+	}
+	return nil
+}
+
+// ReadError is a 2xx response whose body could not be read, along with what triage found out about the root CID of
+// its path.
+type ReadError struct {
+	Result *Result
+	// Probe and Diagnosis are whether the root CID could be retrieved from its providers, if they were probed, and
+	// CidContact what cid.contact knows about it, if it was looked up.
+	Probe      *ProbeReport      `json:",omitempty"`
+	Diagnosis  *ProbeDiagnosis   `json:",omitempty"`
+	CidContact *CidContactLookup `json:",omitempty"`
+}
+
+// readErrorRecords returns the read errors of the component, keyed by path, along with what triage found out about
+// them. The caller must hold the lock.
+func (re *RequestExecutor) readErrorRecords(c Component) map[string]*ReadError {
+	reads := re.responseReads.Components[c.Name]
+	out := make(map[string]*ReadError, len(reads.ReadErrors))
+	for path, r := range reads.ReadErrors {
+		out[path] = &ReadError{Result: r, Probe: re.probes[path], Diagnosis: re.diagnoses[path], CidContact: re.lookups[path]}
+	}
+	return out
+}
+
+// triagePaths returns the distinct paths of the mismatches of the categories. The caller must hold the lock.
+func (re *RequestExecutor) triagePaths(categories []TriageCategory) []string {
+	var paths []string
+	seen := make(map[string]struct{})
+	for _, c := range categories {
+		byKey := re.mismatchPaths(c)
+		keys := make([]string, 0, len(byKey))
+		for k := range byKey {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, path := range byKey[k] {
+				if _, ok := seen[path]; !ok {
+					seen[path] = struct{}{}
+					paths = append(paths, path)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// CidContactLookup is what cid.contact knows about the root CID of a mismatched path.
+type CidContactLookup struct {
+	Cid    string
+	Status int `json:",omitempty"`
+	// ProviderCount is the number of providers of the CID, and Providers the names of the rules that match them.
+	ProviderCount int      `json:",omitempty"`
+	Providers     []string `json:",omitempty"`
+	// Error is set if the CID could not be looked up.
+	Error string `json:",omitempty"`
+}
+
+// lookUpMismatches classifies the mismatches of every pair, or the read errors of every layer, of the categories by
+// the providers of their CIDs on cid.contact, and contributes the lookup of every path to its mismatch records.
+func (re *RequestExecutor) lookUpMismatches(ctx context.Context, categories []TriageCategory) {
+	re.mu.Lock()
+	byCategory := make(map[TriageCategory]map[string][]string, len(categories))
+	for _, c := range categories {
+		byCategory[c] = re.mismatchPaths(c)
+	}
+	paths := re.triagePaths(categories)
+	re.mu.Unlock()
+
+	klm := re.cidContactChecker()
+	lookups := klm.lookupAll(ctx, paths, re.contentPaths(paths))
+	if err := klm.Cache.Save(); err != nil {
+		re.log.Error("failed to save cid.contact cache", "err", err)
+	}
+	summaries := make(map[TriageCategory]map[string]CidContactSummary, len(categories))
+	for _, c := range categories {
+		summaries[c] = make(map[string]CidContactSummary)
+		for key, ps := range byCategory[c] {
+			summaries[c][key] = summarizeLookups(ps, lookups)
+		}
+	}
+
+	re.mu.Lock()
+	defer re.mu.Unlock()
+	if re.cidContact == nil {
+		re.cidContact = make(map[TriageCategory]map[string]CidContactSummary)
+		re.lookups = make(map[string]*CidContactLookup)
+	}
+	for c, byKey := range summaries {
+		re.cidContact[c] = byKey
+	}
+	for path, l := range lookups {
+		re.lookups[path] = l
+	}
+	for _, c := range categories {
+		for _, p := range re.pairs {
+			for path, m := range re.mismatchRecords(c, p) {
+				m.CidContact = re.lookups[path]
+			}
+		}
+	}
+}
+
+// cidContactChecker returns a checker that shares the cache and provider rules of the run.
+func (re *RequestExecutor) cidContactChecker() *CidContactChecker {
+	klm := NewCidContactChecker(nil)
+	klm.Cache = re.opts.CidContactCache
+	if re.opts.ProviderRules != nil {
+		klm.Rules = re.opts.ProviderRules
+	}
+	return klm
+}
+
+// lookup looks up the root CID of the path and classifies its providers.
+func (klm *CidContactChecker) lookup(ctx context.Context, path string) *CidContactLookup {
+	root, err := ParseCidFromPath(path)
+	if err != nil {
+		return &CidContactLookup{Error: err.Error()}
+	}
+	l := &CidContactLookup{Cid: root}
+	cc, err := klm.getWithRetries(ctx, root)
+	if err != nil {
+		l.Error = err.Error()
+		return l
+	}
+	l.Status = cc.Status
+	if cc.Status != http.StatusNotFound {
+		l.ProviderCount = len(cc.Records)
+		l.Providers = classify(klm.Rules, cc.Records)
+	}
+	return l
+}
+
+// lookupAll looks up the root CIDs of the paths, which are looked up by their content paths, using a pool of workers,
+// and returns the lookups keyed by path.
+func (klm *CidContactChecker) lookupAll(ctx context.Context, paths, contentPaths []string) map[string]*CidContactLookup {
+	out := make(map[string]*CidContactLookup, len(paths))
+	var mu sync.Mutex
+	idx := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < klm.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				l := klm.lookup(ctx, contentPaths[i])
+				mu.Lock()
+				out[paths[i]] = l
+				mu.Unlock()
+			}
+		}()
+	}
+loop:
+	for i := range paths {
+		select {
+		case idx <- i:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(idx)
+	wg.Wait()
+	return out
+}
+
+// summarizeLookups classifies the paths by their lookups as Check does.
+func summarizeLookups(paths []string, lookups map[string]*CidContactLookup) CidContactSummary {
+	sum := CidContactSummary{Providers: make(map[string]int)}
+	for _, path := range paths {
+		l := lookups[path]
+		switch {
+		case l == nil || len(l.Error) != 0:
+			sum.LookupErrors++
+		case l.Status == http.StatusNotFound:
+			sum.NotFoundOnCidContact++
+		case len(l.Providers) == 0:
+			sum.Others++
+		}
+		if l != nil {
+			for _, name := range l.Providers {
+				sum.Providers[name]++
+			}
+		}
+	}
+	return sum
+}
+
+// printCidContactSummary prints the cid.contact summary of the mismatches of the category for the pair or layer, if
+// they were looked up, and writes it to the file in the response reads directory. The caller must hold the lock.
+func (re *RequestExecutor) printCidContactSummary(c TriageCategory, key, file string) {
+	byKey, ok := re.cidContact[c]
+	if !ok {
+		return
+	}
+	sum, ok := byKey[key]
+	if !ok {
+		sum = CidContactSummary{Providers: make(map[string]int)}
+	}
+	sum.Print()
+	re.writeJSON(sum, re.rrFile(file))
+}
+
+// writeTriage writes the cid.contact lookups of the mismatched paths, if they were looked up. The caller must hold
+// the lock.
+func (re *RequestExecutor) writeTriage() {
+	if re.lookups != nil {
+		re.writeJSON(re.lookups, "cid-contact-lookups.json")
+	}
+}
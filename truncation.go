@@ -0,0 +1,149 @@
+package onion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	car "github.com/ipld/go-car/v2"
+)
+
+// setReadError records the error that the response body failed to be read with. Bodies that ended before their
+// Content-Length was read are truncated rather than failed reads.
+func (r *Result) setReadError(resp *http.Response, read uint64, err error) {
+	if msg := contentLengthTruncation(resp, read, err); len(msg) != 0 {
+		r.setTruncated(msg)
+		return
+	}
+	r.ResponseBodyReadError = fmt.Sprintf("error reading response body: %s", err.Error())
+	r.ErrorKind = errorKind(err, true)
+}
+
+// setCarReadError records the error that reading the body failed with, as the truncation of the CAR that the framer
+// followed if the body ended unexpectedly within a section, e.g. because a chunked response was cut off. framer may
+// be nil for bodies that are not CARs.
+func (r *Result) setCarReadError(resp *http.Response, read uint64, err error, framer *carFramer) {
+	r.setReadError(resp, read, err)
+	if framer != nil && errors.Is(err, io.ErrUnexpectedEOF) {
+		r.setTruncated(framer.truncation())
+	}
+}
+
+// setTruncated records that the response body is truncated, if the truncation is not empty. Truncated bodies are
+// not compared and are retried like bodies that failed to be read.
+func (r *Result) setTruncated(truncation string) {
+	if len(truncation) == 0 {
+		return
+	}
+	r.ResponseBodyReadError = truncation
+	r.ErrorKind = ErrorTruncated
+}
+
+// contentLengthTruncation describes a response body that ended before its Content-Length was read, if it did.
+func contentLengthTruncation(resp *http.Response, read uint64, err error) string {
+	if !errors.Is(err, io.ErrUnexpectedEOF) || resp.ContentLength < 0 || read >= uint64(resp.ContentLength) {
+		return ""
+	}
+	return fmt.Sprintf("response body is truncated: read %d of its %d bytes Content-Length", read, resp.ContentLength)
+}
+
+// carFramer follows the sections of a CAR as it is written to it to tell whether the CAR is complete, i.e. whether
+// it does not end within a block. Responses whose body ended cleanly, e.g. because a chunked response was cut off
+// by the server, would otherwise only surface as byte mismatches.
+type carFramer struct {
+	n uint64
+	// prefix is the CARv2 pragma and header, if the CAR is long enough.
+	prefix []byte
+
+	// remaining is the number of bytes of the current section that have not been written yet. Otherwise, the
+	// varint length of the next section is being read.
+	remaining  uint64
+	length     uint64
+	shift      uint
+	varintRead int
+}
+
+func (f *carFramer) Write(p []byte) (int, error) {
+	if need := car.PragmaSize + car.HeaderSize - len(f.prefix); need > 0 {
+		if need > len(p) {
+			need = len(p)
+		}
+		f.prefix = append(f.prefix, p[:need]...)
+	}
+	f.n += uint64(len(p))
+
+	for b := p; len(b) > 0; {
+		if f.remaining > 0 {
+			skip := uint64(len(b))
+			if skip > f.remaining {
+				skip = f.remaining
+			}
+			f.remaining -= skip
+			b = b[skip:]
+			continue
+		}
+		c := b[0]
+		b = b[1:]
+		f.varintRead++
+		if f.shift < 64 {
+			f.length |= uint64(c&0x7f) << f.shift
+		}
+		if c&0x80 != 0 {
+			f.shift += 7
+			continue
+		}
+		f.remaining = f.length
+		f.length, f.shift, f.varintRead = 0, 0, 0
+	}
+	return len(p), nil
+}
+
+// truncation describes how the CAR is truncated, if it is. Empty bodies are not CARs and are not truncated.
+func (f *carFramer) truncation() string {
+	if f.n == 0 {
+		return ""
+	}
+	if len(f.prefix) >= car.PragmaSize && bytes.Equal(f.prefix[:car.PragmaSize], car.Pragma) {
+		return f.carV2Truncation()
+	}
+	switch {
+	case f.remaining > 0:
+		return fmt.Sprintf("car is truncated: its last section is missing %d bytes", f.remaining)
+	case f.varintRead > 0:
+		return "car is truncated: it ends within the length of a section"
+	}
+	return ""
+}
+
+// carV2Truncation describes how the CARv2 is truncated, if it is, i.e. if it ends before the end of its data
+// payload or before the start of its index.
+func (f *carFramer) carV2Truncation() string {
+	if len(f.prefix) < car.PragmaSize+car.HeaderSize {
+		return fmt.Sprintf("car is truncated: it ends within its %d bytes carv2 header", car.PragmaSize+car.HeaderSize)
+	}
+	var h car.Header
+	if _, err := h.ReadFrom(bytes.NewReader(f.prefix[car.PragmaSize:])); err != nil {
+		// malformed headers are reported by the verification of the index
+		return ""
+	}
+	switch {
+	case f.n < h.DataOffset+h.DataSize:
+		return fmt.Sprintf("car is truncated: its data payload ends at byte %d but the car is %d bytes", h.DataOffset+h.DataSize, f.n)
+	case h.HasIndex() && f.n <= h.IndexOffset:
+		return fmt.Sprintf("car is truncated: its index starts at byte %d but the car is %d bytes", h.IndexOffset, f.n)
+	}
+	return ""
+}
+
+// writeTruncations prints a summary of the truncated responses of every component. The caller must hold the lock.
+func (re *RequestExecutor) writeTruncations() {
+	fmt.Println("\n ----------SUMMARY OF TRUNCATED RESPONSES --------------")
+	for _, c := range re.components {
+		reads := re.responseReads.Components[c.Name]
+		re.writeJSON(reads.Truncated, re.rrFile(fmt.Sprintf("%s-truncated-responses.json", c.Name)))
+		fmt.Printf("\n Run-%d; %s returned 200 but truncated responses for %d requests", re.n, c.Name, len(reads.TruncatedPaths))
+	}
+	fmt.Println()
+}
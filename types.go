@@ -1,12 +1,64 @@
 package onion
 
+import (
+	"net/http"
+	"time"
+)
+
 type URLsToTest struct {
 	Path string
+	// Key is the key of the request among the requests of a run and in its results, which is Path unless requests
+	// are deduplicated by more than their path, e.g. "/ipfs/{cid}?dag-scope=entity" with replay.DedupURL.
+	Key string
+	// ResolvedPath is the /ipfs/ path that an /ipns/ Path was resolved to, if it was resolved.
+	ResolvedPath string
+
+	// URLs maps a component name to the URL to send to that component.
+	URLs map[string]string
+
+	// Method is the HTTP method of the original request. Defaults to GET.
+	Method string
+	// Headers maps a component name to the headers of the original request to send to that component.
+	Headers map[string]http.Header
+	// Body is the body of the original request, if any.
+	Body []byte
+
+	// Range is the byte range requested by the original request, if any.
+	Range *ByteRange
+	// ExpectedSize is the size of the response bifrost served for the path, if known, from which a longer timeout
+	// is derived for large paths.
+	ExpectedSize int64
+	// Replay is what the replay log records about the original request, if anything, against which the responses
+	// are compared.
+	Replay *ReplayMetadata
+	// Offset is when the original request was received relative to the first request of the replay log, if the log
+	// records when requests were received. Paths are sent at their offset when the replay is paced.
+	Offset time.Duration
 
-	Lassie    string
-	L1Shim    string
-	L1Nginx   string
-	KuboGWUrl string
+	// RawBlock is set if the original request asked for a single raw block rather than a CAR or file bytes.
+	RawBlock bool
+	// Variant is the gateway variant of a replayed path that the path is, if it is one.
+	Variant GatewayVariant
+}
+
+// key returns the key of the request, which defaults to its path.
+func (o URLsToTest) key() string {
+	if len(o.Key) != 0 {
+		return o.Key
+	}
+	return o.Path
+}
 
-	BifrostURL string
+// subpath returns the path of the requested entity below the root of its content path, e.g. "/dir/file.png" for
+// /ipfs/{cid}/dir/file.png, or "" if the root itself is requested.
+func (o URLsToTest) subpath() string {
+	path := o.Path
+	if len(o.ResolvedPath) != 0 {
+		path = o.ResolvedPath
+	}
+	_, _, rest, err := splitContentPath(path)
+	if err != nil {
+		return ""
+	}
+	return rest
 }
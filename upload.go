@@ -0,0 +1,357 @@
+package onion
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// defaultUploadConcurrency is the number of files uploaded at once by default.
+	defaultUploadConcurrency = 4
+	// uploadAttempts is the number of times the upload of a file is attempted on transient errors.
+	uploadAttempts = 3
+	// gcsEndpoint is the endpoint of the XML API of GCS, which accepts S3 requests signed with HMAC keys.
+	gcsEndpoint = "https://storage.googleapis.com"
+)
+
+// UploadConfig configures uploading the results directory of every run to an S3 or GCS bucket once the run is
+// complete, so that the results of runs on ephemeral machines are not lost.
+type UploadConfig struct {
+	// URL is the bucket and the prefix to upload to, e.g. s3://bucket/onion or gs://bucket/onion. The results of a
+	// run are uploaded under its run ID, e.g. s3://bucket/onion/<run_id>/results.json.
+	URL string
+	// Endpoint is the base URL of an S3 compatible object store to upload to instead, e.g. http://127.0.0.1:9000 for
+	// MinIO. Objects are addressed by path on it.
+	Endpoint string
+	// Region is the region of the bucket. Defaults to us-east-1 for S3 and to auto for GCS.
+	Region string
+	// AccessKeyID, SecretAccessKey and SessionToken sign the uploads. GCS buckets are uploaded to with HMAC keys
+	// of a service account.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Store also uploads a snapshot of the result store of the run, if it has one, as store.db.
+	Store bool
+	// Concurrency is the number of files uploaded at once. Defaults to 4.
+	Concurrency int
+	// Client sends the uploads. Defaults to a client with a timeout of 10 minutes.
+	Client *http.Client
+}
+
+// Validate checks that the bucket URL and the credentials are set.
+func (u *UploadConfig) Validate() error {
+	_, _, err := u.bucket()
+	if err != nil {
+		return err
+	}
+	if len(u.AccessKeyID) == 0 || len(u.SecretAccessKey) == 0 {
+		return fmt.Errorf("uploading to %s requires an access key ID and a secret access key", u.URL)
+	}
+	if len(u.Endpoint) != 0 {
+		if e, err := url.Parse(u.Endpoint); err != nil || (e.Scheme != "http" && e.Scheme != "https") || len(e.Host) == 0 {
+			return fmt.Errorf("invalid upload endpoint %q", u.Endpoint)
+		}
+	}
+	return nil
+}
+
+// bucket returns the bucket and the key prefix of the URL.
+func (u *UploadConfig) bucket() (string, string, error) {
+	b, err := url.Parse(u.URL)
+	if err != nil || (b.Scheme != "s3" && b.Scheme != "gs") || len(b.Host) == 0 {
+		return "", "", fmt.Errorf("invalid upload url %q: must be s3://<bucket>/<prefix> or gs://<bucket>/<prefix>", u.URL)
+	}
+	return b.Host, strings.Trim(b.Path, "/"), nil
+}
+
+func (u *UploadConfig) client() *http.Client {
+	if u.Client != nil {
+		return u.Client
+	}
+	return &http.Client{Timeout: 10 * time.Minute}
+}
+
+// objectURL returns the URL of the object with the key in the bucket. Buckets on AWS are addressed by host, and
+// those of GCS and other endpoints by path.
+func (u *UploadConfig) objectURL(bucket, key string) (string, string) {
+	region := u.Region
+	endpoint := strings.TrimSuffix(u.Endpoint, "/")
+	switch {
+	case len(endpoint) != 0:
+	case strings.HasPrefix(u.URL, "gs://"):
+		endpoint = gcsEndpoint
+		if len(region) == 0 {
+			region = "auto"
+		}
+	default:
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", bucket, region, uriEncode(key, false)), region
+	}
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	return fmt.Sprintf("%s/%s/%s", endpoint, bucket, uriEncode(key, false)), region
+}
+
+// Upload is an uploaded file.
+type Upload struct {
+	// File is the local file, and URL the object it was uploaded to.
+	File  string
+	URL   string
+	Size  int64
+	Error string `json:",omitempty"`
+}
+
+// UploadRun uploads the files of the results directory of the run under the ID of the run, along with the
+// index.json manifest of the results directory and, if Store is set, a snapshot of the store. Failing to upload a
+// file does not stop the others from being uploaded; the first error is returned along with the outcome of every
+// file.
+func (u *UploadConfig) UploadRun(ctx context.Context, resultsDir, dir string, runID string, store *ResultStore) ([]Upload, error) {
+	bucket, prefix, err := u.bucket()
+	if err != nil {
+		return nil, err
+	}
+	prefix = path.Join(prefix, runID)
+
+	type file struct{ local, key string }
+	var files []file
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		// the checkpoint of a complete run is only needed to resume it on this machine
+		if name := info.Name(); name == checkpointFile || name == checkpointFile+".tmp" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{p, path.Join(prefix, filepath.ToSlash(rel))})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if index := filepath.Join(resultsDir, runIndexFile); isFile(index) {
+		files = append(files, file{index, path.Join(prefix, runIndexFile)})
+	}
+	if u.Store && store != nil {
+		snapshot, err := store.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(snapshot)
+		files = append(files, file{snapshot, path.Join(prefix, "store.db")})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].key < files[j].key })
+
+	concurrency := u.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+	out := make([]Upload, len(files))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, f file) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			objectURL, region := u.objectURL(bucket, f.key)
+			size, err := u.put(ctx, f.local, objectURL, region)
+			out[i] = Upload{File: f.local, URL: objectURL, Size: size}
+			if err != nil {
+				out[i].Error = err.Error()
+			}
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, up := range out {
+		if len(up.Error) != 0 {
+			return out, fmt.Errorf("failed to upload %s: %s", up.File, up.Error)
+		}
+	}
+	return out, nil
+}
+
+// isFile reports whether the file exists and is a regular file.
+func isFile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// put uploads the file to the object, retrying transient errors.
+func (u *UploadConfig) put(ctx context.Context, file, objectURL, region string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	payloadHash := hex.EncodeToString(h.Sum(nil))
+
+	for attempt := 1; ; attempt++ {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return size, err
+		}
+		var body io.Reader = http.NoBody
+		if size != 0 {
+			body = io.NopCloser(f)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL, body)
+		if err != nil {
+			return size, err
+		}
+		req.ContentLength = size
+		if ct := mime.TypeByExtension(path.Ext(objectURL)); len(ct) != 0 {
+			req.Header.Set("Content-Type", ct)
+		}
+		if len(u.SessionToken) != 0 {
+			req.Header.Set("X-Amz-Security-Token", u.SessionToken)
+		}
+		signV4(req, payloadHash, u.AccessKeyID, u.SecretAccessKey, region, time.Now())
+
+		resp, err := u.client().Do(req)
+		var status int
+		if err == nil {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			status = resp.StatusCode
+			if status == http.StatusOK {
+				return size, nil
+			}
+			err = fmt.Errorf("%s returned %d: %s", objectURL, status, strings.TrimSpace(string(body)))
+		}
+		if attempt == uploadAttempts || (status != 0 && status < 500 && status != http.StatusTooManyRequests) {
+			return size, err
+		}
+		select {
+		case <-ctx.Done():
+			return size, err
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// signV4 signs the request with AWS Signature Version 4 for S3, signing its host and every header set on it.
+func signV4(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(vs, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	crh := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crh[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// canonicalQuery returns the query sorted by name and value with both URI encoded.
+func canonicalQuery(q url.Values) string {
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes every byte of s but the unreserved characters and, unless encodeSlash is set, "/".
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' ||
+			c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// uploadRun uploads the results directory of the run and prints where it was uploaded to. Failing to upload is
+// logged and does not fail the run, whose results are still in the results directory.
+func (cfg RunConfig) uploadRun(ctx context.Context, resultsDir, dir string, run IndexedRun, log *slog.Logger) {
+	uploads, err := cfg.Upload.UploadRun(ctx, resultsDir, dir, run.RunID.String(), cfg.Store)
+	var size int64
+	failed := 0
+	for _, up := range uploads {
+		size += up.Size
+		if len(up.Error) != 0 {
+			failed++
+			log.Error("failed to upload file", "err", up.Error, "run", run.N, "file", up.File)
+		}
+	}
+	if err != nil && failed == 0 {
+		log.Error("failed to upload run", "err", err, "run", run.N)
+	}
+	fmt.Println("\n ----------SUMMARY OF UPLOAD --------------")
+	fmt.Printf("\n Run-%d; uploaded %d of %d files (%d bytes) to %s/%s, %d failed\n", run.N, len(uploads)-failed,
+		len(uploads), size, strings.TrimSuffix(cfg.Upload.URL, "/"), run.RunID, failed)
+}
@@ -1,121 +1,206 @@
 package onion
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"strings"
 )
 
-var kuboGWHost = "ipfs.io"
-
 type URLBuilder struct {
-	lassieIP  string
-	l1ShimIP  string
-	l1NginxIP string
-	bifrostIP string
+	components []Component
+
+	// Resolver resolves /ipns/ paths in Resolve. If nil, /ipns/ paths are sent to the components as is.
+	Resolver Resolver
+	// resolved caches resolved /ipns/ paths so that all requests for a name are sent to the same CID.
+	resolved map[string]string
 }
 
-func NewURLBuilder(lassieIP, l1ShimIP, l1NginxIP, bifrostIP string) *URLBuilder {
+func NewURLBuilder(components []Component) *URLBuilder {
 	return &URLBuilder{
-		lassieIP:  lassieIP,
-		l1ShimIP:  l1ShimIP,
-		l1NginxIP: l1NginxIP,
-		bifrostIP: bifrostIP,
+		components: components,
+		resolved:   make(map[string]string),
 	}
 }
 
-func (ub *URLBuilder) BuildURLsToTest(bifrostReqUrl string) URLsToTest {
+// BuildURLsToTest builds the URLs to send to every component for the bifrost request URL. It fails if the URL is
+// malformed or has no path.
+func (ub *URLBuilder) BuildURLsToTest(bifrostReqUrl string) (URLsToTest, error) {
+	path, err := parseRequestPath(bifrostReqUrl)
+	if err != nil {
+		return URLsToTest{}, err
+	}
 
-	return URLsToTest{
-		Path:       parseRequestPath(bifrostReqUrl),
-		Lassie:     ub.BuildLassieUrl(bifrostReqUrl),
-		L1Shim:     ub.BuildL1ShimUrl(bifrostReqUrl),
-		L1Nginx:    ub.BuildL1NginxUrl(bifrostReqUrl),
-		KuboGWUrl:  ub.BuildKuboGWUrl(bifrostReqUrl),
-		BifrostURL: ub.BuildBifrostUrl(bifrostReqUrl),
+	urls := make(map[string]string, len(ub.components))
+	for _, c := range ub.components {
+		u, err := c.BuildURL(bifrostReqUrl)
+		if err != nil {
+			return URLsToTest{}, fmt.Errorf("failed to build url for %s: %w", c.Name, err)
+		}
+		urls[c.Name] = u
 	}
-}
 
-func (b *URLBuilder) BuildLassieUrl(bifrostUrl string) string {
-	u := replaceIPInURL(bifrostUrl, b.lassieIP)
-	u = switchHTTPStoHTTP(u)
-	return u
+	return URLsToTest{
+		Path:     path,
+		URLs:     urls,
+		RawBlock: IsRawBlockRequest(bifrostReqUrl, nil),
+	}, nil
 }
 
-func (b *URLBuilder) BuildL1ShimUrl(bifrostUrl string) string {
-	u := replaceIPInURL(bifrostUrl, b.l1ShimIP)
-	u = switchHTTPStoHTTP(u)
-	u = u + "&nocache=1"
-	return u
+// BuildRangeURLsToTest builds the URLs for a request for a byte range of the entity. Components that take
+// the range as an entity-bytes query param get it added to their URL; the others get the range applied
+// when the request is sent. An entity-bytes param of the bifrost URL is replaced by the range.
+func (ub *URLBuilder) BuildRangeURLsToTest(bifrostReqUrl string, rng ByteRange) (URLsToTest, error) {
+	u, err := deleteQueryParam(bifrostReqUrl, "entity-bytes")
+	if err != nil {
+		return URLsToTest{}, err
+	}
+	out, err := ub.BuildURLsToTest(u)
+	if err != nil {
+		return URLsToTest{}, err
+	}
+	for _, c := range ub.components {
+		if c.Range == RangeEntityBytes {
+			if out.URLs[c.Name], err = setQueryParam(out.URLs[c.Name], "entity-bytes", rng.EntityBytes()); err != nil {
+				return URLsToTest{}, err
+			}
+		}
+	}
+	out.Range = &rng
+	return out, nil
 }
 
-func (b *URLBuilder) BuildL1NginxUrl(bifrostUrl string) string {
-	u := replaceIPInURL(bifrostUrl, b.l1NginxIP)
-	u = switchHTTPtoHTTPS(u)
-	return u
-}
+// Resolve resolves the /ipns/ path of the URLs to test with the Resolver and sends the components the resolved
+// /ipfs/ path instead so that all of them are asked for the same content even if the name is updated during the
+// run. The URLs to test are still keyed by the /ipns/ path.
+func (ub *URLBuilder) Resolve(ctx context.Context, o URLsToTest) (URLsToTest, error) {
+	if ub.Resolver == nil || !IsIPNSPath(o.Path) {
+		return o, nil
+	}
 
-func (b *URLBuilder) BuildKuboGWUrl(bifrostUrl string) string {
-	var result string
-	if idx := strings.Index(bifrostUrl, "?"); idx != -1 {
-		result = bifrostUrl[:idx]
-	} else {
-		panic("params not found in bifrost url")
+	resolved, ok := ub.resolved[o.Path]
+	if !ok {
+		var err error
+		if resolved, err = ResolvePath(ctx, ub.Resolver, o.Path); err != nil {
+			return o, err
+		}
+		ub.resolved[o.Path] = resolved
 	}
 
-	result = replaceIPInURL(result, kuboGWHost)
-	return result
+	urls := make(map[string]string, len(o.URLs))
+	for name, s := range o.URLs {
+		u, err := url.Parse(s)
+		if err != nil {
+			return o, fmt.Errorf("failed to parse url: %w", err)
+		}
+		u.Path = resolved
+		u.RawPath = ""
+		urls[name] = u.String()
+	}
+	o.URLs = urls
+	o.ResolvedPath = resolved
+	return o, nil
 }
 
-func (b *URLBuilder) BuildBifrostUrl(bifrostUrl string) string {
-	var result string
-	if idx := strings.Index(bifrostUrl, "?"); idx != -1 {
-		result = bifrostUrl[:idx]
-	} else {
-		panic("params not found in bifrost url")
+// WithRequest sets the method, headers and body of the original request on the URLs to test. Range headers are
+// dropped as ranges are requested as per BuildRangeURLsToTest, and Accept headers asking for CARs are dropped for
+// components that return file bytes. Requests for raw blocks are marked as such.
+func (ub *URLBuilder) WithRequest(o URLsToTest, method string, header http.Header, body []byte) URLsToTest {
+	o.Method = method
+	o.Body = body
+	if IsRawBlockRequest("", header) {
+		o.RawBlock = true
+	}
+	o.Headers = make(map[string]http.Header, len(ub.components))
+	for _, c := range ub.components {
+		h := header.Clone()
+		if h == nil {
+			h = make(http.Header)
+		}
+		h.Del("Range")
+		if c.Extract == ExtractRawFile && strings.Contains(h.Get("Accept"), "application/vnd.ipld.car") {
+			h.Del("Accept")
+		}
+		o.Headers[c.Name] = h
 	}
+	return o
+}
 
-	result = replaceIPInURL(result, b.bifrostIP)
-	result = switchHTTPStoHTTP(result)
-	return result
+func setQueryParam(s, key, value string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse url: %w", err)
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func deleteQueryParam(s, key string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse url: %w", err)
+	}
+	q := u.Query()
+	if !q.Has(key) {
+		return s, nil
+	}
+	q.Del(key)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
 }
 
-func switchHTTPStoHTTP(u string) string {
-	return strings.Replace(u, "https://", "http://", -1)
+// entityBytes returns the value of the entity-bytes query param of the URL, if any.
+func entityBytes(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ""
+	}
+	return u.Query().Get("entity-bytes")
 }
 
-func switchHTTPtoHTTPS(u string) string {
-	return strings.Replace(u, "http://", "https://", -1)
+// stripQuery returns the URL without its query params, if it has any.
+func stripQuery(u string) string {
+	if idx := strings.Index(u, "?"); idx != -1 {
+		return u[:idx]
+	}
+	return u
 }
 
-func replaceIPInURL(s, newIP string) string {
+// rewriteURL returns the URL with its scheme and host replaced, leaving its path and query, which may contain URLs
+// themselves, untouched.
+func rewriteURL(s string, protocol Protocol, host string) (string, error) {
 	u, err := url.Parse(s)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse url: %s", err))
+		return "", fmt.Errorf("failed to parse url: %w", err)
 	}
-	u.Host = newIP
-	return u.String()
+	u.Scheme = string(protocol)
+	u.Host = host
+	return u.String(), nil
 }
 
-func parseRequestPath(bifrostUrl string) string {
+func parseRequestPath(bifrostUrl string) (string, error) {
 	u, err := url.Parse(bifrostUrl)
 	if err != nil {
-		panic(fmt.Errorf("failed to parse bifrost url: %s", err))
+		return "", fmt.Errorf("failed to parse bifrost url: %w", err)
 	}
 
 	if len(u.Path) == 0 {
-		panic(fmt.Errorf("invalid bifrost url: %s; no path", bifrostUrl))
+		return "", fmt.Errorf("invalid bifrost url: %s; no path", bifrostUrl)
 	}
-	return u.Path
+	return u.Path, nil
 }
 
-func ParseCidFromPath(path string) string {
-	split := strings.SplitN(path, "/ipfs/", 2)
-	if len(split) == 2 {
-		x := split[1]
-		split = strings.SplitN(x, "/", -1)
-		return split[0]
+// ParseCidFromPath returns the root CID of an /ipfs/ path. /ipns/ paths must be resolved with ResolvePath first.
+func ParseCidFromPath(path string) (string, error) {
+	ns, root, _, err := splitContentPath(path)
+	if err != nil {
+		return "", err
 	}
-
-	panic("invalid path")
+	if ns != "ipfs" {
+		return "", fmt.Errorf("can not parse cid from unresolved path %s", path)
+	}
+	return root, nil
 }
@@ -0,0 +1,62 @@
+package onion
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// VerificationHeaders are the headers with which gateways tell clients how to verify a response against the CIDs of
+// its path: X-Ipfs-Roots lists the CID of every segment of the path and X-Ipfs-Path is the path that was resolved.
+// Gateways that only know them once the response has been streamed send them as trailers instead.
+var VerificationHeaders = []string{"X-Ipfs-Roots", "X-Ipfs-Path"}
+
+// verificationHeaders returns the verification headers of the result, taking trailers over headers as they carry the
+// final values.
+func verificationHeaders(r *Result) http.Header {
+	out := make(http.Header, len(VerificationHeaders))
+	for _, name := range VerificationHeaders {
+		if vs := http.Header(r.Trailers).Values(name); len(vs) != 0 {
+			out[name] = vs
+		} else if vs := http.Header(r.Headers).Values(name); len(vs) != 0 {
+			out[name] = vs
+		}
+	}
+	return out
+}
+
+// verificationDiff returns the verification headers whose normalised values differ between the two results, sorted
+// by name. A value is empty if the component returned the header neither as a header nor as a trailer.
+func verificationDiff(a, b *Result) []HeaderDiff {
+	ha, hb := verificationHeaders(a), verificationHeaders(b)
+	var out []HeaderDiff
+	for _, name := range VerificationHeaders {
+		va, vb := normaliseVerificationHeader(name, ha.Values(name)), normaliseVerificationHeader(name, hb.Values(name))
+		if va != vb {
+			out = append(out, HeaderDiff{Name: name, A: va, B: vb})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// normaliseVerificationHeader joins the values of a verification header like normaliseHeader, converting the CIDs of
+// X-Ipfs-Roots to CIDv1 so that layers that print CIDv0s compare equal to those that do not.
+func normaliseVerificationHeader(name string, values []string) string {
+	if name != "X-Ipfs-Roots" {
+		return normaliseHeader(name, values)
+	}
+	var roots []string
+	for _, v := range values {
+		for _, root := range strings.Split(v, ",") {
+			root = strings.TrimSpace(root)
+			if c, err := cid.Decode(root); err == nil {
+				root = cid.NewCidV1(c.Type(), c.Hash()).String()
+			}
+			roots = append(roots, root)
+		}
+	}
+	return strings.Join(roots, ",")
+}